@@ -0,0 +1,18 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Asgardeo action types
+const actionPreIssueAccessToken = "PRE_ISSUE_ACCESS_TOKEN"
+
+// actionHandler handles a decoded action request of one action type
+type actionHandler func(s *Server, w http.ResponseWriter, r *http.Request, req Request, now time.Time)
+
+// actionHandlers maps each supported action type to its handler. Requests of any
+// other type get a SUCCESS response without operations.
+var actionHandlers = map[string]actionHandler{
+	actionPreIssueAccessToken: (*Server).handlePreIssueAccessToken,
+}
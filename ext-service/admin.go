@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// requireAdminToken rejects requests that do not carry "Authorization: Bearer <ADMIN_TOKEN>"
+func (s *Server) requireAdminToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.adminAuthenticated(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeErrorResponse(w, http.StatusUnauthorized, "unauthorized", "Admin authentication failed")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireSharedSecret rejects requests that do not carry
+// "Authorization: Bearer <ACTION_SHARED_SECRET>", like action requests
+func (s *Server) requireSharedSecret(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.verifyRequestAuth(r); err != nil {
+			loggerFrom(r.Context()).Warn("Rejecting unauthenticated request", "path", r.URL.Path, "error", err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeErrorResponse(w, http.StatusUnauthorized, "unauthorized", "Request authentication failed")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// statsHandler returns a JSON snapshot of the service counters
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(stats.snapshot()); err != nil {
+		slog.Error("Error encoding stats", "error", err)
+	}
+}
+
+// loadedEntitlements is the JSON body of GET /admin/entitlements
+type loadedEntitlements struct {
+	Source       string        `json:"source"`
+	SourceType   string        `json:"sourceType"`
+	Generation   int64         `json:"generation"`
+	LoadedAt     time.Time     `json:"loadedAt"`
+	Entitlements []Entitlement `json:"entitlements"`
+}
+
+// entitlementsHandler returns the default entitlements currently served, or with
+// ?subjectId= only those of that subject ID (normalized like request subjects)
+func entitlementsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	snapshot := defaultEntitlements.current.Load()
+	if snapshot.data == nil {
+		http.Error(w, "Entitlements not loaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	body := loadedEntitlements{
+		Source:       defaultEntitlements.source,
+		SourceType:   defaultEntitlements.sourceType,
+		Generation:   snapshot.generation,
+		LoadedAt:     snapshot.loadedAt,
+		Entitlements: []Entitlement{},
+	}
+	subjectID, filtered := r.URL.Query()["subjectId"]
+	for _, entitlement := range snapshot.data.Entitlements {
+		if filtered && !subjectIDMatches(entitlement.Subject.ID, normalizeSubjectID(subjectID[0])) {
+			continue
+		}
+		body.Entitlements = append(body.Entitlements, entitlement)
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Error("Error encoding entitlements", "error", err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import "strings"
+
+// audienceClaim is the access token audience claim
+const audienceClaim = "aud"
+
+// requestedAudiences returns the audiences requested in REQUESTED_AUDIENCE_HEADER;
+// a header value may list several separated by spaces. When a request names
+// any, scopes of entitlements tagged with a different audience are not granted.
+func (c *Config) requestedAudiences(headers []Header) []string {
+	if c.requestedAudienceHeader == "" {
+		return nil
+	}
+	var audiences []string
+	for _, header := range headers {
+		if header.Name != c.requestedAudienceHeader {
+			continue
+		}
+		for _, value := range header.Value {
+			audiences = append(audiences, strings.Fields(value)...)
+		}
+	}
+	return audiences
+}
+
+// relevantToAudiences reports whether an entitlement's scope belongs in a token
+// for the requested audiences. Entitlements without an audience tag apply to
+// every audience, and no requested audience means no filtering.
+func relevantToAudiences(e Entitlement, requested []string) bool {
+	if e.Audience == "" || len(requested) == 0 {
+		return true
+	}
+	for _, aud := range requested {
+		if aud == e.Audience {
+			return true
+		}
+	}
+	return false
+}
+
+// existingAudiences returns the token's current audiences and whether aud is
+// single-valued (a plain string rather than a list)
+func existingAudiences(claims []Claim) (audiences []string, single bool, present bool) {
+	value, ok := getClaimValue(claims, audienceClaim)
+	if !ok {
+		return nil, false, false
+	}
+	switch v := value.(type) {
+	case string:
+		return []string{v}, true, true
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				audiences = append(audiences, s)
+			}
+		}
+		return audiences, false, true
+	}
+	return nil, false, true
+}
+
+// audienceTarget returns the op and path used to add audiences to this token:
+// appending to an aud list, replacing a single-valued aud with a list, or adding
+// the aud claim when the token has none
+func audienceTarget(claims []Claim) (string, string) {
+	_, single, present := existingAudiences(claims)
+	switch {
+	case !present:
+		return "add", accessTokenClaimsPath
+	case single:
+		return "replace", "/accessToken/claims/aud"
+	default:
+		return "add", "/accessToken/claims/aud/-"
+	}
+}
+
+// hasAudience reports whether the token already carries audience
+func hasAudience(claims []Claim, audience string) bool {
+	current, _, _ := existingAudiences(claims)
+	for _, aud := range current {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// audienceOperations builds the operations adding audiences (deduplicated, and
+// skipping ones the token already has) to the aud claim
+func audienceOperations(claims []Claim, audiences []string) []OperationResponse {
+	current, single, present := existingAudiences(claims)
+
+	seen := make(map[string]bool)
+	for _, aud := range current {
+		seen[aud] = true
+	}
+	var added []string
+	for _, aud := range audiences {
+		if !seen[aud] {
+			seen[aud] = true
+			added = append(added, aud)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	op, path := audienceTarget(claims)
+	switch {
+	case !present:
+		return []OperationResponse{{Op: op, Path: path, Value: Claim{Name: audienceClaim, Value: added}}}
+	case single:
+		return []OperationResponse{{Op: op, Path: path, Value: append(current, added...)}}
+	}
+
+	ops := make([]OperationResponse, 0, len(added))
+	for _, aud := range added {
+		ops = append(ops, OperationResponse{Op: op, Path: path, Value: aud})
+	}
+	return ops
+}
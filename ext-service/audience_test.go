@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHandlerEmitsScopeWithAudience(t *testing.T) {
+	provider := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{{
+		EntitlementID: "ent_read",
+		Subject:       Subject{Type: "partner", ID: "org_acme"},
+		Action:        "read",
+		Audience:      "https://orders.example.com",
+	}}}}
+	scope := OperationResponse{Op: "add", Path: accessTokenScopesPath, Value: "partner:read"}
+	allowAll := []Operation{
+		{Op: "add", Paths: []string{accessTokenScopesPath, accessTokenClaimsPath, "/accessToken/claims/aud/-"}},
+		{Op: "replace", Paths: []string{"/accessToken/claims/aud"}},
+	}
+	tests := []struct {
+		name    string
+		aud     interface{}
+		allowed []Operation
+		want    []OperationResponse
+	}{
+		{
+			"no aud claim", nil, allowAll,
+			[]OperationResponse{scope, {Op: "add", Path: accessTokenClaimsPath, Value: Claim{Name: "aud", Value: []string{"https://orders.example.com"}}}},
+		},
+		{
+			"single-valued aud", "client", allowAll,
+			[]OperationResponse{scope, {Op: "replace", Path: "/accessToken/claims/aud", Value: []string{"client", "https://orders.example.com"}}},
+		},
+		{
+			"multi-valued aud", []interface{}{"client", "https://billing.example.com"}, allowAll,
+			[]OperationResponse{scope, {Op: "add", Path: "/accessToken/claims/aud/-", Value: "https://orders.example.com"}},
+		},
+		{
+			"audience already present", []interface{}{"client", "https://orders.example.com"}, allowAll,
+			[]OperationResponse{scope},
+		},
+		{
+			// Without its audience the scope would be valid everywhere, so neither is emitted
+			"audience not allowed", "client", []Operation{{Op: "add", Paths: []string{accessTokenScopesPath}}},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		var claims []Claim
+		if tt.aud != nil {
+			claims = []Claim{{Name: "aud", Value: tt.aud}}
+		}
+		req := Request{
+			ActionType: actionPreIssueAccessToken,
+			Event: Event{
+				Request:     RequestData{AdditionalHeaders: []Header{partnerHeader("org_acme")}},
+				AccessToken: AccessToken{Scopes: []string{}, Claims: claims},
+			},
+			AllowedOperations: tt.allowed,
+		}
+
+		_, resp := serve(t, NewServer(provider), http.MethodPost, marshalRequest(t, req))
+
+		if got := mustJSON(t, resp.Operations); got != mustJSON(t, tt.want) {
+			t.Errorf("%s: operations = %s, want %s", tt.name, got, mustJSON(t, tt.want))
+		}
+	}
+}
+
+func TestHandlerFiltersScopesByRequestedAudience(t *testing.T) {
+	provider := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{
+		{EntitlementID: "ent_orders", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "orders", Audience: "https://orders.example.com"},
+		{EntitlementID: "ent_billing", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "billing", Audience: "https://billing.example.com"},
+		{EntitlementID: "ent_read", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "read"},
+	}}}
+	s := NewServer(provider)
+	s.requestedAudienceHeader = "x-audience"
+	tests := []struct {
+		name     string
+		audience string
+		want     string
+	}{
+		{"no requested audience", "", `["partner:orders","partner:billing","partner:read"]`},
+		{"orders", "https://orders.example.com", `["partner:orders","partner:read"]`},
+		{"billing", "https://billing.example.com", `["partner:billing","partner:read"]`},
+		{"both", "https://orders.example.com https://billing.example.com", `["partner:orders","partner:billing","partner:read"]`},
+		{"other", "https://shipping.example.com", `["partner:read"]`},
+	}
+	for _, tt := range tests {
+		headers := []Header{partnerHeader("org_acme")}
+		if tt.audience != "" {
+			headers = append(headers, Header{Name: "x-audience", Value: []string{tt.audience}})
+		}
+		req := Request{
+			ActionType: actionPreIssueAccessToken,
+			Event: Event{
+				Request:     RequestData{AdditionalHeaders: headers},
+				AccessToken: AccessToken{Scopes: []string{}},
+			},
+			AllowedOperations: []Operation{{Op: "add", Paths: []string{accessTokenScopesPath, accessTokenClaimsPath}}},
+		}
+
+		_, resp := serve(t, s, http.MethodPost, marshalRequest(t, req))
+
+		if got := mustJSON(t, grantedScopes(resp.Operations)); got != tt.want {
+			t.Errorf("%s: scopes = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// auditSchemaVersion is bumped on any breaking change to auditRecord. Fields may
+// be added in a compatible way; renaming or removing one is a breaking change.
+const auditSchemaVersion = "1"
+
+// The evaluated-claim summary is bounded so a request with large claims or many
+// constrained entitlements cannot blow up its audit record
+const (
+	// maxAuditConstraints caps the constraint outcomes kept per record
+	maxAuditConstraints = 32
+	// maxAuditClaimValueBytes caps the encoded size of each evaluated claim value
+	maxAuditClaimValueBytes = 256
+)
+
+// auditRecord is one audit log entry per token decision
+type auditRecord struct {
+	SchemaVersion       string    `json:"schemaVersion"`
+	Timestamp           time.Time `json:"timestamp"`
+	ActionType          string    `json:"actionType"`
+	ClientID            string    `json:"clientId"`
+	GrantType           string    `json:"grantType"`
+	PartnerID           string    `json:"partnerId"`
+	ActionStatus        string    `json:"actionStatus"`
+	GrantedScopes       []string  `json:"grantedScopes"`
+	MatchedEntitlements []string  `json:"matchedEntitlements"`
+	OperationCount      int       `json:"operationCount"`
+	// RequestID correlates the record with the request's log lines (X-Request-Id)
+	RequestID string `json:"requestId,omitempty"`
+	// SubjectRewrite is set when the decision rewrote the token subject
+	SubjectRewrite *subjectRewrite `json:"subjectRewrite,omitempty"`
+	// Constraints are the outcomes of the constrained entitlements evaluated for
+	// the decision, in evaluation order, with the claim values they read.
+	// ConstraintsOmitted counts the outcomes left out past maxAuditConstraints.
+	Constraints        []constraintOutcome `json:"constraints,omitempty"`
+	ConstraintsOmitted int                 `json:"constraintsOmitted,omitempty"`
+}
+
+// constraintOutcome records whether an entitlement's constraints were satisfied,
+// and the request claim values its claim constraints were evaluated against. A
+// claim the request did not carry is recorded as null.
+type constraintOutcome struct {
+	EntitlementID string                 `json:"entitlementId"`
+	Satisfied     bool                   `json:"satisfied"`
+	Claims        map[string]interface{} `json:"claims,omitempty"`
+}
+
+// constraintOutcome builds the audit outcome of evaluating entitlement's
+// constraints against ev. Values of the claims in AUDIT_REDACT_CLAIMS are
+// redacted, and oversized values truncated.
+func (c *Config) constraintOutcome(entitlement Entitlement, ev Event, satisfied bool) constraintOutcome {
+	outcome := constraintOutcome{EntitlementID: entitlement.EntitlementID, Satisfied: satisfied}
+	claims, _ := entitlement.Constraints["claims"].(map[string]interface{})
+	for name := range claims {
+		if outcome.Claims == nil {
+			outcome.Claims = make(map[string]interface{}, len(claims))
+		}
+		value, ok := getClaimValue(ev.AccessToken.Claims, name)
+		switch {
+		case !ok:
+			outcome.Claims[name] = nil
+		case c.auditRedactClaims["*"] || c.auditRedactClaims[name]:
+			outcome.Claims[name] = redacted
+		default:
+			outcome.Claims[name] = boundAuditValue(value)
+		}
+	}
+	return outcome
+}
+
+// boundAuditValue returns value unchanged when it encodes within
+// maxAuditClaimValueBytes, and otherwise a truncated string of its encoding
+func boundAuditValue(value interface{}) interface{} {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return redacted
+	}
+	if len(encoded) <= maxAuditClaimValueBytes {
+		return value
+	}
+	truncated := string(encoded[:maxAuditClaimValueBytes])
+	// Do not cut a multi-byte character in half
+	for !utf8.ValidString(truncated) {
+		truncated = truncated[:len(truncated)-1]
+	}
+	return truncated + "...(truncated)"
+}
+
+// newAuditRecord builds the audit record for a decision
+func newAuditRecord(now time.Time, requestID string, req Request, partnerID string, resp Response, matched []Entitlement, constraints []constraintOutcome) auditRecord {
+	record := auditRecord{
+		SchemaVersion:       auditSchemaVersion,
+		Timestamp:           now.UTC(),
+		RequestID:           requestID,
+		ActionType:          req.ActionType,
+		ClientID:            req.Event.Request.ClientID,
+		GrantType:           req.Event.Request.GrantType,
+		PartnerID:           partnerID,
+		ActionStatus:        resp.ActionStatus,
+		GrantedScopes:       grantedScopes(resp.Operations),
+		MatchedEntitlements: entitlementIDs(matched),
+		OperationCount:      len(resp.Operations),
+		SubjectRewrite:      subjectRewriteFor(resp.Operations, req.Event.AccessToken.Claims),
+		Constraints:         constraints,
+	}
+	if len(constraints) > maxAuditConstraints {
+		record.Constraints = constraints[:maxAuditConstraints]
+		record.ConstraintsOmitted = len(constraints) - maxAuditConstraints
+	}
+	return record
+}
+
+// entitlementIDs returns the IDs of entitlements, never nil so it encodes as []
+func entitlementIDs(entitlements []Entitlement) []string {
+	ids := []string{}
+	for _, entitlement := range entitlements {
+		ids = append(ids, entitlement.EntitlementID)
+	}
+	return ids
+}
+
+// auditLogger writes audit records as JSON lines. When batchSize is above one,
+// records are buffered and written together once the batch fills up or the
+// flush interval elapses, whichever comes first.
+type auditLogger struct {
+	mu        sync.Mutex
+	w         io.Writer
+	batchSize int
+	buf       []byte
+	pending   int
+}
+
+// configureAudit opens AUDIT_LOG_FILE ("-" for stdout) and applies
+// AUDIT_BATCH_SIZE, AUDIT_FLUSH_INTERVAL and AUDIT_REDACT_CLAIMS
+func (c *Config) configureAudit() error {
+	path := os.Getenv("AUDIT_LOG_FILE")
+	if path == "" {
+		return nil
+	}
+
+	for _, name := range strings.Split(os.Getenv("AUDIT_REDACT_CLAIMS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			if c.auditRedactClaims == nil {
+				c.auditRedactClaims = make(map[string]bool)
+			}
+			c.auditRedactClaims[name] = true
+		}
+	}
+
+	batchSize := 1
+	if v := os.Getenv("AUDIT_BATCH_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid AUDIT_BATCH_SIZE %q", v)
+		}
+		batchSize = n
+	}
+	flushInterval := time.Second
+	if v := os.Getenv("AUDIT_FLUSH_INTERVAL"); v != "" {
+		d, err := parseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid AUDIT_FLUSH_INTERVAL %q", v)
+		}
+		flushInterval = d
+	}
+
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return fmt.Errorf("failed to open audit log: %w", err)
+		}
+		w = f
+	}
+	c.auditLog = &auditLogger{w: w, batchSize: batchSize}
+	if batchSize > 1 {
+		go c.auditLog.flushEvery(flushInterval)
+	}
+	return nil
+}
+
+// record writes one audit record, or buffers it when batching
+func (a *auditLogger) record(record auditRecord) {
+	if a == nil {
+		return
+	}
+	line, err := marshalAuditRecord(record)
+	if err != nil {
+		slog.Error("Error encoding audit record", "error", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.buf = append(a.buf, line...)
+	a.pending++
+	if a.pending >= a.batchSize {
+		a.flushLocked()
+	}
+}
+
+// flush writes any buffered records
+func (a *auditLogger) flush() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.flushLocked()
+}
+
+// flushLocked writes the buffer in a single call; a.mu must be held
+func (a *auditLogger) flushLocked() {
+	if a.pending == 0 {
+		return
+	}
+	if _, err := a.w.Write(a.buf); err != nil {
+		slog.Error("Error writing audit records", "count", a.pending, "error", err)
+	}
+	a.buf = a.buf[:0]
+	a.pending = 0
+}
+
+// flushEvery flushes buffered records on a fixed interval
+func (a *auditLogger) flushEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		a.flush()
+	}
+}
+
+// marshalAuditRecord encodes a record as a single newline-terminated JSON line
+func marshalAuditRecord(record auditRecord) ([]byte, error) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
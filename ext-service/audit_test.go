@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// withAuditLog makes s write each audit record to the returned buffer
+func withAuditLog(s *Server) *bytes.Buffer {
+	var buf bytes.Buffer
+	s.auditLog = &auditLogger{w: &buf, batchSize: 1}
+	return &buf
+}
+
+// auditRecords decodes the JSON lines written to an audit log
+func auditRecords(t *testing.T, buf *bytes.Buffer) []auditRecord {
+	t.Helper()
+	var records []auditRecord
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record auditRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("decode audit record %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// constrainedEntitlements grants org_acme read to gold-tier tokens, write to EU
+// tokens, and admin to one email address
+var constrainedEntitlements = fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{
+	{EntitlementID: "ent_gold", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "read",
+		Constraints: map[string]interface{}{"claims": map[string]interface{}{"tier": "gold"}}},
+	{EntitlementID: "ent_eu", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "write",
+		Constraints: map[string]interface{}{"claims": map[string]interface{}{"region": "eu"}}},
+	{EntitlementID: "ent_email", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "admin",
+		Constraints: map[string]interface{}{"claims": map[string]interface{}{"email": "ops@acme.example"}}},
+	{EntitlementID: "ent_open", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "list"},
+}}}
+
+func TestHandlerAuditsEvaluatedClaims(t *testing.T) {
+	s := NewServer(constrainedEntitlements)
+	s.auditRedactClaims = map[string]bool{"email": true}
+	audit := withAuditLog(s)
+
+	req := Request{
+		ActionType: actionPreIssueAccessToken,
+		Event: Event{
+			Request: RequestData{AdditionalHeaders: []Header{partnerHeader("org_acme")}},
+			AccessToken: AccessToken{Scopes: []string{}, Claims: []Claim{
+				{Name: "tier", Value: "gold"},
+				{Name: "email", Value: "ops@acme.example"},
+			}},
+		},
+		AllowedOperations: []Operation{{Op: "add", Paths: []string{accessTokenScopesPath}}},
+	}
+	r := httptest.NewRequest(http.MethodPost, "/token-validation", strings.NewReader(marshalRequest(t, req)))
+	r.Header.Set(requestIDHeader, "req-42")
+	logRequests(http.HandlerFunc(s.handler)).ServeHTTP(httptest.NewRecorder(), r)
+
+	records := auditRecords(t, audit)
+	if len(records) != 1 {
+		t.Fatalf("audit records = %d, want 1", len(records))
+	}
+	record := records[0]
+	if record.RequestID != "req-42" {
+		t.Errorf("requestId = %q, want req-42", record.RequestID)
+	}
+	want := []constraintOutcome{
+		{EntitlementID: "ent_gold", Satisfied: true, Claims: map[string]interface{}{"tier": "gold"}},
+		{EntitlementID: "ent_eu", Satisfied: false, Claims: map[string]interface{}{"region": nil}},
+		{EntitlementID: "ent_email", Satisfied: true, Claims: map[string]interface{}{"email": redacted}},
+	}
+	if got := mustJSON(t, record.Constraints); got != mustJSON(t, want) {
+		t.Errorf("constraints = %s, want %s", got, mustJSON(t, want))
+	}
+}
+
+func TestHandlerAuditsConstraintsOfDenial(t *testing.T) {
+	s := NewServer(fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{
+		{EntitlementID: "deny_blocked", Subject: Subject{Type: "partner", ID: "org_acme"}, Effect: effectDeny,
+			Constraints: map[string]interface{}{"claims": map[string]interface{}{"status": "blocked"}}},
+	}}})
+	audit := withAuditLog(s)
+
+	req := Request{
+		ActionType: actionPreIssueAccessToken,
+		Event: Event{
+			Request:     RequestData{AdditionalHeaders: []Header{partnerHeader("org_acme")}},
+			AccessToken: AccessToken{Scopes: []string{}, Claims: []Claim{{Name: "status", Value: "blocked"}}},
+		},
+	}
+	serve(t, s, http.MethodPost, marshalRequest(t, req))
+
+	records := auditRecords(t, audit)
+	if len(records) != 1 || records[0].ActionStatus != "FAILED" {
+		t.Fatalf("audit records = %+v, want one FAILED decision", records)
+	}
+	want := []constraintOutcome{{EntitlementID: "deny_blocked", Satisfied: true, Claims: map[string]interface{}{"status": "blocked"}}}
+	if got := mustJSON(t, records[0].Constraints); got != mustJSON(t, want) {
+		t.Errorf("constraints = %s, want %s", got, mustJSON(t, want))
+	}
+}
+
+func TestAuditConstraintSummaryIsBounded(t *testing.T) {
+	cfg := defaultConfig()
+	long := strings.Repeat("x", 2*maxAuditClaimValueBytes)
+	ev := Event{AccessToken: AccessToken{Claims: []Claim{{Name: "note", Value: long}}}}
+	entitlement := Entitlement{EntitlementID: "ent_note", Constraints: map[string]interface{}{"claims": map[string]interface{}{"note": long}}}
+
+	outcome := cfg.constraintOutcome(entitlement, ev, true)
+	value, _ := outcome.Claims["note"].(string)
+	if len(value) > maxAuditClaimValueBytes+len("...(truncated)") || !strings.HasSuffix(value, "...(truncated)") {
+		t.Errorf("note = %d bytes, want it truncated to %d", len(value), maxAuditClaimValueBytes)
+	}
+
+	// A multi-byte character straddling the limit is dropped rather than split
+	accented := strings.Repeat("é", maxAuditClaimValueBytes)
+	if value, _ := boundAuditValue(accented).(string); !utf8.ValidString(value) || !strings.HasSuffix(value, "...(truncated)") {
+		t.Errorf("accented note = %q, want valid UTF-8 truncated", value)
+	}
+
+	cfg.auditRedactClaims = map[string]bool{"*": true}
+	if got := cfg.constraintOutcome(entitlement, ev, true).Claims["note"]; got != redacted {
+		t.Errorf("note with every claim redacted = %v, want %s", got, redacted)
+	}
+
+	outcomes := make([]constraintOutcome, maxAuditConstraints+5)
+	record := newAuditRecord(clock(), "", Request{}, "", Response{}, nil, outcomes)
+	if len(record.Constraints) != maxAuditConstraints || record.ConstraintsOmitted != 5 {
+		t.Errorf("constraints = %d, omitted = %d, want %d and 5", len(record.Constraints), record.ConstraintsOmitted, maxAuditConstraints)
+	}
+}
+
+func TestEvaluateSkipsConstraintSummaryWithoutAudit(t *testing.T) {
+	s := NewServer(constrainedEntitlements)
+	result := s.evaluateEntitlements(slog.Default(), Request{}, Event{}, constrainedEntitlements.data.Entitlements, nil, 0, clock())
+	if result.constraints != nil {
+		t.Errorf("constraints = %+v, want none collected with auditing disabled", result.constraints)
+	}
+}
+
+// updateGolden rewrites golden files from the current output: go test -run Golden -update
+var updateGolden = flag.Bool("update", false, "rewrite golden files")
+
+func TestAuditRecordMatchesGoldenSchema(t *testing.T) {
+	req := Request{
+		ActionType: actionPreIssueAccessToken,
+		Event: Event{
+			Request:     RequestData{ClientID: "client", GrantType: "client_credentials"},
+			AccessToken: AccessToken{Claims: []Claim{{Name: "sub", Value: "svc-account"}}},
+		},
+	}
+	resp := Response{ActionStatus: "SUCCESS", Operations: []OperationResponse{
+		{Op: "add", Path: accessTokenScopesPath, Value: "partner:read"},
+		{Op: "replace", Path: "/accessToken/claims/sub", Value: "org_acme"},
+	}}
+	matched := []Entitlement{{EntitlementID: "ent_read"}}
+	constraints := []constraintOutcome{{EntitlementID: "ent_read", Satisfied: true, Claims: map[string]interface{}{"tier": "gold"}}}
+	record := newAuditRecord(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC), "req-1", req, "org_acme", resp, matched, constraints)
+
+	got, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		t.Fatalf("marshal audit record: %v", err)
+	}
+	got = append(got, '\n')
+
+	golden := filepath.Join("testdata", "audit_record.golden.json")
+	if *updateGolden {
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("read golden file: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("audit record changed shape; bump auditSchemaVersion for breaking changes and rerun with -update\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// writeRecorder records each write made to it
+type writeRecorder struct {
+	mu     sync.Mutex
+	writes []string
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+// snapshot returns the writes made so far
+func (w *writeRecorder) snapshot() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.writes...)
+}
+
+func TestAuditLoggerBatchesWrites(t *testing.T) {
+	w := &writeRecorder{}
+	audit := &auditLogger{w: w, batchSize: 3}
+
+	audit.record(auditRecord{PartnerID: "org_1"})
+	audit.record(auditRecord{PartnerID: "org_2"})
+	if writes := w.snapshot(); len(writes) != 0 {
+		t.Fatalf("writes = %d before the batch filled, want 0", len(writes))
+	}
+	audit.record(auditRecord{PartnerID: "org_3"})
+
+	writes := w.snapshot()
+	if len(writes) != 1 || strings.Count(writes[0], "\n") != 3 {
+		t.Errorf("writes = %q, want the three records in a single write", writes)
+	}
+}
+
+func TestAuditLoggerFlushesPeriodically(t *testing.T) {
+	w := &writeRecorder{}
+	audit := &auditLogger{w: w, batchSize: 100}
+	go audit.flushEvery(10 * time.Millisecond)
+
+	audit.record(auditRecord{PartnerID: "org_acme"})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(w.snapshot()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if writes := w.snapshot(); len(writes) != 1 || !strings.Contains(writes[0], `"partnerId":"org_acme"`) {
+		t.Errorf("writes = %q, want the record flushed by the interval", writes)
+	}
+}
+
+func TestAuditLoggerFlushesOnShutdown(t *testing.T) {
+	w := &writeRecorder{}
+	audit := &auditLogger{w: w, batchSize: 100}
+	audit.record(auditRecord{PartnerID: "org_1"})
+	audit.record(auditRecord{PartnerID: "org_2"})
+
+	audit.flush()
+	audit.flush()
+
+	if writes := w.snapshot(); len(writes) != 1 || strings.Count(writes[0], "\n") != 2 {
+		t.Errorf("writes = %q, want the pending records written once", writes)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// authenticatedRequest sends a request with the given bearer token (none when
+// empty) through s's authentication middleware to its routes
+func authenticatedRequest(t *testing.T, s *Server, method string, path string, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	mux := http.NewServeMux()
+	routes(mux, mux, s)
+
+	var body string
+	if method == http.MethodPost {
+		body = actionRequest(t)
+	}
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.authenticate(mux).ServeHTTP(rec, r)
+	return rec
+}
+
+// authServer returns a server with a Prometheus backend, the shared secret
+// "s3cret" and the admin token "admin"
+func authServer() *Server {
+	s := prometheusServer()
+	s.actionSharedSecret, s.adminToken = "s3cret", "admin"
+	return s
+}
+
+func TestAuthenticateExemptsProbes(t *testing.T) {
+	withDefaultEntitlements(t, &EntitlementsData{})
+	s := authServer()
+
+	for _, path := range []string{"/health", "/healthz", "/ready", "/metrics"} {
+		if rec := authenticatedRequest(t, s, http.MethodGet, path, ""); rec.Code == http.StatusUnauthorized {
+			t.Errorf("GET %s without credentials = %d, want it served", path, rec.Code)
+		}
+	}
+}
+
+func TestAuthenticateProtectsEndpoints(t *testing.T) {
+	withDefaultEntitlements(t, &EntitlementsData{})
+	s := authServer()
+
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{http.MethodPost, "/token-validation", "", http.StatusUnauthorized},
+		{http.MethodPost, "/token-validation", "wrong", http.StatusUnauthorized},
+		{http.MethodPost, "/token-validation", "s3cret", http.StatusOK},
+		{http.MethodGet, "/stats", "", http.StatusUnauthorized},
+		{http.MethodGet, "/stats", "s3cret", http.StatusUnauthorized},
+		{http.MethodGet, "/stats", "admin", http.StatusOK},
+		{http.MethodGet, "/admin/disabled-tags", "", http.StatusUnauthorized},
+		{http.MethodGet, "/admin/entitlements", "", http.StatusUnauthorized},
+		{http.MethodGet, "/unknown", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		rec := authenticatedRequest(t, s, tt.method, tt.path, tt.token)
+		if rec.Code != tt.want {
+			t.Errorf("%s %s with token %q = %d, want %d", tt.method, tt.path, tt.token, rec.Code, tt.want)
+		}
+		if tt.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s %s: WWW-Authenticate = %q, want Bearer", tt.method, tt.path, rec.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestConfigureUnauthenticatedPaths(t *testing.T) {
+	t.Setenv("UNAUTHENTICATED_PATHS", " /health ,")
+	s := authServer()
+	if err := s.configureUnauthenticatedPaths(); err != nil {
+		t.Fatalf("configureUnauthenticatedPaths: %v", err)
+	}
+
+	if rec := authenticatedRequest(t, s, http.MethodGet, "/health", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET /health = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec := authenticatedRequest(t, s, http.MethodGet, "/metrics", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET /metrics once no longer listed = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	t.Setenv("UNAUTHENTICATED_PATHS", "health")
+	if err := s.configureUnauthenticatedPaths(); err == nil {
+		t.Error("configureUnauthenticatedPaths accepted a path without a leading slash")
+	}
+}
+
+func TestAuthenticateWithoutSharedSecret(t *testing.T) {
+	s := authServer()
+	s.actionSharedSecret = ""
+
+	if rec := authenticatedRequest(t, s, http.MethodPost, "/token-validation", ""); rec.Code != http.StatusOK {
+		t.Errorf("POST /token-validation without ACTION_SHARED_SECRET = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec := authenticatedRequest(t, s, http.MethodGet, "/stats", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET /stats without the admin token = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
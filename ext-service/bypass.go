@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// parseBypassClients parses BYPASS_CLIENT_IDS: comma-separated clientId=scopes
+// entries where scopes are space-separated and may be empty, e.g.
+// "svc-internal=internal:read internal:write,probe-client="
+func parseBypassClients(value string) (map[string][]string, error) {
+	clients := make(map[string][]string)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		clientID, scopes, ok := strings.Cut(item, "=")
+		clientID = strings.TrimSpace(clientID)
+		if !ok || clientID == "" {
+			return nil, fmt.Errorf("invalid bypass entry %q (expected clientId=scopes)", item)
+		}
+		clients[clientID] = strings.Fields(scopes)
+	}
+	return clients, nil
+}
+
+// bypassResponse returns the fixed response for a bypassed client
+func bypassResponse(logger *slog.Logger, scopes []string, allowed []Operation) Response {
+	ops := operationSet{logger: logger}
+	for _, scope := range scopes {
+		ops.applyIfAllowed(allowed, OperationResponse{Op: "add", Path: accessTokenScopesPath, Value: scope})
+	}
+	ops.logOutcomes()
+	return Response{ActionStatus: "SUCCESS", Operations: ops.operations}
+}
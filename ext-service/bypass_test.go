@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHandlerBypassedClientSkipsMatching(t *testing.T) {
+	// Matching would fail, so only a bypassed request can succeed
+	s := NewServer(fakeEntitlements{err: errTest})
+
+	s.bypassClients = map[string][]string{"client": {"internal:read", "internal:write"}}
+	_, resp := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+	if scopes := grantedScopes(resp.Operations); resp.ActionStatus != "SUCCESS" || mustJSON(t, scopes) != `["internal:read","internal:write"]` {
+		t.Errorf("response = %+v, want the fixed scopes", resp)
+	}
+
+	s.bypassClients = map[string][]string{"client": nil}
+	if _, resp := serve(t, s, http.MethodPost, actionRequest(t)); resp.ActionStatus != "SUCCESS" || len(resp.Operations) != 0 {
+		t.Errorf("response = %+v, want a SUCCESS no-op", resp)
+	}
+
+	s.bypassClients = map[string][]string{"other-client": {"internal:read"}}
+	if rec, _ := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme"))); rec.Code != http.StatusInternalServerError {
+		t.Errorf("status for a client that is not bypassed = %d, want %d from matching", rec.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestParseBypassClients(t *testing.T) {
+	clients, err := parseBypassClients("svc-internal=internal:read internal:write, probe-client=")
+	if err != nil {
+		t.Fatalf("parseBypassClients: %v", err)
+	}
+	if got := mustJSON(t, clients); got != `{"probe-client":[],"svc-internal":["internal:read","internal:write"]}` {
+		t.Errorf("clients = %s", got)
+	}
+	for _, value := range []string{"svc-internal", "=internal:read"} {
+		if _, err := parseBypassClients(value); err == nil {
+			t.Errorf("parseBypassClients accepted %q", value)
+		}
+	}
+}
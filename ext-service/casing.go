@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// fieldCasing converts a canonical camelCase response field name into the
+// casing a given Asgardeo version expects
+type fieldCasing func(camel string) string
+
+// fieldCasings are the selectable response casings (RESPONSE_FIELD_CASING).
+// Current Asgardeo versions expect camelCase.
+var fieldCasings = map[string]fieldCasing{
+	"camel":  nil,
+	"snake":  snakeCase,
+	"pascal": pascalCase,
+}
+
+// responseCasing is the casing applied to response field names; nil keeps the
+// camelCase names from the struct tags
+var responseCasing fieldCasing
+
+// configureResponseCasing selects the response casing by name
+func configureResponseCasing(name string) error {
+	if name == "" {
+		name = "camel"
+	}
+	casing, ok := fieldCasings[name]
+	if !ok {
+		return fmt.Errorf("unknown RESPONSE_FIELD_CASING %q (expected camel, snake or pascal)", name)
+	}
+	responseCasing = casing
+	return nil
+}
+
+// snakeCase converts actionStatus to action_status
+func snakeCase(camel string) string {
+	var b strings.Builder
+	for i, r := range camel {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// pascalCase converts actionStatus to ActionStatus
+func pascalCase(camel string) string {
+	if camel == "" {
+		return camel
+	}
+	return strings.ToUpper(camel[:1]) + camel[1:]
+}
+
+// jsonObject writes a JSON object field by field, keeping field order and
+// applying responseCasing to each name
+type jsonObject struct {
+	buf bytes.Buffer
+	err error
+}
+
+// field writes name: value, skipping it when omitEmpty is set and value is empty
+func (o *jsonObject) field(name string, value interface{}, omitEmpty bool) {
+	if o.err != nil || (omitEmpty && isEmptyJSONValue(value)) {
+		return
+	}
+	if o.buf.Len() == 0 {
+		o.buf.WriteByte('{')
+	} else {
+		o.buf.WriteByte(',')
+	}
+
+	key, _ := json.Marshal(responseCasing(name))
+	o.buf.Write(key)
+	o.buf.WriteByte(':')
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		o.err = err
+		return
+	}
+	o.buf.Write(encoded)
+}
+
+// bytes returns the encoded object
+func (o *jsonObject) bytes() ([]byte, error) {
+	if o.err != nil {
+		return nil, o.err
+	}
+	if o.buf.Len() == 0 {
+		return []byte("{}"), nil
+	}
+	o.buf.WriteByte('}')
+	return o.buf.Bytes(), nil
+}
+
+// isEmptyJSONValue mirrors encoding/json's omitempty for the field types we use
+func isEmptyJSONValue(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case []OperationResponse:
+		return len(v) == 0
+	}
+	return false
+}
+
+// responseJSON is Response without its MarshalJSON method
+type responseJSON Response
+
+// MarshalJSON encodes the response with the configured field casing
+func (r Response) MarshalJSON() ([]byte, error) {
+	if responseCasing == nil {
+		return json.Marshal(responseJSON(r))
+	}
+	var o jsonObject
+	o.field("actionStatus", r.ActionStatus, false)
+	o.field("operations", r.Operations, true)
+	o.field("previewOperations", r.PreviewOperations, true)
+	o.field("failureReason", r.FailureReason, true)
+	o.field("failureDescription", r.FailureDescription, true)
+	o.field("errorMessage", r.ErrorMessage, true)
+	o.field("errorDescription", r.ErrorDescription, true)
+	return o.bytes()
+}
+
+// operationResponseJSON is OperationResponse without its MarshalJSON method
+type operationResponseJSON OperationResponse
+
+// MarshalJSON encodes the operation with the configured field casing
+func (op OperationResponse) MarshalJSON() ([]byte, error) {
+	if responseCasing == nil {
+		return json.Marshal(operationResponseJSON(op))
+	}
+	var o jsonObject
+	o.field("op", op.Op, false)
+	o.field("path", op.Path, false)
+	o.field("value", op.Value, true)
+	return o.bytes()
+}
+
+// claimJSON is Claim without its MarshalJSON method
+type claimJSON Claim
+
+// MarshalJSON encodes a claim added through an operation with the configured
+// field casing. Request decoding is unaffected.
+func (c Claim) MarshalJSON() ([]byte, error) {
+	if responseCasing == nil {
+		return json.Marshal(claimJSON(c))
+	}
+	var o jsonObject
+	o.field("name", c.Name, false)
+	o.field("value", c.Value, false)
+	return o.bytes()
+}
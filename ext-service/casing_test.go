@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// withResponseCasing selects the named response casing for the duration of a test
+func withResponseCasing(t *testing.T, name string) {
+	t.Helper()
+	previous := responseCasing
+	if err := configureResponseCasing(name); err != nil {
+		t.Fatalf("configureResponseCasing(%q): %v", name, err)
+	}
+	t.Cleanup(func() { responseCasing = previous })
+}
+
+func TestResponseFieldCasing(t *testing.T) {
+	resp := Response{
+		ActionStatus: "SUCCESS",
+		Operations: []OperationResponse{
+			{Op: "add", Path: accessTokenScopesPath, Value: "partner:read"},
+			{Op: "add", Path: accessTokenClaimsPath, Value: Claim{Name: "tier", Value: "gold"}},
+		},
+	}
+	failed := Response{ActionStatus: "FAILED", FailureReason: "access_denied", FailureDescription: "denied"}
+	tests := []struct {
+		casing     string
+		want       string
+		wantFailed string
+	}{
+		{
+			"",
+			`{"actionStatus":"SUCCESS","operations":[{"op":"add","path":"/accessToken/scopes/-","value":"partner:read"},{"op":"add","path":"/accessToken/claims/-","value":{"name":"tier","value":"gold"}}]}`,
+			`{"actionStatus":"FAILED","failureReason":"access_denied","failureDescription":"denied"}`,
+		},
+		{
+			"snake",
+			`{"action_status":"SUCCESS","operations":[{"op":"add","path":"/accessToken/scopes/-","value":"partner:read"},{"op":"add","path":"/accessToken/claims/-","value":{"name":"tier","value":"gold"}}]}`,
+			`{"action_status":"FAILED","failure_reason":"access_denied","failure_description":"denied"}`,
+		},
+		{
+			"pascal",
+			`{"ActionStatus":"SUCCESS","Operations":[{"Op":"add","Path":"/accessToken/scopes/-","Value":"partner:read"},{"Op":"add","Path":"/accessToken/claims/-","Value":{"Name":"tier","Value":"gold"}}]}`,
+			`{"ActionStatus":"FAILED","FailureReason":"access_denied","FailureDescription":"denied"}`,
+		},
+	}
+	for _, tt := range tests {
+		withResponseCasing(t, tt.casing)
+
+		for _, c := range []struct {
+			resp Response
+			want string
+		}{{resp, tt.want}, {failed, tt.wantFailed}} {
+			got, err := json.Marshal(c.resp)
+			if err != nil || string(got) != c.want {
+				t.Errorf("casing %q: body = %s, %v, want %s", tt.casing, got, err, c.want)
+			}
+		}
+	}
+}
+
+func TestConfigureResponseCasingRejectsUnknownCasing(t *testing.T) {
+	if err := configureResponseCasing("kebab"); err == nil {
+		t.Error("configureResponseCasing accepted kebab")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"text/template"
+	"time"
+)
+
+// Config holds the settings and components a Server handles action requests
+// with. Each Server carries its own, so a test (or a second listener) can run a
+// handler with different settings without touching the environment or the
+// rest of the process. main fills one in from the environment with the
+// configureX methods.
+//
+// Process-wide concerns stay outside it: logging, tracing, readiness, the
+// response encoding format, and entitlement loading, including the subject ID
+// normalization applied both at load and to request subjects.
+type Config struct {
+	// actionSharedSecret is the bearer token Asgardeo sends with action
+	// requests. Request authentication is disabled when it is unset.
+	actionSharedSecret string
+	// adminToken guards the admin endpoints. They are not registered when it is unset.
+	adminToken string
+	// unauthenticatedPaths are served without either credential
+	// (UNAUTHENTICATED_PATHS), so probes keep working
+	unauthenticatedPaths map[string]bool
+	// requestTimeout bounds the context of each action request (0 means no cap)
+	requestTimeout time.Duration
+	// jwksTimeout bounds each partner-assertion JWKS fetch
+	jwksTimeout time.Duration
+	// maxBodyBytes caps the request body read from the caller (MAX_BODY_BYTES)
+	maxBodyBytes int64
+	// A gzip-encoded body is capped both as read from the caller
+	// (MAX_COMPRESSED_BYTES) and once decoded (MAX_DECOMPRESSED_BYTES)
+	maxCompressedBytes   int64
+	maxDecompressedBytes int64
+	// preprocessors is the configured chain, run in order
+	preprocessors []Preprocessor
+	// failOnPreprocessorError aborts the request when a step fails; otherwise the
+	// failure is logged and the remaining steps still run
+	failOnPreprocessorError bool
+	// bypassClients maps internal client IDs to the fixed scopes they always
+	// get, skipping entitlement matching. An empty list means a plain SUCCESS
+	// with no operations.
+	bypassClients map[string][]string
+	// rateLimiter is nil when rate limiting is disabled
+	rateLimiter *keyedRateLimiter
+
+	// Partner assertion settings. When partnerAssertionHeader is set, the partner
+	// ID is read from partnerAssertionClaim of the JWT carried in that additional
+	// header.
+	partnerAssertionHeader        string
+	partnerAssertionClaim         string
+	partnerAssertionVerifier      *jwksVerifier
+	rejectInvalidPartnerAssertion bool
+	// allowUnsignedPartnerAssertions accepts assertions without a JWKS to verify
+	// them against (PARTNER_ASSERTION_ALLOW_UNSIGNED); otherwise they are invalid
+	allowUnsignedPartnerAssertions bool
+	// partnerAssertionSourceClaim names the assertion claim selecting the
+	// entitlement source (PARTNER_ASSERTION_SOURCE_CLAIM). It is only read from
+	// signature-verified assertions.
+	partnerAssertionSourceClaim string
+	// subjectClaim is an access token claim that also carries the partner ID
+	subjectClaim string
+	// subjectConflictPolicy decides which source wins when they disagree
+	subjectConflictPolicy string
+	// subjectSources maps subject types other than partner to where their IDs
+	// come from (SUBJECT_SOURCES); partner IDs keep their own resolution
+	subjectSources map[string]subjectSource
+	// defaultSubject is matched when a request resolves no subject, so catch-all
+	// entitlements can grant baseline scopes (nil leaves such requests without any)
+	defaultSubject *Subject
+
+	// matchFirst stops evaluation at the first entitlement that grants or denies
+	// (MATCH_MODE=first); by default every matching entitlement is aggregated
+	matchFirst bool
+	// rules is the compiled rule set; empty when RULES_FILE is not set
+	rules []rule
+	// expressionCostLimit is the CEL runtime cost limit from CEL_COST_LIMIT
+	expressionCostLimit uint64
+	// consentClaim names the access token claim listing the scopes the user
+	// consented to; empty disables consent filtering
+	consentClaim string
+	// grantWithoutConsent grants every entitled scope when the claim is missing
+	grantWithoutConsent bool
+	// requestedAudienceHeader is the additional header carrying the audience
+	// (resource server) the token is requested for
+	requestedAudienceHeader string
+	// Resource attributes come from additional headers named
+	// resourceHeaderPrefix+attribute and claims named resourceClaimPrefix+attribute
+	resourceHeaderPrefix string
+	resourceClaimPrefix  string
+	// disabledTags excludes entitlements carrying any of its tags from evaluation
+	disabledTags *tagFilter
+	// enricher is nil when attribute enrichment is disabled
+	enricher *attributeEnricher
+	// riskEvaluator is nil when risk scoring is disabled
+	riskEvaluator RiskEvaluator
+
+	// scopePrefixRewrites are applied in order to every computed scope; the
+	// first rule whose prefix matches wins
+	scopePrefixRewrites []scopePrefixRewrite
+	// scopeTemplate formats scopes when SCOPE_TEMPLATE is set, replacing the
+	// <type>:<action> format and SCOPE_INCLUDE_SUBJECT
+	scopeTemplate *template.Template
+	// Subject ID inclusion (SCOPE_INCLUDE_SUBJECT). With the "prefix" position
+	// the scope is <type>:<id>:<action>, with "suffix" it is <type>:<action>:<id>.
+	scopeIncludeSubject  bool
+	scopeSubjectPosition string
+	// sanitizeScopes makes normalizeScope replace invalid characters instead of
+	// rejecting the scope
+	sanitizeScopes bool
+	// Scope length limit. maxScopeLength of 0 disables the check; scopes over
+	// the limit are dropped unless truncateLongScopes is set.
+	maxScopeLength     int
+	truncateLongScopes bool
+
+	// partnerMetadataClaims lists the metadata fields emitted as claims, in order
+	partnerMetadataClaims []metadataClaim
+	// allowSubjectRewrite enables rewriteSubject entitlements
+	// (ALLOW_SUBJECT_REWRITE). Changing who a token is issued to is security
+	// sensitive, so it is off by default.
+	allowSubjectRewrite bool
+	// refreshTokenClaims also sets entitlement claims on the refresh token in
+	// refresh_token grants, so they survive later refreshes
+	refreshTokenClaims bool
+	// Scopes granted by time-bound entitlements can be tagged with a companion
+	// claim listing each scope and its expiry, so a downstream knows to re-check
+	// them rather than trusting them for the lifetime of the token.
+	emitScopeRecheckHints bool
+	scopeRecheckClaim     string
+	// A decision can also be summarized in a claim of its own, for consumers
+	// (such as an audit system) that read one claim rather than the scopes
+	emitScopeSummary  bool
+	scopeSummaryClaim string
+
+	// defaultDecisionTTL is the global decision TTL from DECISION_TTL (0 means no header)
+	defaultDecisionTTL time.Duration
+	// exposeGrantedScopes echoes the granted scopes in X-Granted-Scopes
+	exposeGrantedScopes bool
+	// maxResponseBytes caps the encoded action response (0 means no cap)
+	maxResponseBytes int
+	// failOversizedResponses answers FAILED instead of dropping operations
+	failOversizedResponses bool
+	// responseBuildTimeout bounds the time from the end of the entitlements
+	// lookup to the encoded response, separately from reading the request and
+	// the lookup itself (0 disables it)
+	responseBuildTimeout time.Duration
+	// slowRequestThreshold is the duration above which a request is logged as
+	// slow (0 disables the slow-request log)
+	slowRequestThreshold time.Duration
+
+	// metrics is the configured backend; the no-op backend is used by default
+	metrics Metrics
+	// operationsCache reuses evaluations for requests with identical inputs;
+	// nil when OPERATIONS_CACHE_SIZE is 0
+	operationsCache *evaluationCache
+	// scopeConsistency is nil when the monitor is disabled
+	scopeConsistency *consistencyMonitor
+	// auditLog is nil when auditing is disabled
+	auditLog *auditLogger
+	// auditRedactClaims names the claims whose evaluated values are redacted in
+	// audit records ("*" for all)
+	auditRedactClaims map[string]bool
+	// recentRequests is nil when the diagnostics buffer is disabled
+	recentRequests *ringBuffer
+	// recentSampleRate is the fraction of requests stored in the buffer
+	recentSampleRate float64
+}
+
+// defaultConfig returns the settings used when nothing is configured
+func defaultConfig() Config {
+	return Config{
+		unauthenticatedPaths:    map[string]bool{"/health": true, "/healthz": true, "/ready": true, "/metrics": true},
+		jwksTimeout:             5 * time.Second,
+		maxBodyBytes:            defaultMaxBodyBytes,
+		maxCompressedBytes:      defaultMaxBodyBytes,
+		maxDecompressedBytes:    defaultMaxBodyBytes,
+		failOnPreprocessorError: true,
+		partnerAssertionClaim:   "partner_id",
+		subjectConflictPolicy:   conflictReject,
+		expressionCostLimit:     defaultExpressionCostLimit,
+		grantWithoutConsent:     true,
+		disabledTags:            &tagFilter{disabled: map[string]bool{}},
+		scopeSubjectPosition:    "prefix",
+		scopeRecheckClaim:       "scope_recheck",
+		scopeSummaryClaim:       "scope_summary",
+		metrics:                 noopMetrics{},
+		recentSampleRate:        1.0,
+	}
+}
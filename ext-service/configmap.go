@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serviceAccountDir is where Kubernetes mounts the pod's service account token
+// and the API server's CA certificate
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// defaultConfigMapKey is the ConfigMap key read when ENTITLEMENTS_CONFIGMAP_KEY is unset
+const defaultConfigMapKey = "entitlements.json"
+
+// configMapWatchRetry is how long a failed ConfigMap watch waits before it reconnects
+const configMapWatchRetry = 5 * time.Second
+
+// errConfigMapAccess marks a ConfigMap the service account may not read. It is
+// fatal at startup rather than retried, since it will not fix itself.
+var errConfigMapAccess = errors.New("configmap access denied")
+
+// k8sConfigMapSource reads the entitlements document from one key of a
+// ConfigMap through the Kubernetes API, and watches the ConfigMap so an edit is
+// served as soon as the API server reports it, rather than when the kubelet
+// next refreshes a mounted volume. It authenticates with the pod's service
+// account, which needs get and watch on configmaps in the namespace.
+type k8sConfigMapSource struct {
+	// apiURL is the API server's base URL
+	apiURL    string
+	namespace string
+	configMap string
+	key       string
+	// name is namespace/configMap#key, for logs, stats and the admin endpoint
+	name string
+	// tokenFile holds the service account token. It is read for every call, as
+	// projected tokens are rotated.
+	tokenFile string
+	// client fetches the ConfigMap; watchClient, without a timeout, holds the
+	// watch stream open
+	client      *http.Client
+	watchClient *http.Client
+
+	// mu guards resourceVersion, the version of the last fetched ConfigMap; a
+	// watch starts from it so only later changes are reported
+	mu              sync.Mutex
+	resourceVersion string
+}
+
+// configMapObject is the part of a ConfigMap the source reads
+type configMapObject struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Data map[string]string `json:"data"`
+}
+
+// watchEvent is one event of a watch stream
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// newK8sConfigMapSource configures the in-cluster source for ref
+// ("namespace/name"), reading ENTITLEMENTS_CONFIGMAP_KEY and the API server
+// address and credentials Kubernetes provides to every pod
+func newK8sConfigMapSource(ref string) (*k8sConfigMapSource, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("ENTITLEMENTS_CONFIGMAP requires running in a Kubernetes pod (KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set)")
+	}
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the Kubernetes API CA certificate: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("failed to parse the Kubernetes API CA certificate")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+
+	key := defaultConfigMapKey
+	if v := os.Getenv("ENTITLEMENTS_CONFIGMAP_KEY"); v != "" {
+		key = v
+	}
+	apiURL := "https://" + net.JoinHostPort(host, port)
+	return newConfigMapSource(apiURL, ref, key, filepath.Join(serviceAccountDir, "token"), transport)
+}
+
+// newConfigMapSource configures reading key of the ConfigMap ref from the API
+// server at apiURL, authenticating with the token in tokenFile
+func newConfigMapSource(apiURL string, ref string, key string, tokenFile string, transport http.RoundTripper) (*k8sConfigMapSource, error) {
+	namespace, name, ok := strings.Cut(ref, "/")
+	if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("invalid ENTITLEMENTS_CONFIGMAP %q (expected namespace/name)", ref)
+	}
+	return &k8sConfigMapSource{
+		apiURL:      strings.TrimSuffix(apiURL, "/"),
+		namespace:   namespace,
+		configMap:   name,
+		key:         key,
+		name:        ref + "#" + key,
+		tokenFile:   tokenFile,
+		client:      &http.Client{Transport: transport, Timeout: 10 * time.Second},
+		watchClient: &http.Client{Transport: transport},
+	}, nil
+}
+
+// newConfigMapStore creates a store for source and loads it once. A ConfigMap
+// the service account may not read is an error; any other failure leaves the
+// store unready until the watch loads it.
+func newConfigMapStore(source *k8sConfigMapSource, m Metrics) (*entitlementStore, error) {
+	store := newStore(source.name, source.fetch, nil, m)
+	store.sourceType = "configmap"
+	if _, err := store.get(); errors.Is(err, errConfigMapAccess) {
+		return nil, err
+	}
+	return store, nil
+}
+
+// fetch reads and parses the entitlements from the ConfigMap
+func (s *k8sConfigMapSource) fetch() (*EntitlementsData, error) {
+	data, err := s.get()
+	stats.recordLoad(s.name, data, err)
+	return data, err
+}
+
+// get performs one read of the ConfigMap; a missing key or malformed document
+// is an error
+func (s *k8sConfigMapSource) get() (*EntitlementsData, error) {
+	resp, err := s.call(context.Background(), s.client, "/api/v1/namespaces/"+url.PathEscape(s.namespace)+"/configmaps/"+url.PathEscape(s.configMap))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var object configMapObject
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxRemoteEntitlementsBytes)).Decode(&object); err != nil {
+		return nil, fmt.Errorf("failed to parse configmap %s: %w", s.name, err)
+	}
+	doc, ok := object.Data[s.key]
+	if !ok {
+		return nil, fmt.Errorf("configmap %s/%s has no key %q", s.namespace, s.configMap, s.key)
+	}
+	data, err := decodeEntitlements(strings.NewReader(doc), s.name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse entitlements from %s: %w", s.name, err)
+	}
+	if err := compileEntitlementExpressions(data); err != nil {
+		return nil, fmt.Errorf("failed to load entitlements from %s: %w", s.name, err)
+	}
+	s.setResourceVersion(object.Metadata.ResourceVersion)
+	return data, nil
+}
+
+// call sends an authenticated GET for path and query to the API server. A
+// status other than 200 is an error, explaining the RBAC needed on 401 and 403.
+func (s *k8sConfigMapSource) call(ctx context.Context, client *http.Client, path string) (*http.Response, error) {
+	token, err := os.ReadFile(s.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the service account token: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.apiURL+path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configmap %s: %w", s.name, err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configmap %s: %w", s.name, err)
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		return nil, fmt.Errorf("%w: the Kubernetes API rejected the service account token (401)", errConfigMapAccess)
+	case http.StatusForbidden:
+		return nil, fmt.Errorf("%w: the service account may not read configmap %s/%s (403); grant it get and watch on configmaps in namespace %s with a Role and RoleBinding",
+			errConfigMapAccess, s.namespace, s.configMap, s.namespace)
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("configmap %s/%s not found", s.namespace, s.configMap)
+	default:
+		return nil, fmt.Errorf("failed to read configmap %s: unexpected status %d", s.name, resp.StatusCode)
+	}
+}
+
+// setResourceVersion records the version of the last fetched ConfigMap
+func (s *k8sConfigMapSource) setResourceVersion(version string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resourceVersion = version
+}
+
+// currentResourceVersion returns the version of the last fetched ConfigMap
+func (s *k8sConfigMapSource) currentResourceVersion() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.resourceVersion
+}
+
+// watch reloads store whenever the ConfigMap changes. The API server closes
+// watches after a while, so it reconnects for as long as the process runs.
+func (s *k8sConfigMapSource) watch(store *entitlementStore) {
+	for {
+		if err := s.watchOnce(context.Background(), store.reloadIfChanged); err != nil {
+			slog.Warn("ConfigMap watch failed, reconnecting", "source", s.name, "error", err, "retry_in", configMapWatchRetry)
+			time.Sleep(configMapWatchRetry)
+		}
+	}
+}
+
+// watchOnce holds one watch stream open, calling changed for every new
+// version of the ConfigMap, until the stream ends
+func (s *k8sConfigMapSource) watchOnce(ctx context.Context, changed func()) error {
+	query := url.Values{
+		"watch":         {"true"},
+		"fieldSelector": {"metadata.name=" + s.configMap},
+	}
+	if version := s.currentResourceVersion(); version != "" {
+		query.Set("resourceVersion", version)
+	}
+	resp, err := s.call(ctx, s.watchClient, "/api/v1/namespaces/"+url.PathEscape(s.namespace)+"/configmaps?"+query.Encode())
+	if err != nil {
+		// The version may be too old to watch from (410 Gone); the next watch
+		// starts over from the current ConfigMap
+		s.setResourceVersion("")
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event watchEvent
+		if err := dec.Decode(&event); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read configmap watch: %w", err)
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			var object configMapObject
+			if err := json.Unmarshal(event.Object, &object); err != nil {
+				return fmt.Errorf("failed to parse configmap watch event: %w", err)
+			}
+			if object.Metadata.ResourceVersion != s.currentResourceVersion() {
+				changed()
+			}
+		case "DELETED":
+			slog.Warn("ConfigMap deleted, keeping the loaded entitlements", "source", s.name)
+		case "ERROR":
+			var status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				// The version is too old to watch from; start over from the
+				// current ConfigMap
+				s.setResourceVersion("")
+			}
+			return fmt.Errorf("configmap watch error %d: %s", status.Code, status.Message)
+		}
+	}
+}
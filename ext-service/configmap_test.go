@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeKubernetesAPI serves the ConfigMap team/entitlements and a watch stream
+// of the events sent on events. It records the last Authorization header.
+type fakeKubernetesAPI struct {
+	mu              sync.Mutex
+	status          int
+	doc             string
+	resourceVersion string
+	authorization   string
+	watchQuery      string
+	events          chan string
+}
+
+func (f *fakeKubernetesAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.authorization = r.Header.Get("Authorization")
+	status := f.status
+	f.mu.Unlock()
+	if status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+
+	if r.URL.Path == "/api/v1/namespaces/team/configmaps" && r.URL.Query().Get("watch") == "true" {
+		f.mu.Lock()
+		f.watchQuery = r.URL.RawQuery
+		f.mu.Unlock()
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case event, ok := <-f.events:
+				if !ok {
+					return
+				}
+				fmt.Fprintln(w, event)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+	if r.URL.Path != "/api/v1/namespaces/team/configmaps/entitlements" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	json.NewEncoder(w).Encode(f.object())
+}
+
+// object returns the ConfigMap as the API serves it
+func (f *fakeKubernetesAPI) object() map[string]interface{} {
+	return map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "entitlements", "resourceVersion": f.resourceVersion},
+		"data":     map[string]interface{}{"entitlements.json": f.doc},
+	}
+}
+
+// update changes the ConfigMap and returns the MODIFIED event reporting it
+func (f *fakeKubernetesAPI) update(doc string, resourceVersion string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.doc, f.resourceVersion = doc, resourceVersion
+	event, _ := json.Marshal(map[string]interface{}{"type": "MODIFIED", "object": f.object()})
+	return string(event)
+}
+
+// configMapSource starts api and returns a source reading its ConfigMap with
+// the service account token "sa-token"
+func configMapSource(t *testing.T, api *fakeKubernetesAPI) *k8sConfigMapSource {
+	t.Helper()
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("sa-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	source, err := newConfigMapSource(server.URL, "team/entitlements", defaultConfigMapKey, tokenFile, http.DefaultTransport)
+	if err != nil {
+		t.Fatalf("newConfigMapSource: %v", err)
+	}
+	return source
+}
+
+func TestConfigMapSourceLoadsKey(t *testing.T) {
+	api := &fakeKubernetesAPI{doc: remoteDoc, resourceVersion: "7"}
+
+	source := configMapSource(t, api)
+	data, err := source.get()
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if len(data.Entitlements) != 1 || data.Entitlements[0].EntitlementID != "ent_read" {
+		t.Errorf("entitlements = %+v, want ent_read", data.Entitlements)
+	}
+	if api.authorization != "Bearer sa-token" {
+		t.Errorf("Authorization = %q, want the service account token", api.authorization)
+	}
+	if source.currentResourceVersion() != "7" {
+		t.Errorf("resourceVersion = %q, want 7", source.currentResourceVersion())
+	}
+
+	source.key = "missing.json"
+	if _, err := source.get(); err == nil || !strings.Contains(err.Error(), `no key "missing.json"`) {
+		t.Errorf("error = %v, want the missing key named", err)
+	}
+}
+
+func TestConfigMapStoreExplainsRBACErrors(t *testing.T) {
+	for _, status := range []int{http.StatusForbidden, http.StatusUnauthorized} {
+		source := configMapSource(t, &fakeKubernetesAPI{status: status})
+
+		_, err := newConfigMapStore(source, noopMetrics{})
+		if !errors.Is(err, errConfigMapAccess) {
+			t.Errorf("status %d: error = %v, want an access error", status, err)
+		}
+		if status == http.StatusForbidden && (err == nil || !strings.Contains(err.Error(), "grant it get and watch on configmaps in namespace team")) {
+			t.Errorf("status %d: error = %v, want the missing RBAC explained", status, err)
+		}
+	}
+}
+
+func TestConfigMapStoreStartsUnreadyOnOtherErrors(t *testing.T) {
+	source := configMapSource(t, &fakeKubernetesAPI{status: http.StatusInternalServerError})
+
+	store, err := newConfigMapStore(source, noopMetrics{})
+	if err != nil {
+		t.Fatalf("newConfigMapStore: %v", err)
+	}
+	if _, err := store.get(); err == nil {
+		t.Error("get succeeded, want the load error until the watch loads the ConfigMap")
+	}
+}
+
+func TestConfigMapWatchReloadsStore(t *testing.T) {
+	api := &fakeKubernetesAPI{doc: remoteDoc, resourceVersion: "7", events: make(chan string)}
+	source := configMapSource(t, api)
+	store, err := newConfigMapStore(source, noopMetrics{})
+	if err != nil {
+		t.Fatalf("newConfigMapStore: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- source.watchOnce(context.Background(), store.reloadIfChanged) }()
+	api.events <- api.update(strings.Replace(remoteDoc, "ent_read", "ent_write", 1), "8")
+	close(api.events)
+	if err := <-done; err != nil {
+		t.Fatalf("watchOnce: %v", err)
+	}
+
+	data, _ := store.get()
+	if len(data.Entitlements) != 1 || data.Entitlements[0].EntitlementID != "ent_write" {
+		t.Errorf("entitlements after MODIFIED = %+v, want ent_write", data.Entitlements)
+	}
+	if !strings.Contains(api.watchQuery, "resourceVersion=7") || !strings.Contains(api.watchQuery, "fieldSelector=metadata.name%3Dentitlements") {
+		t.Errorf("watch query = %q, want it to start at version 7 of the ConfigMap", api.watchQuery)
+	}
+}
+
+func TestConfigMapWatchRestartsAfterExpiredVersion(t *testing.T) {
+	api := &fakeKubernetesAPI{doc: remoteDoc, resourceVersion: "7", events: make(chan string, 1)}
+	source := configMapSource(t, api)
+	if _, err := source.get(); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+
+	api.events <- `{"type":"ERROR","object":{"kind":"Status","code":410,"message":"too old resource version"}}`
+	err := source.watchOnce(context.Background(), func() { t.Error("changed called for an ERROR event") })
+	if err == nil || !strings.Contains(err.Error(), "410") {
+		t.Errorf("error = %v, want the expired version reported", err)
+	}
+	if source.currentResourceVersion() != "" {
+		t.Errorf("resourceVersion = %q, want it cleared so the next watch starts over", source.currentResourceVersion())
+	}
+}
+
+func TestNewConfigMapSourceRejectsInvalidSettings(t *testing.T) {
+	for _, ref := range []string{"entitlements", "/entitlements", "team/", "team/a/b"} {
+		if _, err := newConfigMapSource("https://kubernetes", ref, defaultConfigMapKey, "token", http.DefaultTransport); err == nil {
+			t.Errorf("newConfigMapSource accepted %q", ref)
+		}
+	}
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	if _, err := newK8sConfigMapSource("team/entitlements"); err == nil || !strings.Contains(err.Error(), "Kubernetes pod") {
+		t.Errorf("error outside a pod = %v, want it explained", err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Policies for a token without the consent claim (CONSENT_MISSING_POLICY)
+const (
+	consentMissingGrantAll  = "grant-all"
+	consentMissingGrantNone = "grant-none"
+)
+
+// configureConsent reads CONSENT_CLAIM and CONSENT_MISSING_POLICY
+func (c *Config) configureConsent() error {
+	c.consentClaim = os.Getenv("CONSENT_CLAIM")
+	switch policy := os.Getenv("CONSENT_MISSING_POLICY"); policy {
+	case "", consentMissingGrantAll:
+		c.grantWithoutConsent = true
+	case consentMissingGrantNone:
+		c.grantWithoutConsent = false
+	default:
+		return fmt.Errorf("invalid CONSENT_MISSING_POLICY %q (expected grant-all or grant-none)", policy)
+	}
+	return nil
+}
+
+// consentedScopes returns a check for whether the user consented to a scope. The
+// consent claim is a space-separated string or a list of scopes. Without consent
+// filtering every scope passes; without the claim, CONSENT_MISSING_POLICY decides.
+func (c *Config) consentedScopes(claims []Claim) func(scope string) bool {
+	if c.consentClaim == "" {
+		return func(string) bool { return true }
+	}
+	value, ok := getClaimValue(claims, c.consentClaim)
+	if !ok {
+		return func(string) bool { return c.grantWithoutConsent }
+	}
+
+	consented := make(map[string]bool)
+	switch v := value.(type) {
+	case string:
+		for _, scope := range strings.Fields(v) {
+			consented[scope] = true
+		}
+	case []interface{}:
+		for _, item := range v {
+			if scope, ok := item.(string); ok {
+				consented[scope] = true
+			}
+		}
+	}
+	return func(scope string) bool { return consented[scope] }
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// consentConfig returns the default settings with the given consent claim and missing-claim policy
+func consentConfig(claim string, grantMissing bool) Config {
+	cfg := defaultConfig()
+	cfg.consentClaim, cfg.grantWithoutConsent = claim, grantMissing
+	return cfg
+}
+
+func TestConsentedScopes(t *testing.T) {
+	cfg := consentConfig("consent", true)
+
+	tests := []struct {
+		name   string
+		claims []Claim
+		scope  string
+		want   bool
+	}{
+		{"string consents", []Claim{{Name: "consent", Value: "partner:read partner:write"}}, "partner:write", true},
+		{"string omits", []Claim{{Name: "consent", Value: "partner:read"}}, "partner:write", false},
+		{"list consents", []Claim{{Name: "consent", Value: []interface{}{"partner:read"}}}, "partner:read", true},
+		{"list omits", []Claim{{Name: "consent", Value: []interface{}{"partner:read"}}}, "partner:admin", false},
+		{"empty consent", []Claim{{Name: "consent", Value: ""}}, "partner:read", false},
+		{"missing claim, grant-all", nil, "partner:read", true},
+	}
+	for _, tt := range tests {
+		if got := cfg.consentedScopes(tt.claims)(tt.scope); got != tt.want {
+			t.Errorf("%s: consented(%q) = %v, want %v", tt.name, tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestConsentedScopesMissingClaimGrantNone(t *testing.T) {
+	cfg := consentConfig("consent", false)
+	if cfg.consentedScopes(nil)("partner:read") {
+		t.Error("scope consented without a consent claim, want it dropped under grant-none")
+	}
+}
+
+func TestConsentedScopesDisabled(t *testing.T) {
+	cfg := consentConfig("", false)
+	if !cfg.consentedScopes(nil)("partner:read") {
+		t.Error("scope dropped with consent filtering disabled")
+	}
+}
+
+func TestHandlerDropsScopesWithoutConsent(t *testing.T) {
+	provider := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{
+		{EntitlementID: "ent_read", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "read"},
+		{EntitlementID: "ent_write", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "write"},
+	}}}
+
+	req := Request{
+		ActionType: actionPreIssueAccessToken,
+		Event: Event{
+			Request:     RequestData{AdditionalHeaders: []Header{partnerHeader("org_acme")}},
+			AccessToken: AccessToken{Claims: []Claim{{Name: "consent", Value: "partner:read"}}, Scopes: []string{}},
+		},
+		AllowedOperations: []Operation{{Op: "add", Paths: []string{accessTokenScopesPath}}},
+	}
+	_, resp := serve(t, NewServerWithConfig(provider, consentConfig("consent", true)), http.MethodPost, marshalRequest(t, req))
+
+	if scopes := grantedScopes(resp.Operations); len(scopes) != 1 || scopes[0] != "partner:read" {
+		t.Errorf("granted scopes = %v, want [partner:read]", scopes)
+	}
+}
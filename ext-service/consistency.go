@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// volatileClaims change on every token and are left out of the input fingerprint
+var volatileClaims = map[string]bool{
+	"iat":       true,
+	"exp":       true,
+	"nbf":       true,
+	"jti":       true,
+	"auth_time": true,
+}
+
+// consistencyMonitor remembers the scopes granted for a fingerprint of each
+// sampled partner's inputs and reports when the same inputs grant different
+// scopes, which points at non-deterministic matching
+type consistencyMonitor struct {
+	sampleRate float64
+	granted    *lruCache[string, string]
+	metrics    Metrics
+}
+
+// configureConsistency reads CONSISTENCY_SAMPLE_RATE and CONSISTENCY_CACHE_SIZE.
+// Mismatches are counted on the configured metrics backend.
+func (c *Config) configureConsistency() error {
+	v := os.Getenv("CONSISTENCY_SAMPLE_RATE")
+	if v == "" {
+		return nil
+	}
+	rate, err := strconv.ParseFloat(v, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return fmt.Errorf("invalid CONSISTENCY_SAMPLE_RATE %q (expected 0 to 1)", v)
+	}
+	if rate == 0 {
+		return nil
+	}
+
+	size := 1024
+	if v := os.Getenv("CONSISTENCY_CACHE_SIZE"); v != "" {
+		size, err = strconv.Atoi(v)
+		if err != nil || size <= 0 {
+			return fmt.Errorf("invalid CONSISTENCY_CACHE_SIZE %q", v)
+		}
+	}
+
+	c.scopeConsistency = &consistencyMonitor{
+		sampleRate: rate,
+		granted:    newLRUCache[string, string](size, 0),
+		metrics:    c.metrics,
+	}
+	return nil
+}
+
+// sampled reports whether partnerID (a request's joined partner IDs) is monitored. Sampling is by partner, not by
+// request, so a monitored partner is always compared against its own history.
+func (m *consistencyMonitor) sampled(partnerID string) bool {
+	h := fnv.New32a()
+	h.Write([]byte(partnerID))
+	return float64(h.Sum32()%10000) < m.sampleRate*10000
+}
+
+// check compares the scopes granted for the request with the scopes last granted
+// for the same inputs, logging and counting a mismatch
+func (m *consistencyMonitor) check(logger *slog.Logger, now time.Time, ev Event, allowed []Operation, partnerIDs []string, entitlements []Entitlement, riskScore float64, scopes []string) {
+	partnerID := strings.Join(partnerIDs, ",")
+	if m == nil || !m.sampled(partnerID) {
+		return
+	}
+	fingerprint, err := inputFingerprint(ev, allowed, partnerIDs, entitlements, riskScore)
+	if err != nil {
+		logger.Error("Error fingerprinting request for consistency check", "error", err)
+		return
+	}
+
+	sorted := append([]string{}, scopes...)
+	sort.Strings(sorted)
+	current := strings.Join(sorted, " ")
+
+	if previous, ok := m.granted.get(fingerprint, now); ok && previous != current {
+		logger.Warn("Scope inconsistency: same inputs granted different scopes", "partner_ids", partnerID, "scopes", current, "previous_scopes", previous)
+		m.metrics.IncCounter(metricScopeInconsistencies, Labels{})
+	}
+	m.granted.put(fingerprint, current, now)
+}
+
+// inputFingerprint hashes everything a decision depends on: the partner, the
+// request (without volatile claims), allowedOperations, the risk score and the
+// partner's entitlements, so that a change to any of them starts a new history
+func inputFingerprint(ev Event, allowed []Operation, partnerIDs []string, entitlements []Entitlement, riskScore float64) (string, error) {
+	partners := make(map[string]bool, len(partnerIDs))
+	for _, id := range partnerIDs {
+		partners[id] = true
+	}
+	var claims []Claim
+	for _, claim := range ev.AccessToken.Claims {
+		if !volatileClaims[claim.Name] {
+			claims = append(claims, claim)
+		}
+	}
+	var own []Entitlement
+	for _, entitlement := range entitlements {
+		if partners[entitlement.Subject.ID] {
+			own = append(own, entitlement)
+		}
+	}
+
+	inputs, err := json.Marshal(struct {
+		Request      RequestData
+		Scopes       []string
+		Claims       []Claim
+		Allowed      []Operation
+		RiskScore    float64
+		Entitlements []Entitlement
+	}{ev.Request, ev.AccessToken.Scopes, claims, allowed, riskScore, own})
+	if err != nil {
+		return "", err
+	}
+
+	h := fnv.New64a()
+	h.Write(inputs)
+	return strings.Join(partnerIDs, ",") + ":" + strconv.FormatUint(h.Sum64(), 16), nil
+}
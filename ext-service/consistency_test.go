@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// consistencyRequest is the event checked by the consistency tests, with an iat
+// claim that changes per token
+func consistencyRequest(iat int64) Event {
+	return Event{
+		Request:     RequestData{ClientID: "client", AdditionalHeaders: []Header{partnerHeader("org_acme")}},
+		AccessToken: AccessToken{Claims: []Claim{{Name: "iat", Value: iat}, {Name: "tier", Value: "gold"}}},
+	}
+}
+
+// newTestConsistencyMonitor monitors every partner and counts mismatches
+func newTestConsistencyMonitor() (*consistencyMonitor, *countingMetrics) {
+	counting := &countingMetrics{counts: make(map[string]int)}
+	return &consistencyMonitor{sampleRate: 1, granted: newLRUCache[string, string](16, 0), metrics: counting}, counting
+}
+
+func TestConsistencyMonitorDetectsInducedInconsistency(t *testing.T) {
+	logs := withDefaultLogger(t)
+	monitor, counting := newTestConsistencyMonitor()
+	entitlements := testEntitlements.data.Entitlements
+	now := time.Now()
+
+	monitor.check(slog.Default(), now, consistencyRequest(1), nil, []string{"org_acme"}, entitlements, 0, []string{"partner:write", "partner:read"})
+	// Scope order does not matter
+	monitor.check(slog.Default(), now, consistencyRequest(2), nil, []string{"org_acme"}, entitlements, 0, []string{"partner:read", "partner:write"})
+	if n := counting.count(metricScopeInconsistencies, ""); n != 0 {
+		t.Fatalf("inconsistencies = %d for the same scopes, want 0", n)
+	}
+
+	// Same inputs apart from the volatile iat claim, but a different outcome
+	monitor.check(slog.Default(), now, consistencyRequest(3), nil, []string{"org_acme"}, entitlements, 0, []string{"partner:read"})
+
+	if n := counting.count(metricScopeInconsistencies, ""); n != 1 {
+		t.Errorf("inconsistencies = %d, want 1", n)
+	}
+	if out := logs.String(); !strings.Contains(out, "Scope inconsistency") || !strings.Contains(out, `"previous_scopes":"partner:read partner:write"`) {
+		t.Errorf("logs = %s, want the mismatch logged with both scope sets", out)
+	}
+}
+
+func TestConsistencyMonitorStartsOverWhenInputsChange(t *testing.T) {
+	monitor, counting := newTestConsistencyMonitor()
+	now := time.Now()
+
+	monitor.check(slog.Default(), now, consistencyRequest(1), nil, []string{"org_acme"}, testEntitlements.data.Entitlements, 0, []string{"partner:read"})
+	changed := []Entitlement{{EntitlementID: "ent_write", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "write"}}
+	monitor.check(slog.Default(), now, consistencyRequest(1), nil, []string{"org_acme"}, changed, 0, []string{"partner:write"})
+
+	if n := counting.count(metricScopeInconsistencies, ""); n != 0 {
+		t.Errorf("inconsistencies = %d after the entitlements changed, want 0", n)
+	}
+}
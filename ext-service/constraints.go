@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// evaluateConstraints reports whether the request event satisfies an entitlement's
+// request constraints. Constraint keys it does not recognize describe the
+// resource rather than the request and are ignored here.
+//
+// Supported constraints:
+//
+//	{"header": "x-channel", "equals": "mobile"}  additional header equals a value
+//	{"headersAll": {"x-channel": "mobile", "x-region": "eu"}}  every header matches
+//	{"headersAny": {"x-channel": "mobile", "x-region": "eu"}}  at least one header matches
+//	{"claims": {"tier": "gold"}}  every access token claim (or enriched attribute) matches
+//	{"grantType": "client_credentials"}  the token request uses the grant type
+//	{"scopeRequired": "read"}  the scope is among the requested scopes
+//	{"validUntil": "2025-12-31T23:59:59Z"}  now is before the RFC 3339 time
+//
+// grantType, scopeRequired and claim values may also be lists, matching when the
+// request value is "in" the list (for scopeRequired, when any listed scope is
+// requested). equals and header values are compared as text, like claim values;
+// a header constraint without an equals value never matches. A validUntil that
+// is not a valid RFC 3339 time never matches. An empty constraint map always
+// allows.
+func evaluateConstraints(c map[string]interface{}, ev Event, now time.Time) bool {
+	headers := ev.Request.AdditionalHeaders
+
+	if _, ok := c["validUntil"]; ok {
+		expiry, valid := constraintExpiry(c)
+		if !valid || !now.Before(expiry) {
+			return false
+		}
+	}
+
+	if name, ok := c["header"].(string); ok {
+		want, ok := c["equals"]
+		if !ok || want == nil || !headerHasValue(headers, name, fmt.Sprint(want)) {
+			return false
+		}
+	}
+
+	if all, ok := c["headersAll"].(map[string]interface{}); ok {
+		for name, want := range all {
+			if !headerHasValue(headers, name, fmt.Sprint(want)) {
+				return false
+			}
+		}
+	}
+
+	if anyOf, ok := c["headersAny"].(map[string]interface{}); ok && len(anyOf) > 0 {
+		matched := false
+		for name, want := range anyOf {
+			if headerHasValue(headers, name, fmt.Sprint(want)) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if claims, ok := c["claims"].(map[string]interface{}); ok {
+		for name, want := range claims {
+			value, exists := getClaimValue(ev.AccessToken.Claims, name)
+			if !exists || !claimHasValue(value, want) {
+				return false
+			}
+		}
+	}
+
+	if want, ok := c["grantType"]; ok && !valueMatches(ev.Request.GrantType, want) {
+		return false
+	}
+
+	if want, ok := c["scopeRequired"]; ok {
+		requested := false
+		for _, scope := range ev.AccessToken.Scopes {
+			if valueMatches(scope, want) {
+				requested = true
+				break
+			}
+		}
+		if !requested {
+			return false
+		}
+	}
+
+	return true
+}
+
+// valueMatches reports whether actual equals want, or is in want when it is a list
+func valueMatches(actual string, want interface{}) bool {
+	if list, ok := want.([]interface{}); ok {
+		for _, item := range list {
+			if fmt.Sprint(item) == actual {
+				return true
+			}
+		}
+		return false
+	}
+	return fmt.Sprint(want) == actual
+}
+
+// claimHasValue reports whether a claim value, or any element of an array
+// value, matches want (a value or a list of values)
+func claimHasValue(value interface{}, want interface{}) bool {
+	if values, ok := value.([]interface{}); ok {
+		for _, v := range values {
+			if valueMatches(fmt.Sprint(v), want) {
+				return true
+			}
+		}
+		return false
+	}
+	return valueMatches(fmt.Sprint(value), want)
+}
+
+// headerHasValue reports whether any value of the named additional header equals want
+func headerHasValue(headers []Header, name string, want string) bool {
+	for _, header := range headers {
+		if header.Name != name {
+			continue
+		}
+		for _, value := range header.Value {
+			if value == want {
+				return true
+			}
+		}
+	}
+	return false
+}
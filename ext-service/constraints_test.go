@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvaluateConstraints(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	ev := Event{
+		Request: RequestData{
+			GrantType:         "client_credentials",
+			AdditionalHeaders: []Header{{Name: "x-channel", Value: []string{"web", "mobile"}}, {Name: "x-partner", Value: []string{"org_acme"}}, {Name: "x-version", Value: []string{"2"}}, {Name: "x-empty", Value: []string{""}}},
+		},
+		AccessToken: AccessToken{
+			Scopes: []string{"read"},
+			Claims: []Claim{{Name: "tier", Value: "gold"}, {Name: "groups", Value: []interface{}{"ops", "dev"}}},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		constraints map[string]interface{}
+		want        bool
+	}{
+		{"empty", map[string]interface{}{}, true},
+		{"nil", nil, true},
+		{"header matches", map[string]interface{}{"header": "x-channel", "equals": "mobile"}, true},
+		{"header differs", map[string]interface{}{"header": "x-channel", "equals": "kiosk"}, false},
+		{"header equals a number", map[string]interface{}{"header": "x-version", "equals": 2}, true},
+		{"header without equals", map[string]interface{}{"header": "x-empty"}, false},
+		{"header equals null", map[string]interface{}{"header": "x-empty", "equals": nil}, false},
+		{"all headers", map[string]interface{}{"headersAll": map[string]interface{}{"x-channel": "web"}}, true},
+		{"missing header", map[string]interface{}{"headersAll": map[string]interface{}{"x-region": "eu"}}, false},
+		{"any header", map[string]interface{}{"headersAny": map[string]interface{}{"x-region": "eu", "x-channel": "web"}}, true},
+		{"several headers all match", map[string]interface{}{"headersAll": map[string]interface{}{"x-channel": "mobile", "x-partner": "org_acme"}}, true},
+		{"headersAll partially matched", map[string]interface{}{"headersAll": map[string]interface{}{"x-channel": "mobile", "x-partner": "org_beta"}}, false},
+		{"headersAny partially matched", map[string]interface{}{"headersAny": map[string]interface{}{"x-channel": "mobile", "x-partner": "org_beta"}}, true},
+		{"headersAny all missing", map[string]interface{}{"headersAny": map[string]interface{}{"x-region": "eu", "x-tier": "gold"}}, false},
+		{"claim matches", map[string]interface{}{"claims": map[string]interface{}{"tier": "gold"}}, true},
+		{"claim in list", map[string]interface{}{"claims": map[string]interface{}{"tier": []interface{}{"silver", "gold"}}}, true},
+		{"array claim contains", map[string]interface{}{"claims": map[string]interface{}{"groups": "dev"}}, true},
+		{"claim differs", map[string]interface{}{"claims": map[string]interface{}{"tier": "silver"}}, false},
+		{"grant type in list", map[string]interface{}{"grantType": []interface{}{"refresh_token", "client_credentials"}}, true},
+		{"grant type differs", map[string]interface{}{"grantType": "refresh_token"}, false},
+		{"scope requested", map[string]interface{}{"scopeRequired": "read"}, true},
+		{"scope not requested", map[string]interface{}{"scopeRequired": "write"}, false},
+		{"not yet expired", map[string]interface{}{"validUntil": "2025-06-01T12:00:01Z"}, true},
+		{"expired", map[string]interface{}{"validUntil": "2025-06-01T11:59:59Z"}, false},
+		{"expires now", map[string]interface{}{"validUntil": "2025-06-01T12:00:00Z"}, false},
+		{"invalid expiry", map[string]interface{}{"validUntil": "tomorrow"}, false},
+		{"all must hold", map[string]interface{}{"grantType": "client_credentials", "validUntil": "2025-06-01T11:00:00Z"}, false},
+	}
+	for _, tt := range tests {
+		if got := evaluateConstraints(tt.constraints, ev, now); got != tt.want {
+			t.Errorf("%s: evaluateConstraints(%v) = %v, want %v", tt.name, tt.constraints, got, tt.want)
+		}
+	}
+}
+
+// withClock fixes the service clock at now for the duration of a test
+func withClock(t *testing.T, now time.Time) {
+	t.Helper()
+	previous := clock
+	clock = func() time.Time { return now }
+	t.Cleanup(func() { clock = previous })
+}
+
+func TestHandlerExpiredEntitlementGrantsNothing(t *testing.T) {
+	withClock(t, time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	provider := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{{
+		EntitlementID: "ent_read",
+		Subject:       Subject{Type: "partner", ID: "org_acme"},
+		Action:        "read",
+		Constraints:   map[string]interface{}{"validUntil": "2025-05-31T00:00:00Z"},
+	}}}}
+
+	_, resp := serve(t, NewServer(provider), "POST", actionRequest(t, partnerHeader("org_acme")))
+
+	if len(resp.Operations) != 0 {
+		t.Errorf("operations = %+v, want none for an expired entitlement", resp.Operations)
+	}
+}
+
+func TestHandlerEmitsRecheckHintForTimeBoundScopes(t *testing.T) {
+	withClock(t, time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	provider := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{
+		{EntitlementID: "ent_read", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "read",
+			Constraints: map[string]interface{}{"validUntil": "2025-06-01T13:00:00Z"}},
+		{EntitlementID: "ent_write", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "write"},
+	}}}
+	req := Request{
+		ActionType: actionPreIssueAccessToken,
+		Event: Event{
+			Request:     RequestData{AdditionalHeaders: []Header{partnerHeader("org_acme")}},
+			AccessToken: AccessToken{Scopes: []string{}},
+		},
+		AllowedOperations: []Operation{{Op: "add", Paths: []string{accessTokenScopesPath, accessTokenClaimsPath}}},
+	}
+	hint := `{"op":"add","path":"/accessToken/claims/-","value":{"name":"scope_recheck","value":[{"scope":"partner:read","exp":1748782800}]}}`
+
+	s := NewServer(provider)
+	if body := serveRaw(s, marshalRequest(t, req)); strings.Contains(body, "scope_recheck") {
+		t.Errorf("response = %s, want no hint while EMIT_SCOPE_RECHECK_HINTS is off", body)
+	}
+
+	s.emitScopeRecheckHints = true
+	if body := serveRaw(s, marshalRequest(t, req)); !strings.Contains(body, hint) {
+		t.Errorf("response = %s, want the hint for partner:read only", body)
+	}
+
+	// The hint is an operation like any other and needs the claims path
+	req.AllowedOperations = []Operation{{Op: "add", Paths: []string{accessTokenScopesPath}}}
+	if body := serveRaw(s, marshalRequest(t, req)); strings.Contains(body, "scope_recheck") {
+		t.Errorf("response = %s, want the hint dropped when claims are not allowed", body)
+	}
+}
+
+// serveRaw sends body to the server's handler and returns the raw response
+func serveRaw(s *Server, body string) string {
+	rec := httptest.NewRecorder()
+	s.handler(rec, httptest.NewRequest(http.MethodPost, "/token-validation", strings.NewReader(body)))
+	return rec.Body.String()
+}
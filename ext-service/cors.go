@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// CORS response settings. Authorization is allowed so browser tools can send the
+// shared secret or admin token; CORS never bypasses those checks.
+const (
+	corsAllowMethods  = "GET, POST, PUT, OPTIONS"
+	corsAllowHeaders  = "Authorization, Content-Type, X-Request-Id, X-Dry-Run"
+	corsExposeHeaders = "X-Request-Id, X-Decision-TTL, X-Granted-Scopes"
+	corsMaxAge        = "600"
+)
+
+// corsOrigins are the origins allowed to call the service from a browser; CORS
+// is disabled when it is empty. A "*" entry allows every origin.
+var corsOrigins map[string]bool
+
+// configureCORS reads CORS_ALLOWED_ORIGINS, a comma-separated list of origins
+// such as "https://tools.example.com", or "*"
+func configureCORS() error {
+	corsOrigins = nil
+	for _, origin := range strings.Split(os.Getenv("CORS_ALLOWED_ORIGINS"), ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if origin == "" {
+			continue
+		}
+		if origin != "*" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			return fmt.Errorf("invalid CORS_ALLOWED_ORIGINS origin %q (expected scheme://host[:port] or *)", origin)
+		}
+		if corsOrigins == nil {
+			corsOrigins = make(map[string]bool)
+		}
+		corsOrigins[origin] = true
+	}
+	return nil
+}
+
+// corsAllowed reports whether origin may call the service
+func corsAllowed(origin string) bool {
+	return origin != "" && (corsOrigins["*"] || corsOrigins[origin])
+}
+
+// handleCORS adds Access-Control-Allow-* headers to requests from allowed
+// origins and answers their preflight requests itself. Preflights from other
+// origins get a 403; their other requests are served without CORS headers, so
+// the browser blocks them. Without CORS_ALLOWED_ORIGINS requests pass through
+// untouched.
+func handleCORS(next http.Handler) http.Handler {
+	if len(corsOrigins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		if !corsAllowed(origin) {
+			if preflight {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The origin is echoed rather than "*" so responses stay per-origin cacheable
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
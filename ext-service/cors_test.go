@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withCORS sets CORS_ALLOWED_ORIGINS for the duration of a test
+func withCORS(t *testing.T, origins string) {
+	t.Helper()
+	t.Setenv("CORS_ALLOWED_ORIGINS", origins)
+	if err := configureCORS(); err != nil {
+		t.Fatalf("configureCORS: %v", err)
+	}
+	t.Cleanup(func() { corsOrigins = nil })
+}
+
+// corsRequest sends a request from origin through the CORS middleware to the routes of s
+func corsRequest(t *testing.T, s *Server, method string, path string, origin string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	mux := http.NewServeMux()
+	routes(mux, mux, s)
+
+	r := httptest.NewRequest(method, path, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	rec := httptest.NewRecorder()
+	handleCORS(mux).ServeHTTP(rec, r)
+	return rec
+}
+
+// preflight is the header of a browser preflight for a POST with Authorization
+var preflight = http.Header{
+	"Access-Control-Request-Method":  {http.MethodPost},
+	"Access-Control-Request-Headers": {"authorization,content-type"},
+}
+
+func TestCORSPreflight(t *testing.T) {
+	withCORS(t, "https://tools.example.com, https://debug.example.com/")
+	s := NewServer(testEntitlements)
+
+	tests := []struct {
+		origin     string
+		wantStatus int
+		wantOrigin string
+	}{
+		{"https://tools.example.com", http.StatusNoContent, "https://tools.example.com"},
+		{"https://debug.example.com", http.StatusNoContent, "https://debug.example.com"},
+		{"https://evil.example.com", http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		rec := corsRequest(t, s, http.MethodOptions, "/token-validation", tt.origin, preflight)
+
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.origin, rec.Code, tt.wantStatus)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q, want %q", tt.origin, got, tt.wantOrigin)
+		}
+		if tt.wantOrigin != "" && rec.Header().Get("Access-Control-Allow-Headers") != corsAllowHeaders {
+			t.Errorf("%s: Access-Control-Allow-Headers = %q, want %q", tt.origin, rec.Header().Get("Access-Control-Allow-Headers"), corsAllowHeaders)
+		}
+	}
+}
+
+func TestCORSStillRequiresAuth(t *testing.T) {
+	withCORS(t, "https://tools.example.com")
+	s := adminServer("s3cret", "admin")
+
+	action := corsRequest(t, s, http.MethodPost, "/token-validation", "https://tools.example.com", nil)
+	if action.Code != http.StatusUnauthorized {
+		t.Errorf("action status = %d, want %d", action.Code, http.StatusUnauthorized)
+	}
+	if got := action.Header().Get("Access-Control-Allow-Origin"); got != "https://tools.example.com" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want the origin", got)
+	}
+
+	admin := corsRequest(t, s, http.MethodGet, "/admin/entitlements", "https://tools.example.com", nil)
+	if admin.Code != http.StatusUnauthorized {
+		t.Errorf("admin status = %d, want %d", admin.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestCORSDisallowedOriginGetsNoHeaders(t *testing.T) {
+	withCORS(t, "https://tools.example.com")
+	s := NewServer(testEntitlements)
+
+	rec := corsRequest(t, s, http.MethodGet, "/health", "https://evil.example.com", nil)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want none", got)
+	}
+}
+
+func TestCORSDisabled(t *testing.T) {
+	withCORS(t, "")
+	s := NewServer(testEntitlements)
+
+	rec := corsRequest(t, s, http.MethodOptions, "/token-validation", "https://tools.example.com", preflight)
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+	for name := range rec.Header() {
+		if strings.HasPrefix(name, "Access-Control-") {
+			t.Errorf("unexpected CORS header %s", name)
+		}
+	}
+}
+
+func TestConfigureCORSRejectsInvalidOrigins(t *testing.T) {
+	t.Setenv("CORS_ALLOWED_ORIGINS", "tools.example.com")
+	if err := configureCORS(); err == nil {
+		t.Error("configureCORS accepted an origin without a scheme")
+	}
+	corsOrigins = nil
+}
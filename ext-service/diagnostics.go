@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redacted replaces values that are not kept in the diagnostics buffer
+const redacted = "[REDACTED]"
+
+// recentEntry is one sampled request and its response. Header and claim values
+// are dropped and only scope values are kept in operations, so the buffer never
+// holds credentials or personal data.
+type recentEntry struct {
+	At              time.Time           `json:"at"`
+	ActionType      string              `json:"actionType"`
+	ClientID        string              `json:"clientId"`
+	GrantType       string              `json:"grantType"`
+	PartnerID       string              `json:"partnerId"`
+	HeaderNames     []string            `json:"headerNames"`
+	ClaimNames      []string            `json:"claimNames"`
+	RequestedScopes []string            `json:"requestedScopes"`
+	ActionStatus    string              `json:"actionStatus"`
+	Operations      []OperationResponse `json:"operations"`
+}
+
+// newRecentEntry builds a redacted entry for a request and its response
+func newRecentEntry(now time.Time, req Request, partnerID string, resp Response) recentEntry {
+	entry := recentEntry{
+		At:              now.UTC(),
+		ActionType:      req.ActionType,
+		ClientID:        req.Event.Request.ClientID,
+		GrantType:       req.Event.Request.GrantType,
+		PartnerID:       partnerID,
+		HeaderNames:     []string{},
+		ClaimNames:      []string{},
+		RequestedScopes: req.Event.AccessToken.Scopes,
+		ActionStatus:    resp.ActionStatus,
+		Operations:      []OperationResponse{},
+	}
+	for _, header := range req.Event.Request.AdditionalHeaders {
+		entry.HeaderNames = append(entry.HeaderNames, header.Name)
+	}
+	for _, claim := range req.Event.AccessToken.Claims {
+		entry.ClaimNames = append(entry.ClaimNames, claim.Name)
+	}
+	for _, op := range resp.Operations {
+		if op.Value != nil && op.Path != accessTokenScopesPath && op.Path != refreshTokenScopesPath {
+			op.Value = redacted
+		}
+		entry.Operations = append(entry.Operations, op)
+	}
+	return entry
+}
+
+// ringBuffer keeps the last len(entries) sampled requests
+type ringBuffer struct {
+	mu      sync.Mutex
+	entries []recentEntry
+	next    int
+	full    bool
+}
+
+// newRingBuffer creates a buffer holding up to size entries
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{entries: make([]recentEntry, size)}
+}
+
+// add stores entry, overwriting the oldest one once the buffer is full
+func (b *ringBuffer) add(entry recentEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries[b.next] = entry
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// snapshot returns the buffered entries, oldest first
+func (b *ringBuffer) snapshot() []recentEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.full {
+		return append([]recentEntry{}, b.entries[:b.next]...)
+	}
+	out := make([]recentEntry, 0, len(b.entries))
+	out = append(out, b.entries[b.next:]...)
+	return append(out, b.entries[:b.next]...)
+}
+
+// configureDiagnostics reads DEBUG_BUFFER_SIZE and DEBUG_SAMPLE_RATE
+func (c *Config) configureDiagnostics() error {
+	if v := os.Getenv("DEBUG_BUFFER_SIZE"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid DEBUG_BUFFER_SIZE %q", v)
+		}
+		if size > 0 {
+			c.recentRequests = newRingBuffer(size)
+		}
+	}
+	if v := os.Getenv("DEBUG_SAMPLE_RATE"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return fmt.Errorf("invalid DEBUG_SAMPLE_RATE %q (expected 0 to 1)", v)
+		}
+		c.recentSampleRate = rate
+	}
+	return nil
+}
+
+// sampleRecent stores the request in the diagnostics buffer when it is enabled
+// and the request is sampled
+func (c *Config) sampleRecent(now time.Time, req Request, partnerID string, resp Response) {
+	if c.recentRequests == nil || rand.Float64() >= c.recentSampleRate {
+		return
+	}
+	c.recentRequests.add(newRecentEntry(now, req, partnerID, resp))
+}
+
+// recentHandler returns the buffered requests, oldest first
+func (s *Server) recentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(s.recentRequests.snapshot()); err != nil {
+		slog.Error("Error encoding recent requests", "error", err)
+	}
+}
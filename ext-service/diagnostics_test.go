@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRingBufferWrapsAround(t *testing.T) {
+	buf := newRingBuffer(3)
+	if got := buf.snapshot(); len(got) != 0 {
+		t.Fatalf("empty buffer snapshot = %+v, want none", got)
+	}
+
+	for i := 1; i <= 5; i++ {
+		buf.add(recentEntry{PartnerID: fmt.Sprintf("org_%d", i)})
+	}
+
+	var ids []string
+	for _, entry := range buf.snapshot() {
+		ids = append(ids, entry.PartnerID)
+	}
+	if got := strings.Join(ids, ","); got != "org_3,org_4,org_5" {
+		t.Errorf("snapshot = %s, want the last three oldest first", got)
+	}
+}
+
+func TestRecentEntryIsRedacted(t *testing.T) {
+	req := Request{
+		ActionType: actionPreIssueAccessToken,
+		Event: Event{
+			Request:     RequestData{ClientID: "client", AdditionalHeaders: []Header{{Name: "authorization", Value: []string{"Bearer secret-token"}}}},
+			AccessToken: AccessToken{Scopes: []string{"openid"}, Claims: []Claim{{Name: "email", Value: "jane@example.com"}}},
+		},
+	}
+	resp := Response{ActionStatus: "SUCCESS", Operations: []OperationResponse{
+		{Op: "add", Path: accessTokenScopesPath, Value: "partner:read"},
+		{Op: "add", Path: accessTokenClaimsPath, Value: Claim{Name: "tier", Value: "gold"}},
+		{Op: "remove", Path: "/accessToken/claims/0"},
+	}}
+
+	entry := newRecentEntry(time.Now(), req, "org_acme", resp)
+
+	encoded := mustJSON(t, entry)
+	for _, secret := range []string{"secret-token", "jane@example.com", "gold"} {
+		if strings.Contains(encoded, secret) {
+			t.Errorf("entry = %s, want %q redacted", encoded, secret)
+		}
+	}
+	for _, kept := range []string{`"headerNames":["authorization"]`, `"claimNames":["email"]`, `"value":"partner:read"`, `"value":"[REDACTED]"`, `"path":"/accessToken/claims/0"`} {
+		if !strings.Contains(encoded, kept) {
+			t.Errorf("entry = %s, want %s kept", encoded, kept)
+		}
+	}
+}
+
+func TestRecentEndpointServesSampledRequests(t *testing.T) {
+	s := adminServer("", "admin")
+	s.recentRequests = newRingBuffer(2)
+	for _, partner := range []string{"org_1", "org_2", "org_acme"} {
+		serve(t, s, http.MethodPost, actionRequest(t, partnerHeader(partner)))
+	}
+
+	if rec := adminGet(t, s, "/debug/recent", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("status without the admin token = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	rec := adminGet(t, s, "/debug/recent", "admin")
+	var entries []recentEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("decode response %q: %v", rec.Body.String(), err)
+	}
+	if len(entries) != 2 || entries[0].PartnerID != "org_2" || entries[1].PartnerID != "org_acme" {
+		t.Errorf("entries = %+v, want the last two requests", entries)
+	}
+}
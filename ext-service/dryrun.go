@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// dryRunHeader asks for the operations a request would get without applying them
+const dryRunHeader = "X-Dry-Run"
+
+// isDryRun reports whether r asks for a dry run
+func isDryRun(r *http.Request) bool {
+	dryRun, err := strconv.ParseBool(r.Header.Get(dryRunHeader))
+	return err == nil && dryRun
+}
+
+// previewOnly moves the operations of resp to previewOperations, so the
+// response reports them but leaves the token unchanged
+func previewOnly(resp Response) Response {
+	resp.PreviewOperations, resp.Operations = resp.Operations, nil
+	return resp
+}
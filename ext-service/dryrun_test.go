@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlerDryRunReturnsOperationsAsPreview(t *testing.T) {
+	body := actionRequest(t, partnerHeader("org_acme"))
+	_, applied := serve(t, NewServer(testEntitlements), http.MethodPost, body)
+
+	r := httptest.NewRequest(http.MethodPost, "/token-validation", strings.NewReader(body))
+	r.Header.Set(dryRunHeader, "true")
+	_, resp := serveRequest(t, NewServer(testEntitlements), r)
+
+	if resp.ActionStatus != "SUCCESS" {
+		t.Fatalf("actionStatus = %q, want SUCCESS", resp.ActionStatus)
+	}
+	if len(resp.Operations) != 0 {
+		t.Errorf("operations = %+v, want none applied", resp.Operations)
+	}
+	if got, want := mustJSON(t, resp.PreviewOperations), mustJSON(t, applied.Operations); got != want {
+		t.Errorf("previewOperations = %s, want the operations of a normal run %s", got, want)
+	}
+}
+
+func TestHandlerWithoutDryRunHasNoPreview(t *testing.T) {
+	_, resp := serve(t, NewServer(testEntitlements), http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+
+	if len(resp.PreviewOperations) != 0 || len(resp.Operations) == 0 {
+		t.Errorf("response = %+v, want applied operations and no preview", resp)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Attribute enrichment failure policies
+const (
+	enrichFailOpen   = "open"
+	enrichFailClosed = "closed"
+)
+
+// attributeEnricher fetches subject attributes from an external service. The
+// URL template's "{subject}" placeholder is replaced with the escaped subject ID
+// and the service answers with a JSON object of attributes.
+type attributeEnricher struct {
+	urlTemplate string
+	client      *http.Client
+	failClosed  bool
+	cache       *lruCache[string, map[string]interface{}]
+}
+
+// configureEnrichment reads ATTRIBUTE_SERVICE_URL, ATTRIBUTE_SERVICE_TIMEOUT,
+// ATTRIBUTE_CACHE_TTL, ATTRIBUTE_CACHE_SIZE and ATTRIBUTE_FAILURE_POLICY
+func (c *Config) configureEnrichment() error {
+	urlTemplate := os.Getenv("ATTRIBUTE_SERVICE_URL")
+	if urlTemplate == "" {
+		return nil
+	}
+	if !strings.Contains(urlTemplate, "{subject}") {
+		return fmt.Errorf("ATTRIBUTE_SERVICE_URL %q has no {subject} placeholder", urlTemplate)
+	}
+
+	timeout := 2 * time.Second
+	if v := os.Getenv("ATTRIBUTE_SERVICE_TIMEOUT"); v != "" {
+		d, err := parseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid ATTRIBUTE_SERVICE_TIMEOUT %q", v)
+		}
+		timeout = d
+	}
+	ttl := 5 * time.Minute
+	if v := os.Getenv("ATTRIBUTE_CACHE_TTL"); v != "" {
+		d, err := parseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid ATTRIBUTE_CACHE_TTL %q", v)
+		}
+		ttl = d
+	}
+	size := 1024
+	if v := os.Getenv("ATTRIBUTE_CACHE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid ATTRIBUTE_CACHE_SIZE %q", v)
+		}
+		size = n
+	}
+
+	failClosed := false
+	switch policy := os.Getenv("ATTRIBUTE_FAILURE_POLICY"); policy {
+	case "", enrichFailOpen:
+	case enrichFailClosed:
+		failClosed = true
+	default:
+		return fmt.Errorf("invalid ATTRIBUTE_FAILURE_POLICY %q (expected open or closed)", policy)
+	}
+
+	c.enricher = &attributeEnricher{
+		urlTemplate: urlTemplate,
+		client:      &http.Client{Timeout: timeout},
+		failClosed:  failClosed,
+		cache:       newLRUCache[string, map[string]interface{}](size, ttl),
+	}
+	return nil
+}
+
+// attributes returns the attributes of subjectID, from the cache when possible
+func (e *attributeEnricher) attributes(ctx context.Context, subjectID string, now time.Time) (map[string]interface{}, error) {
+	if attrs, ok := e.cache.get(subjectID, now); ok {
+		return attrs, nil
+	}
+
+	target := strings.ReplaceAll(e.urlTemplate, "{subject}", url.PathEscape(subjectID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build attribute request: %w", err)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch attributes: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch attributes: unexpected status %d", resp.StatusCode)
+	}
+	var attrs map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&attrs); err != nil {
+		return nil, fmt.Errorf("failed to parse attributes: %w", err)
+	}
+
+	e.cache.put(subjectID, attrs, now)
+	return attrs, nil
+}
+
+// enrichEvent returns a copy of ev whose access token claims also carry the
+// subject's attributes, so constraints and rules can reference them like
+// claims. Claims already on the token take precedence over attributes of the
+// same name. The original event, whose claim indices operations refer to, is
+// left untouched.
+func enrichEvent(ev Event, attrs map[string]interface{}) Event {
+	if len(attrs) == 0 {
+		return ev
+	}
+	// Attributes are appended in name order, so the same attributes always
+	// produce the same claims
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	claims := append([]Claim{}, ev.AccessToken.Claims...)
+	for _, name := range names {
+		if _, exists := getClaimValue(ev.AccessToken.Claims, name); !exists {
+			claims = append(claims, Claim{Name: name, Value: attrs[name]})
+		}
+	}
+	token := ev.AccessToken
+	token.Claims = claims
+	ev.AccessToken = token
+	return ev
+}
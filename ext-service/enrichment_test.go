@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeAttributeService serves response for every subject, counting lookups
+type fakeAttributeService struct {
+	response string
+	status   int
+	calls    atomic.Int32
+	subject  atomic.Value
+}
+
+func (f *fakeAttributeService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.calls.Add(1)
+	f.subject.Store(r.URL.Path)
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+	}
+	io.WriteString(w, f.response)
+}
+
+// tierEntitlements grants org_acme the read action only to gold tier partners
+var tierEntitlements = fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{{
+	EntitlementID: "ent_gold_read",
+	Subject:       Subject{Type: "partner", ID: "org_acme"},
+	Action:        "read",
+	Constraints:   map[string]interface{}{"claims": map[string]interface{}{"tier": "gold"}},
+}}}}
+
+// enrichedServer starts service and returns a server enriching requests from it
+func enrichedServer(t *testing.T, service *fakeAttributeService, failClosed bool) *Server {
+	t.Helper()
+	server := httptest.NewServer(service)
+	t.Cleanup(server.Close)
+	s := NewServer(tierEntitlements)
+	s.enricher = &attributeEnricher{
+		urlTemplate: server.URL + "/partners/{subject}",
+		client:      server.Client(),
+		failClosed:  failClosed,
+		cache:       newLRUCache[string, map[string]interface{}](16, time.Minute),
+	}
+	return s
+}
+
+func TestEnrichedAttributesSatisfyConstraints(t *testing.T) {
+	service := &fakeAttributeService{response: `{"tier":"gold","region":"eu"}`}
+	s := enrichedServer(t, service, false)
+
+	for i := 0; i < 2; i++ {
+		_, resp := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+		if scopes := grantedScopes(resp.Operations); mustJSON(t, scopes) != `["partner:read"]` {
+			t.Errorf("request %d scopes = %v, want the tier constraint satisfied by the attribute", i+1, scopes)
+		}
+	}
+	if path := service.subject.Load(); path != "/partners/org_acme" {
+		t.Errorf("lookup path = %v, want the subject in the URL", path)
+	}
+	// The second request is served from the cache
+	if n := service.calls.Load(); n != 1 {
+		t.Errorf("attribute service calls = %d, want 1", n)
+	}
+}
+
+func TestEnrichedAttributesDoNotOverrideClaims(t *testing.T) {
+	ev := Event{AccessToken: AccessToken{Claims: []Claim{{Name: "tier", Value: "silver"}}}}
+
+	enriched := enrichEvent(ev, map[string]interface{}{"tier": "gold", "region": "eu"})
+
+	if got := mustJSON(t, enriched.AccessToken.Claims); got != `[{"name":"tier","value":"silver"},{"name":"region","value":"eu"}]` {
+		t.Errorf("claims = %s, want the token claim kept and the new attribute added", got)
+	}
+	if len(ev.AccessToken.Claims) != 1 {
+		t.Errorf("original claims = %+v, want them untouched", ev.AccessToken.Claims)
+	}
+}
+
+func TestEnrichmentFailurePolicy(t *testing.T) {
+	service := &fakeAttributeService{status: http.StatusServiceUnavailable}
+
+	// Failing open evaluates without the attributes, so the constraint fails
+	rec, resp := serve(t, enrichedServer(t, service, false), http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+	if rec.Code != http.StatusOK || len(grantedScopes(resp.Operations)) != 0 {
+		t.Errorf("fail open: status = %d, response = %+v, want SUCCESS without the constrained scope", rec.Code, resp)
+	}
+
+	rec, resp = serve(t, enrichedServer(t, service, true), http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+	if rec.Code != http.StatusInternalServerError || resp.ErrorDescription != "Attribute enrichment failed" {
+		t.Errorf("fail closed: status = %d, response = %+v, want %d", rec.Code, resp, http.StatusInternalServerError)
+	}
+}
+
+func TestConfigureEnrichmentRejectsInvalidSettings(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"ATTRIBUTE_SERVICE_URL", "https://crm.example.com/partners"},
+		{"ATTRIBUTE_SERVICE_TIMEOUT", "0s"},
+		{"ATTRIBUTE_CACHE_TTL", "soon"},
+		{"ATTRIBUTE_CACHE_SIZE", "0"},
+		{"ATTRIBUTE_FAILURE_POLICY", "retry"},
+	}
+	for _, tt := range tests {
+		t.Setenv("ATTRIBUTE_SERVICE_URL", "https://crm.example.com/partners/{subject}")
+		t.Setenv(tt.name, tt.value)
+		c := defaultConfig()
+		if err := c.configureEnrichment(); err == nil {
+			t.Errorf("configureEnrichment accepted %s=%q", tt.name, tt.value)
+		}
+		t.Setenv(tt.name, "")
+	}
+}
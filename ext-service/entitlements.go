@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultEntitlementsFile is used when no per-tenant file applies
+const defaultEntitlementsFile = "entitlements.json"
+
+// tenantNamePattern restricts tenant names rendered into file paths so a tenant
+// cannot point the template outside the entitlements directory
+var tenantNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+var (
+	// entitlementsPathTemplate locates per-tenant files, e.g. "entitlements/{tenant}.json"
+	entitlementsPathTemplate string
+	// failOnMissingEntitlements makes a missing entitlements file an error rather
+	// than an empty entitlement set
+	failOnMissingEntitlements = true
+	// tenantEntitlements caches parsed per-tenant entitlement files
+	tenantEntitlements *lruCache[string, *EntitlementsData]
+)
+
+// entitlementLoads numbers decoded entitlements documents, so cached evaluations
+// can tell loads apart
+var entitlementLoads atomic.Uint64
+
+// sortByPriority returns a copy of entitlements ordered by descending priority,
+// then by entitlement ID
+func sortByPriority(entitlements []Entitlement) []Entitlement {
+	sorted := make([]Entitlement, len(entitlements))
+	copy(sorted, entitlements)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Priority != sorted[j].Priority {
+			return sorted[i].Priority > sorted[j].Priority
+		}
+		return sorted[i].EntitlementID < sorted[j].EntitlementID
+	})
+	return sorted
+}
+
+// configureEntitlements reads the entitlement loading settings from the environment
+func configureEntitlements() error {
+	entitlementsPathTemplate = os.Getenv("ENTITLEMENTS_PATH_TEMPLATE")
+	if entitlementsPathTemplate != "" && !strings.Contains(entitlementsPathTemplate, "{tenant}") {
+		return fmt.Errorf("ENTITLEMENTS_PATH_TEMPLATE %q has no {tenant} placeholder", entitlementsPathTemplate)
+	}
+
+	fieldMap, err := parseFieldMap(os.Getenv("ENTITLEMENT_FIELD_MAP"))
+	if err != nil {
+		return fmt.Errorf("invalid ENTITLEMENT_FIELD_MAP: %w", err)
+	}
+	entitlementFieldMap = fieldMap
+
+	switch policy := os.Getenv("MISSING_ENTITLEMENTS_POLICY"); policy {
+	case "", "error":
+		failOnMissingEntitlements = true
+	case "empty":
+		failOnMissingEntitlements = false
+	default:
+		return fmt.Errorf("invalid MISSING_ENTITLEMENTS_POLICY %q (expected error or empty)", policy)
+	}
+
+	cacheSize := 64
+	if v := os.Getenv("ENTITLEMENTS_CACHE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid ENTITLEMENTS_CACHE_SIZE %q", v)
+		}
+		cacheSize = n
+	}
+
+	cacheTTL := 5 * time.Minute
+	if v := os.Getenv("ENTITLEMENTS_CACHE_TTL"); v != "" {
+		d, err := parseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid ENTITLEMENTS_CACHE_TTL %q", v)
+		}
+		cacheTTL = d
+	}
+
+	tenantEntitlements = newLRUCache[string, *EntitlementsData](cacheSize, cacheTTL)
+
+	if v := os.Getenv("ENTITLEMENTS_CACHE_TTL_JITTER"); v != "" {
+		percent, err := strconv.ParseFloat(v, 64)
+		if err != nil || percent < 0 || percent >= 100 {
+			return fmt.Errorf("invalid ENTITLEMENTS_CACHE_TTL_JITTER %q (expected a percentage below 100)", v)
+		}
+		tenantEntitlements.jitter = percent / 100
+	}
+	return nil
+}
+
+// loadEntitlementsForEvent returns the entitlements for the event's tenant, reading
+// the tenant's file on first use and caching it. Requests without a tenant, or
+// deployments without a path template, use the in-memory default entitlements.
+func loadEntitlementsForEvent(ev Event, now time.Time) (*EntitlementsData, error) {
+	if entitlementsPathTemplate == "" || ev.Tenant == nil || ev.Tenant.Name == "" {
+		return defaultEntitlements.get()
+	}
+
+	tenant := ev.Tenant.Name
+	if !tenantNamePattern.MatchString(tenant) {
+		return nil, fmt.Errorf("invalid tenant name %q", tenant)
+	}
+
+	if data, ok := tenantEntitlements.get(tenant, now); ok {
+		stats.cacheHits.Add(1)
+		return data, nil
+	}
+	stats.cacheMisses.Add(1)
+
+	path := strings.ReplaceAll(entitlementsPathTemplate, "{tenant}", tenant)
+	data, err := loadEntitlementsWithPolicy(path)
+	if err != nil {
+		return nil, err
+	}
+	tenantEntitlements.put(tenant, data, now)
+	slog.Info("Loaded tenant entitlements", "count", len(data.Entitlements), "tenant", tenant, "path", path)
+	return data, nil
+}
+
+// loadEntitlementsWithPolicy loads path, applying the missing-entitlements policy
+// when the file does not exist
+func loadEntitlementsWithPolicy(path string) (*EntitlementsData, error) {
+	data, err := loadEntitlements(path)
+	if err != nil && errors.Is(err, fs.ErrNotExist) && !failOnMissingEntitlements {
+		slog.Warn("Entitlements file not found, using no entitlements", "path", path)
+		return &EntitlementsData{}, nil
+	}
+	return data, err
+}
+
+// loadEntitlements loads and parses an entitlements file
+func loadEntitlements(path string) (*EntitlementsData, error) {
+	data, err := readEntitlementsFile(path)
+	stats.recordLoad(path, data, err)
+	return data, err
+}
+
+// readEntitlementsFile reads and parses the entitlements file at path
+func readEntitlementsFile(path string) (*EntitlementsData, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer f.Close()
+
+	entitlementsData, err := decodeEntitlements(bufio.NewReader(f), path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if err := compileEntitlementExpressions(entitlementsData); err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", path, err)
+	}
+
+	return entitlementsData, nil
+}
+
+// decodeEntitlements parses an entitlements document from r one entitlement at a
+// time, normalizing and indexing each as it is read, so a large document is never
+// held in memory both raw and decoded. An entitlement that does not fit the schema
+// is skipped with a warning naming source; malformed JSON fails the whole load.
+func decodeEntitlements(r io.Reader, source string) (*EntitlementsData, error) {
+	dec := json.NewDecoder(r)
+	data := &EntitlementsData{bySubject: make(map[string][]int), loadID: entitlementLoads.Add(1)}
+
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if key, _ := token.(string); key != "entitlements" {
+			// Other fields are not ours to interpret
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := decodeEntitlementList(dec, data, source); err != nil {
+			return nil, err
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after the entitlements document")
+	}
+	return data, nil
+}
+
+// decodeEntitlementList adds the elements of the entitlements array at dec to data
+func decodeEntitlementList(dec *json.Decoder, data *EntitlementsData, source string) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return nil
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("entitlements is %v, expected an array", token)
+	}
+	for position := 0; dec.More(); position++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		entitlement, err := unmarshalEntitlement(raw)
+		if err != nil {
+			slog.Warn("Skipping malformed entitlement", "source", source, "position", position, "error", err)
+			continue
+		}
+		entitlement.Subject.ID = normalizeSubjectID(entitlement.Subject.ID)
+		if err := validateSubjectPattern(entitlement.Subject.ID); err != nil {
+			slog.Warn("Skipping entitlement with an invalid subject ID pattern", "source", source, "position", position, "subject_id", entitlement.Subject.ID, "error", err)
+			continue
+		}
+		data.add(entitlement)
+	}
+	return expectDelim(dec, ']')
+}
+
+// expectDelim reads the next token from dec and fails unless it is want
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != want {
+		return fmt.Errorf("unexpected %v, expected %v", token, want)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadEntitlementsFileSkipsMalformedEntries(t *testing.T) {
+	const valid = 20000
+	var b strings.Builder
+	b.WriteString(`{"version": 3, "entitlements": [`)
+	for i := 0; i < valid; i++ {
+		fmt.Fprintf(&b, `{"entitlementId": "ent_%d", "subject": {"type": "partner", "id": "org_%d"}, "action": "read"},`, i, i%100)
+		if i%1000 == 0 {
+			// Valid JSON, but not an entitlement
+			b.WriteString(`{"entitlementId": 7, "subject": "org_bad"},`)
+		}
+	}
+	b.WriteString(`{"entitlementId": "ent_last", "subject": {"type": "partner", "id": "org_0"}, "action": "write"}]}`)
+	path := filepath.Join(t.TempDir(), "entitlements.json")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatalf("write entitlements: %v", err)
+	}
+
+	data, err := readEntitlementsFile(path)
+	if err != nil {
+		t.Fatalf("readEntitlementsFile: %v", err)
+	}
+	if len(data.Entitlements) != valid+1 {
+		t.Fatalf("loaded %d entitlements, want %d", len(data.Entitlements), valid+1)
+	}
+	found := data.forSubjects(map[Subject]bool{{Type: "partner", ID: "org_0"}: true})
+	if len(found) != valid/100+1 || found[len(found)-1].EntitlementID != "ent_last" {
+		t.Errorf("indexed %d entitlements for org_0, want %d ending with ent_last", len(found), valid/100+1)
+	}
+}
+
+func TestDecodeEntitlementsRejectsInvalidJSON(t *testing.T) {
+	for _, doc := range []string{
+		`{"entitlements": [{"entitlementId": "e1"`,
+		`{"entitlements": {"entitlementId": "e1"}}`,
+		`[]`,
+		`{"entitlements": []} {}`,
+	} {
+		if _, err := decodeEntitlements(strings.NewReader(doc), "test"); err == nil {
+			t.Errorf("decodeEntitlements(%q) succeeded, want an error", doc)
+		}
+	}
+}
+
+func TestDecodeEntitlementsAppliesFieldMap(t *testing.T) {
+	previous := entitlementFieldMap
+	entitlementFieldMap = []fieldRename{{From: "id", To: "entitlementId"}}
+	t.Cleanup(func() { entitlementFieldMap = previous })
+
+	data, err := decodeEntitlements(strings.NewReader(`{"entitlements": [{"id": "e1", "action": "read"}]}`), "test")
+	if err != nil {
+		t.Fatalf("decodeEntitlements: %v", err)
+	}
+	if len(data.Entitlements) != 1 || data.Entitlements[0].EntitlementID != "e1" {
+		t.Errorf("entitlements = %+v, want e1", data.Entitlements)
+	}
+}
+
+// withTenantFiles serves per-tenant entitlements from dir/{tenant}.json for the
+// duration of a test, caching them for ttl
+func withTenantFiles(t *testing.T, dir string, ttl time.Duration) {
+	t.Helper()
+	previousTemplate, previousCache := entitlementsPathTemplate, tenantEntitlements
+	entitlementsPathTemplate = filepath.Join(dir, "{tenant}.json")
+	tenantEntitlements = newLRUCache[string, *EntitlementsData](8, ttl)
+	t.Cleanup(func() { entitlementsPathTemplate, tenantEntitlements = previousTemplate, previousCache })
+}
+
+// writeTenantFile writes an entitlements file granting org_acme action
+func writeTenantFile(t *testing.T, path string, action string) {
+	t.Helper()
+	doc := `{"entitlements": [{"entitlementId": "ent_` + action + `", "subject": {"type": "partner", "id": "org_acme"}, "action": "` + action + `"}]}`
+	if err := os.WriteFile(path, []byte(doc), 0o644); err != nil {
+		t.Fatalf("write entitlements: %v", err)
+	}
+}
+
+func TestLoadEntitlementsForEventResolvesTenantFile(t *testing.T) {
+	dir := t.TempDir()
+	withTenantFiles(t, dir, time.Minute)
+	withDefaultEntitlements(t, &EntitlementsData{Entitlements: []Entitlement{{EntitlementID: "ent_default"}}})
+	writeTenantFile(t, filepath.Join(dir, "acme.json"), "read")
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		tenant *Tenant
+		want   string
+	}{
+		{"tenant file", &Tenant{Name: "acme"}, "ent_read"},
+		{"no tenant", nil, "ent_default"},
+		{"empty tenant name", &Tenant{}, "ent_default"},
+	}
+	for _, tt := range tests {
+		data, err := loadEntitlementsForEvent(Event{Tenant: tt.tenant}, now)
+		if err != nil {
+			t.Fatalf("%s: loadEntitlementsForEvent: %v", tt.name, err)
+		}
+		if len(data.Entitlements) != 1 || data.Entitlements[0].EntitlementID != tt.want {
+			t.Errorf("%s: entitlements = %+v, want %s", tt.name, data.Entitlements, tt.want)
+		}
+	}
+
+	for _, name := range []string{"../acme", "other"} {
+		if _, err := loadEntitlementsForEvent(Event{Tenant: &Tenant{Name: name}}, now); err == nil {
+			t.Errorf("tenant %q: loadEntitlementsForEvent succeeded, want an error", name)
+		}
+	}
+}
+
+func TestLoadEntitlementsForEventCachesTenantFile(t *testing.T) {
+	dir := t.TempDir()
+	withTenantFiles(t, dir, time.Minute)
+	path := filepath.Join(dir, "acme.json")
+	writeTenantFile(t, path, "read")
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	ev := Event{Tenant: &Tenant{Name: "acme"}}
+
+	first, err := loadEntitlementsForEvent(ev, now)
+	if err != nil {
+		t.Fatalf("loadEntitlementsForEvent: %v", err)
+	}
+	writeTenantFile(t, path, "write")
+
+	cached, _ := loadEntitlementsForEvent(ev, now.Add(30*time.Second))
+	if cached != first {
+		t.Error("tenant file was read again within the cache TTL")
+	}
+	reloaded, _ := loadEntitlementsForEvent(ev, now.Add(2*time.Minute))
+	if len(reloaded.Entitlements) != 1 || reloaded.Entitlements[0].EntitlementID != "ent_write" {
+		t.Errorf("entitlements after the TTL = %+v, want the rewritten file", reloaded.Entitlements)
+	}
+}
+
+func TestMatchModeFirstIgnoresLowerPriorityMatches(t *testing.T) {
+	acme := Subject{Type: "partner", ID: "org_acme"}
+	provider := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{
+		{EntitlementID: "ent_write", Subject: acme, Action: "write", Priority: 1},
+		{EntitlementID: "ent_read", Subject: acme, Action: "read", Priority: 5},
+		{EntitlementID: "ent_admin", Subject: acme, Action: "admin", Priority: 1},
+	}}}
+
+	_, resp := serve(t, NewServer(provider), "POST", actionRequest(t, partnerHeader("org_acme")))
+	if scopes := grantedScopes(resp.Operations); len(scopes) != 3 {
+		t.Errorf("all mode scopes = %v, want every match aggregated", scopes)
+	}
+
+	s := NewServer(provider)
+	s.matchFirst = true
+	_, resp = serve(t, s, "POST", actionRequest(t, partnerHeader("org_acme")))
+	if scopes := grantedScopes(resp.Operations); len(scopes) != 1 || scopes[0] != "partner:read" {
+		t.Errorf("first mode scopes = %v, want only the highest-priority partner:read", scopes)
+	}
+}
+
+func TestMatchModeFirstLetsHigherPriorityDenyWin(t *testing.T) {
+	acme := Subject{Type: "partner", ID: "org_acme"}
+	provider := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{
+		{EntitlementID: "ent_read", Subject: acme, Action: "read", Priority: 5},
+		{EntitlementID: "deny_acme", Subject: acme, Effect: effectDeny},
+	}}}
+
+	_, resp := serve(t, NewServer(provider), "POST", actionRequest(t, partnerHeader("org_acme")))
+	if resp.ActionStatus != "FAILED" {
+		t.Errorf("all mode response = %+v, want the deny to block", resp)
+	}
+
+	s := NewServer(provider)
+	s.matchFirst = true
+	_, resp = serve(t, s, "POST", actionRequest(t, partnerHeader("org_acme")))
+	if scopes := grantedScopes(resp.Operations); resp.ActionStatus != "SUCCESS" || len(scopes) != 1 {
+		t.Errorf("first mode response = %+v, want the higher-priority grant to stop evaluation", resp)
+	}
+}
+
+func TestSortByPriorityBreaksTiesByID(t *testing.T) {
+	sorted := sortByPriority([]Entitlement{
+		{EntitlementID: "ent_b"}, {EntitlementID: "ent_c", Priority: 2}, {EntitlementID: "ent_a"},
+	})
+	var ids []string
+	for _, entitlement := range sorted {
+		ids = append(ids, entitlement.EntitlementID)
+	}
+	if got := strings.Join(ids, ","); got != "ent_c,ent_a,ent_b" {
+		t.Errorf("order = %s, want ent_c,ent_a,ent_b", got)
+	}
+}
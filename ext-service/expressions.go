@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+
+	"github.com/google/cel-go/cel"
+)
+
+// defaultExpressionCostLimit bounds the work one scopes expression may do per request
+const defaultExpressionCostLimit = 10000
+
+// expressionEnv declares the request context a scopesExpression can read:
+//
+//	claims     map of access token claim names (and enriched attributes) to values
+//	scopes     the requested scopes
+//	grantType  the token request's grant type
+//	clientId   the client the token is issued to
+//	headers    map of additional header names to their values
+//	subject    the entitlement's partner ID
+//
+// For example:
+//
+//	grantType == "client_credentials" && claims.tier == "gold" ? ["orders:read", "orders:write"] : ["orders:read"]
+var expressionEnv = mustExpressionEnv()
+
+// mustExpressionEnv builds expressionEnv; the declarations are fixed, so an
+// error is a programming mistake
+func mustExpressionEnv() *cel.Env {
+	env, err := cel.NewEnv(
+		cel.Variable("claims", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("scopes", cel.ListType(cel.StringType)),
+		cel.Variable("grantType", cel.StringType),
+		cel.Variable("clientId", cel.StringType),
+		cel.Variable("headers", cel.MapType(cel.StringType, cel.ListType(cel.StringType))),
+		cel.Variable("subject", cel.StringType),
+	)
+	if err != nil {
+		panic(err)
+	}
+	return env
+}
+
+// programCostLimit is the cost limit scopes expressions are compiled with as
+// entitlements load. Loads happen outside any Server, so CEL_COST_LIMIT is kept
+// here as well as in Config.
+var programCostLimit uint64 = defaultExpressionCostLimit
+
+// configureExpressions reads CEL_COST_LIMIT
+func (c *Config) configureExpressions() error {
+	if v := os.Getenv("CEL_COST_LIMIT"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || n == 0 {
+			return fmt.Errorf("invalid CEL_COST_LIMIT %q", v)
+		}
+		c.expressionCostLimit = n
+		programCostLimit = n
+	}
+	return nil
+}
+
+// compileExpression compiles a scopes expression, which must type-check to a
+// list of strings, into a program bounded by costLimit
+func compileExpression(source string, costLimit uint64) (cel.Program, error) {
+	ast, issues := expressionEnv.Compile(source)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if !ast.OutputType().IsExactType(cel.ListType(cel.StringType)) {
+		return nil, fmt.Errorf("expression returns %s, expected list(string)", ast.OutputType())
+	}
+	return expressionEnv.Program(ast, cel.CostLimit(costLimit))
+}
+
+// compileEntitlementExpressions compiles every scopes expression of data with
+// CEL_COST_LIMIT, so a broken expression fails the load instead of the requests
+// that reach it. The programs are kept on the entitlements and go away with
+// the load they came from.
+func compileEntitlementExpressions(data *EntitlementsData) error {
+	for i := range data.Entitlements {
+		entitlement := &data.Entitlements[i]
+		if entitlement.ScopesExpression == "" {
+			continue
+		}
+		program, err := compileExpression(entitlement.ScopesExpression, programCostLimit)
+		if err != nil {
+			return fmt.Errorf("entitlement %s: invalid scopesExpression: %w", entitlement.EntitlementID, err)
+		}
+		entitlement.program = program
+	}
+	return nil
+}
+
+// entitlementScopes returns the scopes an entitlement grants: those a decision
+// point set, the result of its scopesExpression, or the single scope built from
+// its action (with SCOPE_TEMPLATE when set)
+func (c *Config) entitlementScopes(entitlement Entitlement, ev Event) ([]string, error) {
+	if len(entitlement.scopes) > 0 {
+		return entitlement.scopes, nil
+	}
+	if entitlement.ScopesExpression == "" {
+		scope, err := c.buildScope(entitlement)
+		if err != nil {
+			return nil, err
+		}
+		return []string{scope}, nil
+	}
+	// Entitlements that did not come from a load are compiled for the request
+	program := entitlement.program
+	if program == nil {
+		var err error
+		if program, err = compileExpression(entitlement.ScopesExpression, c.expressionCostLimit); err != nil {
+			return nil, err
+		}
+	}
+
+	claims := make(map[string]interface{}, len(ev.AccessToken.Claims))
+	for _, claim := range ev.AccessToken.Claims {
+		claims[claim.Name] = claim.Value
+	}
+	headers := make(map[string][]string, len(ev.Request.AdditionalHeaders))
+	for _, header := range ev.Request.AdditionalHeaders {
+		headers[header.Name] = append(headers[header.Name], header.Value...)
+	}
+
+	out, _, err := program.Eval(map[string]interface{}{
+		"claims":    claims,
+		"scopes":    ev.AccessToken.Scopes,
+		"grantType": ev.Request.GrantType,
+		"clientId":  ev.Request.ClientID,
+		"headers":   headers,
+		"subject":   entitlement.Subject.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	native, err := out.ConvertToNative(reflect.TypeOf([]string{}))
+	if err != nil {
+		return nil, err
+	}
+	return native.([]string), nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tieredScopesExpression grants write only to gold tier client credentials tokens
+const tieredScopesExpression = `grantType == "client_credentials" && "tier" in claims && claims.tier == "gold" ? ["orders:read", "orders:write"] : ["orders:read"]`
+
+func TestHandlerGrantsScopesFromExpression(t *testing.T) {
+	provider := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{{
+		EntitlementID:    "ent_orders",
+		Subject:          Subject{Type: "partner", ID: "org_acme"},
+		ScopesExpression: tieredScopesExpression,
+	}}}}
+	tests := []struct {
+		name      string
+		grantType string
+		tier      string
+		want      string
+	}{
+		{"gold client credentials", "client_credentials", "gold", `["orders:read","orders:write"]`},
+		{"silver client credentials", "client_credentials", "silver", `["orders:read"]`},
+		{"gold refresh", "refresh_token", "gold", `["orders:read"]`},
+		{"no tier claim", "client_credentials", "", `["orders:read"]`},
+	}
+	for _, tt := range tests {
+		var claims []Claim
+		if tt.tier != "" {
+			claims = []Claim{{Name: "tier", Value: tt.tier}}
+		}
+		req := Request{
+			ActionType: actionPreIssueAccessToken,
+			Event: Event{
+				Request:     RequestData{GrantType: tt.grantType, AdditionalHeaders: []Header{partnerHeader("org_acme")}},
+				AccessToken: AccessToken{Scopes: []string{}, Claims: claims},
+			},
+			AllowedOperations: []Operation{{Op: "add", Paths: []string{accessTokenScopesPath}}},
+		}
+
+		_, resp := serve(t, NewServer(provider), http.MethodPost, marshalRequest(t, req))
+
+		if got := mustJSON(t, grantedScopes(resp.Operations)); got != tt.want {
+			t.Errorf("%s: scopes = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCompileExpressionRejectsInvalidExpressions(t *testing.T) {
+	for _, source := range []string{
+		`["orders:read"`,
+		`"orders:read"`,
+		`[1, 2]`,
+		`grantType + 1`,
+		`unknown == "x" ? ["a"] : []`,
+	} {
+		if _, err := compileExpression(source, defaultExpressionCostLimit); err == nil {
+			t.Errorf("compileExpression accepted %s", source)
+		}
+	}
+}
+
+func TestExpressionCostLimit(t *testing.T) {
+	entitlement := Entitlement{
+		EntitlementID:    "ent_expensive",
+		ScopesExpression: `scopes.filter(a, scopes.exists(b, a + b == "never"))`,
+	}
+	var ev Event
+	for i := 0; i < 50; i++ {
+		ev.AccessToken.Scopes = append(ev.AccessToken.Scopes, fmt.Sprintf("scope_%d", i))
+	}
+
+	bounded := Config{expressionCostLimit: 100}
+	if _, err := bounded.entitlementScopes(entitlement, ev); err == nil || !strings.Contains(err.Error(), "cost limit") {
+		t.Errorf("error = %v, want the cost limit exceeded", err)
+	}
+	generous := Config{expressionCostLimit: 1000000}
+	if scopes, err := generous.entitlementScopes(entitlement, ev); err != nil || len(scopes) != 0 {
+		t.Errorf("scopes = %v, err = %v, want an empty result within the limit", scopes, err)
+	}
+}
+
+func TestLoadFailsOnInvalidExpression(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "entitlements.json")
+	doc := `{"entitlements":[{"entitlementId":"ent_bad","subject":{"type":"partner","id":"org_acme"},"scopesExpression":"\"orders:read\""}]}`
+	if err := os.WriteFile(path, []byte(doc), 0o600); err != nil {
+		t.Fatalf("write entitlements: %v", err)
+	}
+
+	_, err := readEntitlementsFile(path)
+
+	if err == nil || !strings.Contains(err.Error(), "entitlement ent_bad: invalid scopesExpression") {
+		t.Errorf("error = %v, want the load to fail on the expression", err)
+	}
+}
+
+func TestConfigureExpressionsRejectsInvalidCostLimit(t *testing.T) {
+	for _, value := range []string{"0", "-1", "lots"} {
+		t.Setenv("CEL_COST_LIMIT", value)
+		c := defaultConfig()
+		if err := c.configureExpressions(); err == nil {
+			t.Errorf("configureExpressions accepted %q", value)
+		}
+	}
+}
+
+func TestLoadCompilesExpressionsWithCostLimit(t *testing.T) {
+	t.Setenv("CEL_COST_LIMIT", "100")
+	c := defaultConfig()
+	if err := c.configureExpressions(); err != nil {
+		t.Fatalf("configureExpressions: %v", err)
+	}
+	t.Cleanup(func() { programCostLimit = defaultExpressionCostLimit })
+	path := filepath.Join(t.TempDir(), "entitlements.json")
+	doc := `{"entitlements":[{"entitlementId":"ent_expensive","subject":{"type":"partner","id":"org_acme"},"scopesExpression":"scopes.filter(a, scopes.exists(b, a + b == \"never\"))"}]}`
+	if err := os.WriteFile(path, []byte(doc), 0o600); err != nil {
+		t.Fatalf("write entitlements: %v", err)
+	}
+
+	data, err := readEntitlementsFile(path)
+	if err != nil {
+		t.Fatalf("readEntitlementsFile: %v", err)
+	}
+
+	entitlement := data.Entitlements[0]
+	if entitlement.program == nil {
+		t.Fatal("program = nil, want the expression compiled by the load")
+	}
+	var ev Event
+	for i := 0; i < 50; i++ {
+		ev.AccessToken.Scopes = append(ev.AccessToken.Scopes, fmt.Sprintf("scope_%d", i))
+	}
+	// The program compiled at load is used, not one for the Config's limit
+	generous := Config{expressionCostLimit: 1000000}
+	if _, err := generous.entitlementScopes(entitlement, ev); err == nil || !strings.Contains(err.Error(), "cost limit") {
+		t.Errorf("error = %v, want the limit configured at load exceeded", err)
+	}
+}
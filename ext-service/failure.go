@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"sync"
+	"text/template"
+)
+
+// effectDeny marks an entitlement that blocks token issuance when it matches
+const effectDeny = "deny"
+
+// defaultFailureDescription is used when a deny entitlement has no template or
+// its template fails to render
+const defaultFailureDescription = "The partner is not authorized for this request."
+
+// failureContext is the data available to failure templates
+type failureContext struct {
+	SubjectType   string
+	SubjectID     string
+	Action        string
+	EntitlementID string
+	ClientID      string
+	GrantType     string
+}
+
+// failureTemplates caches parsed failure templates by source text
+var failureTemplates sync.Map
+
+// renderFailureDescription renders the entitlement's failureTemplate, falling
+// back to a static message when it is empty or broken
+func renderFailureDescription(logger *slog.Logger, entitlement Entitlement, ev Event, subjectID string) string {
+	if entitlement.FailureTemplate == "" {
+		return defaultFailureDescription
+	}
+
+	tmpl, err := parseFailureTemplate(entitlement.FailureTemplate)
+	if err != nil {
+		logger.Warn("Error parsing failure template", "entitlement_id", entitlement.EntitlementID, "error", err)
+		return defaultFailureDescription
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, failureContext{
+		SubjectType:   entitlement.Subject.Type,
+		SubjectID:     subjectID,
+		Action:        entitlement.Action,
+		EntitlementID: entitlement.EntitlementID,
+		ClientID:      ev.Request.ClientID,
+		GrantType:     ev.Request.GrantType,
+	})
+	if err != nil {
+		logger.Warn("Error rendering failure template", "entitlement_id", entitlement.EntitlementID, "error", err)
+		return defaultFailureDescription
+	}
+	return buf.String()
+}
+
+// parseFailureTemplate returns the parsed template for text, parsing it once
+func parseFailureTemplate(text string) (*template.Template, error) {
+	if cached, ok := failureTemplates.Load(text); ok {
+		return cached.(*template.Template), nil
+	}
+	tmpl, err := template.New("failure").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	failureTemplates.Store(text, tmpl)
+	return tmpl, nil
+}
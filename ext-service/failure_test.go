@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRenderFailureDescription(t *testing.T) {
+	ev := Event{Request: RequestData{ClientID: "client", GrantType: "client_credentials"}}
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"rendered", "Partner {{.SubjectID}} is not authorized for {{.Action}} via {{.ClientID}}.", "Partner org_acme is not authorized for write via client."},
+		{"no template", "", defaultFailureDescription},
+		{"parse error", "Partner {{.SubjectID", defaultFailureDescription},
+		{"execution error", "Partner {{.Missing}}", defaultFailureDescription},
+	}
+	for _, tt := range tests {
+		entitlement := Entitlement{EntitlementID: "deny_write", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "write", Effect: effectDeny, FailureTemplate: tt.template}
+
+		if got := renderFailureDescription(slog.Default(), entitlement, ev, "org_acme"); got != tt.want {
+			t.Errorf("%s: description = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHandlerRendersFailureTemplate(t *testing.T) {
+	logs := withDefaultLogger(t)
+	deny := func(template string) fakeEntitlements {
+		return fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{{
+			EntitlementID: "deny_acme", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "read",
+			Effect: effectDeny, FailureTemplate: template,
+		}}}}
+	}
+
+	_, resp := serve(t, NewServer(deny("Partner {{.SubjectID}} is not authorized for {{.Action}}.")), http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+	if resp.ActionStatus != "FAILED" || resp.FailureDescription != "Partner org_acme is not authorized for read." {
+		t.Errorf("response = %+v, want the rendered description", resp)
+	}
+
+	_, resp = serve(t, NewServer(deny("{{.Broken")), http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+	if resp.ActionStatus != "FAILED" || resp.FailureDescription != defaultFailureDescription {
+		t.Errorf("response = %+v, want the static description", resp)
+	}
+	if !strings.Contains(logs.String(), "Error parsing failure template") {
+		t.Errorf("logs = %s, want the broken template logged", logs.String())
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// fieldRename renames an external entitlement field to its canonical name. Parent
+// is the path of the object holding the field, empty for top-level fields.
+type fieldRename struct {
+	Parent []string
+	From   string
+	To     string
+}
+
+// entitlementFieldMap translates external entitlement documents into our schema
+var entitlementFieldMap []fieldRename
+
+// parseFieldMap parses ENTITLEMENT_FIELD_MAP, a comma-separated list of
+// external=canonical field names. Nested fields use dotted paths under the same
+// parent, e.g. "id=entitlementId,resource=object,subject.kind=subject.type".
+func parseFieldMap(value string) ([]fieldRename, error) {
+	var renames []fieldRename
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(item, "=")
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid field mapping %q (expected external=canonical)", item)
+		}
+
+		fromPath := strings.Split(from, ".")
+		toPath := strings.Split(to, ".")
+		if len(fromPath) != len(toPath) || strings.Join(fromPath[:len(fromPath)-1], ".") != strings.Join(toPath[:len(toPath)-1], ".") {
+			return nil, fmt.Errorf("invalid field mapping %q: both fields must have the same parent", item)
+		}
+
+		renames = append(renames, fieldRename{
+			Parent: fromPath[:len(fromPath)-1],
+			From:   fromPath[len(fromPath)-1],
+			To:     toPath[len(toPath)-1],
+		})
+	}
+	return renames, nil
+}
+
+// unmarshalEntitlement parses one entitlement of a document, applying the field
+// map to it first when one is configured
+func unmarshalEntitlement(raw json.RawMessage) (Entitlement, error) {
+	var entitlement Entitlement
+	if len(entitlementFieldMap) == 0 {
+		err := json.Unmarshal(raw, &entitlement)
+		return entitlement, err
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return entitlement, err
+	}
+	applyFieldMap(doc, entitlementFieldMap)
+	mapped, err := json.Marshal(doc)
+	if err != nil {
+		return entitlement, err
+	}
+	err = json.Unmarshal(mapped, &entitlement)
+	return entitlement, err
+}
+
+// applyFieldMap renames fields of a decoded entitlement in place
+func applyFieldMap(entitlement map[string]interface{}, renames []fieldRename) {
+	for _, rename := range renames {
+		parent := entitlement
+		for _, key := range rename.Parent {
+			child, ok := parent[key].(map[string]interface{})
+			if !ok {
+				parent = nil
+				break
+			}
+			parent = child
+		}
+		if parent == nil {
+			continue
+		}
+		if value, ok := parent[rename.From]; ok {
+			delete(parent, rename.From)
+			parent[rename.To] = value
+		}
+	}
+}
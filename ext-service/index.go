@@ -0,0 +1,125 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// subjectKey is the index key of a subject
+func subjectKey(subject Subject) string {
+	return subject.Type + "|" + subject.ID
+}
+
+// sortedSubjects returns the subjects of a set ordered by subjectKey
+func sortedSubjects(subjects map[Subject]bool) []Subject {
+	ordered := make([]Subject, 0, len(subjects))
+	for subject := range subjects {
+		ordered = append(ordered, subject)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return subjectKey(ordered[i]) < subjectKey(ordered[j]) })
+	return ordered
+}
+
+// isSubjectPattern reports whether a subject ID is a path.Match pattern such as
+// "acme-*" rather than a literal ID
+func isSubjectPattern(id string) bool {
+	return strings.ContainsAny(id, "*?[")
+}
+
+// validateSubjectPattern checks that a pattern subject ID is well formed
+func validateSubjectPattern(id string) error {
+	if !isSubjectPattern(id) {
+		return nil
+	}
+	_, err := path.Match(id, "")
+	return err
+}
+
+// subjectIDMatches reports whether an entitlement's subject ID covers id: a
+// pattern matches with path.Match, a literal ID only matches itself exactly
+func subjectIDMatches(pattern, id string) bool {
+	if !isSubjectPattern(pattern) {
+		return pattern == id
+	}
+	matched, err := path.Match(pattern, id)
+	return err == nil && matched
+}
+
+// indexEntitlements indexes data's entitlements by subject. Loaded documents are
+// indexed as they are decoded, after subject IDs are normalized; the index is part
+// of the loaded snapshot, so a reload replaces it together with the entitlements.
+func indexEntitlements(data *EntitlementsData) {
+	data.bySubject = make(map[string][]int)
+	data.patterns = nil
+	for i, entitlement := range data.Entitlements {
+		data.index(i, entitlement)
+	}
+}
+
+// add appends entitlement and indexes it, so a document can be indexed while it
+// is decoded
+func (d *EntitlementsData) add(entitlement Entitlement) {
+	if d.bySubject == nil {
+		d.bySubject = make(map[string][]int)
+	}
+	d.Entitlements = append(d.Entitlements, entitlement)
+	d.index(len(d.Entitlements)-1, entitlement)
+}
+
+// index records that the entitlement at position belongs to its subject, or to
+// the subjects its pattern matches
+func (d *EntitlementsData) index(position int, entitlement Entitlement) {
+	if isSubjectPattern(entitlement.Subject.ID) {
+		d.patterns = append(d.patterns, position)
+		return
+	}
+	key := subjectKey(entitlement.Subject)
+	d.bySubject[key] = append(d.bySubject[key], position)
+}
+
+// forSubjects returns the entitlements of the given subjects: those naming a
+// subject exactly in file order, then those whose subject ID pattern matches one,
+// in file order, so exact matches are preferred. A pattern entitlement is
+// returned once per subject it matches, with its ID resolved to that subject's.
+// Entitlements built without indexEntitlements are scanned instead.
+func (d *EntitlementsData) forSubjects(subjects map[Subject]bool) []Entitlement {
+	var exact, patterns []int
+	if d.bySubject == nil {
+		for i, entitlement := range d.Entitlements {
+			if isSubjectPattern(entitlement.Subject.ID) {
+				patterns = append(patterns, i)
+			} else if subjects[entitlement.Subject] {
+				exact = append(exact, i)
+			}
+		}
+	} else {
+		for subject := range subjects {
+			exact = append(exact, d.bySubject[subjectKey(subject)]...)
+		}
+		sort.Ints(exact)
+		patterns = d.patterns
+	}
+
+	found := make([]Entitlement, 0, len(exact))
+	for _, position := range exact {
+		found = append(found, d.Entitlements[position])
+	}
+	if len(patterns) == 0 {
+		return found
+	}
+
+	// Subjects are visited in a fixed order so the result does not depend on map order
+	ordered := sortedSubjects(subjects)
+	for _, position := range patterns {
+		entitlement := d.Entitlements[position]
+		for _, subject := range ordered {
+			if subject.Type == entitlement.Subject.Type && subjectIDMatches(entitlement.Subject.ID, subject.ID) {
+				resolved := entitlement
+				resolved.Subject.ID = subject.ID
+				found = append(found, resolved)
+			}
+		}
+	}
+	return found
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestForSubjectsKeepsFileOrder(t *testing.T) {
+	data := &EntitlementsData{Entitlements: []Entitlement{
+		{EntitlementID: "1", Subject: Subject{Type: "partner", ID: "org_b"}},
+		{EntitlementID: "2", Subject: Subject{Type: "partner", ID: "org_a"}},
+		{EntitlementID: "3", Subject: Subject{Type: "user", ID: "org_a"}},
+		{EntitlementID: "4", Subject: Subject{Type: "partner", ID: "org_b"}},
+		{EntitlementID: "5", Subject: Subject{Type: "partner", ID: "org_c"}},
+	}}
+	subjects := map[Subject]bool{{Type: "partner", ID: "org_a"}: true, {Type: "partner", ID: "org_b"}: true}
+
+	scanned := data.forSubjects(subjects)
+	indexEntitlements(data)
+	indexed := data.forSubjects(subjects)
+
+	for name, got := range map[string][]Entitlement{"scan": scanned, "index": indexed} {
+		var ids string
+		for _, entitlement := range got {
+			ids += entitlement.EntitlementID
+		}
+		if ids != "124" {
+			t.Errorf("%s: entitlement IDs = %q, want %q", name, ids, "124")
+		}
+	}
+}
+
+func TestForSubjectsMatchesSubjectPatterns(t *testing.T) {
+	data := &EntitlementsData{Entitlements: []Entitlement{
+		{EntitlementID: "prefix", Subject: Subject{Type: "partner", ID: "acme-*"}},
+		{EntitlementID: "exact", Subject: Subject{Type: "partner", ID: "acme-eu"}},
+		{EntitlementID: "literal", Subject: Subject{Type: "partner", ID: "acme"}},
+		{EntitlementID: "user", Subject: Subject{Type: "user", ID: "acme-*"}},
+	}}
+	tests := []struct {
+		name    string
+		subject string
+		want    string
+	}{
+		{"exact before pattern", "acme-eu", "exact:acme-eu prefix:acme-eu"},
+		{"prefix wildcard", "acme-us", "prefix:acme-us"},
+		{"literal", "acme", "literal:acme"},
+		{"literal never matches partially", "acme2", ""},
+		{"pattern needs the prefix", "org-acme-eu", ""},
+	}
+	indexed := &EntitlementsData{Entitlements: data.Entitlements}
+	indexEntitlements(indexed)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subjects := map[Subject]bool{{Type: "partner", ID: tt.subject}: true}
+			for name, got := range map[string][]Entitlement{"scan": data.forSubjects(subjects), "index": indexed.forSubjects(subjects)} {
+				var matches []string
+				for _, entitlement := range got {
+					matches = append(matches, entitlement.EntitlementID+":"+entitlement.Subject.ID)
+				}
+				if got := strings.Join(matches, " "); got != tt.want {
+					t.Errorf("%s: matches = %q, want %q", name, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateSubjectPattern(t *testing.T) {
+	for id, valid := range map[string]bool{"acme": true, "acme-*": true, "acme-[ab]?": true, "acme-[": false} {
+		if err := validateSubjectPattern(id); (err == nil) != valid {
+			t.Errorf("validateSubjectPattern(%q) = %v, want valid %v", id, err, valid)
+		}
+	}
+}
+
+// largeEntitlements returns n entitlements spread over n/10 partners
+func largeEntitlements(n int) *EntitlementsData {
+	data := &EntitlementsData{}
+	for i := 0; i < n; i++ {
+		data.Entitlements = append(data.Entitlements, Entitlement{
+			EntitlementID: fmt.Sprintf("ent_%d", i),
+			Subject:       Subject{Type: "partner", ID: fmt.Sprintf("org_%d", i%(n/10))},
+			Action:        "read",
+		})
+	}
+	return data
+}
+
+func BenchmarkForSubjects(b *testing.B) {
+	subjects := map[Subject]bool{{Type: "partner", ID: "org_42"}: true}
+	for _, n := range []int{1000, 10000, 100000} {
+		data := largeEntitlements(n)
+		b.Run(fmt.Sprintf("scan/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				data.forSubjects(subjects)
+			}
+		})
+
+		indexed := largeEntitlements(n)
+		indexEntitlements(indexed)
+		b.Run(fmt.Sprintf("index/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				indexed.forSubjects(subjects)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwksRefreshInterval bounds how often an unknown key ID triggers a JWKS refetch
+const jwksRefreshInterval = time.Minute
+
+// jwtHeader holds the JOSE header fields we care about
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// parsedJWT is a decoded compact JWS
+type parsedJWT struct {
+	Header       jwtHeader
+	Claims       map[string]interface{}
+	signingInput string
+	signature    []byte
+}
+
+// parseJWT decodes a compact JWT without verifying its signature
+func parseJWT(token string) (*parsedJWT, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT: expected 3 segments")
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT header: %w", err)
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, fmt.Errorf("malformed JWT header: %w", err)
+	}
+
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT payload: %w", err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payloadBytes, &claims); err != nil {
+		return nil, fmt.Errorf("malformed JWT payload: %w", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT signature: %w", err)
+	}
+
+	return &parsedJWT{
+		Header:       header,
+		Claims:       claims,
+		signingInput: parts[0] + "." + parts[1],
+		signature:    signature,
+	}, nil
+}
+
+// validateTimeClaims checks the exp and nbf claims against now
+func (t *parsedJWT) validateTimeClaims(now time.Time) error {
+	if exp, ok := t.Claims["exp"].(float64); ok && now.Unix() >= int64(exp) {
+		return errors.New("JWT has expired")
+	}
+	if nbf, ok := t.Claims["nbf"].(float64); ok && now.Unix() < int64(nbf) {
+		return errors.New("JWT is not yet valid")
+	}
+	return nil
+}
+
+// jwk is a single RSA key from a JWKS document
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// jwksVerifier verifies RS256 JWTs against keys fetched from a JWKS URL
+type jwksVerifier struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// newJWKSVerifier creates a verifier that lazily fetches keys from url, giving
+// each fetch up to timeout
+func newJWKSVerifier(url string, timeout time.Duration) *jwksVerifier {
+	return &jwksVerifier{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// verify checks the JWT signature using the key named by its kid. A JWKS fetch
+// it triggers is bounded by ctx as well as the verifier's own timeout.
+func (v *jwksVerifier) verify(ctx context.Context, t *parsedJWT) error {
+	if t.Header.Alg != "RS256" {
+		return fmt.Errorf("unsupported JWT algorithm %q", t.Header.Alg)
+	}
+
+	key, err := v.key(ctx, t.Header.Kid)
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256([]byte(t.signingInput))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], t.signature); err != nil {
+		return errors.New("invalid JWT signature")
+	}
+	return nil
+}
+
+// key returns the public key for kid, refetching the JWKS when the kid is unknown.
+// The lock is not held during the fetch, so a slow JWKS endpoint does not block
+// verifications with known keys.
+func (v *jwksVerifier) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	if key, ok := v.keys[kid]; ok {
+		v.mu.Unlock()
+		return key, nil
+	}
+	if time.Since(v.fetchedAt) < jwksRefreshInterval && v.keys != nil {
+		v.mu.Unlock()
+		return nil, fmt.Errorf("unknown JWT key ID %q", kid)
+	}
+	// Claim the refresh so concurrent requests for unknown kids do not all fetch
+	v.fetchedAt = time.Now()
+	v.mu.Unlock()
+
+	keys, err := v.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.mu.Unlock()
+
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown JWT key ID %q", kid)
+	}
+	return key, nil
+}
+
+// fetch downloads and parses the JWKS document
+func (v *jwksVerifier) fetch(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build JWKS request: %w", err)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: unexpected status %d", resp.StatusCode)
+	}
+
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range doc.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		key, err := k.rsaPublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWKS key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+// rsaPublicKey converts the JWK modulus and exponent into an RSA public key
+func (k jwk) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
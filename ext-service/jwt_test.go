@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSigningKey returns an RSA key shared by the tests that sign JWTs
+var testSigningKey = sync.OnceValue(func() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+})
+
+// signJWT builds an RS256 JWT over claims, signed with key under kid
+func signJWT(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(mustJSON(t, v)))
+	}
+	signingInput := encode(jwtHeader{Alg: "RS256", Kid: kid}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("sign JWT: %v", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// jwksServer serves the public half of key under kid, calling before (when set)
+// ahead of each response
+func jwksServer(t *testing.T, key *rsa.PrivateKey, kid string, before func()) *httptest.Server {
+	t.Helper()
+	doc := map[string][]jwk{"keys": {{
+		Kty: "RSA",
+		Kid: kid,
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if before != nil {
+			before()
+		}
+		json.NewEncoder(w).Encode(doc)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestJWKSVerifierChecksSignature(t *testing.T) {
+	key := testSigningKey()
+	verifier := newJWKSVerifier(jwksServer(t, key, "k1", nil).URL, time.Second)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	claims := map[string]interface{}{"partner_id": "org_acme"}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"signed", signJWT(t, key, "k1", claims), false},
+		{"signed by another key", signJWT(t, other, "k1", claims), true},
+		{"unknown kid", signJWT(t, key, "k2", claims), true},
+	}
+	for _, tt := range tests {
+		token, err := parseJWT(tt.token)
+		if err != nil {
+			t.Fatalf("%s: parse: %v", tt.name, err)
+		}
+		if err := verifier.verify(context.Background(), token); (err != nil) != tt.wantErr {
+			t.Errorf("%s: verify error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestJWKSVerifierKnownKeyNotBlockedByFetch(t *testing.T) {
+	key := testSigningKey()
+	release := make(chan struct{})
+	var fetches sync.WaitGroup
+	fetches.Add(1)
+	first := true
+	server := jwksServer(t, key, "k1", func() {
+		if first {
+			first = false
+			return
+		}
+		fetches.Done()
+		<-release
+	})
+	t.Cleanup(func() { close(release) })
+	verifier := newJWKSVerifier(server.URL, 5*time.Second)
+	known, _ := parseJWT(signJWT(t, key, "k1", map[string]interface{}{}))
+	unknown, _ := parseJWT(signJWT(t, key, "k2", map[string]interface{}{}))
+
+	if err := verifier.verify(context.Background(), known); err != nil {
+		t.Fatalf("verify known key: %v", err)
+	}
+	// Let the refresh interval pass so the unknown kid refetches, then hold that fetch
+	verifier.mu.Lock()
+	verifier.fetchedAt = time.Now().Add(-2 * jwksRefreshInterval)
+	verifier.mu.Unlock()
+	go verifier.verify(context.Background(), unknown)
+	fetches.Wait()
+
+	done := make(chan error, 1)
+	go func() { done <- verifier.verify(context.Background(), known) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("verify known key during fetch: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("verify with a known key blocked on the JWKS fetch")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestIDHeader carries the request ID; an incoming value is reused so log
+// lines can be correlated with the caller's
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds a reused request ID so a caller cannot bloat every log line
+const maxRequestIDLength = 128
+
+// logLevel is the minimum level logged, from LOG_LEVEL
+var logLevel = new(slog.LevelVar)
+
+// defaultLogPaths logs every request except probes and scrapes
+const defaultLogPaths = "*,!/health,!/healthz,!/ready,!/metrics"
+
+// logPaths selects the paths whose requests get a completion line (LOG_PATHS)
+var logPaths = mustParseLogPaths(defaultLogPaths)
+
+// logPathRules lists the paths allowed and denied an access log line; "*"
+// stands for every path
+type logPathRules struct {
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+// parseLogPaths parses a comma-separated list of paths to log, where a path
+// prefixed with "!" is never logged
+func parseLogPaths(v string) (logPathRules, error) {
+	rules := logPathRules{allow: make(map[string]bool), deny: make(map[string]bool)}
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		target := rules.allow
+		if rest, ok := strings.CutPrefix(entry, "!"); ok {
+			target, entry = rules.deny, rest
+		}
+		if entry != "*" && !strings.HasPrefix(entry, "/") {
+			return rules, fmt.Errorf("invalid LOG_PATHS entry %q (expected a path or *)", entry)
+		}
+		target[entry] = true
+	}
+	return rules, nil
+}
+
+// mustParseLogPaths parses a built-in LOG_PATHS value
+func mustParseLogPaths(v string) logPathRules {
+	rules, err := parseLogPaths(v)
+	if err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+// logs reports whether requests to path get a completion line: the path is
+// allowed (by name or "*") and not denied
+func (r logPathRules) logs(path string) bool {
+	if r.deny[path] || r.deny["*"] {
+		return false
+	}
+	return r.allow[path] || r.allow["*"]
+}
+
+// configureLogging installs a JSON slog handler at LOG_LEVEL (debug or info) and
+// reads LOG_PATHS. The standard log package is routed through the same handler,
+// so every log event is one JSON object.
+func configureLogging() error {
+	switch level := os.Getenv("LOG_LEVEL"); level {
+	case "", "info":
+		logLevel.Set(slog.LevelInfo)
+	case "debug":
+		logLevel.Set(slog.LevelDebug)
+	default:
+		return fmt.Errorf("invalid LOG_LEVEL %q (expected debug or info)", level)
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+
+	if v, ok := os.LookupEnv("LOG_PATHS"); ok {
+		rules, err := parseLogPaths(v)
+		if err != nil {
+			return err
+		}
+		logPaths = rules
+	}
+	return nil
+}
+
+// requestID returns the request's X-Request-Id, or a new UUID when it has none
+// (or an unusable one)
+func requestID(r *http.Request) string {
+	if id := strings.TrimSpace(r.Header.Get(requestIDHeader)); id != "" && len(id) <= maxRequestIDLength && printable(id) {
+		return id
+	}
+	return newUUID()
+}
+
+// printable reports whether s holds only printable ASCII
+func printable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		slog.Error("Error generating request ID", "error", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// requestLog holds a request's logger. Attributes learned while handling the
+// request (action type, client, partner) are added to it, so later lines,
+// including the completion line, carry them.
+type requestLog struct {
+	mu     sync.Mutex
+	logger *slog.Logger
+}
+
+type requestLogKey struct{}
+
+// withRequestLogger returns ctx carrying a logger tagged with id
+func withRequestLogger(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestLogKey{}, &requestLog{logger: slog.Default().With("request_id", id)})
+}
+
+// loggerFrom returns the request's logger, or the default logger outside a request
+func loggerFrom(ctx context.Context) *slog.Logger {
+	l, ok := ctx.Value(requestLogKey{}).(*requestLog)
+	if !ok {
+		return slog.Default()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.logger
+}
+
+// addLogAttrs adds attributes to every later log line of the request
+func addLogAttrs(ctx context.Context, args ...any) *slog.Logger {
+	l, ok := ctx.Value(requestLogKey{}).(*requestLog)
+	if !ok {
+		return slog.Default().With(args...)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logger = l.logger.With(args...)
+	return l.logger
+}
+
+// debugEnabled reports whether debug lines are logged, for callers that would
+// otherwise build expensive attributes for nothing
+func debugEnabled() bool {
+	return logLevel.Level() <= slog.LevelDebug
+}
+
+// logRequests tags every request with a request ID and logger, and logs a
+// completion line for requests to paths selected by LOG_PATHS
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := requestID(r)
+		w.Header().Set(requestIDHeader, id)
+		ctx := withRequestLogger(r.Context(), id)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if path := r.URL.Path; logPaths.logs(path) {
+			loggerFrom(ctx).Info("Request completed", "path", path, "status", rec.status, "latency_ms", time.Since(start).Milliseconds())
+		}
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withLogPaths sets LOG_PATHS to v for the duration of a test
+func withLogPaths(t *testing.T, v string) {
+	t.Helper()
+	rules, err := parseLogPaths(v)
+	if err != nil {
+		t.Fatalf("parseLogPaths(%q): %v", v, err)
+	}
+	previous := logPaths
+	logPaths = rules
+	t.Cleanup(func() { logPaths = previous })
+}
+
+// accessLogged reports whether a request to path through logRequests logged a
+// completion line
+func accessLogged(t *testing.T, path string) bool {
+	t.Helper()
+	logs := withDefaultLogger(t)
+	noop := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	logRequests(noop).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	out := logs.String()
+	return strings.Contains(out, `"msg":"Request completed"`) && strings.Contains(out, `"path":"`+path+`"`)
+}
+
+func TestRequestLoggingFollowsLogPaths(t *testing.T) {
+	tests := []struct {
+		logPaths string
+		path     string
+		want     bool
+	}{
+		{defaultLogPaths, "/token-validation", true},
+		{defaultLogPaths, "/health", false},
+		{defaultLogPaths, "/ready", false},
+		{defaultLogPaths, "/metrics", false},
+		{"/token-validation", "/token-validation", true},
+		{"/token-validation", "/admin/entitlements", false},
+		{"*,!/token-validation", "/token-validation", false},
+		{"*,!/token-validation", "/metrics", true},
+		{"!*", "/token-validation", false},
+		{"", "/token-validation", false},
+	}
+	for _, tt := range tests {
+		withLogPaths(t, tt.logPaths)
+		if got := accessLogged(t, tt.path); got != tt.want {
+			t.Errorf("LOG_PATHS=%q: %s logged = %v, want %v", tt.logPaths, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestParseLogPathsRejectsRelativePaths(t *testing.T) {
+	for _, v := range []string{"token-validation", "*,!metrics"} {
+		if _, err := parseLogPaths(v); err == nil {
+			t.Errorf("parseLogPaths accepted %q", v)
+		}
+	}
+}
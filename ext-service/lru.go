@@ -0,0 +1,116 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+// lruCache is a size-bounded, concurrency-safe LRU cache whose entries expire
+// after a TTL (a TTL of 0 keeps entries until they are evicted)
+type lruCache[K comparable, V any] struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	// jitter spreads expiries by up to ±jitter of the TTL, deterministically per key
+	jitter  float64
+	order   *list.List
+	entries map[K]*list.Element
+}
+
+// lruEntry is the value stored in each list element
+type lruEntry[K comparable, V any] struct {
+	key       K
+	value     V
+	expiresAt time.Time
+}
+
+// newLRUCache creates a cache holding at most capacity entries
+func newLRUCache[K comparable, V any](capacity int, ttl time.Duration) *lruCache[K, V] {
+	return &lruCache[K, V]{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  make(map[K]*list.Element),
+	}
+}
+
+// get returns the cached value for key if present and not expired
+func (c *lruCache[K, V]) get(key K, now time.Time) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero V
+	elem, ok := c.entries[key]
+	if !ok {
+		return zero, false
+	}
+	entry := elem.Value.(*lruEntry[K, V])
+	if !entry.expiresAt.IsZero() && !now.Before(entry.expiresAt) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return zero, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.value, true
+}
+
+// put stores value under key, evicting the least recently used entry when full
+func (c *lruCache[K, V]) put(key K, value V, now time.Time) {
+	c.putUntil(key, value, now, time.Time{})
+}
+
+// putUntil stores value under key like put, expiring it no later than until
+// (a zero until leaves the TTL alone)
+func (c *lruCache[K, V]) putUntil(key K, value V, now, until time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var expiresAt time.Time
+	if c.ttl > 0 {
+		expiresAt = now.Add(c.ttlFor(key))
+	}
+	if !until.IsZero() && (expiresAt.IsZero() || until.Before(expiresAt)) {
+		expiresAt = until
+	}
+
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*lruEntry[K, V])
+		entry.value = value
+		entry.expiresAt = expiresAt
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry[K, V]{key: key, value: value, expiresAt: expiresAt})
+	for c.capacity > 0 && c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry[K, V]).key)
+	}
+}
+
+// purge removes every entry
+func (c *lruCache[K, V]) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.entries = make(map[K]*list.Element)
+}
+
+// ttlFor returns the TTL for key with jitter applied. The offset is derived from a
+// hash of the key, so a key always gets the same TTL while different keys
+// spread out and do not all expire at once.
+func (c *lruCache[K, V]) ttlFor(key K) time.Duration {
+	if c.jitter <= 0 {
+		return c.ttl
+	}
+	h := fnv.New64a()
+	fmt.Fprint(h, key)
+	// Map the hash onto [-1, 1]
+	unit := float64(h.Sum64())/float64(math.MaxUint64)*2 - 1
+	return time.Duration(float64(c.ttl) * (1 + c.jitter*unit))
+}
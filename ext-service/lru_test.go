@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLRUCacheTTLJitterIsBoundedAndStablePerKey(t *testing.T) {
+	cache := newLRUCache[string, int](0, time.Minute)
+	cache.jitter = 0.1
+	low, high := 54*time.Second, 66*time.Second
+
+	distinct := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("tenant-%d", i)
+		ttl := cache.ttlFor(key)
+		if ttl < low || ttl > high {
+			t.Errorf("ttlFor(%s) = %v, want within [%v, %v]", key, ttl, low, high)
+		}
+		if again := cache.ttlFor(key); again != ttl {
+			t.Errorf("ttlFor(%s) = %v then %v, want the same TTL every time", key, ttl, again)
+		}
+		distinct[ttl] = true
+	}
+	if len(distinct) < 50 {
+		t.Errorf("%d distinct TTLs for 100 keys, want expiries spread out", len(distinct))
+	}
+
+	cache.jitter = 0
+	if ttl := cache.ttlFor("tenant-1"); ttl != time.Minute {
+		t.Errorf("ttlFor without jitter = %v, want %v", ttl, time.Minute)
+	}
+}
+
+func TestLRUCacheEntryExpiresAtJitteredTTL(t *testing.T) {
+	cache := newLRUCache[string, int](0, time.Minute)
+	cache.jitter = 0.2
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	ttl := cache.ttlFor("tenant-a")
+
+	cache.put("tenant-a", 1, now)
+
+	if _, ok := cache.get("tenant-a", now.Add(ttl-time.Millisecond)); !ok {
+		t.Error("entry expired before its jittered TTL")
+	}
+	if _, ok := cache.get("tenant-a", now.Add(ttl)); ok {
+		t.Error("entry still cached at its jittered TTL")
+	}
+}
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newLRUCache[string, int](2, 0)
+	now := time.Now()
+	cache.put("a", 1, now)
+	cache.put("b", 2, now)
+	cache.get("a", now)
+	cache.put("c", 3, now)
+
+	if _, ok := cache.get("b", now); ok {
+		t.Error("b still cached, want the least recently used entry evicted")
+	}
+	if _, ok := cache.get("a", now); !ok {
+		t.Error("a evicted, want it kept after its recent use")
+	}
+}
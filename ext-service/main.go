@@ -2,14 +2,26 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// clock returns the current time; tests replace it to control time-based behavior
+var clock = time.Now
+
 // MinimalRequest represents the minimal required fields
 type Request struct {
 	ActionType        string            `json:"actionType"`
@@ -22,6 +34,13 @@ type Event struct {
 	Request      RequestData   `json:"request"`
 	AccessToken  AccessToken   `json:"accessToken"`
 	RefreshToken *RefreshToken `json:"refreshToken,omitempty"`
+	Tenant       *Tenant       `json:"tenant,omitempty"`
+}
+
+// Tenant identifies the Asgardeo tenant the token is issued in
+type Tenant struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
 }
 
 // Header represents a header in additionalHeaders
@@ -35,12 +54,18 @@ type RequestData struct {
 	ClientID          string   `json:"clientId"`
 	GrantType         string   `json:"grantType"`
 	AdditionalHeaders []Header `json:"additionalHeaders,omitempty"`
+
+	// present is set when the request carried the object
+	present bool
 }
 
 // AccessToken token info
 type AccessToken struct {
 	Scopes []string `json:"scopes"`
 	Claims []Claim  `json:"claims"`
+
+	// present is set when the request carried the object
+	present bool
 }
 
 // RefreshToken refresh token info
@@ -64,6 +89,8 @@ type Operation struct {
 type Response struct {
 	ActionStatus        string             `json:"actionStatus"`
 	Operations          []OperationResponse `json:"operations,omitempty"`
+	// PreviewOperations are the operations a dry run would have applied
+	PreviewOperations []OperationResponse `json:"previewOperations,omitempty"`
 	FailureReason      string             `json:"failureReason,omitempty"`
 	FailureDescription string             `json:"failureDescription,omitempty"`
 	ErrorMessage       string             `json:"errorMessage,omitempty"`
@@ -80,6 +107,16 @@ type OperationResponse struct {
 // EntitlementsData represents the structure of entitlements.json
 type EntitlementsData struct {
 	Entitlements []Entitlement `json:"entitlements"`
+
+	// bySubject maps subjectKey to the positions of the subject's entitlements
+	bySubject map[string][]int
+	// patterns are the positions of entitlements whose subject ID is a pattern
+	patterns []int
+	// loadID identifies the load the entitlements came from
+	loadID uint64
+	// live entitlements were decided for one request, by a decision point, so
+	// evaluations against them are not cached
+	live bool
 }
 
 // Entitlement represents a single entitlement
@@ -89,6 +126,71 @@ type Entitlement struct {
 	Action        string                  `json:"action"`
 	Object        map[string]interface{} `json:"object"`
 	Constraints   map[string]interface{} `json:"constraints"`
+	// DecisionTTLSeconds overrides DECISION_TTL for decisions involving this entitlement
+	DecisionTTLSeconds int `json:"decisionTtlSeconds,omitempty"`
+	// PersistToRefreshToken also adds the granted scope to the refresh token
+	PersistToRefreshToken bool `json:"persistToRefreshToken,omitempty"`
+	// NotBefore sets the access token nbf claim for delayed-activation credentials
+	NotBefore *NotBefore `json:"notBefore,omitempty"`
+	// Audience restricts the granted scope to a resource server by also adding it to aud
+	Audience string `json:"audience,omitempty"`
+	// MergeClaims adds fields to object claims (claim name to fields) without replacing their other fields
+	MergeClaims map[string]map[string]interface{} `json:"mergeClaims,omitempty"`
+	// RemoveClaims lists access token claims withheld from this partner's tokens
+	RemoveClaims []string `json:"removeClaims,omitempty"`
+	// Priority orders entitlements in MATCH_MODE=first (higher wins)
+	Priority int `json:"priority,omitempty"`
+	// MaxRisk is the highest request risk score this entitlement still grants at
+	MaxRisk *float64 `json:"maxRisk,omitempty"`
+	// Effect "deny" blocks token issuance instead of granting a scope
+	Effect string `json:"effect,omitempty"`
+	// FailureTemplate is a text/template for the FAILED response description of a deny entitlement
+	FailureTemplate string `json:"failureTemplate,omitempty"`
+	// Tags group entitlements so they can be disabled together through DISABLED_TAGS
+	Tags []string `json:"tags,omitempty"`
+	// PartnerMetadata holds partner context (name, tier, region, ...) that PARTNER_METADATA_CLAIMS can emit as claims
+	PartnerMetadata map[string]interface{} `json:"partnerMetadata,omitempty"`
+	// ScopesExpression is a CEL expression returning the list of scopes to grant, instead of the action/object scope
+	ScopesExpression string `json:"scopesExpression,omitempty"`
+	// RewriteSubject replaces the token sub claim ("{partner}" is the partner ID); needs ALLOW_SUBJECT_REWRITE
+	RewriteSubject string `json:"rewriteSubject,omitempty"`
+	// Claims are access token claims (name to any JSON value) set when the entitlement matches
+	Claims map[string]interface{} `json:"claims,omitempty"`
+
+	// scopes are granted as they are instead of the action/object scope. They
+	// are set by a decision point rather than read from a document.
+	scopes []string
+	// program is the compiled ScopesExpression, set when entitlements load
+	program cel.Program
+}
+
+// decisionTTLHeader tells Asgardeo how long it may reuse our decision. The action
+// response schema has no field for this, so it is only sent as a header.
+const decisionTTLHeader = "X-Decision-TTL"
+
+// grantedScopesHeader echoes the granted scopes when EXPOSE_GRANTED_SCOPES is
+// enabled. It is a troubleshooting aid only and must not be enabled in production.
+const grantedScopesHeader = "X-Granted-Scopes"
+
+// scopeRecheck is one entry of the scope re-check claim
+type scopeRecheck struct {
+	Scope string `json:"scope"`
+	Exp   int64  `json:"exp"`
+}
+
+// grantTypeRefreshToken is the grant type of a token refresh
+const grantTypeRefreshToken = "refresh_token"
+
+// scopeSummary is the value of the scope summary claim
+type scopeSummary struct {
+	GrantedScopeCount   int      `json:"grantedScopeCount"`
+	MatchedEntitlements []string `json:"matchedEntitlements"`
+}
+
+// NotBefore is either an absolute nbf (Unix seconds) or an offset from issuance
+type NotBefore struct {
+	At            int64 `json:"at,omitempty"`
+	OffsetSeconds int64 `json:"offsetSeconds,omitempty"`
 }
 
 // Subject represents the subject in an entitlement
@@ -97,111 +199,559 @@ type Subject struct {
 	ID   string `json:"id"`
 }
 
-func handler(w http.ResponseWriter, r *http.Request) {
+// handler decodes an action request and dispatches it by action type
+func (s *Server) handler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeErrorResponse(w, http.StatusMethodNotAllowed, "invalid_request", "Method not allowed")
 		return
 	}
 
-	// Log full request details
-	log.Printf("=== Full Request Details ===")
-	log.Printf("Method: %s", r.Method)
-	log.Printf("URL: %s", r.URL.String())
-	log.Printf("Protocol: %s", r.Proto)
-	log.Printf("Remote Address: %s", r.RemoteAddr)
-	
-	// Log all headers
-	log.Printf("Headers:")
-	for name, values := range r.Header {
-		for _, value := range values {
-			log.Printf("  %s: %s", name, value)
-		}
+	stats.requests.Add(1)
+	now := clock()
+	if s.requestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
 	}
+	logger := loggerFrom(r.Context())
 
-	// Read and log body
-	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err := s.verifyRequestAuth(r); err != nil {
+		logger.Warn("Rejecting unauthenticated request", "remote_addr", r.RemoteAddr, "error", err)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeErrorResponse(w, http.StatusUnauthorized, "unauthorized", "Request authentication failed")
+		return
+	}
+
+	// The body is capped while it is read, so an oversized one cannot exhaust memory
+	bodyBytes, err := s.readRequestBody(w, r)
+	var tooLarge *bodyLimitError
+	if errors.As(err, &tooLarge) {
+		logger.Warn("Rejecting oversized request body", "limit", tooLarge.setting, "limit_bytes", tooLarge.limit)
+		writeErrorResponse(w, http.StatusRequestEntityTooLarge, "invalid_request", "Request body too large")
+		return
+	}
+	if errors.Is(err, errUnsupportedEncoding) {
+		logger.Warn("Rejecting request body", "error", err)
+		writeErrorResponse(w, http.StatusUnsupportedMediaType, "invalid_request", "Request body encoding is not supported")
+		return
+	}
 	if err != nil {
-		log.Printf("Error reading request body: %v", err)
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		logger.Warn("Error reading request body", "error", err)
+		writeErrorResponse(w, http.StatusBadRequest, "invalid_request", "Request body could not be read")
 		return
 	}
-	
-	// Log body as string
-	log.Printf("Body: %s", string(bodyBytes))
-	log.Printf("=== End Request Details ===")
+	if debugEnabled() {
+		headers := make(map[string][]string, len(r.Header))
+		for name, values := range r.Header {
+			if name == "Authorization" {
+				values = []string{redacted}
+			}
+			headers[name] = values
+		}
+		logger.Debug("Request details",
+			"method", r.Method,
+			"url", r.URL.String(),
+			"protocol", r.Proto,
+			"remote_addr", r.RemoteAddr,
+			"headers", headers,
+			"body_bytes", len(bodyBytes))
+	}
 
 	// Restore body for decoding
 	r.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
 
 	var req Request
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("Error decoding request: %v", err)
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		logger.Warn("Error decoding request", "error", err)
+		writeErrorResponse(w, http.StatusBadRequest, "invalid_request", "Request body is not a valid action request")
+		return
+	}
+	if err := validateRequest(req); err != nil {
+		logger.Warn("Rejecting incomplete request", "error", err)
+		writeJSON(w, http.StatusOK, Response{
+			ActionStatus:       "FAILED",
+			FailureReason:      "invalid_request",
+			FailureDescription: "The action request is " + err.Error(),
+		})
+		return
+	}
+
+	// Treat a missing scopes array the same as an empty one
+	if req.Event.AccessToken.Scopes == nil {
+		req.Event.AccessToken.Scopes = []string{}
+	}
+
+	timing := timingFrom(r.Context())
+	timing.mark("decode")
+	recordActionType(w, req.ActionType)
+	logger = addLogAttrs(r.Context(), "action_type", req.ActionType, "client_id", req.Event.Request.ClientID)
+	setSpanAttributes(r.Context(), attribute.String("action_type", req.ActionType), attribute.String("client_id", req.Event.Request.ClientID))
+	// The body is only logged as a sanitized copy, since it carries token claims
+	if debugEnabled() {
+		logger.Debug("Decoded request", "request", sanitizeForLog(req))
+	}
+
+	if err := s.runPreprocessors(r.Context(), &req); err != nil {
+		logger.Error("Error preprocessing request", "error", err)
+		writeErrorResponse(w, http.StatusInternalServerError, "server_error", "Request preprocessing failed")
+		return
+	}
+	timing.mark("preprocess")
+
+	dispatch, ok := actionHandlers[req.ActionType]
+	if !ok {
+		logger.Info("Unhandled action type")
+		writeJSON(w, http.StatusOK, Response{ActionStatus: "SUCCESS"})
+		return
+	}
+	dispatch(s, w, r, req, now)
+}
+
+// handlePreIssueAccessToken adds the scopes and claims the partner is entitled to
+func (s *Server) handlePreIssueAccessToken(w http.ResponseWriter, r *http.Request, req Request, now time.Time) {
+	logger := loggerFrom(r.Context())
+	dryRun := isDryRun(r)
+	if dryRun {
+		logger = addLogAttrs(r.Context(), "dry_run", true)
+	}
+	if scopes, ok := s.bypassClients[req.Event.Request.ClientID]; ok {
+		logger.Debug("Bypassing entitlement matching")
+		resp := bypassResponse(logger, scopes, req.AllowedOperations)
+		if dryRun {
+			resp = previewOnly(resp)
+		}
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	logger.Info("Processing request")
+
+	// Get the partner IDs from event.request.additionalHeaders
+	partnerIDs, selectedSource, err := s.resolvePartnerIDs(r.Context(), req.Event.Request.AdditionalHeaders)
+	if err != nil {
+		logger.Warn("Invalid partner assertion", "error", err)
+		if s.rejectInvalidPartnerAssertion {
+			writeErrorResponse(w, http.StatusBadRequest, "invalid_request", "Invalid partner assertion")
+			return
+		}
+	}
+	partnerIDs = normalizeSubjectIDs(partnerIDs)
+	partnerIDs, err = s.reconcileSubject(logger, partnerIDs, req.Event.AccessToken.Claims)
+	if err != nil {
+		logger.Warn("Rejecting request", "error", err)
+		writeErrorResponse(w, http.StatusBadRequest, "invalid_request", "Partner header and subject claim do not match")
 		return
 	}
+	// The first partner ID is the primary one, used for rate limiting,
+	// enrichment and audit; entitlements of every partner ID are matched
+	var partnerID string
+	if len(partnerIDs) > 0 {
+		partnerID = partnerIDs[0]
+	}
+	timing := timingFrom(r.Context())
+	timing.setPartner(partnerID)
+	if partnerID != "" {
+		logger = addLogAttrs(r.Context(), "partner_id", partnerID)
+		setSpanAttributes(r.Context(), attribute.String("partner_id", partnerID))
+	}
+	if s.rateLimiter != nil {
+		key := s.rateLimiter.keyFor(r, req.Event, partnerID)
+		if !s.rateLimiter.allow(key) {
+			logger.Warn("Rate limit exceeded", "key_source", s.rateLimiter.key.Source, "key", key)
+			writeErrorResponse(w, http.StatusTooManyRequests, "rate_limited", "Too many requests")
+			return
+		}
+	}
 
-	// Log parsed request info
-	log.Printf("Processing %s for client: %s", req.ActionType, req.Event.Request.ClientID)
-	
-	// Log AdditionalHeaders if present
-	if len(req.Event.Request.AdditionalHeaders) > 0 {
-		log.Printf("AdditionalHeaders:")
-		for _, h := range req.Event.Request.AdditionalHeaders {
-			log.Printf("  %s: %v", h.Name, h.Value)
+	// Entitlements are matched against the partners and the other configured
+	// subject types, or the default subject when the request has none of them
+	partners := make(map[string]bool, len(partnerIDs))
+	subjects := make(map[Subject]bool, len(partnerIDs))
+	for _, id := range partnerIDs {
+		partners[id] = true
+		subjects[Subject{Type: "partner", ID: id}] = true
+	}
+	for subjectType := range s.subjectSources {
+		if id := s.resolveSubjectID(subjectType, req.Event); id != "" {
+			subjects[Subject{Type: subjectType, ID: id}] = true
 		}
 	}
 
-	// Get the partner ID from event.request.additionalHeaders
-	partnerID := getHeaderValue(req.Event.Request.AdditionalHeaders, "x-b2b-usp-partner")
-	if partnerID == "" {
-		log.Printf("Warning: x-b2b-usp-partner header not found in AdditionalHeaders")
+	if len(subjects) == 0 && s.defaultSubject == nil {
+		logger.Warn("Partner header not found in additional headers", "header", "x-b2b-usp-partner")
 		resp := Response{
 			ActionStatus: "SUCCESS",
 		}
+		s.setDecisionTTLHeader(w, nil, now)
 		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			log.Printf("Error encoding response: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			logger.Error("Error encoding response", "error", err)
+			writeErrorResponse(w, http.StatusInternalServerError, "server_error", "Response could not be built")
 		}
 		return
 	}
 
-	log.Printf("Partner ID from AdditionalHeaders: %s", partnerID)
+	if len(subjects) == 0 {
+		logger.Info("No subject resolved, matching the default subject", "subject_type", s.defaultSubject.Type, "subject_id", s.defaultSubject.ID)
+		subjects[*s.defaultSubject] = true
+	} else if partnerID != "" {
+		logger.Info("Partner IDs from additional headers", "partner_ids", partnerIDs)
+	}
 
-	// Load entitlements.json
-	entitlementsData, err := loadEntitlements()
+	// Load the entitlements for the request's tenant
+	query := EntitlementsQuery{Event: req.Event, Subjects: sortedSubjects(subjects), Resource: s.requestedResource(req.Event), Source: selectedSource, Now: now}
+	if selectedSource != "" {
+		logger.Info("Partner assertion selects the entitlement source", "source", selectedSource)
+	}
+	entitlementsData, err := s.entitlements.EntitlementsFor(r.Context(), query)
 	if err != nil {
-		log.Printf("Error loading entitlements: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		logger.Error("Error loading entitlements", "error", err)
+		writeErrorResponse(w, http.StatusInternalServerError, "server_error", "Entitlements could not be loaded")
 		return
 	}
+	buildDeadline := s.responseBuildDeadline(time.Now())
+	timing.mark("lookup")
 
-	// Find matching entitlements and create scopes
-	var operations []OperationResponse
-	for _, entitlement := range entitlementsData.Entitlements {
-		if entitlement.Subject.Type == "partner" && entitlement.Subject.ID == partnerID {
-			scope := fmt.Sprintf("%s:%s", entitlement.Subject.Type, entitlement.Action)
-			operations = append(operations, OperationResponse{
-				Op:   "add",
-				Path: "/accessToken/scopes/-",
-				Value: scope,
-			})
-			log.Printf("Added scope: %s for partner %s", scope, partnerID)
+	// Constraints and rules see the subject's attributes as extra claims
+	evalEvent := req.Event
+	if s.enricher != nil && partnerID != "" {
+		attrs, err := s.enricher.attributes(r.Context(), partnerID, now)
+		if err != nil {
+			logger.Warn("Error enriching partner", "error", err)
+			if s.enricher.failClosed {
+				writeErrorResponse(w, http.StatusInternalServerError, "server_error", "Attribute enrichment failed")
+				return
+			}
+		}
+		evalEvent = enrichEvent(req.Event, attrs)
+	}
+
+	var riskScore float64
+	if s.riskEvaluator != nil {
+		riskScore = s.riskEvaluator.Evaluate(req.Event, now)
+		logger.Info("Risk score evaluated", "risk_score", riskScore)
+	}
+
+	// Find matching entitlements and create scopes. The outcome only depends on
+	// the inputs in the cache key, so a cached one is reused until a reload or
+	// until the first of its entitlements expires.
+	cacheKey, cacheable := s.operationsCache.key(&s.Config, entitlementsData, req, evalEvent, partnerIDs, subjects, riskScore)
+	result, cached := s.operationsCache.get(cacheKey, cacheable, now)
+	if cached {
+		logger.Info("Using cached operations", "operations", len(result.operations))
+	} else {
+		// Candidates are the entitlements of the request's subjects, from the subject index
+		candidates := entitlementsData.forSubjects(subjects)
+		if s.matchFirst {
+			candidates = sortByPriority(candidates)
 		}
+		result = s.evaluateEntitlements(logger, req, evalEvent, candidates, partners, riskScore, now)
+		if result.denial == nil && !dependsOnTime(result.matched) {
+			s.operationsCache.put(cacheKey, cacheable, result, now)
+		}
+	}
+	if result.denial != nil {
+		entitlement := *result.denial
+		resp := Response{
+			ActionStatus:       "FAILED",
+			FailureReason:      "access_denied",
+			FailureDescription: renderFailureDescription(logger, entitlement, req.Event, entitlement.Subject.ID),
+		}
+		s.auditLog.record(newAuditRecord(now, w.Header().Get(requestIDHeader), req, partnerID, resp, []Entitlement{entitlement}, result.constraints))
+		s.sampleRecent(now, req, partnerID, resp)
+		writeJSON(w, http.StatusOK, resp)
+		return
 	}
+	matched := result.matched
+	stats.matches.Add(int64(len(matched)))
 
 	// Return success response with actionStatus and operations
 	resp := Response{
 		ActionStatus: "SUCCESS",
-		Operations:  operations,
+		Operations:  result.operations,
+	}
+	if dryRun {
+		// The operations are computed exactly as normal, but only reported
+		resp = previewOnly(resp)
+		logger.Info("Dry run, returning operations as a preview", "operations", len(resp.PreviewOperations))
 	}
 
+	timing.mark("evaluate")
+	body, err := encodeWithDeadline(resp, buildDeadline)
+	timing.mark("encode")
+	if err != nil {
+		logger.Error("Error encoding response", "error", err)
+		writeErrorResponse(w, http.StatusServiceUnavailable, "server_error", "Response could not be built in time")
+		return
+	}
+	resp, body, err = s.limitResponseSize(logger, resp, body)
+	if err != nil {
+		logger.Error("Error limiting response size", "error", err)
+		writeErrorResponse(w, http.StatusInternalServerError, "server_error", "Response could not be built")
+		return
+	}
+
+	// A dry run issues no token, so there is nothing to audit
+	if !dryRun {
+		s.auditLog.record(newAuditRecord(now, w.Header().Get(requestIDHeader), req, partnerID, resp, matched, result.constraints))
+	}
+	s.scopeConsistency.check(logger, now, req.Event, req.AllowedOperations, partnerIDs, entitlementsData.Entitlements, riskScore, grantedScopes(resp.Operations))
+	s.sampleRecent(now, req, partnerID, resp)
+
+	s.setDecisionTTLHeader(w, matched, now)
+	if s.exposeGrantedScopes {
+		w.Header().Set(grantedScopesHeader, strings.Join(grantedScopes(resp.Operations), " "))
+	}
+	recordActionStatus(w, resp.ActionStatus)
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		log.Printf("Error encoding response: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	if _, err := w.Write(body); err != nil {
+		logger.Warn("Error writing response", "error", err)
+	}
+}
+
+// evaluation is the outcome of matching a request against its candidate entitlements
+type evaluation struct {
+	operations []OperationResponse
+	matched    []Entitlement
+	// denial is the deny entitlement that matched, if any
+	denial *Entitlement
+	// constraints are the constraint outcomes kept for the audit log; only
+	// collected when auditing is enabled
+	constraints []constraintOutcome
+}
+
+// evaluateEntitlements matches req against candidates, in order, and builds the
+// operations for the scopes and claims the matched entitlements grant
+func (s *Server) evaluateEntitlements(logger *slog.Logger, req Request, evalEvent Event, candidates []Entitlement, partners map[string]bool, riskScore float64, now time.Time) evaluation {
+	ops := operationSet{logger: logger}
+	var matched []Entitlement
+	var constraints []constraintOutcome
+	var rechecks []scopeRecheck
+	var audiences []string
+	granted := make(map[string]bool)
+	// Scopes the token already carries are not added again
+	present := make(map[string]bool, len(req.Event.AccessToken.Scopes))
+	for _, scope := range req.Event.AccessToken.Scopes {
+		present[scope] = true
+	}
+	duplicates := 0
+	requested := s.requestedAudiences(req.Event.Request.AdditionalHeaders)
+	resource := s.requestedResource(req.Event)
+	consented := s.consentedScopes(req.Event.AccessToken.Claims)
+
+	for _, entitlement := range candidates {
+		if tag, disabled := s.disabledTags.disabledTag(entitlement); disabled {
+			logger.Info("Skipping entitlement: tag is disabled", "entitlement_id", entitlement.EntitlementID, "tag", tag)
+			continue
+		}
+		satisfied := evaluateConstraints(entitlement.Constraints, evalEvent, now)
+		if s.auditLog != nil && len(entitlement.Constraints) > 0 {
+			constraints = append(constraints, s.constraintOutcome(entitlement, evalEvent, satisfied))
+		}
+		if !satisfied {
+			logger.Debug("Skipping entitlement: constraints not satisfied", "entitlement_id", entitlement.EntitlementID)
+			continue
+		}
+		if entitlement.Effect == effectDeny {
+			logger.Info("Entitlement denies partner", "entitlement_id", entitlement.EntitlementID, "subject_id", entitlement.Subject.ID)
+			return evaluation{denial: &entitlement, constraints: constraints}
+		}
+		if s.riskEvaluator != nil && entitlement.MaxRisk != nil && riskScore > *entitlement.MaxRisk {
+			logger.Info("Skipping entitlement: risk score exceeds maxRisk", "entitlement_id", entitlement.EntitlementID, "risk_score", riskScore, "max_risk", *entitlement.MaxRisk)
+			continue
+		}
+		if !relevantToAudiences(entitlement, requested) {
+			logger.Debug("Skipping entitlement: audience was not requested", "entitlement_id", entitlement.EntitlementID, "audience", entitlement.Audience)
+			continue
+		}
+		if !matchesResource(entitlement.Object, resource) {
+			logger.Debug("Skipping entitlement: object does not match the requested resource", "entitlement_id", entitlement.EntitlementID)
+			continue
+		}
+		scopes, err := s.entitlementScopes(entitlement, evalEvent)
+		if err != nil {
+			logger.Warn("Skipping entitlement: scope could not be built", "entitlement_id", entitlement.EntitlementID, "error", err)
+			continue
+		}
+		// An audience-restricted scope is only granted together with its audience
+		needsAudience := entitlement.Audience != "" && !hasAudience(req.Event.AccessToken.Claims, entitlement.Audience)
+		audienceAllowed := true
+		if needsAudience {
+			op, path := audienceTarget(req.Event.AccessToken.Claims)
+			audienceAllowed = isOperationAllowed(req.AllowedOperations, op, path)
+		}
+		granting := false
+		for _, built := range scopes {
+			scope, err := s.normalizeScope(s.rewriteScope(built))
+			if err != nil {
+				logger.Warn("Dropping scope: invalid scope syntax", "entitlement_id", entitlement.EntitlementID, "error", err)
+				ops.skip(OperationResponse{Op: "add", Path: accessTokenScopesPath, Value: built}, "invalid scope syntax")
+				continue
+			}
+			scope, ok := s.enforceScopeLength(logger, scope, entitlement.EntitlementID)
+			if !ok {
+				ops.skip(OperationResponse{Op: "add", Path: accessTokenScopesPath, Value: scope}, "scope exceeds MAX_SCOPE_LENGTH")
+				continue
+			}
+			scopeOp := OperationResponse{
+				Op:    "add",
+				Path:  accessTokenScopesPath,
+				Value: scope,
+			}
+			if !isOperationAllowed(req.AllowedOperations, scopeOp.Op, scopeOp.Path) {
+				ops.skip(scopeOp, "operation not in allowedOperations")
+				continue
+			}
+			if !audienceAllowed {
+				ops.skip(scopeOp, "audience operation not in allowedOperations")
+				continue
+			}
+			if !consented(scope) {
+				ops.skip(scopeOp, "scope not consented")
+				continue
+			}
+			granting = true
+			// Overlapping partners may be entitled to the same scope; add it once
+			if granted[scope] {
+				logger.Debug("Scope already granted, not adding it again", "scope", scope, "subject_id", entitlement.Subject.ID)
+			} else if present[scope] {
+				granted[scope] = true
+				duplicates++
+				logger.Debug("Scope already on the token, not adding it", "scope", scope, "subject_id", entitlement.Subject.ID)
+			} else {
+				granted[scope] = true
+				ops.apply(scopeOp)
+				logger.Info("Added scope", "scope", scope, "subject_id", entitlement.Subject.ID)
+			}
+
+			if expiry, ok := constraintExpiry(entitlement.Constraints); ok {
+				rechecks = append(rechecks, scopeRecheck{Scope: scope, Exp: expiry.Unix()})
+			}
+
+			// Mirror the scope onto the refresh token so later refreshes keep it
+			if entitlement.PersistToRefreshToken {
+				mirror := OperationResponse{
+					Op:    "add",
+					Path:  refreshTokenScopesPath,
+					Value: scope,
+				}
+				if req.Event.RefreshToken == nil {
+					ops.skip(mirror, "request has no refresh token")
+				} else {
+					ops.applyIfAllowed(req.AllowedOperations, mirror)
+				}
+			}
+		}
+		if !granting {
+			continue
+		}
+		if needsAudience {
+			audiences = append(audiences, entitlement.Audience)
+		}
+		matched = append(matched, entitlement)
+
+		// In first-match mode the highest-priority granting entitlement wins
+		if s.matchFirst {
+			break
+		}
+	}
+	if duplicates > 0 {
+		logger.Info("Suppressed scope operations already on the token", "count", duplicates)
+	}
+	for _, op := range audienceOperations(req.Event.AccessToken.Claims, audiences) {
+		ops.applyIfAllowed(req.AllowedOperations, op)
+	}
+
+	merges, conflicts := claimMerges(matched, req.Event.AccessToken.Claims)
+	for _, name := range conflicts {
+		logger.Warn("Not merging into claim: existing value is not an object", "claim", name)
+	}
+	for _, op := range merges {
+		ops.applyIfAllowed(req.AllowedOperations, op)
+	}
+
+	for _, op := range entitlementClaimOperations(matched, req.Event.AccessToken.Claims) {
+		ops.applyIfAllowed(req.AllowedOperations, op)
+	}
+	for _, op := range s.refreshTokenClaimOperations(req.Event, matched) {
+		ops.applyIfAllowed(req.AllowedOperations, op)
+	}
+
+	for _, op := range claimRemovals(matched, req.Event.AccessToken.Claims) {
+		ops.applyIfAllowed(req.AllowedOperations, op)
+	}
+
+	for _, op := range s.partnerMetadataOperations(matched) {
+		ops.applyIfAllowed(req.AllowedOperations, op)
+	}
+
+	if op, ok := subjectRewriteOperation(logger, matched, req.Event.AccessToken.Claims); ok {
+		ops.applySubjectRewrite(s.allowSubjectRewrite, req.AllowedOperations, op, req.Event.AccessToken.Claims)
+	}
+
+	if notBefore, ok := notBeforeFor(matched, now); ok {
+		ops.applyIfAllowed(req.AllowedOperations, claimOperation(req.Event.AccessToken.Claims, "nbf", notBefore))
+	}
+
+	s.applyRules(&ops, req.AllowedOperations, evalEvent, partners)
+
+	if s.emitScopeRecheckHints && len(rechecks) > 0 {
+		hint := OperationResponse{
+			Op:    "add",
+			Path:  accessTokenClaimsPath,
+			Value: Claim{Name: s.scopeRecheckClaim, Value: rechecks},
+		}
+		ops.applyIfAllowed(req.AllowedOperations, hint)
+	}
+
+	if s.emitScopeSummary {
+		summary := scopeSummary{
+			GrantedScopeCount:   len(grantedScopes(ops.operations)),
+			MatchedEntitlements: entitlementIDs(matched),
+		}
+		ops.applyIfAllowed(req.AllowedOperations, OperationResponse{
+			Op:    "add",
+			Path:  accessTokenClaimsPath,
+			Value: Claim{Name: s.scopeSummaryClaim, Value: summary},
+		})
+	}
+	ops.logOutcomes()
+	return evaluation{operations: ops.operations, matched: matched, constraints: constraints}
+}
+
+// writeJSON writes resp as the JSON action response with the given status code.
+// ERROR responses are written as Problem Details when ERROR_FORMAT asks for it.
+func writeJSON(w http.ResponseWriter, status int, resp Response) {
+	recordActionStatus(w, resp.ActionStatus)
+	if problemErrors && resp.ActionStatus == "ERROR" {
+		writeProblem(w, status, resp)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.Error("Error encoding response", "error", err)
+	}
+}
+
+// writeErrorResponse writes an ERROR action response, so Asgardeo can report the
+// failure reason instead of a generic error
+func writeErrorResponse(w http.ResponseWriter, status int, errMsg string, errDesc string) {
+	writeJSON(w, status, Response{
+		ActionStatus:     "ERROR",
+		ErrorMessage:     errMsg,
+		ErrorDescription: errDesc,
+	})
+}
+
+// getClaimValue returns the value of the named claim
+func getClaimValue(claims []Claim, name string) (interface{}, bool) {
+	for _, claim := range claims {
+		if claim.Name == name {
+			return claim.Value, true
+		}
+	}
+	return nil, false
 }
 
 // getHeaderValue extracts the first value of a header from AdditionalHeaders array
@@ -214,19 +764,111 @@ func getHeaderValue(headers []Header, headerName string) string {
 	return ""
 }
 
-// loadEntitlements loads and parses the entitlements.json file
-func loadEntitlements() (*EntitlementsData, error) {
-	data, err := ioutil.ReadFile("entitlements.json")
-	if err != nil {
-		return nil, fmt.Errorf("failed to read entitlements.json: %w", err)
+// getHeaderValues returns every value of a header from AdditionalHeaders,
+// splitting comma-separated values and dropping empty ones
+func getHeaderValues(headers []Header, headerName string) []string {
+	var values []string
+	for _, header := range headers {
+		if header.Name != headerName {
+			continue
+		}
+		for _, value := range header.Value {
+			for _, part := range strings.Split(value, ",") {
+				if part = strings.TrimSpace(part); part != "" {
+					values = append(values, part)
+				}
+			}
+		}
+	}
+	return values
+}
+
+// notBeforeFor returns the nbf to set for the matched entitlements. When several
+// entitlements delay activation, the latest time wins.
+func notBeforeFor(matched []Entitlement, now time.Time) (int64, bool) {
+	var nbf int64
+	found := false
+	for _, entitlement := range matched {
+		if entitlement.NotBefore == nil {
+			continue
+		}
+		at := entitlement.NotBefore.At
+		if at == 0 {
+			at = now.Unix() + entitlement.NotBefore.OffsetSeconds
+		}
+		if !found || at > nbf {
+			nbf = at
+			found = true
+		}
 	}
+	return nbf, found
+}
 
-	var entitlementsData EntitlementsData
-	if err := json.Unmarshal(data, &entitlementsData); err != nil {
-		return nil, fmt.Errorf("failed to parse entitlements.json: %w", err)
+// setDecisionTTLHeader sets X-Decision-TTL (in seconds) when a decision TTL applies
+func (c *Config) setDecisionTTLHeader(w http.ResponseWriter, matched []Entitlement, now time.Time) {
+	ttl, ok := c.decisionTTL(matched, now)
+	if !ok {
+		return
+	}
+	w.Header().Set(decisionTTLHeader, strconv.Itoa(int(ttl/time.Second)))
+}
+
+// decisionTTL returns the TTL of a decision built from the matched entitlements.
+// Each entitlement contributes its own TTL (or the global one), capped to the
+// expiry of its time-bound constraints; the decision gets the smallest of these.
+func (c *Config) decisionTTL(matched []Entitlement, now time.Time) (time.Duration, bool) {
+	if len(matched) == 0 {
+		return c.defaultDecisionTTL, c.defaultDecisionTTL > 0
+	}
+
+	var ttl time.Duration
+	found := false
+	for _, entitlement := range matched {
+		entTTL := c.defaultDecisionTTL
+		if entitlement.DecisionTTLSeconds > 0 {
+			entTTL = time.Duration(entitlement.DecisionTTLSeconds) * time.Second
+		}
+		hasTTL := entTTL > 0
+
+		if expiry, ok := constraintExpiry(entitlement.Constraints); ok {
+			remaining := expiry.Sub(now)
+			if remaining < 0 {
+				remaining = 0
+			}
+			if !hasTTL || remaining < entTTL {
+				entTTL = remaining
+				hasTTL = true
+			}
+		}
+
+		if hasTTL && (!found || entTTL < ttl) {
+			ttl = entTTL
+			found = true
+		}
+	}
+	return ttl, found
+}
+
+// constraintExpiry reads the "validUntil" (RFC 3339) time-bound constraint
+func constraintExpiry(constraints map[string]interface{}) (time.Time, bool) {
+	raw, ok := constraints["validUntil"].(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	expiry, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		slog.Warn("Ignoring invalid validUntil constraint", "value", raw, "error", err)
+		return time.Time{}, false
 	}
+	return expiry, true
+}
 
-	return &entitlementsData, nil
+// parseDuration accepts a Go duration ("90s", "5m") or a plain number of seconds
+func parseDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
 }
 
 // healthHandler provides a health check endpoint for Envoy gateway
@@ -240,18 +882,276 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	if err := configureLogging(); err != nil {
+		log.Fatalf("Invalid logging configuration: %v", err)
+	}
+	shutdownTracing, err := configureTracing(context.Background())
+	if err != nil {
+		log.Fatalf("Invalid tracing configuration: %v", err)
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8090"
 	}
 
-	http.HandleFunc("/token-validation", handler)
-	// Health check endpoint for Envoy readiness probes
-	http.HandleFunc("/health", healthHandler)
-	http.HandleFunc("/healthz", healthHandler)
-	
+	cfg := defaultConfig()
+
+	// The backend is set up first so the components recording on it, and the
+	// first entitlements load, have it
+	backend, err := newMetrics(os.Getenv("METRICS_BACKEND"))
+	if err != nil {
+		log.Fatalf("Invalid metrics configuration: %v", err)
+	}
+	cfg.metrics = backend
+
+	if ttl := os.Getenv("DECISION_TTL"); ttl != "" {
+		d, err := parseDuration(ttl)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid DECISION_TTL %q", ttl)
+		}
+		cfg.defaultDecisionTTL = d
+	}
+
+	cfg.configureRequestAuth()
+	if err := cfg.configureUnauthenticatedPaths(); err != nil {
+		log.Fatalf("Invalid authentication configuration: %v", err)
+	}
+
+	if err := cfg.configureSubjectClaim(); err != nil {
+		log.Fatalf("Invalid subject configuration: %v", err)
+	}
+	if err := configureSubjectNormalization(); err != nil {
+		log.Fatalf("Invalid subject configuration: %v", err)
+	}
+	if err := cfg.configureDefaultSubject(); err != nil {
+		log.Fatalf("Invalid subject configuration: %v", err)
+	}
+	if err := cfg.configureSubjectSources(); err != nil {
+		log.Fatalf("Invalid subject configuration: %v", err)
+	}
+	if err := cfg.configureConsent(); err != nil {
+		log.Fatalf("Invalid consent configuration: %v", err)
+	}
+
+	cfg.partnerAssertionHeader = os.Getenv("PARTNER_ASSERTION_HEADER")
+	if claim := os.Getenv("PARTNER_ASSERTION_CLAIM"); claim != "" {
+		cfg.partnerAssertionClaim = claim
+	}
+	cfg.partnerAssertionSourceClaim = os.Getenv("PARTNER_ASSERTION_SOURCE_CLAIM")
+	if err := configureRedaction(); err != nil {
+		log.Fatalf("Invalid logging configuration: %v", err)
+	}
+	if err := cfg.configureTimeouts(); err != nil {
+		log.Fatalf("Invalid timeout configuration: %v", err)
+	}
+	cfg.allowUnsignedPartnerAssertions = os.Getenv("PARTNER_ASSERTION_ALLOW_UNSIGNED") == "true"
+	if jwksURL := os.Getenv("PARTNER_ASSERTION_JWKS_URL"); jwksURL != "" {
+		cfg.partnerAssertionVerifier = newJWKSVerifier(jwksURL, cfg.jwksTimeout)
+	} else if cfg.partnerAssertionHeader != "" {
+		if !cfg.allowUnsignedPartnerAssertions {
+			log.Fatalf("PARTNER_ASSERTION_HEADER requires PARTNER_ASSERTION_JWKS_URL (or PARTNER_ASSERTION_ALLOW_UNSIGNED=true)")
+		}
+		slog.Warn("PARTNER_ASSERTION_ALLOW_UNSIGNED is set, partner assertions are not signature-verified")
+	}
+	switch policy := os.Getenv("PARTNER_ASSERTION_POLICY"); policy {
+	case "", "ignore":
+	case "reject":
+		cfg.rejectInvalidPartnerAssertion = true
+	default:
+		log.Fatalf("Invalid PARTNER_ASSERTION_POLICY %q (expected ignore or reject)", policy)
+	}
+
+	if err := cfg.configureBodyLimit(); err != nil {
+		log.Fatalf("Invalid body limit configuration: %v", err)
+	}
+
+	rewrites, err := parseScopePrefixRewrites(os.Getenv("SCOPE_PREFIX_REWRITES"))
+	if err != nil {
+		log.Fatalf("Invalid SCOPE_PREFIX_REWRITES: %v", err)
+	}
+	cfg.scopePrefixRewrites = rewrites
+
+	cfg.emitScopeRecheckHints = os.Getenv("EMIT_SCOPE_RECHECK_HINTS") == "true"
+
+	cfg.requestedAudienceHeader = os.Getenv("REQUESTED_AUDIENCE_HEADER")
+	cfg.resourceHeaderPrefix = os.Getenv("RESOURCE_HEADER_PREFIX")
+	cfg.resourceClaimPrefix = os.Getenv("RESOURCE_CLAIM_PREFIX")
+
+	cfg.exposeGrantedScopes = os.Getenv("EXPOSE_GRANTED_SCOPES") == "true"
+	if cfg.exposeGrantedScopes {
+		slog.Warn("EXPOSE_GRANTED_SCOPES is enabled; do not use this in production")
+	}
+	cfg.allowSubjectRewrite = os.Getenv("ALLOW_SUBJECT_REWRITE") == "true"
+	if cfg.allowSubjectRewrite {
+		slog.Warn("ALLOW_SUBJECT_REWRITE is enabled; entitlements can change the token subject")
+	}
+	if claim := os.Getenv("SCOPE_RECHECK_CLAIM"); claim != "" {
+		cfg.scopeRecheckClaim = claim
+	}
+	cfg.emitScopeSummary = os.Getenv("EMIT_SCOPE_SUMMARY") == "true"
+	cfg.refreshTokenClaims = os.Getenv("REFRESH_TOKEN_CLAIMS") == "true"
+	if claim := os.Getenv("SCOPE_SUMMARY_CLAIM"); claim != "" {
+		cfg.scopeSummaryClaim = claim
+	}
+
+	switch mode := os.Getenv("MATCH_MODE"); mode {
+	case "", "all":
+	case "first":
+		cfg.matchFirst = true
+	default:
+		log.Fatalf("Invalid MATCH_MODE %q (expected all or first)", mode)
+	}
+
+	if err := configureResponseCasing(os.Getenv("RESPONSE_FIELD_CASING")); err != nil {
+		log.Fatalf("Invalid response configuration: %v", err)
+	}
+	if err := configureErrorFormat(); err != nil {
+		log.Fatalf("Invalid response configuration: %v", err)
+	}
+
+	clients, err := parseBypassClients(os.Getenv("BYPASS_CLIENT_IDS"))
+	if err != nil {
+		log.Fatalf("Invalid BYPASS_CLIENT_IDS: %v", err)
+	}
+	cfg.bypassClients = clients
+
+	if err := configureDegradation(); err != nil {
+		log.Fatalf("Invalid degradation configuration: %v", err)
+	}
+
+	if err := cfg.configureConsistency(); err != nil {
+		log.Fatalf("Invalid consistency monitor configuration: %v", err)
+	}
+	if err := cfg.configureOperationsCache(); err != nil {
+		log.Fatalf("Invalid operations cache configuration: %v", err)
+	}
+
+	if err := cfg.configureDiagnostics(); err != nil {
+		log.Fatalf("Invalid diagnostics configuration: %v", err)
+	}
+
+	if err := cfg.configureAudit(); err != nil {
+		log.Fatalf("Invalid audit configuration: %v", err)
+	}
+
+	if err := cfg.configurePreprocessors(os.Getenv("PREPROCESSORS"), os.Getenv("PREPROCESSOR_FAILURE_POLICY")); err != nil {
+		log.Fatalf("Invalid preprocessor configuration: %v", err)
+	}
+
+	if err := cfg.configureRisk(); err != nil {
+		log.Fatalf("Invalid risk configuration: %v", err)
+	}
+
+	if err := cfg.configureRateLimit(); err != nil {
+		log.Fatalf("Invalid rate limit configuration: %v", err)
+	}
+
+	if err := cfg.configureScopeSubject(); err != nil {
+		log.Fatalf("Invalid scope subject configuration: %v", err)
+	}
+	if err := cfg.configureScopeTemplate(); err != nil {
+		log.Fatalf("Invalid scope template: %v", err)
+	}
+
+	if err := cfg.configureScopeSyntax(); err != nil {
+		log.Fatalf("Invalid scope syntax configuration: %v", err)
+	}
+	if err := cfg.configureScopeLength(); err != nil {
+		log.Fatalf("Invalid scope length configuration: %v", err)
+	}
+
+	if err := cfg.configureExpressions(); err != nil {
+		log.Fatalf("Invalid expression configuration: %v", err)
+	}
+
+	if err := configureEntitlements(); err != nil {
+		log.Fatalf("Invalid entitlements configuration: %v", err)
+	}
+	// The store marks the service ready once the default entitlements load, and
+	// shutdown withdraws it. A file left behind by a run that did not shut down
+	// cleanly is removed first, so it cannot claim readiness for this one.
+	readyFile = os.Getenv("READY_FILE")
+	removeReadyFile()
+	if err := configureEntitlementStore(cfg.metrics); err != nil {
+		log.Fatalf("Invalid entitlements configuration: %v", err)
+	}
+	if readyFile != "" {
+		if _, err := defaultEntitlements.get(); err != nil {
+			slog.Warn("Not marking service ready until the entitlements load", "error", err)
+		}
+	}
+	cfg.configureDisabledTags()
+
+	if err := cfg.configureSlowRequests(); err != nil {
+		log.Fatalf("Invalid slow request configuration: %v", err)
+	}
+
+	if err := cfg.configureResponseBuildTimeout(); err != nil {
+		log.Fatalf("Invalid response configuration: %v", err)
+	}
+	if err := cfg.configureResponseLimit(); err != nil {
+		log.Fatalf("Invalid response configuration: %v", err)
+	}
+
+	if err := cfg.configurePartnerMetadata(); err != nil {
+		log.Fatalf("Invalid partner metadata configuration: %v", err)
+	}
+
+	if err := cfg.configureEnrichment(); err != nil {
+		log.Fatalf("Invalid attribute enrichment configuration: %v", err)
+	}
+
+	if err := cfg.configureRules(); err != nil {
+		log.Fatalf("Invalid rules: %v", err)
+	}
+
+	cfg.adminToken = os.Getenv("ADMIN_TOKEN")
+	if cfg.adminToken == "" {
+		slog.Info("ADMIN_TOKEN is not set, admin endpoints are disabled")
+	}
+
+	strictPaths = os.Getenv("STRICT_PATHS") == "true"
+	if err := configureCORS(); err != nil {
+		log.Fatalf("Invalid CORS configuration: %v", err)
+	}
+
 	// Explicitly bind to 0.0.0.0 to ensure Envoy can connect
 	addr := fmt.Sprintf("0.0.0.0:%s", port)
-	log.Printf("Extension service listening on %s...", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	serverCfg, err := loadServerConfig()
+	if err != nil {
+		log.Fatalf("Invalid server configuration: %v", err)
+	}
+	provider, err := configureEntitlementsProvider()
+	if err != nil {
+		log.Fatalf("Invalid entitlements provider configuration: %v", err)
+	}
+	service := NewServerWithConfig(provider, cfg)
+	// Cached evaluations belong to the previous load once entitlements reload
+	defaultEntitlements.onReload(service.operationsCache.purge)
+
+	// Probes, metrics and admin endpoints share the main listener unless
+	// ADMIN_PORT gives them their own
+	public := http.DefaultServeMux
+	admin := public
+	if adminPort := os.Getenv("ADMIN_PORT"); adminPort != "" {
+		admin = http.NewServeMux()
+	}
+	routes(public, admin, service)
+
+	servers := []*http.Server{newServer(addr, recoverPanics(normalizePaths(logRequests(handleCORS(service.authenticate(public))))), serverCfg)}
+	slog.Info("Extension service listening", "addr", addr, "tls", serverCfg.tls != nil)
+	if admin != public {
+		adminAddr := fmt.Sprintf("0.0.0.0:%s", os.Getenv("ADMIN_PORT"))
+		servers = append(servers, newServer(adminAddr, recoverPanics(normalizePaths(logRequests(handleCORS(service.authenticate(admin))))), serverCfg))
+		slog.Info("Admin endpoints listening", "addr", adminAddr, "tls", serverCfg.tls != nil)
+	}
+	if err := serveUntilSignal(servers, serverCfg.shutdownTimeout); err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+	service.auditLog.flush()
+	if err := shutdownTracing(context.Background()); err != nil {
+		slog.Warn("Error flushing traces", "error", err)
+	}
+	slog.Info("Shutdown complete")
 }
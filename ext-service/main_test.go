@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeEntitlements provides a fixed set of entitlements
+type fakeEntitlements struct {
+	data *EntitlementsData
+	err  error
+}
+
+func (f fakeEntitlements) EntitlementsFor(context.Context, EntitlementsQuery) (*EntitlementsData, error) {
+	return f.data, f.err
+}
+
+var errTest = errors.New("test failure")
+
+// testEntitlements grants org_acme the read action
+var testEntitlements = fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{{
+	EntitlementID: "ent_read",
+	Subject:       Subject{Type: "partner", ID: "org_acme"},
+	Action:        "read",
+}}}}
+
+// actionRequest builds a pre-issue access token request body with the given
+// additional headers, allowing scope additions
+func actionRequest(t *testing.T, headers ...Header) string {
+	t.Helper()
+	req := Request{
+		ActionType: actionPreIssueAccessToken,
+		Event: Event{
+			Request: RequestData{
+				ClientID:          "client",
+				GrantType:         "client_credentials",
+				AdditionalHeaders: headers,
+			},
+			AccessToken: AccessToken{Scopes: []string{}},
+		},
+		AllowedOperations: []Operation{{Op: "add", Paths: []string{accessTokenScopesPath}}},
+	}
+	return marshalRequest(t, req)
+}
+
+// marshalRequest encodes req as a request body
+func marshalRequest(t *testing.T, req Request) string {
+	t.Helper()
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("marshal request: %v", err)
+	}
+	return string(body)
+}
+
+// serve sends body to the server's handler with method and decodes the response
+func serve(t *testing.T, s *Server, method string, body string) (*httptest.ResponseRecorder, Response) {
+	t.Helper()
+	return serveRequest(t, s, httptest.NewRequest(method, "/token-validation", strings.NewReader(body)))
+}
+
+// serveRequest sends r to the server's handler and decodes the response
+func serveRequest(t *testing.T, s *Server, r *http.Request) (*httptest.ResponseRecorder, Response) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.handler(rec, r)
+
+	var resp Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response %q: %v", rec.Body.String(), err)
+	}
+	return rec, resp
+}
+
+// partnerHeader is the additional header naming the partner id
+func partnerHeader(id string) Header {
+	return Header{Name: "x-b2b-usp-partner", Value: []string{id}}
+}
+
+func TestHandlerMissingPartnerHeader(t *testing.T) {
+	rec, resp := serve(t, NewServer(testEntitlements), http.MethodPost, actionRequest(t))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if resp.ActionStatus != "SUCCESS" || len(resp.Operations) != 0 {
+		t.Errorf("response = %+v, want SUCCESS without operations", resp)
+	}
+}
+
+func TestHandlerMatchingEntitlementAddsScope(t *testing.T) {
+	rec, resp := serve(t, NewServer(testEntitlements), http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if resp.ActionStatus != "SUCCESS" {
+		t.Fatalf("actionStatus = %q, want SUCCESS", resp.ActionStatus)
+	}
+	if scopes := grantedScopes(resp.Operations); len(scopes) != 1 || scopes[0] != "partner:read" {
+		t.Errorf("granted scopes = %v, want [partner:read]", scopes)
+	}
+}
+
+func TestHandlerNoMatchingEntitlement(t *testing.T) {
+	rec, resp := serve(t, NewServer(testEntitlements), http.MethodPost, actionRequest(t, partnerHeader("org_other")))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if resp.ActionStatus != "SUCCESS" || len(resp.Operations) != 0 {
+		t.Errorf("response = %+v, want SUCCESS without operations", resp)
+	}
+}
+
+func TestHandlerMalformedBody(t *testing.T) {
+	rec, resp := serve(t, NewServer(testEntitlements), http.MethodPost, `{"actionType":`)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if resp.ActionStatus != "ERROR" || resp.ErrorMessage != "invalid_request" {
+		t.Errorf("response = %+v, want ERROR invalid_request", resp)
+	}
+}
+
+func TestHandlerWrongMethod(t *testing.T) {
+	rec, resp := serve(t, NewServer(testEntitlements), http.MethodGet, "")
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+	if resp.ActionStatus != "ERROR" {
+		t.Errorf("actionStatus = %q, want ERROR", resp.ActionStatus)
+	}
+}
+
+func TestHandlerEntitlementsUnavailable(t *testing.T) {
+	s := NewServer(fakeEntitlements{err: errTest})
+	rec, resp := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	if resp.ActionStatus != "ERROR" || resp.ErrorMessage != "server_error" {
+		t.Errorf("response = %+v, want ERROR server_error", resp)
+	}
+}
+
+// defaultSubjectServer returns a server over defaultSubjectEntitlements that
+// matches subject when a request resolves none
+func defaultSubjectServer(subject Subject) *Server {
+	s := NewServer(defaultSubjectEntitlements)
+	s.defaultSubject = &subject
+	return s
+}
+
+// defaultSubjectEntitlements grants org_acme read and the anonymous default
+// subject baseline
+var defaultSubjectEntitlements = fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{
+	{EntitlementID: "ent_read", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "read"},
+	{EntitlementID: "ent_baseline", Subject: Subject{Type: "anonymous", ID: "default"}, Action: "baseline"},
+}}}
+
+func TestHandlerDefaultSubjectWithoutPartner(t *testing.T) {
+	_, resp := serve(t, defaultSubjectServer(Subject{Type: "anonymous", ID: "default"}), http.MethodPost, actionRequest(t))
+
+	if scopes := grantedScopes(resp.Operations); len(scopes) != 1 || scopes[0] != "anonymous:baseline" {
+		t.Errorf("granted scopes = %v, want [anonymous:baseline]", scopes)
+	}
+}
+
+func TestHandlerDefaultSubjectIgnoredWithPartner(t *testing.T) {
+	_, resp := serve(t, defaultSubjectServer(Subject{Type: "anonymous", ID: "default"}), http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+
+	if scopes := grantedScopes(resp.Operations); len(scopes) != 1 || scopes[0] != "partner:read" {
+		t.Errorf("granted scopes = %v, want [partner:read]", scopes)
+	}
+}
+
+func TestHandlerNoDefaultSubjectWithoutPartner(t *testing.T) {
+	_, resp := serve(t, NewServer(defaultSubjectEntitlements), http.MethodPost, actionRequest(t))
+
+	if len(resp.Operations) != 0 {
+		t.Errorf("operations = %+v, want none", resp.Operations)
+	}
+}
+
+func TestHandlerSkipsScopesAlreadyOnToken(t *testing.T) {
+	provider := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{
+		{EntitlementID: "ent_read", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "read"},
+		{EntitlementID: "ent_write", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "write"},
+	}}}
+	req := Request{
+		ActionType: actionPreIssueAccessToken,
+		Event: Event{
+			Request:     RequestData{AdditionalHeaders: []Header{partnerHeader("org_acme")}},
+			AccessToken: AccessToken{Scopes: []string{"openid", "partner:read"}},
+		},
+		AllowedOperations: []Operation{{Op: "add", Paths: []string{accessTokenScopesPath}}},
+	}
+
+	_, resp := serve(t, NewServer(provider), http.MethodPost, marshalRequest(t, req))
+
+	if scopes := grantedScopes(resp.Operations); len(scopes) != 1 || scopes[0] != "partner:write" {
+		t.Errorf("granted scopes = %v, want [partner:write]", scopes)
+	}
+}
+
+func TestHandlerTreatsMissingScopesAsEmpty(t *testing.T) {
+	empty := actionRequest(t, partnerHeader("org_acme"))
+	bodies := map[string]string{
+		"null":    strings.Replace(empty, `"scopes":[]`, `"scopes":null`, 1),
+		"missing": strings.Replace(empty, `"scopes":[],`, ``, 1),
+	}
+	_, want := serve(t, NewServer(testEntitlements), http.MethodPost, empty)
+
+	for name, body := range bodies {
+		if body == empty {
+			t.Fatalf("%s: request body was not rewritten: %s", name, body)
+		}
+		_, resp := serve(t, NewServer(testEntitlements), http.MethodPost, body)
+		if mustJSON(t, resp) != mustJSON(t, want) {
+			t.Errorf("%s scopes: response = %s, want %s", name, mustJSON(t, resp), mustJSON(t, want))
+		}
+	}
+}
+
+func TestDecisionTTL(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	expiring := func(d time.Duration) Entitlement {
+		return Entitlement{Constraints: map[string]interface{}{"validUntil": now.Add(d).Format(time.RFC3339)}}
+	}
+
+	tests := []struct {
+		name       string
+		defaultTTL time.Duration
+		matched    []Entitlement
+		want       time.Duration
+		wantOK     bool
+	}{
+		{"no TTL", 0, []Entitlement{{}}, 0, false},
+		{"default TTL", time.Hour, []Entitlement{{}}, time.Hour, true},
+		{"entitlement TTL", time.Hour, []Entitlement{{DecisionTTLSeconds: 60}}, time.Minute, true},
+		{"expiry caps default", time.Hour, []Entitlement{expiring(10 * time.Minute)}, 10 * time.Minute, true},
+		{"expiry without default", 0, []Entitlement{expiring(10 * time.Minute)}, 10 * time.Minute, true},
+		{"soonest expiry wins", time.Hour, []Entitlement{expiring(30 * time.Minute), expiring(10 * time.Minute)}, 10 * time.Minute, true},
+		{"later expiry keeps default", time.Hour, []Entitlement{expiring(2 * time.Hour)}, time.Hour, true},
+	}
+	for _, tt := range tests {
+		cfg := defaultConfig()
+		cfg.defaultDecisionTTL = tt.defaultTTL
+		got, ok := cfg.decisionTTL(tt.matched, now)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("%s: decisionTTL = %v, %v, want %v, %v", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestHandlerDecisionTTLHeaderUsesSoonestExpiry(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	withClock(t, now)
+	provider := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{
+		{
+			EntitlementID: "ent_read",
+			Subject:       Subject{Type: "partner", ID: "org_acme"},
+			Action:        "read",
+			Constraints:   map[string]interface{}{"validUntil": now.Add(30 * time.Minute).Format(time.RFC3339)},
+		},
+		{
+			EntitlementID: "ent_write",
+			Subject:       Subject{Type: "partner", ID: "org_acme"},
+			Action:        "write",
+			Constraints:   map[string]interface{}{"validUntil": now.Add(10 * time.Minute).Format(time.RFC3339)},
+		},
+	}}}
+
+	s := NewServer(provider)
+	s.defaultDecisionTTL = time.Hour
+
+	rec, _ := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+
+	if got := rec.Header().Get(decisionTTLHeader); got != "600" {
+		t.Errorf("%s = %q, want %q", decisionTTLHeader, got, "600")
+	}
+}
+
+func TestHandlerExposesGrantedScopesWhenEnabled(t *testing.T) {
+	provider := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{
+		{EntitlementID: "ent_read", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "read"},
+		{EntitlementID: "ent_write", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "write"},
+	}}}
+	s := NewServer(provider)
+
+	rec, _ := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+	if _, ok := rec.Header()[grantedScopesHeader]; ok {
+		t.Errorf("%s = %q, want it absent by default", grantedScopesHeader, rec.Header().Get(grantedScopesHeader))
+	}
+
+	s.exposeGrantedScopes = true
+	rec, _ = serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+	if got := rec.Header().Get(grantedScopesHeader); got != "partner:read partner:write" {
+		t.Errorf("%s = %q, want the granted scopes", grantedScopesHeader, got)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// metadataClaim maps a partner metadata field of an entitlement to a token claim
+type metadataClaim struct {
+	Field string
+	Claim string
+}
+
+// parsePartnerMetadataClaims parses PARTNER_METADATA_CLAIMS, a comma-separated
+// list of "field" or "field:claim" entries, e.g. "name:partner_name,tier,region"
+func parsePartnerMetadataClaims(value string) ([]metadataClaim, error) {
+	var claims []metadataClaim
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		field, claim, hasClaim := strings.Cut(entry, ":")
+		if !hasClaim {
+			claim = field
+		}
+		if field == "" || claim == "" {
+			return nil, fmt.Errorf("invalid PARTNER_METADATA_CLAIMS entry %q (expected field or field:claim)", entry)
+		}
+		claims = append(claims, metadataClaim{Field: field, Claim: claim})
+	}
+	return claims, nil
+}
+
+// configurePartnerMetadata reads PARTNER_METADATA_CLAIMS
+func (c *Config) configurePartnerMetadata() error {
+	claims, err := parsePartnerMetadataClaims(os.Getenv("PARTNER_METADATA_CLAIMS"))
+	if err != nil {
+		return err
+	}
+	c.partnerMetadataClaims = claims
+	return nil
+}
+
+// partnerMetadataOperations returns add operations for the configured metadata
+// fields of the matched entitlements. When several entitlements supply a field,
+// the highest priority one wins (the first matched on a tie).
+func (c *Config) partnerMetadataOperations(matched []Entitlement) []OperationResponse {
+	var ops []OperationResponse
+	for _, mc := range c.partnerMetadataClaims {
+		var value interface{}
+		found := false
+		priority := 0
+		for _, entitlement := range matched {
+			v, ok := entitlement.PartnerMetadata[mc.Field]
+			if !ok || (found && entitlement.Priority <= priority) {
+				continue
+			}
+			value, priority, found = v, entitlement.Priority, true
+		}
+		if found {
+			ops = append(ops, OperationResponse{
+				Op:    "add",
+				Path:  accessTokenClaimsPath,
+				Value: Claim{Name: mc.Claim, Value: value},
+			})
+		}
+	}
+	return ops
+}
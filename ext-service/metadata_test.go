@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHandlerEmitsPartnerMetadataClaims(t *testing.T) {
+	provider := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{
+		{
+			EntitlementID:   "ent_read",
+			Subject:         Subject{Type: "partner", ID: "org_acme"},
+			Action:          "read",
+			PartnerMetadata: map[string]interface{}{"name": "Acme", "tier": "silver", "region": "eu"},
+		},
+		{
+			EntitlementID:   "ent_write",
+			Subject:         Subject{Type: "partner", ID: "org_acme"},
+			Action:          "write",
+			Priority:        10,
+			PartnerMetadata: map[string]interface{}{"tier": "gold", "internal": "not emitted"},
+		},
+	}}}
+	s := NewServer(provider)
+	claims, err := parsePartnerMetadataClaims("name:partner_name, tier, region")
+	if err != nil {
+		t.Fatalf("parsePartnerMetadataClaims: %v", err)
+	}
+	s.partnerMetadataClaims = claims
+	req := Request{
+		ActionType: actionPreIssueAccessToken,
+		Event: Event{
+			Request:     RequestData{AdditionalHeaders: []Header{partnerHeader("org_acme")}},
+			AccessToken: AccessToken{Scopes: []string{}},
+		},
+		AllowedOperations: []Operation{{Op: "add", Paths: []string{accessTokenScopesPath, accessTokenClaimsPath}}},
+	}
+
+	body := serveRaw(s, marshalRequest(t, req))
+
+	for _, want := range []string{
+		`{"op":"add","path":"/accessToken/claims/-","value":{"name":"partner_name","value":"Acme"}}`,
+		`{"op":"add","path":"/accessToken/claims/-","value":{"name":"tier","value":"gold"}}`,
+		`{"op":"add","path":"/accessToken/claims/-","value":{"name":"region","value":"eu"}}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("response = %s, want %s", body, want)
+		}
+	}
+	// Only the highest priority tier is emitted, and unconfigured fields never are
+	if n := strings.Count(body, `"name":"tier"`); n != 1 {
+		t.Errorf("tier claims = %d, want 1", n)
+	}
+	if strings.Contains(body, "internal") {
+		t.Errorf("response = %s, want unconfigured metadata left out", body)
+	}
+}
+
+func TestPartnerMetadataTieKeepsFirstMatch(t *testing.T) {
+	c := Config{partnerMetadataClaims: []metadataClaim{{Field: "tier", Claim: "tier"}}}
+	matched := []Entitlement{
+		{PartnerMetadata: map[string]interface{}{"tier": "silver"}},
+		{PartnerMetadata: map[string]interface{}{"tier": "gold"}},
+	}
+
+	ops := c.partnerMetadataOperations(matched)
+
+	if got := mustJSON(t, ops); got != `[{"op":"add","path":"/accessToken/claims/-","value":{"name":"tier","value":"silver"}}]` {
+		t.Errorf("operations = %s, want the first entitlement's tier", got)
+	}
+}
+
+func TestParsePartnerMetadataClaimsRejectsEmptyNames(t *testing.T) {
+	for _, value := range []string{":partner_name", "name:"} {
+		if _, err := parsePartnerMetadataClaims(value); err == nil {
+			t.Errorf("parsePartnerMetadataClaims accepted %q", value)
+		}
+	}
+}
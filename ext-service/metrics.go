@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metric names recorded by the service
+const (
+	metricRequestsTotal        = "http_requests_total"
+	metricRequestDuration      = "http_request_duration_seconds"
+	metricRequestsActive       = "http_requests_in_flight"
+	metricScopeInconsistencies = "scope_inconsistencies_total"
+	metricDecisionsTotal       = "token_decisions_total"
+	metricPhaseDuration        = "request_phase_duration_seconds"
+	metricEntitlementsLoaded   = "entitlements_loaded"
+	metricOperationsCache      = "operations_cache_lookups_total"
+)
+
+// metricHelp describes each metric for backends that expose help text
+var metricHelp = map[string]string{
+	metricRequestsTotal:        "HTTP requests handled, by path and status code.",
+	metricRequestDuration:      "HTTP request latency in seconds, by path.",
+	metricRequestsActive:       "HTTP requests currently being handled.",
+	metricScopeInconsistencies: "Decisions granting different scopes than an earlier decision with the same inputs.",
+	metricDecisionsTotal:       "Action requests handled, by action type and outcome (success, denied or error).",
+	metricPhaseDuration:        "Time spent in each phase of an action request in seconds, by phase.",
+	metricEntitlementsLoaded:   "Entitlements in the loaded generation, by source.",
+	metricOperationsCache:      "Operations cache lookups, by result (hit or miss).",
+}
+
+// maxLabels is the most labels a single metric can carry
+const maxLabels = 3
+
+// Label is a metric label name and value
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Labels is a fixed-size label set. It is passed by value so that recording a
+// metric through the interface does not allocate; unused entries are left empty.
+type Labels [maxLabels]Label
+
+// Metrics records service instrumentation on a pluggable backend
+type Metrics interface {
+	// IncCounter adds one to a counter
+	IncCounter(name string, labels Labels)
+	// ObserveHistogram records a sample in a histogram
+	ObserveHistogram(name string, value float64, labels Labels)
+	// SetGauge sets a gauge to value
+	SetGauge(name string, value float64, labels Labels)
+}
+
+// newMetrics creates the backend selected by METRICS_BACKEND
+func newMetrics(backend string) (Metrics, error) {
+	switch backend {
+	case "", "none":
+		return noopMetrics{}, nil
+	case "prometheus":
+		return newPrometheusMetrics(), nil
+	case "statsd":
+		addr := os.Getenv("STATSD_ADDR")
+		if addr == "" {
+			addr = "127.0.0.1:8125"
+		}
+		return newStatsdMetrics(addr, os.Getenv("STATSD_PREFIX"))
+	default:
+		return nil, fmt.Errorf("unknown METRICS_BACKEND %q (expected none, prometheus or statsd)", backend)
+	}
+}
+
+// noopMetrics discards every metric
+type noopMetrics struct{}
+
+func (noopMetrics) IncCounter(string, Labels)                {}
+func (noopMetrics) ObserveHistogram(string, float64, Labels) {}
+func (noopMetrics) SetGauge(string, float64, Labels)         {}
+
+// prometheusMetrics records metrics in a Prometheus registry. Metric vectors are
+// created on first use from the label names of that first sample.
+type prometheusMetrics struct {
+	registry *prometheus.Registry
+
+	mu         sync.Mutex
+	counters   map[string]*prometheus.CounterVec
+	histograms map[string]*prometheus.HistogramVec
+	gauges     map[string]*prometheus.GaugeVec
+}
+
+// newPrometheusMetrics creates a backend with its own registry
+func newPrometheusMetrics() *prometheusMetrics {
+	return &prometheusMetrics{
+		registry:   prometheus.NewRegistry(),
+		counters:   make(map[string]*prometheus.CounterVec),
+		histograms: make(map[string]*prometheus.HistogramVec),
+		gauges:     make(map[string]*prometheus.GaugeVec),
+	}
+}
+
+// handler serves the registry in the Prometheus exposition format
+func (m *prometheusMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *prometheusMetrics) IncCounter(name string, labels Labels) {
+	m.mu.Lock()
+	vec, ok := m.counters[name]
+	if !ok {
+		vec = prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: metricHelp[name]}, labelNames(labels))
+		m.registry.MustRegister(vec)
+		m.counters[name] = vec
+	}
+	m.mu.Unlock()
+	vec.WithLabelValues(labelValues(labels)...).Inc()
+}
+
+func (m *prometheusMetrics) ObserveHistogram(name string, value float64, labels Labels) {
+	m.mu.Lock()
+	vec, ok := m.histograms[name]
+	if !ok {
+		vec = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: metricHelp[name]}, labelNames(labels))
+		m.registry.MustRegister(vec)
+		m.histograms[name] = vec
+	}
+	m.mu.Unlock()
+	vec.WithLabelValues(labelValues(labels)...).Observe(value)
+}
+
+func (m *prometheusMetrics) SetGauge(name string, value float64, labels Labels) {
+	m.mu.Lock()
+	vec, ok := m.gauges[name]
+	if !ok {
+		vec = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: metricHelp[name]}, labelNames(labels))
+		m.registry.MustRegister(vec)
+		m.gauges[name] = vec
+	}
+	m.mu.Unlock()
+	vec.WithLabelValues(labelValues(labels)...).Set(value)
+}
+
+// labelNames returns the names of the set labels
+func labelNames(labels Labels) []string {
+	var names []string
+	for _, label := range labels {
+		if label.Name != "" {
+			names = append(names, label.Name)
+		}
+	}
+	return names
+}
+
+// labelValues returns the values of the set labels
+func labelValues(labels Labels) []string {
+	var values []string
+	for _, label := range labels {
+		if label.Name != "" {
+			values = append(values, label.Value)
+		}
+	}
+	return values
+}
+
+// statsdMetrics sends metrics over UDP using the StatsD line protocol with
+// DogStatsD-style tags. Sends are fire-and-forget.
+type statsdMetrics struct {
+	conn   net.Conn
+	prefix string
+}
+
+// newStatsdMetrics creates a backend sending to addr
+func newStatsdMetrics(addr string, prefix string) (*statsdMetrics, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to StatsD at %s: %w", addr, err)
+	}
+	return &statsdMetrics{conn: conn, prefix: prefix}, nil
+}
+
+func (m *statsdMetrics) IncCounter(name string, labels Labels) {
+	m.send(name, "1", "c", labels)
+}
+
+func (m *statsdMetrics) ObserveHistogram(name string, value float64, labels Labels) {
+	m.send(name, strconv.FormatFloat(value, 'f', -1, 64), "h", labels)
+}
+
+func (m *statsdMetrics) SetGauge(name string, value float64, labels Labels) {
+	m.send(name, strconv.FormatFloat(value, 'f', -1, 64), "g", labels)
+}
+
+// send writes a single StatsD line
+func (m *statsdMetrics) send(name string, value string, kind string, labels Labels) {
+	var line strings.Builder
+	line.WriteString(m.prefix)
+	line.WriteString(name)
+	line.WriteString(":")
+	line.WriteString(value)
+	line.WriteString("|")
+	line.WriteString(kind)
+
+	first := true
+	for _, label := range labels {
+		if label.Name == "" {
+			continue
+		}
+		if first {
+			line.WriteString("|#")
+			first = false
+		} else {
+			line.WriteString(",")
+		}
+		line.WriteString(label.Name)
+		line.WriteString(":")
+		line.WriteString(label.Value)
+	}
+
+	if _, err := m.conn.Write([]byte(line.String())); err != nil {
+		slog.Warn("Error sending StatsD metric", "metric", name, "error", err)
+	}
+}
+
+// inFlightRequests counts requests currently being handled
+var inFlightRequests atomic.Int64
+
+// statusRecorder captures the status code written by a handler, and the action
+// type and action status of the response when the handler notes them
+type statusRecorder struct {
+	http.ResponseWriter
+	status       int
+	actionType   string
+	actionStatus string
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// recordActionType notes the decoded action type on an instrumented response
+func recordActionType(w http.ResponseWriter, actionType string) {
+	if rec, ok := w.(*statusRecorder); ok {
+		rec.actionType = actionType
+	}
+}
+
+// recordActionStatus notes the action status written on an instrumented response
+func recordActionStatus(w http.ResponseWriter, actionStatus string) {
+	if rec, ok := w.(*statusRecorder); ok {
+		rec.actionStatus = actionStatus
+	}
+}
+
+// decisionOutcome classifies a response as success, denied or error
+func decisionOutcome(status int, actionStatus string) string {
+	switch {
+	case status >= http.StatusBadRequest || actionStatus == "ERROR":
+		return "error"
+	case actionStatus == "FAILED":
+		return "denied"
+	default:
+		return "success"
+	}
+}
+
+// instrument records request count, latency and in-flight requests for path, and
+// logs requests slower than SLOW_REQUEST_MS
+func (s *Server) instrument(path string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		s.metrics.SetGauge(metricRequestsActive, float64(inFlightRequests.Add(1)), Labels{})
+		defer func() {
+			s.metrics.SetGauge(metricRequestsActive, float64(inFlightRequests.Add(-1)), Labels{})
+		}()
+
+		ctx, timing := withRequestTiming(r.Context(), start, s.metrics)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r.WithContext(ctx))
+
+		end := time.Now()
+		timing.logIfSlow(loggerFrom(ctx), s.slowRequestThreshold, path, rec.status, end)
+		recentErrors.record(end, rec.status >= http.StatusInternalServerError)
+		s.metrics.IncCounter(metricRequestsTotal, Labels{{"path", path}, {"status", strconv.Itoa(rec.status)}})
+		s.metrics.ObserveHistogram(metricRequestDuration, end.Sub(start).Seconds(), Labels{{"path", path}})
+		actionType := rec.actionType
+		if actionType == "" {
+			actionType = "unknown"
+		}
+		s.metrics.IncCounter(metricDecisionsTotal, Labels{{"action_type", actionType}, {"outcome", decisionOutcome(rec.status, rec.actionStatus)}})
+	}
+}
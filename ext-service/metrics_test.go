@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingMetrics records every metric as a "kind name labels" line
+type recordingMetrics struct {
+	mu      sync.Mutex
+	samples []string
+}
+
+func (m *recordingMetrics) record(kind string, name string, labels Labels) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples = append(m.samples, kind+" "+name+" "+strings.Join(labelValues(labels), ","))
+}
+
+func (m *recordingMetrics) IncCounter(name string, labels Labels) {
+	m.record("counter", name, labels)
+}
+
+func (m *recordingMetrics) ObserveHistogram(name string, _ float64, labels Labels) {
+	m.record("histogram", name, labels)
+}
+
+func (m *recordingMetrics) SetGauge(name string, _ float64, labels Labels) {
+	m.record("gauge", name, labels)
+}
+
+// has reports whether the sample was recorded
+func (m *recordingMetrics) has(sample string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.samples {
+		if s == sample {
+			return true
+		}
+	}
+	return false
+}
+
+func TestNoopMetricsDoesNotAllocate(t *testing.T) {
+	var m Metrics = noopMetrics{}
+	labels := Labels{{"path", "/token-validation"}, {"status", "200"}}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		m.IncCounter(metricRequestsTotal, labels)
+		m.ObserveHistogram(metricRequestDuration, 0.25, labels)
+		m.SetGauge(metricRequestsActive, 1, Labels{})
+	})
+	if allocs != 0 {
+		t.Errorf("allocations per run = %v, want 0", allocs)
+	}
+}
+
+func TestInstrumentRecordsThroughMetricsInterface(t *testing.T) {
+	s := NewServer(testEntitlements)
+	recording := &recordingMetrics{}
+	s.metrics = recording
+
+	rec := httptest.NewRecorder()
+	s.instrument("/token-validation", s.handler)(rec, httptest.NewRequest(http.MethodPost, "/token-validation", strings.NewReader(actionRequest(t, partnerHeader("org_acme")))))
+
+	for _, want := range []string{
+		"counter " + metricRequestsTotal + " /token-validation,200",
+		"histogram " + metricRequestDuration + " /token-validation",
+		"counter " + metricDecisionsTotal + " PRE_ISSUE_ACCESS_TOKEN,success",
+		"gauge " + metricRequestsActive + " ",
+	} {
+		if !recording.has(want) {
+			t.Errorf("samples = %q, want %q", recording.samples, want)
+		}
+	}
+}
+
+func TestStatsdMetricsSendsTaggedLines(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	m, err := newStatsdMetrics(conn.LocalAddr().String(), "ext.")
+	if err != nil {
+		t.Fatalf("newStatsdMetrics: %v", err)
+	}
+
+	m.IncCounter(metricRequestsTotal, Labels{{"path", "/token-validation"}, {"status", "200"}})
+	m.ObserveHistogram(metricRequestDuration, 0.5, Labels{{"path", "/token-validation"}})
+	m.SetGauge(metricRequestsActive, 3, Labels{})
+
+	buf := make([]byte, 512)
+	for _, want := range []string{
+		"ext." + metricRequestsTotal + ":1|c|#path:/token-validation,status:200",
+		"ext." + metricRequestDuration + ":0.5|h|#path:/token-validation",
+		"ext." + metricRequestsActive + ":3|g",
+	} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if got := string(buf[:n]); got != want {
+			t.Errorf("line = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestNewMetricsSelectsBackend(t *testing.T) {
+	t.Setenv("STATSD_ADDR", "127.0.0.1:8125")
+	tests := []struct {
+		backend string
+		check   func(Metrics) bool
+	}{
+		{"", func(m Metrics) bool { _, ok := m.(noopMetrics); return ok }},
+		{"none", func(m Metrics) bool { _, ok := m.(noopMetrics); return ok }},
+		{"prometheus", func(m Metrics) bool { _, ok := m.(*prometheusMetrics); return ok }},
+		{"statsd", func(m Metrics) bool { _, ok := m.(*statsdMetrics); return ok }},
+	}
+	for _, tt := range tests {
+		m, err := newMetrics(tt.backend)
+		if err != nil || !tt.check(m) {
+			t.Errorf("newMetrics(%q) = %T, %v", tt.backend, m, err)
+		}
+	}
+	if _, err := newMetrics("otel"); err == nil {
+		t.Error("newMetrics accepted an unknown backend")
+	}
+}
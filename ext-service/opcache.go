@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// evaluationCache maps a fingerprint of everything an evaluation depends on to
+// its outcome. It is purged whenever entitlements reload or the disabled tags
+// change; per-tenant entitlements are part of the fingerprint by load.
+type evaluationCache struct {
+	entries *lruCache[string, evaluation]
+	metrics Metrics
+	// inputs are the claims and headers the last keyed load refers to
+	inputs atomic.Pointer[evaluationInputs]
+}
+
+// configureOperationsCache reads OPERATIONS_CACHE_SIZE. Hits and misses are
+// counted on the configured metrics backend.
+func (c *Config) configureOperationsCache() error {
+	v := os.Getenv("OPERATIONS_CACHE_SIZE")
+	if v == "" {
+		return nil
+	}
+	size, err := strconv.Atoi(v)
+	if err != nil || size < 0 {
+		return fmt.Errorf("invalid OPERATIONS_CACHE_SIZE %q", v)
+	}
+	if size > 0 {
+		c.operationsCache = newEvaluationCache(size, c.metrics)
+	}
+	return nil
+}
+
+// newEvaluationCache creates a cache holding at most size evaluations, counting
+// lookups on m
+func newEvaluationCache(size int, m Metrics) *evaluationCache {
+	return &evaluationCache{entries: newLRUCache[string, evaluation](size, 0), metrics: m}
+}
+
+// evaluationInputs are the claims and headers whose values evaluations against
+// one entitlements load can read. Every other claim only matters by name, for
+// operations that add, replace or remove it by position. all is set when a
+// scopes expression can read any claim or header.
+type evaluationInputs struct {
+	data    *EntitlementsData
+	claims  map[string]bool
+	headers map[string]bool
+	all     bool
+}
+
+// evaluationInputsFor collects the claims and headers read by the constraints,
+// scopes expressions, mergeClaims and audiences of data, and by the rules,
+// consent claim and audience header of c
+func (c *Config) evaluationInputsFor(data *EntitlementsData) *evaluationInputs {
+	inputs := &evaluationInputs{
+		data:    data,
+		claims:  map[string]bool{"aud": true},
+		headers: make(map[string]bool),
+	}
+	if c.consentClaim != "" {
+		inputs.claims[c.consentClaim] = true
+	}
+	if c.requestedAudienceHeader != "" {
+		inputs.headers[c.requestedAudienceHeader] = true
+	}
+	for _, r := range c.rules {
+		for name := range r.When.Claims {
+			inputs.claims[name] = true
+		}
+		for name := range r.When.Headers {
+			inputs.headers[name] = true
+		}
+	}
+	for _, entitlement := range data.Entitlements {
+		if entitlement.ScopesExpression != "" {
+			inputs.all = true
+		}
+		for name := range entitlement.MergeClaims {
+			inputs.claims[name] = true
+		}
+		constraints := entitlement.Constraints
+		if name, ok := constraints["header"].(string); ok {
+			inputs.headers[name] = true
+		}
+		for _, key := range []string{"headersAll", "headersAny"} {
+			headers, _ := constraints[key].(map[string]interface{})
+			for name := range headers {
+				inputs.headers[name] = true
+			}
+		}
+		claims, _ := constraints["claims"].(map[string]interface{})
+		for name := range claims {
+			inputs.claims[name] = true
+		}
+	}
+	return inputs
+}
+
+// readsClaim reports whether an evaluation can read the value of the named claim
+func (in *evaluationInputs) readsClaim(c *Config, name string) bool {
+	if in.all || in.claims[name] {
+		return true
+	}
+	return c.resourceClaimPrefix != "" && strings.HasPrefix(name, c.resourceClaimPrefix)
+}
+
+// readsHeader reports whether an evaluation can read the value of the named header
+func (in *evaluationInputs) readsHeader(c *Config, name string) bool {
+	if in.all || in.headers[name] {
+		return true
+	}
+	return c.resourceHeaderPrefix != "" && strings.HasPrefix(name, c.resourceHeaderPrefix)
+}
+
+// key fingerprints what an evaluation reads: the entitlements load, the
+// subjects, the risk score, the grant type, the requested scopes, the
+// allowedOperations, the claim names in order and the values of the claims
+// (including enriched attributes) and headers the load and rules refer to.
+// Unlike the consistency fingerprint nothing the evaluation reads is left out,
+// since a hit replaces evaluation. It reports false when the cache is disabled,
+// the entitlements are live or the inputs cannot be encoded.
+func (c *evaluationCache) key(cfg *Config, data *EntitlementsData, req Request, evalEvent Event, partnerIDs []string, subjects map[Subject]bool, riskScore float64) (string, bool) {
+	if c == nil || data.live {
+		return "", false
+	}
+	referenced := c.inputs.Load()
+	if referenced == nil || referenced.data != data {
+		referenced = cfg.evaluationInputsFor(data)
+		c.inputs.Store(referenced)
+	}
+
+	keys := make([]string, 0, len(subjects))
+	for subject := range subjects {
+		keys = append(keys, subjectKey(subject))
+	}
+	sort.Strings(keys)
+	claimNames := make([]string, 0, len(req.Event.AccessToken.Claims))
+	for _, claim := range req.Event.AccessToken.Claims {
+		claimNames = append(claimNames, claim.Name)
+	}
+	claims := make(map[string]interface{})
+	for _, claim := range evalEvent.AccessToken.Claims {
+		if _, seen := claims[claim.Name]; !seen && referenced.readsClaim(cfg, claim.Name) {
+			claims[claim.Name] = claim.Value
+		}
+	}
+	headers := make(map[string][]string)
+	for _, header := range req.Event.Request.AdditionalHeaders {
+		if referenced.readsHeader(cfg, header.Name) {
+			headers[header.Name] = append(headers[header.Name], header.Value...)
+		}
+	}
+	// A refresh token matters by presence and by the names of its claims
+	var refreshTokenClaims []string
+	if req.Event.RefreshToken != nil {
+		refreshTokenClaims = make([]string, 0, len(req.Event.RefreshToken.Claims))
+		for _, claim := range req.Event.RefreshToken.Claims {
+			refreshTokenClaims = append(refreshTokenClaims, claim.Name)
+		}
+	}
+	// Only scopes expressions read the client ID
+	var clientID string
+	if referenced.all {
+		clientID = req.Event.Request.ClientID
+	}
+
+	inputs, err := json.Marshal(struct {
+		Load               uint64
+		PartnerIDs         []string
+		Subjects           []string
+		RiskScore          float64
+		GrantType          string
+		ClientID           string
+		Scopes             []string
+		AllowedOperations  []Operation
+		ClaimNames         []string
+		Claims             map[string]interface{}
+		Headers            map[string][]string
+		RefreshTokenClaims []string
+	}{data.loadID, partnerIDs, keys, riskScore, req.Event.Request.GrantType, clientID, req.Event.AccessToken.Scopes,
+		req.AllowedOperations, claimNames, claims, headers, refreshTokenClaims})
+	if err != nil {
+		return "", false
+	}
+	sum := sha256.Sum256(inputs)
+	return hex.EncodeToString(sum[:]), true
+}
+
+// get returns the cached evaluation for key, counting the hit or miss
+func (c *evaluationCache) get(key string, cacheable bool, now time.Time) (evaluation, bool) {
+	if c == nil || !cacheable {
+		return evaluation{}, false
+	}
+	result, ok := c.entries.get(key, now)
+	if ok {
+		c.metrics.IncCounter(metricOperationsCache, Labels{{"result", "hit"}})
+	} else {
+		c.metrics.IncCounter(metricOperationsCache, Labels{{"result", "miss"}})
+	}
+	return result, ok
+}
+
+// put caches result under key until the soonest validUntil of the matched
+// entitlements, after which the evaluation would no longer grant them
+func (c *evaluationCache) put(key string, cacheable bool, result evaluation, now time.Time) {
+	if c == nil || !cacheable {
+		return
+	}
+	c.entries.putUntil(key, result, now, soonestExpiry(result.matched))
+}
+
+// purge drops every cached evaluation
+func (c *evaluationCache) purge() {
+	if c == nil {
+		return
+	}
+	c.entries.purge()
+}
+
+// dependsOnTime reports whether the operations for matched change with the time
+// of the request, which makes them unsafe to cache
+func dependsOnTime(matched []Entitlement) bool {
+	for _, entitlement := range matched {
+		if entitlement.NotBefore != nil && entitlement.NotBefore.At == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// soonestExpiry returns the earliest validUntil among matched, or the zero time
+// when none of them expires
+func soonestExpiry(matched []Entitlement) time.Time {
+	var soonest time.Time
+	for _, entitlement := range matched {
+		expiry, ok := constraintExpiry(entitlement.Constraints)
+		if ok && (soonest.IsZero() || expiry.Before(soonest)) {
+			soonest = expiry
+		}
+	}
+	return soonest
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingMetrics counts counter increments by metric name and first label value
+type countingMetrics struct {
+	noopMetrics
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (m *countingMetrics) IncCounter(name string, labels Labels) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[name+":"+labels[0].Value]++
+}
+
+// count returns how often the counter was incremented with the label value
+func (m *countingMetrics) count(name string, value string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counts[name+":"+value]
+}
+
+// withOperationsCache enables an operations cache and counting metrics on s
+func withOperationsCache(s *Server, size int) *countingMetrics {
+	counting := &countingMetrics{counts: make(map[string]int)}
+	s.metrics, s.operationsCache = counting, newEvaluationCache(size, counting)
+	return counting
+}
+
+func TestOperationsCacheHitReturnsSameOperations(t *testing.T) {
+	s := NewServer(testEntitlements)
+	counting := withOperationsCache(s, 16)
+	body := actionRequest(t, partnerHeader("org_acme"))
+
+	_, first := serve(t, s, http.MethodPost, body)
+	_, second := serve(t, s, http.MethodPost, body)
+
+	if got, want := mustJSON(t, second), mustJSON(t, first); got != want {
+		t.Errorf("cached response = %s, want %s", got, want)
+	}
+	if scopes := grantedScopes(second.Operations); len(scopes) != 1 || scopes[0] != "partner:read" {
+		t.Errorf("granted scopes = %v, want [partner:read]", scopes)
+	}
+	if hits, misses := counting.count(metricOperationsCache, "hit"), counting.count(metricOperationsCache, "miss"); hits != 1 || misses != 1 {
+		t.Errorf("hits = %d, misses = %d, want 1 and 1", hits, misses)
+	}
+}
+
+func TestOperationsCacheKeysOnRequest(t *testing.T) {
+	s := NewServer(testEntitlements)
+	counting := withOperationsCache(s, 16)
+
+	serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+	_, resp := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_other")))
+
+	if len(resp.Operations) != 0 {
+		t.Errorf("operations = %+v, want none for another partner", resp.Operations)
+	}
+	if hits := counting.count(metricOperationsCache, "hit"); hits != 0 {
+		t.Errorf("hits = %d, want 0", hits)
+	}
+}
+
+func TestOperationsCacheClearedOnReload(t *testing.T) {
+	action := "read"
+	previous := defaultEntitlements
+	defaultEntitlements = newStore("test.json", func() (*EntitlementsData, error) {
+		return &EntitlementsData{Entitlements: []Entitlement{{
+			EntitlementID: "ent",
+			Subject:       Subject{Type: "partner", ID: "org_acme"},
+			Action:        action,
+		}}}, nil
+	}, nil, noopMetrics{})
+	t.Cleanup(func() { defaultEntitlements = previous })
+
+	s := NewServer(configuredEntitlements{})
+	counting := withOperationsCache(s, 16)
+	defaultEntitlements.onReload(s.operationsCache.purge)
+	body := actionRequest(t, partnerHeader("org_acme"))
+	serve(t, s, http.MethodPost, body)
+
+	action = "write"
+	defaultEntitlements.reloadIfChanged()
+	_, resp := serve(t, s, http.MethodPost, body)
+
+	if scopes := grantedScopes(resp.Operations); len(scopes) != 1 || scopes[0] != "partner:write" {
+		t.Errorf("granted scopes after reload = %v, want [partner:write]", scopes)
+	}
+	if hits, misses := counting.count(metricOperationsCache, "hit"), counting.count(metricOperationsCache, "miss"); hits != 0 || misses != 2 {
+		t.Errorf("hits = %d, misses = %d, want 0 and 2", hits, misses)
+	}
+}
+
+func TestOperationsCacheExpiresWithEntitlement(t *testing.T) {
+	start := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	withClock(t, start)
+	s := NewServer(fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{{
+		EntitlementID: "ent_read",
+		Subject:       Subject{Type: "partner", ID: "org_acme"},
+		Action:        "read",
+		Constraints:   map[string]interface{}{"validUntil": "2025-06-01T13:00:00Z"},
+	}}}})
+	counting := withOperationsCache(s, 16)
+	body := actionRequest(t, partnerHeader("org_acme"))
+
+	_, before := serve(t, s, http.MethodPost, body)
+	if scopes := grantedScopes(before.Operations); len(scopes) != 1 || scopes[0] != "partner:read" {
+		t.Fatalf("granted scopes before expiry = %v, want [partner:read]", scopes)
+	}
+
+	withClock(t, start.Add(2*time.Hour))
+	_, after := serve(t, s, http.MethodPost, body)
+
+	if len(after.Operations) != 0 {
+		t.Errorf("operations after expiry = %+v, want none", after.Operations)
+	}
+	if hits := counting.count(metricOperationsCache, "hit"); hits != 0 {
+		t.Errorf("hits = %d, want 0 once the entitlement expired", hits)
+	}
+}
+
+func TestOperationsCacheHitsForEnrichedRequests(t *testing.T) {
+	service := &fakeAttributeService{response: `{"tier":"gold","region":"eu","segment":"retail","country":"lk","plan":"annual"}`}
+	s := enrichedServer(t, service, false)
+	counting := withOperationsCache(s, 16)
+	body := actionRequest(t, partnerHeader("org_acme"))
+
+	serve(t, s, http.MethodPost, body)
+	_, resp := serve(t, s, http.MethodPost, body)
+
+	if scopes := grantedScopes(resp.Operations); mustJSON(t, scopes) != `["partner:read"]` {
+		t.Errorf("granted scopes = %v, want [partner:read]", scopes)
+	}
+	if hits, misses := counting.count(metricOperationsCache, "hit"), counting.count(metricOperationsCache, "miss"); hits != 1 || misses != 1 {
+		t.Errorf("hits = %d, misses = %d, want 1 and 1", hits, misses)
+	}
+}
+
+func TestOperationsCacheKeysOnReferencedHeadersOnly(t *testing.T) {
+	s := NewServer(fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{{
+		EntitlementID: "ent_mobile",
+		Subject:       Subject{Type: "partner", ID: "org_acme"},
+		Action:        "read",
+		Constraints:   map[string]interface{}{"header": "x-channel", "equals": "mobile"},
+	}}}})
+	counting := withOperationsCache(s, 16)
+	request := func(channel, trace string) string {
+		return actionRequest(t, partnerHeader("org_acme"),
+			Header{Name: "x-channel", Value: []string{channel}},
+			Header{Name: "x-trace-id", Value: []string{trace}})
+	}
+
+	serve(t, s, http.MethodPost, request("mobile", "trace-1"))
+	_, resp := serve(t, s, http.MethodPost, request("mobile", "trace-2"))
+	if scopes := grantedScopes(resp.Operations); mustJSON(t, scopes) != `["partner:read"]` {
+		t.Errorf("granted scopes = %v, want [partner:read]", scopes)
+	}
+	if hits := counting.count(metricOperationsCache, "hit"); hits != 1 {
+		t.Errorf("hits = %d, want 1 when only an unreferenced header differs", hits)
+	}
+
+	_, resp = serve(t, s, http.MethodPost, request("web", "trace-2"))
+	if len(resp.Operations) != 0 {
+		t.Errorf("operations = %+v, want none for another channel", resp.Operations)
+	}
+	if hits := counting.count(metricOperationsCache, "hit"); hits != 1 {
+		t.Errorf("hits = %d, want the referenced header to miss", hits)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Operation paths used in action responses
+const (
+	accessTokenScopesPath  = "/accessToken/scopes/-"
+	accessTokenClaimsPath  = "/accessToken/claims/-"
+	refreshTokenScopesPath = "/refreshToken/scopes/-"
+	refreshTokenClaimsPath = "/refreshToken/claims/-"
+)
+
+// pointerEscaper escapes a JSON Pointer reference token (RFC 6901): "~" becomes
+// "~0" and "/" becomes "~1". strings.Replacer applies both in a single pass, so
+// the "~" introduced for "/" is not escaped again.
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// claimPath returns the path of an access token claim, or of the claim at an
+// index, escaping the segment so names containing "/" or "~" stay one segment
+func claimPath(segment string) string {
+	return "/accessToken/claims/" + pointerEscaper.Replace(segment)
+}
+
+// validatePointer checks that every "~" in path starts a valid "~0" or "~1" escape
+func validatePointer(path string) error {
+	for i := 0; i < len(path); i++ {
+		if path[i] != '~' {
+			continue
+		}
+		if i+1 >= len(path) || (path[i+1] != '0' && path[i+1] != '1') {
+			return fmt.Errorf("path %q has an invalid JSON Pointer escape at offset %d", path, i)
+		}
+	}
+	return nil
+}
+
+// refreshTokenClaimPath returns the path of a refresh token claim, escaped like claimPath
+func refreshTokenClaimPath(segment string) string {
+	return "/refreshToken/claims/" + pointerEscaper.Replace(segment)
+}
+
+// claimOperation sets a top-level access token claim: it replaces the claim when
+// the token already has it and adds it otherwise
+func claimOperation(claims []Claim, name string, value interface{}) OperationResponse {
+	if _, ok := getClaimValue(claims, name); ok {
+		return OperationResponse{Op: "replace", Path: claimPath(name), Value: value}
+	}
+	return OperationResponse{Op: "add", Path: accessTokenClaimsPath, Value: Claim{Name: name, Value: value}}
+}
+
+// claimMerges builds operations merging the matched entitlements' mergeClaims
+// fields into existing object claims without clobbering their other fields. A
+// claim the token lacks is added with just the new fields; a claim that exists
+// but is not an object is left alone.
+func claimMerges(matched []Entitlement, claims []Claim) (ops []OperationResponse, conflicts []string) {
+	fields := make(map[string]map[string]interface{})
+	var names []string
+	for _, entitlement := range matched {
+		for name, values := range entitlement.MergeClaims {
+			if _, ok := fields[name]; !ok {
+				fields[name] = make(map[string]interface{})
+				names = append(names, name)
+			}
+			for key, value := range values {
+				fields[name][key] = value
+			}
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		existing, ok := getClaimValue(claims, name)
+		if !ok {
+			ops = append(ops, OperationResponse{Op: "add", Path: accessTokenClaimsPath, Value: Claim{Name: name, Value: fields[name]}})
+			continue
+		}
+		current, ok := existing.(map[string]interface{})
+		if !ok {
+			conflicts = append(conflicts, name)
+			continue
+		}
+		merged := make(map[string]interface{}, len(current)+len(fields[name]))
+		for key, value := range current {
+			merged[key] = value
+		}
+		for key, value := range fields[name] {
+			merged[key] = value
+		}
+		ops = append(ops, OperationResponse{Op: "replace", Path: claimPath(name), Value: merged})
+	}
+	return ops, conflicts
+}
+
+// findClaimIndex returns the index of the named claim, or -1 when it is absent
+func findClaimIndex(claims []Claim, name string) int {
+	for i, claim := range claims {
+		if claim.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// entitlementClaimOperations builds operations setting the matched entitlements'
+// claims (see entitlementClaims), in name order: added when the token lacks the
+// claim, replaced when it has one.
+func entitlementClaimOperations(matched []Entitlement, claims []Claim) []OperationResponse {
+	names, values := entitlementClaims(matched)
+	var ops []OperationResponse
+	for _, name := range names {
+		ops = append(ops, claimOperation(claims, name, values[name]))
+	}
+	return ops
+}
+
+// refreshTokenClaimOperations builds operations setting the matched entitlements'
+// claims on the refresh token of a refresh_token grant when REFRESH_TOKEN_CLAIMS
+// is enabled, resolved like entitlementClaimOperations
+func (c *Config) refreshTokenClaimOperations(ev Event, matched []Entitlement) []OperationResponse {
+	if !c.refreshTokenClaims || ev.Request.GrantType != grantTypeRefreshToken || ev.RefreshToken == nil {
+		return nil
+	}
+	names, values := entitlementClaims(matched)
+	var ops []OperationResponse
+	for _, name := range names {
+		if _, ok := getClaimValue(ev.RefreshToken.Claims, name); ok {
+			ops = append(ops, OperationResponse{Op: "replace", Path: refreshTokenClaimPath(name), Value: values[name]})
+		} else {
+			ops = append(ops, OperationResponse{Op: "add", Path: refreshTokenClaimsPath, Value: Claim{Name: name, Value: values[name]}})
+		}
+	}
+	return ops
+}
+
+// entitlementClaims returns the claims the matched entitlements set, by name in
+// name order. When several entitlements set a claim the highest priority wins,
+// then the first matched.
+func entitlementClaims(matched []Entitlement) ([]string, map[string]interface{}) {
+	values := make(map[string]interface{})
+	priorities := make(map[string]int)
+	var names []string
+	for _, entitlement := range matched {
+		for name, value := range entitlement.Claims {
+			if priority, ok := priorities[name]; ok {
+				if entitlement.Priority <= priority {
+					continue
+				}
+			} else {
+				names = append(names, name)
+			}
+			values[name], priorities[name] = value, entitlement.Priority
+		}
+	}
+	sort.Strings(names)
+	return names, values
+}
+
+// claimRemovals builds remove operations for the claims the matched entitlements
+// withhold. Claims the token does not carry are skipped. Operations are ordered
+// by descending index because each removal shifts the claims after it.
+func claimRemovals(matched []Entitlement, claims []Claim) []OperationResponse {
+	seen := make(map[int]bool)
+	var indices []int
+	for _, entitlement := range matched {
+		for _, name := range entitlement.RemoveClaims {
+			index := findClaimIndex(claims, name)
+			if index < 0 || seen[index] {
+				continue
+			}
+			seen[index] = true
+			indices = append(indices, index)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(indices)))
+
+	ops := make([]OperationResponse, 0, len(indices))
+	for _, index := range indices {
+		ops = append(ops, OperationResponse{Op: "remove", Path: claimPath(strconv.Itoa(index))})
+	}
+	return ops
+}
+
+// arrayPaths are targets holding a whole array, which a replace must supply in full
+var arrayPaths = map[string]bool{
+	"/accessToken/scopes":     true,
+	"/accessToken/claims/aud": true,
+	"/refreshToken/scopes":    true,
+}
+
+// validateOperationValue checks that op's path is a well-formed JSON Pointer and
+// that its value has the JSON shape its target expects: appending to an array
+// ("/-") takes a single element, replacing a whole array takes an array, and
+// remove takes no value
+func validateOperationValue(op OperationResponse) error {
+	if err := validatePointer(op.Path); err != nil {
+		return err
+	}
+	isArray := op.Value != nil && reflect.TypeOf(op.Value).Kind() == reflect.Slice
+
+	switch op.Op {
+	case "remove":
+		if op.Value != nil {
+			return errors.New("remove operation must not carry a value")
+		}
+	case "add":
+		if strings.HasSuffix(op.Path, "/-") && isArray {
+			return errors.New("appending to an array takes a single value, not an array")
+		}
+		if op.Value == nil {
+			return errors.New("add operation requires a value")
+		}
+	case "replace":
+		if arrayPaths[op.Path] && !isArray {
+			return fmt.Errorf("replacing %s requires an array value", op.Path)
+		}
+		if op.Value == nil {
+			return errors.New("replace operation requires a value")
+		}
+	default:
+		return fmt.Errorf("unsupported operation %q", op.Op)
+	}
+	return nil
+}
+
+// isOperationAllowed reports whether allowedOperations permits op on path. An
+// allowed path ending in "/" also covers every path beneath it, so
+// "/accessToken/scopes/" permits "/accessToken/scopes/-". An empty list permits
+// nothing.
+func isOperationAllowed(allowed []Operation, op string, path string) bool {
+	for _, operation := range allowed {
+		if operation.Op != op {
+			continue
+		}
+		for _, allowedPath := range operation.Paths {
+			if allowedPath == path {
+				return true
+			}
+			if strings.HasSuffix(allowedPath, "/") && strings.HasPrefix(path, allowedPath) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// operationOutcome records whether a candidate operation was emitted or dropped.
+// It leaves out the operation's value, which may carry claim values.
+type operationOutcome struct {
+	Op      string `json:"op"`
+	Path    string `json:"path"`
+	Applied bool   `json:"applied"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// operationSet collects the operations to emit along with the outcome of every
+// candidate operation. Outcomes are only logged, never sent to Asgardeo.
+type operationSet struct {
+	operations []OperationResponse
+	outcomes   []operationOutcome
+	// logger is the request's logger; the default logger when nil
+	logger *slog.Logger
+}
+
+// log returns the logger for the set's request
+func (s *operationSet) log() *slog.Logger {
+	if s.logger == nil {
+		return slog.Default()
+	}
+	return s.logger
+}
+
+// apply emits op, dropping it if its value does not have the shape its target
+// expects. The sub claim can only be changed through applySubjectRewrite.
+func (s *operationSet) apply(op OperationResponse) {
+	if targetsSubject(op) {
+		s.skip(op, "sub claim can only be changed by rewriteSubject")
+		return
+	}
+	if err := validateOperationValue(op); err != nil {
+		s.skip(op, err.Error())
+		return
+	}
+	s.emit(op)
+}
+
+// emit adds op to the emitted operations
+func (s *operationSet) emit(op OperationResponse) {
+	s.operations = append(s.operations, op)
+	s.outcomes = append(s.outcomes, operationOutcome{Op: op.Op, Path: op.Path, Applied: true})
+}
+
+// applyIfAllowed emits op when allowedOperations permits it and skips it otherwise
+func (s *operationSet) applyIfAllowed(allowed []Operation, op OperationResponse) {
+	if !isOperationAllowed(allowed, op.Op, op.Path) {
+		s.skip(op, "operation not in allowedOperations")
+		return
+	}
+	s.apply(op)
+}
+
+// skip drops op, logging and recording why
+func (s *operationSet) skip(op OperationResponse, reason string) {
+	s.log().Info("Skipping operation", "op", op.Op, "path", op.Path, "reason", reason)
+	s.outcomes = append(s.outcomes, operationOutcome{Op: op.Op, Path: op.Path, Reason: reason})
+}
+
+// logOutcomes logs the outcome list as a single JSON line
+func (s *operationSet) logOutcomes() {
+	if len(s.outcomes) == 0 {
+		return
+	}
+	s.log().Info("Operation outcomes", "outcomes", s.outcomes)
+}
+
+// grantedScopes returns the access token scopes added by ops
+func grantedScopes(ops []OperationResponse) []string {
+	scopes := []string{}
+	for _, op := range ops {
+		if op.Path == accessTokenScopesPath {
+			if scope, ok := op.Value.(string); ok {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	return scopes
+}
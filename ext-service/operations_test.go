@@ -0,0 +1,511 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEntitlementClaimOperations(t *testing.T) {
+	matched := []Entitlement{
+		{EntitlementID: "low", Claims: map[string]interface{}{"tier": "silver", "region": "eu"}},
+		{EntitlementID: "high", Priority: 5, Claims: map[string]interface{}{"tier": "gold"}},
+	}
+	existing := []Claim{{Name: "aud", Value: "api"}, {Name: "region", Value: "us"}}
+
+	ops := entitlementClaimOperations(matched, existing)
+
+	want := []OperationResponse{
+		{Op: "replace", Path: claimPath("region"), Value: "eu"},
+		{Op: "add", Path: accessTokenClaimsPath, Value: Claim{Name: "tier", Value: "gold"}},
+	}
+	if len(ops) != len(want) {
+		t.Fatalf("operations = %+v, want %+v", ops, want)
+	}
+	for i := range want {
+		if got, _ := json.Marshal(ops[i]); string(got) != mustJSON(t, want[i]) {
+			t.Errorf("operation %d = %s, want %s", i, got, mustJSON(t, want[i]))
+		}
+	}
+}
+
+func TestHandlerEmitsScopesAndClaims(t *testing.T) {
+	var data EntitlementsData
+	err := json.Unmarshal([]byte(`{"entitlements":[{
+		"entitlementId": "ent_read",
+		"subject": {"type": "partner", "id": "org_acme"},
+		"action": "read",
+		"claims": {
+			"tier": "gold",
+			"quota": 250,
+			"ratio": 0.5,
+			"trusted": true,
+			"regions": ["eu", "us"],
+			"contact": {"team": "payments", "oncall": false},
+			"note": null
+		}
+	}]}`), &data)
+	if err != nil {
+		t.Fatalf("unmarshal entitlements: %v", err)
+	}
+
+	req := Request{
+		ActionType: actionPreIssueAccessToken,
+		Event: Event{
+			Request:     RequestData{AdditionalHeaders: []Header{partnerHeader("org_acme")}},
+			AccessToken: AccessToken{Scopes: []string{}},
+		},
+		AllowedOperations: []Operation{{Op: "add", Paths: []string{accessTokenScopesPath, accessTokenClaimsPath}}},
+	}
+	rec := httptest.NewRecorder()
+	NewServer(fakeEntitlements{data: &data}).handler(rec, httptest.NewRequest(http.MethodPost, "/token-validation", strings.NewReader(marshalRequest(t, req))))
+
+	var resp struct {
+		Operations []json.RawMessage `json:"operations"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response %q: %v", rec.Body.String(), err)
+	}
+	want := []string{
+		`{"op":"add","path":"/accessToken/scopes/-","value":"partner:read"}`,
+		`{"op":"add","path":"/accessToken/claims/-","value":{"name":"contact","value":{"oncall":false,"team":"payments"}}}`,
+		`{"op":"add","path":"/accessToken/claims/-","value":{"name":"note","value":null}}`,
+		`{"op":"add","path":"/accessToken/claims/-","value":{"name":"quota","value":250}}`,
+		`{"op":"add","path":"/accessToken/claims/-","value":{"name":"ratio","value":0.5}}`,
+		`{"op":"add","path":"/accessToken/claims/-","value":{"name":"regions","value":["eu","us"]}}`,
+		`{"op":"add","path":"/accessToken/claims/-","value":{"name":"tier","value":"gold"}}`,
+		`{"op":"add","path":"/accessToken/claims/-","value":{"name":"trusted","value":true}}`,
+	}
+	if len(resp.Operations) != len(want) {
+		t.Fatalf("operations = %s, want %d operations", rec.Body.String(), len(want))
+	}
+	for i := range want {
+		if string(resp.Operations[i]) != want[i] {
+			t.Errorf("operation %d = %s, want %s", i, resp.Operations[i], want[i])
+		}
+	}
+}
+
+func TestHandlerSkipsClaimsNotAllowed(t *testing.T) {
+	provider := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{{
+		EntitlementID: "ent_read",
+		Subject:       Subject{Type: "partner", ID: "org_acme"},
+		Action:        "read",
+		Claims:        map[string]interface{}{"tier": "gold"},
+	}}}}
+
+	_, resp := serve(t, NewServer(provider), http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+
+	if len(resp.Operations) != 1 || resp.Operations[0].Path != accessTokenScopesPath {
+		t.Errorf("operations = %+v, want only the scope", resp.Operations)
+	}
+}
+
+// mustJSON encodes v
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshal %v: %v", v, err)
+	}
+	return string(b)
+}
+
+// refreshTokenServer returns a server over claimsEntitlements with
+// REFRESH_TOKEN_CLAIMS set to enabled
+func refreshTokenServer(enabled bool) *Server {
+	s := NewServer(claimsEntitlements)
+	s.refreshTokenClaims = enabled
+	return s
+}
+
+// refreshGrantRequest builds a refresh_token grant request for org_acme whose
+// refresh token carries claims, allowing refresh token claim operations
+func refreshGrantRequest(t *testing.T, grantType string, claims []Claim) string {
+	t.Helper()
+	req := Request{
+		ActionType: actionPreIssueAccessToken,
+		Event: Event{
+			Request:      RequestData{ClientID: "client", GrantType: grantType, AdditionalHeaders: []Header{partnerHeader("org_acme")}},
+			AccessToken:  AccessToken{Scopes: []string{}},
+			RefreshToken: &RefreshToken{Claims: claims},
+		},
+		AllowedOperations: []Operation{
+			{Op: "add", Paths: []string{accessTokenScopesPath, refreshTokenClaimsPath}},
+			{Op: "replace", Paths: []string{"/refreshToken/claims/"}},
+		},
+	}
+	return marshalRequest(t, req)
+}
+
+// claimsEntitlements grants org_acme the read action with claims
+var claimsEntitlements = fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{{
+	EntitlementID: "ent_read",
+	Subject:       Subject{Type: "partner", ID: "org_acme"},
+	Action:        "read",
+	Claims:        map[string]interface{}{"region": "eu", "tier": "gold"},
+}}}}
+
+func TestHandlerSetsRefreshTokenClaimsOnRefreshGrant(t *testing.T) {
+	body := refreshGrantRequest(t, grantTypeRefreshToken, []Claim{{Name: "tier", Value: "silver"}})
+	_, resp := serve(t, refreshTokenServer(true), http.MethodPost, body)
+
+	want := []OperationResponse{
+		{Op: "add", Path: accessTokenScopesPath, Value: "partner:read"},
+		{Op: "add", Path: refreshTokenClaimsPath, Value: map[string]interface{}{"name": "region", "value": "eu"}},
+		{Op: "replace", Path: refreshTokenClaimPath("tier"), Value: "gold"},
+	}
+	if mustJSON(t, resp.Operations) != mustJSON(t, want) {
+		t.Errorf("operations = %s, want %s", mustJSON(t, resp.Operations), mustJSON(t, want))
+	}
+}
+
+func TestHandlerRefreshTokenClaimsRespectAllowedOperations(t *testing.T) {
+	req := Request{
+		ActionType: actionPreIssueAccessToken,
+		Event: Event{
+			Request:      RequestData{GrantType: grantTypeRefreshToken, AdditionalHeaders: []Header{partnerHeader("org_acme")}},
+			AccessToken:  AccessToken{Scopes: []string{}},
+			RefreshToken: &RefreshToken{},
+		},
+		AllowedOperations: []Operation{{Op: "add", Paths: []string{accessTokenScopesPath}}},
+	}
+	_, resp := serve(t, refreshTokenServer(true), http.MethodPost, marshalRequest(t, req))
+
+	if len(resp.Operations) != 1 || resp.Operations[0].Path != accessTokenScopesPath {
+		t.Errorf("operations = %+v, want only the scope", resp.Operations)
+	}
+}
+
+func TestHandlerRefreshTokenClaimsOnlyOnRefreshGrant(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		grant   string
+	}{
+		{"other grant", true, "client_credentials"},
+		{"disabled", false, grantTypeRefreshToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, resp := serve(t, refreshTokenServer(tt.enabled), http.MethodPost, refreshGrantRequest(t, tt.grant, nil))
+
+			for _, op := range resp.Operations {
+				if strings.HasPrefix(op.Path, "/refreshToken/") {
+					t.Errorf("unexpected refresh token operation %+v", op)
+				}
+			}
+		})
+	}
+}
+
+func TestOperationSetRecordsOutcomes(t *testing.T) {
+	var logs strings.Builder
+	set := operationSet{logger: slog.New(slog.NewJSONHandler(&logs, nil))}
+	allowed := []Operation{{Op: "add", Paths: []string{accessTokenScopesPath}}}
+
+	set.applyIfAllowed(allowed, OperationResponse{Op: "add", Path: accessTokenScopesPath, Value: "partner:read"})
+	set.applyIfAllowed(allowed, OperationResponse{Op: "add", Path: accessTokenClaimsPath, Value: Claim{Name: "tier", Value: "secret-tier"}})
+	set.logOutcomes()
+
+	want := []operationOutcome{
+		{Op: "add", Path: accessTokenScopesPath, Applied: true},
+		{Op: "add", Path: accessTokenClaimsPath, Reason: "operation not in allowedOperations"},
+	}
+	if got := mustJSON(t, set.outcomes); got != mustJSON(t, want) {
+		t.Errorf("outcomes = %s, want %s", got, mustJSON(t, want))
+	}
+	if len(set.operations) != 1 || set.operations[0].Path != accessTokenScopesPath {
+		t.Errorf("operations = %+v, want only the scope", set.operations)
+	}
+	if strings.Contains(logs.String(), "secret-tier") || strings.Contains(logs.String(), "partner:read") {
+		t.Errorf("outcome log leaks operation values: %s", logs.String())
+	}
+}
+
+func TestHandlerMirrorsScopeOntoRefreshToken(t *testing.T) {
+	provider := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{{
+		EntitlementID:         "ent_read",
+		Subject:               Subject{Type: "partner", ID: "org_acme"},
+		Action:                "read",
+		PersistToRefreshToken: true,
+	}}}}
+	tests := []struct {
+		name         string
+		refreshToken *RefreshToken
+		allowed      []string
+		wantMirror   bool
+	}{
+		{"present and allowed", &RefreshToken{}, []string{accessTokenScopesPath, refreshTokenScopesPath}, true},
+		{"no refresh token", nil, []string{accessTokenScopesPath, refreshTokenScopesPath}, false},
+		{"not allowed", &RefreshToken{}, []string{accessTokenScopesPath}, false},
+	}
+	for _, tt := range tests {
+		req := Request{
+			ActionType: actionPreIssueAccessToken,
+			Event: Event{
+				Request:      RequestData{AdditionalHeaders: []Header{partnerHeader("org_acme")}},
+				AccessToken:  AccessToken{Scopes: []string{}},
+				RefreshToken: tt.refreshToken,
+			},
+			AllowedOperations: []Operation{{Op: "add", Paths: tt.allowed}},
+		}
+
+		_, resp := serve(t, NewServer(provider), http.MethodPost, marshalRequest(t, req))
+
+		want := []OperationResponse{{Op: "add", Path: accessTokenScopesPath, Value: "partner:read"}}
+		if tt.wantMirror {
+			want = append(want, OperationResponse{Op: "add", Path: refreshTokenScopesPath, Value: "partner:read"})
+		}
+		if got := mustJSON(t, resp.Operations); got != mustJSON(t, want) {
+			t.Errorf("%s: operations = %s, want %s", tt.name, got, mustJSON(t, want))
+		}
+	}
+}
+
+func TestHandlerSetsNotBefore(t *testing.T) {
+	withClock(t, time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	entitlement := func(id string, action string, nbf NotBefore) Entitlement {
+		return Entitlement{EntitlementID: id, Subject: Subject{Type: "partner", ID: "org_acme"}, Action: action, NotBefore: &nbf}
+	}
+	scope := OperationResponse{Op: "add", Path: accessTokenScopesPath, Value: "partner:read"}
+	tests := []struct {
+		name         string
+		entitlements []Entitlement
+		claims       []Claim
+		allowed      []Operation
+		want         []OperationResponse
+	}{
+		{
+			"relative offset",
+			[]Entitlement{entitlement("ent_read", "read", NotBefore{OffsetSeconds: 3600})},
+			nil,
+			[]Operation{{Op: "add", Paths: []string{accessTokenScopesPath, accessTokenClaimsPath}}},
+			[]OperationResponse{scope, {Op: "add", Path: accessTokenClaimsPath, Value: Claim{Name: "nbf", Value: 1748782800}}},
+		},
+		{
+			"latest time wins",
+			[]Entitlement{
+				entitlement("ent_read", "read", NotBefore{OffsetSeconds: 3600}),
+				entitlement("ent_write", "write", NotBefore{At: 1748790000}),
+			},
+			nil,
+			[]Operation{{Op: "add", Paths: []string{accessTokenScopesPath, accessTokenClaimsPath}}},
+			[]OperationResponse{
+				scope,
+				{Op: "add", Path: accessTokenScopesPath, Value: "partner:write"},
+				{Op: "add", Path: accessTokenClaimsPath, Value: Claim{Name: "nbf", Value: 1748790000}},
+			},
+		},
+		{
+			"existing claim replaced",
+			[]Entitlement{entitlement("ent_read", "read", NotBefore{At: 1748790000})},
+			[]Claim{{Name: "nbf", Value: 1748779200}},
+			[]Operation{{Op: "add", Paths: []string{accessTokenScopesPath}}, {Op: "replace", Paths: []string{"/accessToken/claims/nbf"}}},
+			[]OperationResponse{scope, {Op: "replace", Path: "/accessToken/claims/nbf", Value: 1748790000}},
+		},
+		{
+			"path not allowed",
+			[]Entitlement{entitlement("ent_read", "read", NotBefore{OffsetSeconds: 3600})},
+			nil,
+			[]Operation{{Op: "add", Paths: []string{accessTokenScopesPath}}},
+			[]OperationResponse{scope},
+		},
+	}
+	for _, tt := range tests {
+		req := Request{
+			ActionType: actionPreIssueAccessToken,
+			Event: Event{
+				Request:     RequestData{AdditionalHeaders: []Header{partnerHeader("org_acme")}},
+				AccessToken: AccessToken{Scopes: []string{}, Claims: tt.claims},
+			},
+			AllowedOperations: tt.allowed,
+		}
+
+		_, resp := serve(t, NewServer(fakeEntitlements{data: &EntitlementsData{Entitlements: tt.entitlements}}), http.MethodPost, marshalRequest(t, req))
+
+		if got := mustJSON(t, resp.Operations); got != mustJSON(t, tt.want) {
+			t.Errorf("%s: operations = %s, want %s", tt.name, got, mustJSON(t, tt.want))
+		}
+	}
+}
+
+func TestFindClaimIndex(t *testing.T) {
+	claims := []Claim{{Name: "sub", Value: "u1"}, {Name: "email", Value: "a@example.com"}}
+	if got := findClaimIndex(claims, "email"); got != 1 {
+		t.Errorf("findClaimIndex(email) = %d, want 1", got)
+	}
+	if got := findClaimIndex(claims, "phone"); got != -1 {
+		t.Errorf("findClaimIndex(phone) = %d, want -1", got)
+	}
+}
+
+func TestHandlerRemovesWithheldClaims(t *testing.T) {
+	provider := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{{
+		EntitlementID: "ent_read",
+		Subject:       Subject{Type: "partner", ID: "org_acme"},
+		Action:        "read",
+		RemoveClaims:  []string{"email", "phone", "sub"},
+	}}}}
+	claims := []Claim{{Name: "sub", Value: "u1"}, {Name: "tier", Value: "gold"}, {Name: "email", Value: "a@example.com"}}
+	scope := OperationResponse{Op: "add", Path: accessTokenScopesPath, Value: "partner:read"}
+	tests := []struct {
+		name    string
+		allowed []Operation
+		want    []OperationResponse
+	}{
+		{
+			"allowed",
+			[]Operation{{Op: "add", Paths: []string{accessTokenScopesPath}}, {Op: "remove", Paths: []string{"/accessToken/claims/"}}},
+			// Highest index first, and nothing for the absent phone claim
+			[]OperationResponse{scope, {Op: "remove", Path: "/accessToken/claims/2"}, {Op: "remove", Path: "/accessToken/claims/0"}},
+		},
+		{
+			"not allowed",
+			[]Operation{{Op: "add", Paths: []string{accessTokenScopesPath}}},
+			[]OperationResponse{scope},
+		},
+	}
+	for _, tt := range tests {
+		req := Request{
+			ActionType: actionPreIssueAccessToken,
+			Event: Event{
+				Request:     RequestData{AdditionalHeaders: []Header{partnerHeader("org_acme")}},
+				AccessToken: AccessToken{Scopes: []string{}, Claims: claims},
+			},
+			AllowedOperations: tt.allowed,
+		}
+
+		_, resp := serve(t, NewServer(provider), http.MethodPost, marshalRequest(t, req))
+
+		if got := mustJSON(t, resp.Operations); got != mustJSON(t, tt.want) {
+			t.Errorf("%s: operations = %s, want %s", tt.name, got, mustJSON(t, tt.want))
+		}
+	}
+}
+
+func TestClaimMerges(t *testing.T) {
+	matched := []Entitlement{
+		{EntitlementID: "ent_read", MergeClaims: map[string]map[string]interface{}{"metadata": {"partner": "org_acme"}}},
+		{EntitlementID: "ent_write", MergeClaims: map[string]map[string]interface{}{
+			"metadata": {"tier": "gold"},
+			"limits":   {"rps": 10},
+			"region":   {"primary": "eu"},
+		}},
+	}
+	claims := []Claim{
+		{Name: "metadata", Value: map[string]interface{}{"issuer": "idp", "tier": "silver"}},
+		{Name: "region", Value: "eu"},
+	}
+
+	ops, conflicts := claimMerges(matched, claims)
+
+	want := []OperationResponse{
+		// Absent, so added with just the new fields
+		{Op: "add", Path: accessTokenClaimsPath, Value: Claim{Name: "limits", Value: map[string]interface{}{"rps": 10}}},
+		// Existing fields are kept, and merged fields override them
+		{Op: "replace", Path: "/accessToken/claims/metadata", Value: map[string]interface{}{"issuer": "idp", "partner": "org_acme", "tier": "gold"}},
+	}
+	if got := mustJSON(t, ops); got != mustJSON(t, want) {
+		t.Errorf("operations = %s, want %s", got, mustJSON(t, want))
+	}
+	if len(conflicts) != 1 || conflicts[0] != "region" {
+		t.Errorf("conflicts = %v, want [region], which is not an object", conflicts)
+	}
+}
+
+func TestIsOperationAllowed(t *testing.T) {
+	allowed := []Operation{
+		{Op: "add", Paths: []string{"/accessToken/scopes/", "/accessToken/claims/-"}},
+		{Op: "replace", Paths: []string{"/accessToken/claims/aud"}},
+	}
+	tests := []struct {
+		allowed []Operation
+		op      string
+		path    string
+		want    bool
+	}{
+		{nil, "add", accessTokenScopesPath, false},
+		{[]Operation{}, "add", accessTokenScopesPath, false},
+		{allowed, "add", accessTokenScopesPath, true},
+		{allowed, "add", "/accessToken/scopes/0", true},
+		{allowed, "add", "/accessToken/scopes", false},
+		{allowed, "add", "/accessToken/scopesX", false},
+		{allowed, "add", accessTokenClaimsPath, true},
+		// "/accessToken/claims/-" is an exact path, not a prefix
+		{allowed, "add", "/accessToken/claims/-/x", false},
+		{allowed, "remove", accessTokenScopesPath, false},
+		{allowed, "replace", "/accessToken/claims/aud", true},
+		{allowed, "replace", "/accessToken/claims/aud/0", false},
+	}
+	for _, tt := range tests {
+		if got := isOperationAllowed(tt.allowed, tt.op, tt.path); got != tt.want {
+			t.Errorf("isOperationAllowed(%v, %q, %q) = %v, want %v", tt.allowed, tt.op, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestHandlerSkipsScopesWithoutAllowedOperations(t *testing.T) {
+	logs := withDefaultLogger(t)
+	req := Request{
+		ActionType: actionPreIssueAccessToken,
+		Event: Event{
+			Request:     RequestData{AdditionalHeaders: []Header{partnerHeader("org_acme")}},
+			AccessToken: AccessToken{Scopes: []string{}},
+		},
+	}
+
+	_, resp := serve(t, NewServer(testEntitlements), http.MethodPost, marshalRequest(t, req))
+
+	if resp.ActionStatus != "SUCCESS" || len(resp.Operations) != 0 {
+		t.Errorf("response = %+v, want SUCCESS without operations", resp)
+	}
+	if out := logs.String(); !strings.Contains(out, `"op":"add","path":"/accessToken/scopes/-","reason":"operation not in allowedOperations"`) {
+		t.Errorf("logs = %s, want the skipped scope logged with its reason", out)
+	}
+}
+
+func TestClaimPathEscapesPointerSegments(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"tier", "/accessToken/claims/tier"},
+		{"https://example.com/roles", "/accessToken/claims/https:~1~1example.com~1roles"},
+		{"a~b", "/accessToken/claims/a~0b"},
+		// "~1" in a name is a literal tilde and one, not an escaped "/"
+		{"~1/", "/accessToken/claims/~01~1"},
+		{"3", "/accessToken/claims/3"},
+	}
+	for _, tt := range tests {
+		path := claimPath(tt.name)
+		if path != tt.want {
+			t.Errorf("claimPath(%q) = %q, want %q", tt.name, path, tt.want)
+		}
+		if err := validatePointer(path); err != nil {
+			t.Errorf("validatePointer(%q): %v", path, err)
+		}
+	}
+}
+
+func TestClaimOperationEscapesExistingClaimName(t *testing.T) {
+	claims := []Claim{{Name: "https://example.com/roles", Value: "viewer"}}
+
+	op := claimOperation(claims, "https://example.com/roles", "admin")
+
+	if op.Op != "replace" || op.Path != "/accessToken/claims/https:~1~1example.com~1roles" {
+		t.Errorf("operation = %+v, want a replace of the escaped claim path", op)
+	}
+}
+
+func TestValidateOperationValueRejectsInvalidEscapes(t *testing.T) {
+	for _, path := range []string{"/accessToken/claims/a~2b", "/accessToken/claims/a~"} {
+		if err := validateOperationValue(OperationResponse{Op: "replace", Path: path, Value: "x"}); err == nil {
+			t.Errorf("validateOperationValue accepted %q", path)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// strictPaths disables path normalization so only exact routes match (STRICT_PATHS=true)
+var strictPaths bool
+
+// normalizePaths routes common path variants to the registered handlers: a
+// trailing slash is trimmed and the path is lower-cased, since every route is
+// registered in lower case. With STRICT_PATHS the path is left untouched.
+func normalizePaths(next http.Handler) http.Handler {
+	if strictPaths {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.ToLower(r.URL.Path)
+		if len(path) > 1 {
+			path = strings.TrimRight(path, "/")
+			if path == "" {
+				path = "/"
+			}
+		}
+		if path != r.URL.Path {
+			r.URL.Path = path
+			r.URL.RawPath = ""
+		}
+		next.ServeHTTP(w, r)
+	})
+}
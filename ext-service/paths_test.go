@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withStrictPaths sets STRICT_PATHS for the duration of a test
+func withStrictPaths(t *testing.T, strict bool) {
+	t.Helper()
+	previous := strictPaths
+	strictPaths = strict
+	t.Cleanup(func() { strictPaths = previous })
+}
+
+// routeStatus sends an action request to path through the normalized routes of s
+func routeStatus(t *testing.T, s *Server, path string) int {
+	t.Helper()
+	mux := http.NewServeMux()
+	routes(mux, mux, s)
+	rec := httptest.NewRecorder()
+	normalizePaths(mux).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(actionRequest(t, partnerHeader("org_acme")))))
+	return rec.Code
+}
+
+func TestPathVariantsRouteUnlessStrict(t *testing.T) {
+	s := NewServer(testEntitlements)
+	variants := []string{"/token-validation/", "/Token-Validation", "/TOKEN-VALIDATION/"}
+
+	withStrictPaths(t, false)
+	for _, path := range append(variants, "/token-validation//") {
+		if got := routeStatus(t, s, path); got != http.StatusOK {
+			t.Errorf("lenient %s: status = %d, want %d", path, got, http.StatusOK)
+		}
+	}
+
+	withStrictPaths(t, true)
+	if got := routeStatus(t, s, "/token-validation"); got != http.StatusOK {
+		t.Errorf("strict exact path: status = %d, want %d", got, http.StatusOK)
+	}
+	for _, path := range variants {
+		if got := routeStatus(t, s, path); got != http.StatusNotFound {
+			t.Errorf("strict %s: status = %d, want %d", path, got, http.StatusNotFound)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Default PDP mapping. The request names the subject, action and resource; the
+// response carries a decision and obligations naming the scopes to grant:
+//
+//	{"decision": "Permit", "obligations": [{"scope": "orders:read"}]}
+const (
+	defaultPDPAction           = "issue_token"
+	defaultPDPRequestTemplate  = `{"subject":{{json .Subject}},"action":{{json .Action}},"resource":{{json .Resource}}}`
+	defaultPDPDecisionTemplate = `{{.decision}}`
+	defaultPDPScopesTemplate   = `{{range .obligations}}{{.scope}} {{end}}`
+)
+
+// maxPDPResponseBytes bounds a PDP decision response
+const maxPDPResponseBytes = 1 << 20
+
+// PDP decisions; anything else (NotApplicable, Indeterminate) grants nothing
+const (
+	pdpPermit = "permit"
+	pdpDeny   = "deny"
+)
+
+// restPDPSource asks an external REST policy decision point (PDP) about every
+// subject of a request, and turns its decisions into entitlements: a Permit
+// grants the scopes its obligations name, a Deny blocks the token like a deny
+// entitlement. The request body and the reading of the response are templates,
+// so the PDP's own format can be mapped without code.
+type restPDPSource struct {
+	url string
+	// name is url without credentials, for logs
+	name string
+	// authorization is sent as the Authorization header when set
+	authorization string
+	client        *http.Client
+	// action is the action asked about
+	action string
+	// request renders the request body from a pdpRequest
+	request *template.Template
+	// decision and scopes render the decision and the space-separated scopes
+	// from the decoded response
+	decision *template.Template
+	scopes   *template.Template
+}
+
+// pdpRequest is the data of the request template
+type pdpRequest struct {
+	Subject   Subject
+	Action    string
+	Resource  map[string]string
+	ClientID  string
+	GrantType string
+	// Scopes are the scopes requested for the token
+	Scopes []string
+}
+
+// pdpTemplateFuncs are available in the PDP templates; json encodes a value so
+// it can be embedded in the request body
+var pdpTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// newRESTPDPSource configures a PDP source for rawURL, reading PDP_AUTHORIZATION,
+// PDP_TIMEOUT, PDP_ACTION and the PDP_REQUEST_TEMPLATE, PDP_DECISION_TEMPLATE and
+// PDP_SCOPES_TEMPLATE mappings
+func newRESTPDPSource(rawURL string) (*restPDPSource, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid PDP_URL %q (expected an http or https URL)", rawURL)
+	}
+
+	timeout := 2 * time.Second
+	if v := os.Getenv("PDP_TIMEOUT"); v != "" {
+		d, err := parseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid PDP_TIMEOUT %q", v)
+		}
+		timeout = d
+	}
+	action := defaultPDPAction
+	if v := os.Getenv("PDP_ACTION"); v != "" {
+		action = v
+	}
+
+	source := &restPDPSource{
+		url:           rawURL,
+		name:          redactURL(u),
+		authorization: os.Getenv("PDP_AUTHORIZATION"),
+		client:        &http.Client{Timeout: timeout},
+		action:        action,
+	}
+	templates := []struct {
+		env      string
+		fallback string
+		target   **template.Template
+	}{
+		{"PDP_REQUEST_TEMPLATE", defaultPDPRequestTemplate, &source.request},
+		{"PDP_DECISION_TEMPLATE", defaultPDPDecisionTemplate, &source.decision},
+		{"PDP_SCOPES_TEMPLATE", defaultPDPScopesTemplate, &source.scopes},
+	}
+	for _, t := range templates {
+		text := os.Getenv(t.env)
+		if text == "" {
+			text = t.fallback
+		}
+		tmpl, err := template.New(t.env).Funcs(pdpTemplateFuncs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", t.env, err)
+		}
+		*t.target = tmpl
+	}
+	return source, nil
+}
+
+// EntitlementsFor asks the PDP about each subject of the request. Decisions are
+// made per request, so the entitlements are never cached.
+func (p *restPDPSource) EntitlementsFor(ctx context.Context, q EntitlementsQuery) (*EntitlementsData, error) {
+	data := &EntitlementsData{loadID: entitlementLoads.Add(1), live: true}
+	for _, subject := range q.Subjects {
+		entitlement, ok, err := p.decide(ctx, pdpRequest{
+			Subject:   subject,
+			Action:    p.action,
+			Resource:  q.Resource,
+			ClientID:  q.Event.Request.ClientID,
+			GrantType: q.Event.Request.GrantType,
+			Scopes:    q.Event.AccessToken.Scopes,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			data.add(entitlement)
+		}
+	}
+	return data, nil
+}
+
+// decide asks the PDP about one subject. It reports false when the decision
+// grants nothing.
+func (p *restPDPSource) decide(ctx context.Context, request pdpRequest) (Entitlement, bool, error) {
+	var body bytes.Buffer
+	if err := p.request.Execute(&body, request); err != nil {
+		return Entitlement{}, false, fmt.Errorf("failed to build PDP request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, &body)
+	if err != nil {
+		return Entitlement{}, false, fmt.Errorf("failed to build PDP request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.authorization != "" {
+		req.Header.Set("Authorization", p.authorization)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = p.name
+		}
+		return Entitlement{}, false, fmt.Errorf("PDP request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Entitlement{}, false, fmt.Errorf("PDP request failed: unexpected status %d", resp.StatusCode)
+	}
+	var decoded interface{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxPDPResponseBytes)).Decode(&decoded); err != nil {
+		return Entitlement{}, false, fmt.Errorf("failed to parse PDP response: %w", err)
+	}
+
+	decision, err := renderPDPTemplate(p.decision, decoded)
+	if err != nil {
+		return Entitlement{}, false, fmt.Errorf("failed to read PDP decision: %w", err)
+	}
+	entitlement := Entitlement{EntitlementID: "pdp", Subject: request.Subject}
+	switch strings.ToLower(strings.TrimSpace(decision)) {
+	case pdpPermit:
+		scopes, err := renderPDPTemplate(p.scopes, decoded)
+		if err != nil {
+			return Entitlement{}, false, fmt.Errorf("failed to read PDP obligations: %w", err)
+		}
+		entitlement.scopes = strings.Fields(scopes)
+		return entitlement, len(entitlement.scopes) > 0, nil
+	case pdpDeny:
+		entitlement.Effect = effectDeny
+		return entitlement, true, nil
+	default:
+		slog.Debug("PDP decision grants nothing", "subject_id", request.Subject.ID, "decision", decision)
+		return Entitlement{}, false, nil
+	}
+}
+
+// renderPDPTemplate executes a response mapping template over the decoded response
+func renderPDPTemplate(tmpl *template.Template, response interface{}) (string, error) {
+	var out strings.Builder
+	if err := tmpl.Execute(&out, response); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
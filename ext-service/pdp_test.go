@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakePDP serves response to every decision request, recording the last
+// request body and Authorization header
+type fakePDP struct {
+	response      string
+	status        int
+	body          map[string]interface{}
+	authorization string
+}
+
+func (f *fakePDP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	raw, _ := io.ReadAll(r.Body)
+	f.body = nil
+	json.Unmarshal(raw, &f.body)
+	f.authorization = r.Header.Get("Authorization")
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+	}
+	io.WriteString(w, f.response)
+}
+
+// pdpServer starts pdp and returns a server asking it for decisions
+func pdpServer(t *testing.T, pdp *fakePDP) *Server {
+	t.Helper()
+	server := httptest.NewServer(pdp)
+	t.Cleanup(server.Close)
+	source, err := newRESTPDPSource(server.URL)
+	if err != nil {
+		t.Fatalf("newRESTPDPSource: %v", err)
+	}
+	return NewServer(source)
+}
+
+func TestPDPPermitObligationsBecomeScopes(t *testing.T) {
+	t.Setenv("PDP_AUTHORIZATION", "Bearer pdp-token")
+	pdp := &fakePDP{response: `{"decision":"Permit","obligations":[{"scope":"orders:read"},{"scope":"orders:write"}]}`}
+	s := pdpServer(t, pdp)
+
+	_, resp := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+
+	if scopes := grantedScopes(resp.Operations); len(scopes) != 2 || scopes[0] != "orders:read" || scopes[1] != "orders:write" {
+		t.Errorf("granted scopes = %v, want [orders:read orders:write]", scopes)
+	}
+	if pdp.authorization != "Bearer pdp-token" {
+		t.Errorf("Authorization = %q, want the configured value", pdp.authorization)
+	}
+	want := `{"action":"issue_token","resource":{},"subject":{"id":"org_acme","type":"partner"}}`
+	if got := mustJSON(t, pdp.body); got != want {
+		t.Errorf("PDP request = %s, want %s", got, want)
+	}
+}
+
+func TestPDPDenyFailsTheRequest(t *testing.T) {
+	s := pdpServer(t, &fakePDP{response: `{"decision":"Deny"}`})
+
+	_, resp := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+
+	if resp.ActionStatus != "FAILED" || resp.FailureReason != "access_denied" {
+		t.Errorf("response = %+v, want FAILED access_denied", resp)
+	}
+}
+
+func TestPDPNotApplicableGrantsNothing(t *testing.T) {
+	s := pdpServer(t, &fakePDP{response: `{"decision":"NotApplicable"}`})
+
+	_, resp := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+
+	if resp.ActionStatus != "SUCCESS" || len(resp.Operations) != 0 {
+		t.Errorf("response = %+v, want SUCCESS without operations", resp)
+	}
+}
+
+func TestPDPErrorFailsClosed(t *testing.T) {
+	s := pdpServer(t, &fakePDP{status: http.StatusInternalServerError, response: `{}`})
+
+	rec, resp := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+
+	if rec.Code != http.StatusInternalServerError || resp.ActionStatus != "ERROR" {
+		t.Errorf("status = %d, response = %+v, want 500 ERROR", rec.Code, resp)
+	}
+}
+
+func TestPDPCustomMapping(t *testing.T) {
+	t.Setenv("PDP_ACTION", "token")
+	t.Setenv("PDP_REQUEST_TEMPLATE", `{"Request":{"AccessSubject":{"Id":{{json .Subject.ID}}},"Action":{"Id":{{json .Action}}},"Client":{{json .ClientID}}}}`)
+	t.Setenv("PDP_DECISION_TEMPLATE", `{{(index .Response 0).Decision}}`)
+	t.Setenv("PDP_SCOPES_TEMPLATE", `{{range (index .Response 0).Obligations}}{{if eq .Id "grant-scope"}}{{.Value}} {{end}}{{end}}`)
+	pdp := &fakePDP{response: `{"Response":[{"Decision":"Permit","Obligations":[
+		{"Id":"grant-scope","Value":"reports:view"},
+		{"Id":"log","Value":"ignored"}
+	]}]}`}
+	s := pdpServer(t, pdp)
+
+	_, resp := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+
+	if scopes := grantedScopes(resp.Operations); len(scopes) != 1 || scopes[0] != "reports:view" {
+		t.Errorf("granted scopes = %v, want [reports:view]", scopes)
+	}
+	want := `{"Request":{"AccessSubject":{"Id":"org_acme"},"Action":{"Id":"token"},"Client":"client"}}`
+	if got := mustJSON(t, pdp.body); got != want {
+		t.Errorf("PDP request = %s, want %s", got, want)
+	}
+}
+
+func TestNewRESTPDPSourceRejectsInvalidSettings(t *testing.T) {
+	if _, err := newRESTPDPSource("pdp.example.com"); err == nil {
+		t.Error("newRESTPDPSource accepted a URL without a scheme")
+	}
+	t.Setenv("PDP_SCOPES_TEMPLATE", "{{range .obligations}")
+	if _, err := newRESTPDPSource("https://pdp.example.com"); err == nil {
+		t.Error("newRESTPDPSource accepted an invalid PDP_SCOPES_TEMPLATE")
+	}
+}
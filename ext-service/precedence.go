@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Entitlement source names used by SOURCE_PRECEDENCE
+const (
+	sourceDocument = "document"
+	sourcePDP      = "pdp"
+)
+
+// namedSource is an entitlements provider known by its SOURCE_PRECEDENCE name
+type namedSource struct {
+	name     string
+	provider EntitlementsProvider
+}
+
+// precedenceEntitlements combines the entitlements of several sources, listed
+// from the highest precedence down. Sources granting different scopes to a
+// subject add up; when they disagree on whether a subject is granted or denied,
+// the decision of the highest-precedence source that made one wins and the
+// other sources' entitlements for that subject are dropped.
+type precedenceEntitlements struct {
+	sources []namedSource
+}
+
+// sourceDecision is how a source decided about a subject
+type sourceDecision struct {
+	source string
+	deny   bool
+}
+
+// EntitlementsFor queries every source in precedence order, or only the source
+// the request selects. A failing source is skipped, so the others still decide;
+// the request fails only when all of them fail. The result is assembled for
+// this request, so it is never cached.
+func (p *precedenceEntitlements) EntitlementsFor(ctx context.Context, q EntitlementsQuery) (*EntitlementsData, error) {
+	logger := loggerFrom(ctx)
+	if q.Source != "" {
+		for _, source := range p.sources {
+			if source.name == q.Source {
+				return source.provider.EntitlementsFor(ctx, q)
+			}
+		}
+		logger.Warn("Selected entitlement source is not configured, using every source", "source", q.Source)
+	}
+	subjects := make(map[Subject]bool, len(q.Subjects))
+	for _, subject := range q.Subjects {
+		subjects[subject] = true
+	}
+
+	merged := &EntitlementsData{loadID: entitlementLoads.Add(1), live: true}
+	decided := make(map[string]sourceDecision)
+	var errs []error
+	for _, source := range p.sources {
+		data, err := source.provider.EntitlementsFor(ctx, q)
+		if err != nil {
+			logger.Warn("Entitlement source failed, skipping it", "source", source.name, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", source.name, err))
+			continue
+		}
+
+		// A source's own entitlements never conflict with each other; its
+		// decisions only bind the sources after it
+		decisions := make(map[string]bool)
+		for _, entitlement := range data.forSubjects(subjects) {
+			key := subjectKey(entitlement.Subject)
+			deny := entitlement.Effect == effectDeny
+			if winner, ok := decided[key]; ok && winner.deny != deny {
+				logger.Warn("Entitlement sources disagree, keeping the decision of the higher-precedence source",
+					"subject_type", entitlement.Subject.Type, "subject_id", entitlement.Subject.ID,
+					"source", winner.source, "denied", winner.deny,
+					"overridden_source", source.name, "overridden_entitlement_id", entitlement.EntitlementID)
+				continue
+			}
+			merged.add(entitlement)
+			// Only an entitlement that applies to the request decides for its
+			// subject; an unmet constraint leaves the decision to later sources
+			if evaluateConstraints(entitlement.Constraints, q.Event, q.Now) {
+				decisions[key] = decisions[key] || deny
+			}
+		}
+		for key, deny := range decisions {
+			if _, ok := decided[key]; !ok {
+				decided[key] = sourceDecision{source: source.name, deny: deny}
+			}
+		}
+	}
+	if len(errs) == len(p.sources) {
+		return nil, fmt.Errorf("every entitlement source failed: %w", errors.Join(errs...))
+	}
+	return merged, nil
+}
+
+// parseSourcePrecedence parses SOURCE_PRECEDENCE, a comma-separated list of
+// source names from the highest precedence down, against the available sources
+func parseSourcePrecedence(v string, available map[string]EntitlementsProvider) ([]namedSource, error) {
+	var sources []namedSource
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(v, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if name != sourceDocument && name != sourcePDP {
+			return nil, fmt.Errorf("invalid SOURCE_PRECEDENCE source %q (expected %s or %s)", name, sourceDocument, sourcePDP)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("invalid SOURCE_PRECEDENCE: %s is listed twice", name)
+		}
+		seen[name] = true
+		provider, ok := available[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid SOURCE_PRECEDENCE: source %s is not configured", name)
+		}
+		sources = append(sources, namedSource{name: name, provider: provider})
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("invalid SOURCE_PRECEDENCE: no sources listed")
+	}
+	return sources, nil
+}
+
+// configuredSources returns the sources the environment configures: the
+// entitlements document always, and the PDP when PDP_URL is set
+func configuredSources() (map[string]EntitlementsProvider, error) {
+	sources := map[string]EntitlementsProvider{sourceDocument: configuredEntitlements{}}
+	if v := os.Getenv("PDP_URL"); v != "" {
+		pdp, err := newRESTPDPSource(v)
+		if err != nil {
+			return nil, err
+		}
+		sources[sourcePDP] = pdp
+	}
+	return sources, nil
+}
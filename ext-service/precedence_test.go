@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// denyEntitlements blocks org_acme
+var denyEntitlements = fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{
+	{EntitlementID: "deny_acme", Subject: Subject{Type: "partner", ID: "org_acme"}, Effect: effectDeny},
+}}}
+
+// precedenceServer combines sources, highest precedence first
+func precedenceServer(sources ...namedSource) *Server {
+	return NewServer(&precedenceEntitlements{sources: sources})
+}
+
+func TestPrecedenceHigherSourceGrantWins(t *testing.T) {
+	logs := withDefaultLogger(t)
+	s := precedenceServer(
+		namedSource{name: sourcePDP, provider: testEntitlements},
+		namedSource{name: sourceDocument, provider: denyEntitlements},
+	)
+
+	_, resp := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+
+	if scopes := grantedScopes(resp.Operations); resp.ActionStatus != "SUCCESS" || len(scopes) != 1 || scopes[0] != "partner:read" {
+		t.Errorf("response = %+v, want partner:read granted", resp)
+	}
+	if out := logs.String(); !strings.Contains(out, "Entitlement sources disagree") || !strings.Contains(out, `"overridden_entitlement_id":"deny_acme"`) {
+		t.Errorf("logs = %s, want the conflict logged", out)
+	}
+}
+
+func TestPrecedenceHigherSourceDenyWins(t *testing.T) {
+	s := precedenceServer(
+		namedSource{name: sourceDocument, provider: denyEntitlements},
+		namedSource{name: sourcePDP, provider: testEntitlements},
+	)
+
+	_, resp := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+
+	if resp.ActionStatus != "FAILED" || resp.FailureReason != "access_denied" {
+		t.Errorf("response = %+v, want FAILED access_denied", resp)
+	}
+}
+
+func TestPrecedenceCombinesAgreeingSources(t *testing.T) {
+	write := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{
+		{EntitlementID: "ent_write", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "write"},
+	}}}
+	s := precedenceServer(
+		namedSource{name: sourcePDP, provider: testEntitlements},
+		namedSource{name: sourceDocument, provider: write},
+	)
+
+	_, resp := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+
+	if scopes := grantedScopes(resp.Operations); len(scopes) != 2 || scopes[0] != "partner:read" || scopes[1] != "partner:write" {
+		t.Errorf("granted scopes = %v, want [partner:read partner:write]", scopes)
+	}
+}
+
+func TestPrecedenceUnmetDenyLeavesDecisionToLaterSources(t *testing.T) {
+	conditional := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{
+		{EntitlementID: "deny_blocked", Subject: Subject{Type: "partner", ID: "org_acme"}, Effect: effectDeny,
+			Constraints: map[string]interface{}{"claims": map[string]interface{}{"status": "blocked"}}},
+	}}}
+	s := precedenceServer(
+		namedSource{name: sourceDocument, provider: conditional},
+		namedSource{name: sourcePDP, provider: testEntitlements},
+	)
+
+	_, resp := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+
+	if scopes := grantedScopes(resp.Operations); len(scopes) != 1 || scopes[0] != "partner:read" {
+		t.Errorf("granted scopes = %v, want [partner:read] from the later source", scopes)
+	}
+}
+
+func TestPrecedenceSkipsFailingSource(t *testing.T) {
+	s := precedenceServer(
+		namedSource{name: sourcePDP, provider: fakeEntitlements{err: errTest}},
+		namedSource{name: sourceDocument, provider: testEntitlements},
+	)
+	if _, resp := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme"))); len(grantedScopes(resp.Operations)) != 1 {
+		t.Errorf("response = %+v, want the working source's scope", resp)
+	}
+
+	s = precedenceServer(
+		namedSource{name: sourcePDP, provider: fakeEntitlements{err: errTest}},
+		namedSource{name: sourceDocument, provider: fakeEntitlements{err: errTest}},
+	)
+	if rec, _ := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme"))); rec.Code != http.StatusInternalServerError {
+		t.Errorf("status with every source failing = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestParseSourcePrecedence(t *testing.T) {
+	available := map[string]EntitlementsProvider{sourceDocument: testEntitlements, sourcePDP: denyEntitlements}
+
+	sources, err := parseSourcePrecedence(" PDP , document", available)
+	if err != nil || len(sources) != 2 || sources[0].name != sourcePDP || sources[1].name != sourceDocument {
+		t.Errorf("sources = %+v, %v, want pdp then document", sources, err)
+	}
+	for _, v := range []string{"pdp,ldap", "pdp,pdp", " , "} {
+		if _, err := parseSourcePrecedence(v, available); err == nil {
+			t.Errorf("parseSourcePrecedence accepted %q", v)
+		}
+	}
+	delete(available, sourcePDP)
+	if _, err := parseSourcePrecedence("pdp,document", available); err == nil || !strings.Contains(err.Error(), "not configured") {
+		t.Errorf("error = %v, want pdp reported as not configured", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Preprocessor is one step run on the decoded request before matching. Steps run
+// in order and may mutate the request for the steps after them.
+type Preprocessor interface {
+	Process(ctx context.Context, req *Request) error
+}
+
+// PreprocessorFunc adapts a function to the Preprocessor interface
+type PreprocessorFunc func(ctx context.Context, req *Request) error
+
+// Process calls f(ctx, req)
+func (f PreprocessorFunc) Process(ctx context.Context, req *Request) error {
+	return f(ctx, req)
+}
+
+// builtinPreprocessors are the steps selectable by name in PREPROCESSORS
+var builtinPreprocessors = map[string]Preprocessor{
+	"lowercaseHeaderNames": PreprocessorFunc(lowercaseHeaderNames),
+	"trimHeaderValues":     PreprocessorFunc(trimHeaderValues),
+}
+
+// configurePreprocessors builds the chain from PREPROCESSORS, a comma-separated
+// list of step names, and reads PREPROCESSOR_FAILURE_POLICY
+func (c *Config) configurePreprocessors(names string, policy string) error {
+	c.preprocessors = nil
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		step, ok := builtinPreprocessors[name]
+		if !ok {
+			return fmt.Errorf("unknown preprocessor %q", name)
+		}
+		c.preprocessors = append(c.preprocessors, step)
+	}
+
+	switch policy {
+	case "", "reject":
+		c.failOnPreprocessorError = true
+	case "continue":
+		c.failOnPreprocessorError = false
+	default:
+		return fmt.Errorf("invalid PREPROCESSOR_FAILURE_POLICY %q (expected reject or continue)", policy)
+	}
+	return nil
+}
+
+// runPreprocessors runs the chain on req, stopping at the first error when the
+// failure policy is reject
+func (c *Config) runPreprocessors(ctx context.Context, req *Request) error {
+	for i, step := range c.preprocessors {
+		if err := step.Process(ctx, req); err != nil {
+			if c.failOnPreprocessorError {
+				return fmt.Errorf("preprocessor %d: %w", i, err)
+			}
+			loggerFrom(ctx).Warn("Preprocessor failed, continuing", "preprocessor", i, "error", err)
+		}
+	}
+	return nil
+}
+
+// lowercaseHeaderNames lower-cases additional header names so lookups match
+// regardless of how the gateway cased them
+func lowercaseHeaderNames(ctx context.Context, req *Request) error {
+	for i := range req.Event.Request.AdditionalHeaders {
+		header := &req.Event.Request.AdditionalHeaders[i]
+		header.Name = strings.ToLower(header.Name)
+	}
+	return nil
+}
+
+// trimHeaderValues trims surrounding whitespace from additional header values
+func trimHeaderValues(ctx context.Context, req *Request) error {
+	for i := range req.Event.Request.AdditionalHeaders {
+		values := req.Event.Request.AdditionalHeaders[i].Value
+		for j := range values {
+			values[j] = strings.TrimSpace(values[j])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestPreprocessorChainSeesEarlierMutations(t *testing.T) {
+	var seen string
+	s := NewServer(testEntitlements)
+	s.preprocessors = []Preprocessor{
+		// Move the partner ID from a custom header to the partner header
+		PreprocessorFunc(func(ctx context.Context, req *Request) error {
+			headers := req.Event.Request.AdditionalHeaders
+			for i := range headers {
+				if headers[i].Name == "x-org" {
+					headers[i].Name = partnerHeader("").Name
+				}
+			}
+			return nil
+		}),
+		PreprocessorFunc(func(ctx context.Context, req *Request) error {
+			seen = getHeaderValue(req.Event.Request.AdditionalHeaders, partnerHeader("").Name)
+			return nil
+		}),
+	}
+
+	_, resp := serve(t, s, http.MethodPost, actionRequest(t, Header{Name: "x-org", Value: []string{"org_acme"}}))
+
+	if seen != "org_acme" {
+		t.Errorf("second step saw partner %q, want the first step's mutation", seen)
+	}
+	if scopes := grantedScopes(resp.Operations); len(scopes) != 1 || scopes[0] != "partner:read" {
+		t.Errorf("granted scopes = %v, want [partner:read] for the rewritten header", scopes)
+	}
+}
+
+func TestPreprocessorFailurePolicy(t *testing.T) {
+	calls := 0
+	failing := PreprocessorFunc(func(ctx context.Context, req *Request) error { return errors.New("lookup failed") })
+	counting := PreprocessorFunc(func(ctx context.Context, req *Request) error { calls++; return nil })
+
+	s := NewServer(testEntitlements)
+	s.preprocessors = []Preprocessor{failing, counting}
+	if rec, _ := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme"))); rec.Code != http.StatusInternalServerError || calls != 0 {
+		t.Errorf("reject: status = %d, later steps run %d times, want %d and none", rec.Code, calls, http.StatusInternalServerError)
+	}
+
+	s.failOnPreprocessorError = false
+	if _, resp := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme"))); resp.ActionStatus != "SUCCESS" || calls != 1 {
+		t.Errorf("continue: response = %+v, later steps run %d times, want SUCCESS and once", resp, calls)
+	}
+}
+
+func TestConfigurePreprocessors(t *testing.T) {
+	cfg := defaultConfig()
+	if err := cfg.configurePreprocessors("lowercaseHeaderNames, trimHeaderValues", "continue"); err != nil {
+		t.Fatalf("configurePreprocessors: %v", err)
+	}
+	if len(cfg.preprocessors) != 2 || cfg.failOnPreprocessorError {
+		t.Errorf("chain = %d steps, fail = %v, want 2 steps continuing on failure", len(cfg.preprocessors), cfg.failOnPreprocessorError)
+	}
+
+	req := Request{Event: Event{Request: RequestData{AdditionalHeaders: []Header{{Name: "X-B2B-USP-Partner", Value: []string{" org_acme "}}}}}}
+	if err := cfg.runPreprocessors(context.Background(), &req); err != nil {
+		t.Fatalf("runPreprocessors: %v", err)
+	}
+	if header := req.Event.Request.AdditionalHeaders[0]; header.Name != "x-b2b-usp-partner" || header.Value[0] != "org_acme" {
+		t.Errorf("header = %+v, want it lower-cased and trimmed", header)
+	}
+
+	if err := cfg.configurePreprocessors("geoip", ""); err == nil {
+		t.Error("configurePreprocessors accepted an unknown step")
+	}
+	if err := cfg.configurePreprocessors("", "ignore"); err == nil {
+		t.Error("configurePreprocessors accepted an unknown failure policy")
+	}
+}
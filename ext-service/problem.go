@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// Error body formats selected by ERROR_FORMAT
+const (
+	errorFormatAsgardeo = "asgardeo"
+	errorFormatProblem  = "problem+json"
+)
+
+// problemTypePrefix namespaces problem types by the Asgardeo error message, e.g.
+// "urn:ext-service:error:rate_limited"
+const problemTypePrefix = "urn:ext-service:error:"
+
+// problemErrors sends ERROR responses as RFC 7807 Problem Details
+var problemErrors bool
+
+// configureErrorFormat reads ERROR_FORMAT
+func configureErrorFormat() error {
+	switch format := os.Getenv("ERROR_FORMAT"); format {
+	case "", errorFormatAsgardeo:
+		problemErrors = false
+	case errorFormatProblem:
+		problemErrors = true
+	default:
+		return fmt.Errorf("invalid ERROR_FORMAT %q (expected %s or %s)", format, errorFormatAsgardeo, errorFormatProblem)
+	}
+	return nil
+}
+
+// problemDetails is an RFC 7807 error body
+type problemDetails struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// writeProblem writes the ERROR response resp as application/problem+json. The
+// instance is the request ID, which instrument has already set on the response.
+func writeProblem(w http.ResponseWriter, status int, resp Response) {
+	problem := problemDetails{
+		Type:     problemTypePrefix + resp.ErrorMessage,
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   resp.ErrorDescription,
+		Instance: w.Header().Get(requestIDHeader),
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(problem); err != nil {
+		slog.Error("Error encoding problem details", "error", err)
+	}
+}
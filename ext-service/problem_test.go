@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withErrorFormat configures ERROR_FORMAT for the duration of a test
+func withErrorFormat(t *testing.T, format string) {
+	t.Helper()
+	t.Setenv("ERROR_FORMAT", format)
+	if err := configureErrorFormat(); err != nil {
+		t.Fatalf("configureErrorFormat: %v", err)
+	}
+	t.Cleanup(func() { problemErrors = false })
+}
+
+// serveWithRequestID sends body to the handler of s behind logRequests, with
+// the given request ID
+func serveWithRequestID(s *Server, body string, id string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/token-validation", strings.NewReader(body))
+	r.Header.Set(requestIDHeader, id)
+	rec := httptest.NewRecorder()
+	logRequests(http.HandlerFunc(s.handler)).ServeHTTP(rec, r)
+	return rec
+}
+
+func TestErrorsAsProblemDetails(t *testing.T) {
+	withErrorFormat(t, errorFormatProblem)
+	s := NewServer(fakeEntitlements{err: errTest})
+
+	rec := serveWithRequestID(s, actionRequest(t, partnerHeader("org_acme")), "req-42")
+
+	if got := rec.Header().Get("Content-Type"); got != "application/problem+json" {
+		t.Errorf("Content-Type = %q, want application/problem+json", got)
+	}
+	want := `{"type":"urn:ext-service:error:server_error","title":"Internal Server Error","status":500,"detail":"Entitlements could not be loaded","instance":"req-42"}` + "\n"
+	if rec.Code != http.StatusInternalServerError || rec.Body.String() != want {
+		t.Errorf("status = %d, body = %s, want %d and %s", rec.Code, rec.Body.String(), http.StatusInternalServerError, want)
+	}
+
+	// Only ERROR responses change format
+	rec = serveWithRequestID(NewServer(testEntitlements), actionRequest(t, partnerHeader("org_acme")), "req-43")
+	if got := rec.Header().Get("Content-Type"); got != "application/json;charset=UTF-8" || !strings.Contains(rec.Body.String(), `"actionStatus":"SUCCESS"`) {
+		t.Errorf("Content-Type = %q, body = %s, want a SUCCESS action response", got, rec.Body.String())
+	}
+}
+
+func TestErrorsDefaultToAsgardeoFormat(t *testing.T) {
+	withErrorFormat(t, "")
+
+	rec := serveWithRequestID(NewServer(fakeEntitlements{err: errTest}), actionRequest(t, partnerHeader("org_acme")), "req-42")
+
+	if got := rec.Header().Get("Content-Type"); got != "application/json;charset=UTF-8" {
+		t.Errorf("Content-Type = %q, want application/json;charset=UTF-8", got)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, `"actionStatus":"ERROR","errorMessage":"server_error"`) {
+		t.Errorf("body = %s, want an Asgardeo ERROR response", body)
+	}
+}
+
+func TestConfigureErrorFormatRejectsUnknownFormat(t *testing.T) {
+	t.Setenv("ERROR_FORMAT", "xml")
+	if err := configureErrorFormat(); err == nil {
+		t.Error("configureErrorFormat accepted xml")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// EntitlementsProvider supplies the entitlements an action request is matched
+// against
+type EntitlementsProvider interface {
+	// EntitlementsFor returns the entitlements that apply to the request. ctx
+	// is the request's context, bounding any call the provider makes.
+	EntitlementsFor(ctx context.Context, q EntitlementsQuery) (*EntitlementsData, error)
+}
+
+// EntitlementsQuery describes the request entitlements are provided for.
+// Providers serving a whole document can ignore all but the event; a decision
+// point asks about the resolved subjects.
+type EntitlementsQuery struct {
+	Event Event
+	// Subjects are the subjects resolved for the request, in a stable order
+	Subjects []Subject
+	// Resource holds the attributes of the requested resource, if any
+	Resource map[string]string
+	// Source is the entitlement source a verified partner assertion selects;
+	// empty leaves the choice to the configuration
+	Source string
+	Now    time.Time
+}
+
+// configuredEntitlements provides the entitlements configured by the environment:
+// the default file (or ENTITLEMENTS_URL) and per-tenant files
+type configuredEntitlements struct{}
+
+func (configuredEntitlements) EntitlementsFor(_ context.Context, q EntitlementsQuery) (*EntitlementsData, error) {
+	return loadEntitlementsForEvent(q.Event, q.Now)
+}
+
+// configureEntitlementsProvider returns the provider requests are matched
+// against. With SOURCE_PRECEDENCE set, the listed sources are combined in that
+// order of precedence. Otherwise the REST PDP at PDP_URL is used when it is set,
+// and the configured entitlements when it is not.
+func configureEntitlementsProvider() (EntitlementsProvider, error) {
+	sources, err := configuredSources()
+	if err != nil {
+		return nil, err
+	}
+	if v := os.Getenv("SOURCE_PRECEDENCE"); v != "" {
+		ordered, err := parseSourcePrecedence(v, sources)
+		if err != nil {
+			return nil, err
+		}
+		if len(ordered) == 1 {
+			return ordered[0].provider, nil
+		}
+		return &precedenceEntitlements{sources: ordered}, nil
+	}
+	if pdp, ok := sources[sourcePDP]; ok {
+		return pdp, nil
+	}
+	return sources[sourceDocument], nil
+}
+
+// Server handles action requests. The entitlements it matches against come from
+// its provider and its settings from its Config, so both can be replaced
+// without touching the environment.
+type Server struct {
+	entitlements EntitlementsProvider
+	Config
+}
+
+// NewServer creates a Server matching against entitlements with the default settings
+func NewServer(entitlements EntitlementsProvider) *Server {
+	return NewServerWithConfig(entitlements, defaultConfig())
+}
+
+// NewServerWithConfig creates a Server matching against entitlements with cfg
+func NewServerWithConfig(entitlements EntitlementsProvider, cfg Config) *Server {
+	return &Server{entitlements: entitlements, Config: cfg}
+}
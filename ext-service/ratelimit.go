@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// sharedRateLimitKey is the bucket used when a request has no value for the key
+const sharedRateLimitKey = "\x00shared"
+
+// rateLimitKey says where the rate limiter key is read from
+type rateLimitKey struct {
+	// Source is "partner", "header", "additionalHeader" or "claim"
+	Source string
+	Name   string
+}
+
+// defaultRateLimitIdleTTL is how long an unused bucket is kept before it is evicted
+const defaultRateLimitIdleTTL = 10 * time.Minute
+
+// keyedRateLimiter keeps one token bucket per key
+type keyedRateLimiter struct {
+	limit rate.Limit
+	burst int
+	key   rateLimitKey
+
+	mu       sync.Mutex
+	limiters map[string]*limiterEntry
+}
+
+// limiterEntry is a bucket and the last time it was used
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// configureRateLimit reads RATELIMIT_RPS, RATELIMIT_BURST, RATELIMIT_KEY and
+// RATELIMIT_IDLE_TTL, and starts the idle bucket sweeper
+func (c *Config) configureRateLimit() error {
+	rps := os.Getenv("RATELIMIT_RPS")
+	if rps == "" {
+		return nil
+	}
+	limit, err := strconv.ParseFloat(rps, 64)
+	if err != nil || limit <= 0 {
+		return fmt.Errorf("invalid RATELIMIT_RPS %q", rps)
+	}
+
+	burst := int(limit)
+	if burst < 1 {
+		burst = 1
+	}
+	if v := os.Getenv("RATELIMIT_BURST"); v != "" {
+		burst, err = strconv.Atoi(v)
+		if err != nil || burst <= 0 {
+			return fmt.Errorf("invalid RATELIMIT_BURST %q", v)
+		}
+	}
+
+	key, err := parseRateLimitKey(os.Getenv("RATELIMIT_KEY"))
+	if err != nil {
+		return err
+	}
+
+	idleTTL := defaultRateLimitIdleTTL
+	if v := os.Getenv("RATELIMIT_IDLE_TTL"); v != "" {
+		idleTTL, err = parseDuration(v)
+		if err != nil || idleTTL <= 0 {
+			return fmt.Errorf("invalid RATELIMIT_IDLE_TTL %q", v)
+		}
+	}
+	// A bucket idle for longer than it takes to refill is indistinguishable
+	// from a new one, so never evict before that.
+	if refill := time.Duration(float64(burst) / limit * float64(time.Second)); idleTTL < refill {
+		idleTTL = refill
+	}
+
+	c.rateLimiter = newKeyedRateLimiter(rate.Limit(limit), burst, key)
+	go c.rateLimiter.sweepEvery(idleTTL/2, idleTTL)
+	return nil
+}
+
+// parseRateLimitKey parses RATELIMIT_KEY: "partner" (the default),
+// "header:<name>", "additionalHeader:<name>" or "claim:<name>"
+func parseRateLimitKey(value string) (rateLimitKey, error) {
+	if value == "" || value == "partner" {
+		return rateLimitKey{Source: "partner"}, nil
+	}
+	source, name, ok := strings.Cut(value, ":")
+	if !ok || name == "" {
+		return rateLimitKey{}, fmt.Errorf("invalid RATELIMIT_KEY %q", value)
+	}
+	switch source {
+	case "header", "additionalHeader", "claim":
+		return rateLimitKey{Source: source, Name: name}, nil
+	default:
+		return rateLimitKey{}, fmt.Errorf("invalid RATELIMIT_KEY source %q (expected partner, header, additionalHeader or claim)", source)
+	}
+}
+
+// newKeyedRateLimiter creates a limiter allowing limit requests per second per key
+func newKeyedRateLimiter(limit rate.Limit, burst int, key rateLimitKey) *keyedRateLimiter {
+	return &keyedRateLimiter{
+		limit:    limit,
+		burst:    burst,
+		key:      key,
+		limiters: make(map[string]*limiterEntry),
+	}
+}
+
+// keyFor returns the bucket key for a request
+func (l *keyedRateLimiter) keyFor(r *http.Request, ev Event, partnerID string) string {
+	var key string
+	switch l.key.Source {
+	case "partner":
+		key = partnerID
+	case "header":
+		key = r.Header.Get(l.key.Name)
+	case "additionalHeader":
+		key = getHeaderValue(ev.Request.AdditionalHeaders, l.key.Name)
+	case "claim":
+		if value, ok := getClaimValue(ev.AccessToken.Claims, l.key.Name); ok {
+			key = fmt.Sprint(value)
+		}
+	}
+	if key == "" {
+		return sharedRateLimitKey
+	}
+	return key
+}
+
+// allow reports whether a request for key may proceed
+func (l *keyedRateLimiter) allow(key string) bool {
+	now := time.Now()
+	l.mu.Lock()
+	entry, ok := l.limiters[key]
+	if !ok {
+		entry = &limiterEntry{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[key] = entry
+	}
+	entry.lastSeen = now
+	l.mu.Unlock()
+	return entry.limiter.AllowN(now, 1)
+}
+
+// sweep evicts buckets not used since before now minus idleTTL
+func (l *keyedRateLimiter) sweep(now time.Time, idleTTL time.Duration) int {
+	cutoff := now.Add(-idleTTL)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	evicted := 0
+	for key, entry := range l.limiters {
+		if entry.lastSeen.Before(cutoff) {
+			delete(l.limiters, key)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// sweepEvery runs sweep on a fixed interval
+func (l *keyedRateLimiter) sweepEvery(interval time.Duration, idleTTL time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if evicted := l.sweep(now, idleTTL); evicted > 0 {
+			slog.Debug("Evicted idle rate limiter buckets", "count", evicted)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// clientRequest builds a request for org_acme whose access token carries the
+// client_id claim, or no claims when clientID is empty
+func clientRequest(t *testing.T, clientID string) string {
+	t.Helper()
+	var claims []Claim
+	if clientID != "" {
+		claims = []Claim{{Name: "client_id", Value: clientID}}
+	}
+	req := Request{
+		ActionType: actionPreIssueAccessToken,
+		Event: Event{
+			Request:     RequestData{AdditionalHeaders: []Header{partnerHeader("org_acme")}},
+			AccessToken: AccessToken{Scopes: []string{}, Claims: claims},
+		},
+		AllowedOperations: []Operation{{Op: "add", Paths: []string{accessTokenScopesPath}}},
+	}
+	return marshalRequest(t, req)
+}
+
+func TestRateLimitKeyedByClaimIsolatesClients(t *testing.T) {
+	s := NewServer(testEntitlements)
+	s.rateLimiter = newKeyedRateLimiter(0.001, 1, rateLimitKey{Source: "claim", Name: "client_id"})
+
+	if rec, _ := serve(t, s, http.MethodPost, clientRequest(t, "client_a")); rec.Code != http.StatusOK {
+		t.Fatalf("first client_a request status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec, _ := serve(t, s, http.MethodPost, clientRequest(t, "client_a")); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("second client_a request status = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	// The partner is the same, but the bucket follows the claim
+	if rec, _ := serve(t, s, http.MethodPost, clientRequest(t, "client_b")); rec.Code != http.StatusOK {
+		t.Errorf("client_b request status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestRateLimitMissingKeyUsesSharedBucket(t *testing.T) {
+	s := NewServer(testEntitlements)
+	s.rateLimiter = newKeyedRateLimiter(0.001, 1, rateLimitKey{Source: "claim", Name: "client_id"})
+
+	if rec, _ := serve(t, s, http.MethodPost, clientRequest(t, "")); rec.Code != http.StatusOK {
+		t.Fatalf("first request status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec, _ := serve(t, s, http.MethodPost, clientRequest(t, "")); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("second request without the claim status = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if _, ok := s.rateLimiter.limiters[sharedRateLimitKey]; !ok {
+		t.Error("no shared bucket, want requests without the claim to share one")
+	}
+}
+
+func TestParseRateLimitKey(t *testing.T) {
+	tests := []struct {
+		value string
+		want  rateLimitKey
+	}{
+		{"", rateLimitKey{Source: "partner"}},
+		{"partner", rateLimitKey{Source: "partner"}},
+		{"header:X-Client", rateLimitKey{Source: "header", Name: "X-Client"}},
+		{"additionalHeader:x-tenant", rateLimitKey{Source: "additionalHeader", Name: "x-tenant"}},
+		{"claim:sub", rateLimitKey{Source: "claim", Name: "sub"}},
+	}
+	for _, tt := range tests {
+		if got, err := parseRateLimitKey(tt.value); err != nil || got != tt.want {
+			t.Errorf("parseRateLimitKey(%q) = %+v, %v, want %+v", tt.value, got, err, tt.want)
+		}
+	}
+	for _, value := range []string{"claim", "claim:", "cookie:session"} {
+		if _, err := parseRateLimitKey(value); err == nil {
+			t.Errorf("parseRateLimitKey accepted %q", value)
+		}
+	}
+}
+
+func TestRateLimiterSweepEvictsIdleBuckets(t *testing.T) {
+	l := newKeyedRateLimiter(1, 1, rateLimitKey{Source: "partner"})
+	l.allow("org_acme")
+
+	if evicted := l.sweep(time.Now(), time.Minute); evicted != 0 {
+		t.Errorf("evicted = %d, want a recently used bucket kept", evicted)
+	}
+	if evicted := l.sweep(time.Now().Add(2*time.Minute), time.Minute); evicted != 1 || len(l.limiters) != 0 {
+		t.Errorf("evicted = %d, buckets = %d, want the idle bucket evicted", evicted, len(l.limiters))
+	}
+}
+
+func TestRateLimiterSweepKeepsActiveBuckets(t *testing.T) {
+	l := newKeyedRateLimiter(0.001, 1, rateLimitKey{Source: "partner"})
+	l.allow("org_idle")
+	l.allow("org_active")
+	now := time.Now()
+	l.limiters["org_idle"].lastSeen = now.Add(-time.Hour)
+
+	if evicted := l.sweep(now, 10*time.Minute); evicted != 1 {
+		t.Errorf("evicted = %d, want only the idle bucket", evicted)
+	}
+	if _, ok := l.limiters["org_idle"]; ok {
+		t.Error("idle bucket kept, want it evicted")
+	}
+	// Keeping the active bucket keeps its state: its one token is still spent
+	if l.allow("org_active") {
+		t.Error("active bucket allowed a request, want its exhausted state kept")
+	}
+}
+
+func TestRateLimiterSweepIsConcurrencySafe(t *testing.T) {
+	l := newKeyedRateLimiter(1000, 1000, rateLimitKey{Source: "partner"})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				l.allow(fmt.Sprintf("org_%d_%d", i, j%10))
+				if j%50 == 0 {
+					l.sweep(time.Now().Add(time.Hour), time.Minute)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// readyFile is touched once entitlements have loaded, for orchestrators that
+// check a marker file instead of an HTTP probe
+var readyFile string
+
+// readyMu guards the readiness flags, so a reload marking the service ready
+// cannot re-create the ready file right after it is removed
+var readyMu sync.Mutex
+
+// shuttingDown is set by markNotReady: once shutdown has withdrawn readiness,
+// reloads that complete while draining must not bring the ready file back
+var shuttingDown bool
+
+// underMaintenance is set through /admin/maintenance; the ready file is removed
+// and /ready answers 503 until maintenance ends
+var underMaintenance bool
+
+// markReady creates (or touches) the ready file, unless the service is shutting
+// down or under maintenance
+func markReady() error {
+	readyMu.Lock()
+	defer readyMu.Unlock()
+	if readyFile == "" || shuttingDown || underMaintenance {
+		return nil
+	}
+	f, err := os.OpenFile(readyFile, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create ready file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to create ready file: %w", err)
+	}
+	now := time.Now()
+	if err := os.Chtimes(readyFile, now, now); err != nil {
+		return fmt.Errorf("failed to touch ready file: %w", err)
+	}
+	slog.Info("Marked service ready", "path", readyFile)
+	return nil
+}
+
+// markNotReady removes the ready file for good on shutdown: later reloads do not
+// re-create it
+func markNotReady() {
+	readyMu.Lock()
+	defer readyMu.Unlock()
+	shuttingDown = true
+	removeReadyFile()
+}
+
+// removeReadyFile removes the ready file; the caller holds readyMu, except at
+// startup before anything can mark the service ready
+func removeReadyFile() {
+	if readyFile == "" {
+		return
+	}
+	if err := os.Remove(readyFile); err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Error removing ready file", "error", err)
+		}
+		return
+	}
+	slog.Info("Removed ready file", "path", readyFile)
+}
+
+// setMaintenance starts or ends maintenance. Starting it removes the ready file;
+// ending it restores the file when the entitlements are loaded.
+func setMaintenance(enabled bool) {
+	readyMu.Lock()
+	underMaintenance = enabled
+	if enabled {
+		removeReadyFile()
+	}
+	readyMu.Unlock()
+
+	if enabled {
+		return
+	}
+	if _, err := defaultEntitlements.get(); err != nil {
+		slog.Warn("Not marking service ready after maintenance", "error", err)
+	} else if err := markReady(); err != nil {
+		slog.Error("Error marking service ready", "error", err)
+	}
+}
+
+// inMaintenance reports whether the service is under maintenance
+func inMaintenance() bool {
+	readyMu.Lock()
+	defer readyMu.Unlock()
+	return underMaintenance
+}
+
+// maintenanceState is the JSON body of /admin/maintenance
+type maintenanceState struct {
+	Maintenance bool `json:"maintenance"`
+}
+
+// maintenanceHandler returns (GET) or sets (PUT, {"maintenance": true|false})
+// the maintenance state
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var state maintenanceState
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			http.Error(w, `Invalid JSON body: expected {"maintenance": true|false}`, http.StatusBadRequest)
+			return
+		}
+		setMaintenance(state.Maintenance)
+		slog.Info("Maintenance updated via admin endpoint", "maintenance", state.Maintenance)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(maintenanceState{Maintenance: inMaintenance()}); err != nil {
+		slog.Error("Error encoding maintenance state", "error", err)
+	}
+}
+
+// errorWindow tracks request outcomes over a sliding window of one-second buckets
+type errorWindow struct {
+	mu      sync.Mutex
+	size    int
+	buckets []errorBucket
+}
+
+// errorBucket counts the requests and errors seen in one second
+type errorBucket struct {
+	second   int64
+	requests int64
+	errors   int64
+}
+
+// newErrorWindow creates a window covering the given duration
+func newErrorWindow(window time.Duration) *errorWindow {
+	size := int(window / time.Second)
+	if size < 1 {
+		size = 1
+	}
+	return &errorWindow{size: size, buckets: make([]errorBucket, size)}
+}
+
+// record counts one request outcome at now
+func (e *errorWindow) record(now time.Time, failed bool) {
+	second := now.Unix()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	bucket := &e.buckets[second%int64(e.size)]
+	if bucket.second != second {
+		*bucket = errorBucket{second: second}
+	}
+	bucket.requests++
+	if failed {
+		bucket.errors++
+	}
+}
+
+// rate returns the requests and error rate within the window ending at now
+func (e *errorWindow) rate(now time.Time) (int64, float64) {
+	oldest := now.Unix() - int64(e.size) + 1
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var requests, errors int64
+	for _, bucket := range e.buckets {
+		if bucket.second >= oldest {
+			requests += bucket.requests
+			errors += bucket.errors
+		}
+	}
+	if requests == 0 {
+		return 0, 0
+	}
+	return requests, float64(errors) / float64(requests)
+}
+
+// Degradation thresholds. The service reports itself degraded when the error
+// rate over the window exceeds degradedErrorRate, once at least
+// degradedMinRequests requests were seen.
+var (
+	recentErrors        = newErrorWindow(time.Minute)
+	degradedErrorRate   = 0.1
+	degradedMinRequests = int64(10)
+)
+
+// configureDegradation reads DEGRADED_ERROR_RATE, DEGRADED_WINDOW and DEGRADED_MIN_REQUESTS
+func configureDegradation() error {
+	if v := os.Getenv("DEGRADED_ERROR_RATE"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return fmt.Errorf("invalid DEGRADED_ERROR_RATE %q (expected 0 to 1)", v)
+		}
+		degradedErrorRate = rate
+	}
+	if v := os.Getenv("DEGRADED_WINDOW"); v != "" {
+		d, err := parseDuration(v)
+		if err != nil || d < time.Second {
+			return fmt.Errorf("invalid DEGRADED_WINDOW %q", v)
+		}
+		recentErrors = newErrorWindow(d)
+	}
+	if v := os.Getenv("DEGRADED_MIN_REQUESTS"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid DEGRADED_MIN_REQUESTS %q", v)
+		}
+		degradedMinRequests = n
+	}
+	return nil
+}
+
+// readiness is the JSON body of GET /ready
+type readiness struct {
+	Status    string  `json:"status"`
+	Degraded  bool    `json:"degraded"`
+	ErrorRate float64 `json:"errorRate"`
+	Requests  int64   `json:"requests"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// readyHandler reports readiness: 503 under maintenance or when entitlements
+// cannot be loaded, and 200 otherwise, with degraded set when the recent error rate is too high
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	requests, errorRate := recentErrors.rate(time.Now())
+	body := readiness{Status: "ok", ErrorRate: errorRate, Requests: requests}
+	status := http.StatusOK
+
+	if inMaintenance() {
+		body.Status = "maintenance"
+		status = http.StatusServiceUnavailable
+	} else if _, err := defaultEntitlements.get(); err != nil {
+		body.Status = "unavailable"
+		body.Error = "entitlements unavailable"
+		status = http.StatusServiceUnavailable
+		slog.Warn("Readiness check failed", "error", err)
+	} else if requests >= degradedMinRequests && errorRate > degradedErrorRate {
+		body.Status = "degraded"
+		body.Degraded = true
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Error("Error encoding readiness", "error", err)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// withReadyFile sets READY_FILE to a path in a temporary directory for the
+// duration of a test
+func withReadyFile(t *testing.T) string {
+	t.Helper()
+	previous := readyFile
+	readyFile = filepath.Join(t.TempDir(), "ready")
+	t.Cleanup(func() {
+		readyFile = previous
+		shuttingDown, underMaintenance = false, false
+	})
+	return readyFile
+}
+
+func TestReloadMarksReadyAfterFailedStartup(t *testing.T) {
+	path := withReadyFile(t)
+	var loadErr error = errors.New("unavailable")
+	store := newStore("test.json", func() (*EntitlementsData, error) {
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		return &EntitlementsData{}, nil
+	}, nil, noopMetrics{})
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("ready file after failed load: stat error = %v, want not exist", err)
+	}
+
+	loadErr = nil
+	store.reloadIfChanged()
+
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("ready file after successful reload: %v", err)
+	}
+}
+
+func TestReadyFileLifecycle(t *testing.T) {
+	path := withReadyFile(t)
+
+	if err := markReady(); err != nil {
+		t.Fatalf("markReady: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("ready file once ready: %v", err)
+	}
+
+	markNotReady()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("ready file on shutdown: stat error = %v, want not exist", err)
+	}
+	// Removing it again, or when it was never created, is not an error
+	markNotReady()
+}
+
+func TestReloadAfterShutdownKeepsReadyFileRemoved(t *testing.T) {
+	path := withReadyFile(t)
+	store := newStore("test.json", func() (*EntitlementsData, error) { return &EntitlementsData{}, nil }, nil, noopMetrics{})
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("ready file after the first load: %v", err)
+	}
+
+	// Only the first load marks the service ready
+	os.Remove(path)
+	store.reloadIfChanged()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("ready file after a later reload: stat error = %v, want not exist", err)
+	}
+
+	markNotReady()
+	if err := markReady(); err != nil {
+		t.Fatalf("markReady: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("ready file marked ready after shutdown: stat error = %v, want not exist", err)
+	}
+}
+
+func TestShutdownRemovesReadyFile(t *testing.T) {
+	path := withReadyFile(t)
+	if err := markReady(); err != nil {
+		t.Fatalf("markReady: %v", err)
+	}
+	// Keep SIGTERM from killing the test before serveUntilSignal listens for it
+	held := make(chan os.Signal, 1)
+	signal.Notify(held, syscall.SIGTERM)
+	defer signal.Stop(held)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- serveUntilSignal([]*http.Server{{Addr: "127.0.0.1:0", Handler: http.NotFoundHandler()}}, time.Second)
+	}()
+	for stopped := false; !stopped; {
+		if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+			t.Fatalf("send SIGTERM: %v", err)
+		}
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("serveUntilSignal: %v", err)
+			}
+			stopped = true
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("ready file after shutdown: stat error = %v, want not exist", err)
+	}
+}
+
+func TestMaintenanceWithdrawsReadiness(t *testing.T) {
+	path := withReadyFile(t)
+	withDefaultEntitlements(t, testEntitlements.data)
+	s := adminServer("", "admin")
+	mux := http.NewServeMux()
+	routes(mux, mux, s)
+	setMaintenanceState := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "/admin/maintenance", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer admin")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, r)
+		return rec
+	}
+	if err := markReady(); err != nil {
+		t.Fatalf("markReady: %v", err)
+	}
+
+	if rec := setMaintenanceState(`{"maintenance": true}`); rec.Code != http.StatusOK || rec.Body.String() != "{\"maintenance\":true}\n" {
+		t.Fatalf("PUT status = %d, body = %q, want maintenance on", rec.Code, rec.Body.String())
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("ready file under maintenance: stat error = %v, want not exist", err)
+	}
+	if status, body := getReadiness(t); status != http.StatusServiceUnavailable || body.Status != "maintenance" {
+		t.Errorf("/ready under maintenance = %d %+v, want 503 maintenance", status, body)
+	}
+
+	setMaintenanceState(`{"maintenance": false}`)
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("ready file after maintenance: %v", err)
+	}
+	if rec := adminGet(t, s, "/admin/maintenance", "admin"); rec.Body.String() != "{\"maintenance\":false}\n" {
+		t.Errorf("GET body = %q, want maintenance off", rec.Body.String())
+	}
+	if rec := setMaintenanceState(`maintenance`); rec.Code != http.StatusBadRequest {
+		t.Errorf("PUT of an invalid body status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestReadyFileDisabled(t *testing.T) {
+	previous := readyFile
+	readyFile = ""
+	t.Cleanup(func() { readyFile = previous })
+
+	if err := markReady(); err != nil {
+		t.Errorf("markReady without READY_FILE: %v", err)
+	}
+	markNotReady()
+}
+
+// withErrorWindow starts a fresh error window for the duration of a test
+func withErrorWindow(t *testing.T) {
+	t.Helper()
+	previous := recentErrors
+	recentErrors = newErrorWindow(time.Minute)
+	t.Cleanup(func() { recentErrors = previous })
+}
+
+// getReadiness calls GET /ready and decodes the body
+func getReadiness(t *testing.T) (int, readiness) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	readyHandler(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	var body readiness
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode readiness %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, body
+}
+
+func TestReadyReportsDegradedAboveErrorRate(t *testing.T) {
+	withErrorWindow(t)
+	withDefaultEntitlements(t, testEntitlements.data)
+	working, broken := NewServer(testEntitlements), NewServer(fakeEntitlements{err: errTest})
+	healthy := working.instrument("/token-validation", working.handler)
+	failing := broken.instrument("/token-validation", broken.handler)
+	send := func(h http.HandlerFunc, n int) {
+		for i := 0; i < n; i++ {
+			h(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/token-validation", strings.NewReader(actionRequest(t, partnerHeader("org_acme")))))
+		}
+	}
+
+	send(healthy, 9)
+	send(failing, 1)
+	if status, body := getReadiness(t); status != http.StatusOK || body.Degraded || body.Requests != 10 {
+		t.Errorf("at a 10%% error rate: status = %d, body = %+v, want 200 and not degraded", status, body)
+	}
+
+	send(failing, 2)
+	status, body := getReadiness(t)
+	if status != http.StatusOK || !body.Degraded || body.Status != "degraded" {
+		t.Errorf("above the error rate: status = %d, body = %+v, want 200 and degraded", status, body)
+	}
+	if body.ErrorRate != 0.25 {
+		t.Errorf("error rate = %v, want 0.25", body.ErrorRate)
+	}
+}
+
+func TestReadyNeedsMinimumRequestsToDegrade(t *testing.T) {
+	withErrorWindow(t)
+	withDefaultEntitlements(t, testEntitlements.data)
+	for i := 0; i < int(degradedMinRequests)-1; i++ {
+		recentErrors.record(time.Now(), true)
+	}
+
+	if _, body := getReadiness(t); body.Degraded {
+		t.Errorf("body = %+v, want too few requests to report degradation", body)
+	}
+}
+
+func TestReadyUnavailableWithoutEntitlements(t *testing.T) {
+	withErrorWindow(t)
+	previous := defaultEntitlements
+	defaultEntitlements = newStore("test.json", func() (*EntitlementsData, error) { return nil, errTest }, nil, noopMetrics{})
+	t.Cleanup(func() { defaultEntitlements = previous })
+
+	if status, body := getReadiness(t); status != http.StatusServiceUnavailable || body.Status != "unavailable" {
+		t.Errorf("status = %d, body = %+v, want 503 unavailable", status, body)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"runtime/debug"
+)
+
+// recoverPanics answers a request whose handler panics with a FAILED action
+// response and a 500, logging the panic and stack trace with the request ID, so
+// one bad request cannot take the service down. http.ErrAbortHandler is
+// re-raised, since it deliberately aborts the response. It wraps every other
+// middleware, so the request ID is read from the response header logRequests
+// set rather than from the request's logger.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if err, ok := p.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(p)
+			}
+			logger := loggerFrom(r.Context())
+			if id := w.Header().Get(requestIDHeader); id != "" {
+				logger = logger.With("request_id", id)
+			}
+			logger.Error("Recovered from panic in handler", "path", r.URL.Path, "panic", p, "stack", string(debug.Stack()))
+			writeJSON(w, http.StatusInternalServerError, Response{
+				ActionStatus:       "FAILED",
+				FailureReason:      "server_error",
+				FailureDescription: "The request could not be processed",
+			})
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecoverPanicsAnswersFailed(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", func(http.ResponseWriter, *http.Request) {
+		var entitlements map[string][]string
+		entitlements["org_acme"] = append(entitlements["org_acme"], "read")
+	})
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	server := httptest.NewServer(recoverPanics(normalizePaths(logRequests(mux))))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/panic", "application/json", nil)
+	if err != nil {
+		t.Fatalf("POST /panic: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusInternalServerError)
+	}
+	if resp.Header.Get(requestIDHeader) == "" {
+		t.Errorf("response has no %s header", requestIDHeader)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "application/json;charset=UTF-8" {
+		t.Errorf("Content-Type = %q, want JSON", got)
+	}
+	var body Response
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if body.ActionStatus != "FAILED" || body.FailureReason != "server_error" {
+		t.Errorf("response = %+v, want FAILED server_error", body)
+	}
+
+	// The server keeps serving after the panic
+	if status := statusOf(t, http.MethodGet, server.URL+"/ok", ""); status != http.StatusNoContent {
+		t.Errorf("status after panic = %d, want %d", status, http.StatusNoContent)
+	}
+}
+
+func TestRecoverPanicsWrapsMiddleware(t *testing.T) {
+	// A panic in a middleware, outside the mux, is recovered too
+	panicking := func(http.Handler) http.Handler {
+		return http.HandlerFunc(func(http.ResponseWriter, *http.Request) { panic("middleware") })
+	}
+	server := httptest.NewServer(recoverPanics(normalizePaths(logRequests(panicking(http.NewServeMux())))))
+	defer server.Close()
+
+	if status := statusOf(t, http.MethodPost, server.URL+"/token-validation", ""); status != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", status, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// defaultRedactPaths hide claim values and scopes, which can carry personal data
+// and what a token grants
+const defaultRedactPaths = "event.accessToken.claims.value,event.accessToken.scopes,event.refreshToken.claims.value"
+
+// redactPaths are the dot-separated JSON paths masked when a request is logged.
+// A path runs through arrays, so "event.accessToken.claims.value" masks the
+// value of every claim and leaves the claim names readable.
+var redactPaths [][]string
+
+// configureRedaction reads LOG_REDACT_PATHS, a comma-separated list of paths
+// replacing the defaults ("none" masks nothing)
+func configureRedaction() error {
+	value, ok := os.LookupEnv("LOG_REDACT_PATHS")
+	if !ok {
+		value = defaultRedactPaths
+	}
+	paths, err := parseRedactPaths(value)
+	if err != nil {
+		return err
+	}
+	redactPaths = paths
+	return nil
+}
+
+// parseRedactPaths parses a comma-separated list of dot-separated paths
+func parseRedactPaths(value string) ([][]string, error) {
+	var paths [][]string
+	if strings.TrimSpace(value) == "none" {
+		return paths, nil
+	}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		segments := strings.Split(entry, ".")
+		for _, segment := range segments {
+			if segment == "" {
+				return nil, fmt.Errorf("invalid LOG_REDACT_PATHS entry %q", entry)
+			}
+		}
+		paths = append(paths, segments)
+	}
+	return paths, nil
+}
+
+// sanitizeForLog returns req as JSON with every redact path masked. It works on
+// a decoded copy, so the request used for processing is never changed.
+func sanitizeForLog(req Request) json.RawMessage {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return json.RawMessage(fmt.Sprintf("%q", redacted))
+	}
+	var view interface{}
+	if err := json.Unmarshal(data, &view); err != nil {
+		return json.RawMessage(fmt.Sprintf("%q", redacted))
+	}
+	for _, path := range redactPaths {
+		redactPath(view, path)
+	}
+	masked, err := json.Marshal(view)
+	if err != nil {
+		return json.RawMessage(fmt.Sprintf("%q", redacted))
+	}
+	return masked
+}
+
+// redactPath masks the values at path beneath node, descending into every
+// element of the arrays along the way
+func redactPath(node interface{}, path []string) {
+	switch n := node.(type) {
+	case []interface{}:
+		for _, item := range n {
+			redactPath(item, path)
+		}
+	case map[string]interface{}:
+		child, ok := n[path[0]]
+		if !ok || child == nil {
+			return
+		}
+		if len(path) == 1 {
+			n[path[0]] = redacted
+			return
+		}
+		redactPath(child, path[1:])
+	}
+}
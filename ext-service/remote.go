@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// maxRemoteEntitlementsBytes bounds a fetched entitlements document
+var maxRemoteEntitlementsBytes int64 = 32 << 20
+
+// remoteEntitlements fetches the entitlements document from ENTITLEMENTS_URL.
+// One client is shared by every fetch.
+type remoteEntitlements struct {
+	url string
+	// name is url without credentials, for logs, stats and the admin endpoint
+	name   string
+	client *http.Client
+	// ttl is how long a fetched copy is served before it is refetched
+	ttl time.Duration
+}
+
+// newRemoteEntitlements configures fetching from rawURL, reading
+// ENTITLEMENTS_URL_TIMEOUT and ENTITLEMENTS_URL_TTL
+func newRemoteEntitlements(rawURL string) (*remoteEntitlements, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid ENTITLEMENTS_URL %q (expected an http or https URL)", rawURL)
+	}
+
+	timeout := 5 * time.Second
+	if v := os.Getenv("ENTITLEMENTS_URL_TIMEOUT"); v != "" {
+		d, err := parseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid ENTITLEMENTS_URL_TIMEOUT %q", v)
+		}
+		timeout = d
+	}
+	ttl := time.Minute
+	if v := os.Getenv("ENTITLEMENTS_URL_TTL"); v != "" {
+		d, err := parseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid ENTITLEMENTS_URL_TTL %q", v)
+		}
+		ttl = d
+	}
+
+	return &remoteEntitlements{
+		url:    rawURL,
+		name:   redactURL(u),
+		client: &http.Client{Timeout: timeout},
+		ttl:    ttl,
+	}, nil
+}
+
+// fetch downloads and parses the entitlements document
+func (e *remoteEntitlements) fetch() (*EntitlementsData, error) {
+	data, err := e.get()
+	stats.recordLoad(e.name, data, err)
+	return data, err
+}
+
+// get performs one fetch; a non-200 status or malformed document is an error
+func (e *remoteEntitlements) get() (*EntitlementsData, error) {
+	resp, err := e.client.Get(e.url)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = e.name
+		}
+		return nil, fmt.Errorf("failed to fetch entitlements: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch entitlements: unexpected status %d", resp.StatusCode)
+	}
+	// Decode straight from the body, reading one byte past the limit to tell an
+	// oversized document from one that fits exactly
+	body := &io.LimitedReader{R: resp.Body, N: maxRemoteEntitlementsBytes + 1}
+	data, err := decodeEntitlements(body, e.name)
+	if body.N <= 0 {
+		return nil, fmt.Errorf("failed to fetch entitlements: document exceeds %d bytes", maxRemoteEntitlementsBytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse entitlements from %s: %w", e.name, err)
+	}
+	if err := compileEntitlementExpressions(data); err != nil {
+		return nil, fmt.Errorf("failed to load entitlements from %s: %w", e.name, err)
+	}
+	return data, nil
+}
+
+// redactURL returns u without userinfo, query or fragment, any of which may
+// carry credentials
+func redactURL(u *url.URL) string {
+	redacted := *u
+	redacted.User = nil
+	redacted.RawQuery = ""
+	redacted.ForceQuery = false
+	redacted.Fragment = ""
+	redacted.RawFragment = ""
+	return redacted.String()
+}
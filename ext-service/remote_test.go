@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// remoteDocument serves doc as the remote entitlements document
+func remoteDocument(t *testing.T, doc string) *remoteEntitlements {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(doc))
+	}))
+	t.Cleanup(server.Close)
+	remote, err := newRemoteEntitlements(server.URL)
+	if err != nil {
+		t.Fatalf("newRemoteEntitlements: %v", err)
+	}
+	return remote
+}
+
+// withRemoteLimit caps remote entitlements documents at limit bytes for a test
+func withRemoteLimit(t *testing.T, limit int64) {
+	t.Helper()
+	previous := maxRemoteEntitlementsBytes
+	maxRemoteEntitlementsBytes = limit
+	t.Cleanup(func() { maxRemoteEntitlementsBytes = previous })
+}
+
+const remoteDoc = `{"entitlements":[{"entitlementId":"ent_read","subject":{"type":"partner","id":"org_acme"},"action":"read"}]}`
+
+func TestRemoteEntitlementsWithinLimit(t *testing.T) {
+	withRemoteLimit(t, int64(len(remoteDoc)))
+
+	data, err := remoteDocument(t, remoteDoc).get()
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if len(data.Entitlements) != 1 || data.Entitlements[0].EntitlementID != "ent_read" {
+		t.Errorf("entitlements = %+v, want ent_read", data.Entitlements)
+	}
+}
+
+func TestRemoteEntitlementsOverLimit(t *testing.T) {
+	withRemoteLimit(t, int64(len(remoteDoc))-1)
+
+	_, err := remoteDocument(t, remoteDoc).get()
+	if err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("error = %v, want the document to exceed the limit", err)
+	}
+}
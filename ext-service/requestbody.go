@@ -0,0 +1,94 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxBodyBytes is far above any real action request
+const defaultMaxBodyBytes = 1 << 20
+
+// errUnsupportedEncoding rejects a Content-Encoding other than gzip
+var errUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+
+// bodyLimitError reports a request body over one of the body limits
+type bodyLimitError struct {
+	// setting names the limit that was exceeded
+	setting string
+	limit   int64
+}
+
+func (e *bodyLimitError) Error() string {
+	return fmt.Sprintf("request body exceeds %s (%d bytes)", e.setting, e.limit)
+}
+
+// configureBodyLimit reads MAX_BODY_BYTES, and MAX_COMPRESSED_BYTES and
+// MAX_DECOMPRESSED_BYTES for gzip bodies. Both default to MAX_BODY_BYTES.
+func (c *Config) configureBodyLimit() error {
+	limits := []struct {
+		env    string
+		target *int64
+	}{
+		{"MAX_BODY_BYTES", &c.maxBodyBytes},
+		{"MAX_COMPRESSED_BYTES", &c.maxCompressedBytes},
+		{"MAX_DECOMPRESSED_BYTES", &c.maxDecompressedBytes},
+	}
+	for _, limit := range limits {
+		*limit.target = c.maxBodyBytes
+		if v := os.Getenv(limit.env); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid %s %q", limit.env, v)
+			}
+			*limit.target = n
+		}
+	}
+	return nil
+}
+
+// readRequestBody reads the request body, decoding it when it is gzip-encoded.
+// A plain body is capped at maxBodyBytes. A gzip body is capped twice,
+// independently: the bytes read from the connection at maxCompressedBytes and
+// the decoded bytes at maxDecompressedBytes, so a small body that inflates far
+// beyond its size is cut off as soon as it passes the limit.
+func (c *Config) readRequestBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, c.maxBodyBytes))
+		return body, limitError(err, "MAX_BODY_BYTES")
+	case "gzip":
+	default:
+		return nil, fmt.Errorf("%w %q", errUnsupportedEncoding, encoding)
+	}
+
+	zr, err := gzip.NewReader(http.MaxBytesReader(w, r.Body, c.maxCompressedBytes))
+	if err != nil {
+		return nil, limitError(fmt.Errorf("invalid gzip body: %w", err), "MAX_COMPRESSED_BYTES")
+	}
+	defer zr.Close()
+	// Read one byte past the limit to tell an oversized body from one that fits exactly
+	body, err := io.ReadAll(io.LimitReader(zr, c.maxDecompressedBytes+1))
+	if err != nil {
+		return nil, limitError(fmt.Errorf("invalid gzip body: %w", err), "MAX_COMPRESSED_BYTES")
+	}
+	if int64(len(body)) > c.maxDecompressedBytes {
+		return nil, &bodyLimitError{setting: "MAX_DECOMPRESSED_BYTES", limit: c.maxDecompressedBytes}
+	}
+	return body, nil
+}
+
+// limitError reports err as a bodyLimitError for setting when it comes from the
+// size cap on the connection
+func limitError(err error, setting string) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return &bodyLimitError{setting: setting, limit: tooLarge.Limit}
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// gzipped compresses body
+func gzipped(t *testing.T, body string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// serveEncoded sends body with the given Content-Encoding to s's handler
+func serveEncoded(s *Server, encoding string, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/token-validation", bytes.NewReader(body))
+	if encoding != "" {
+		r.Header.Set("Content-Encoding", encoding)
+	}
+	rec := httptest.NewRecorder()
+	s.handler(rec, r)
+	return rec
+}
+
+func TestHandlerDecodesGzipBody(t *testing.T) {
+	s := NewServer(testEntitlements)
+
+	rec := serveEncoded(s, "gzip", gzipped(t, actionRequest(t, partnerHeader("org_acme"))))
+
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "partner:read") {
+		t.Errorf("status = %d, body = %s, want partner:read granted", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHandlerRejectsGzipBombOverDecompressedLimit(t *testing.T) {
+	logs := withDefaultLogger(t)
+	s := NewServer(testEntitlements)
+	s.maxDecompressedBytes = 64 << 10
+	// A few hundred bytes on the wire that inflate to 1 MiB
+	bomb := gzipped(t, strings.Repeat(" ", 1<<20))
+	if int64(len(bomb)) >= s.maxCompressedBytes {
+		t.Fatalf("compressed body = %d bytes, want it under the compressed limit", len(bomb))
+	}
+
+	rec := serveEncoded(s, "gzip", bomb)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+	if !strings.Contains(logs.String(), `"limit":"MAX_DECOMPRESSED_BYTES"`) {
+		t.Errorf("logs = %s, want MAX_DECOMPRESSED_BYTES named", logs.String())
+	}
+}
+
+func TestHandlerEnforcesCompressedLimit(t *testing.T) {
+	s := NewServer(testEntitlements)
+	body := gzipped(t, actionRequest(t, partnerHeader("org_acme")))
+	s.maxCompressedBytes = int64(len(body)) - 1
+
+	if rec := serveEncoded(s, "gzip", body); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	// The decoded body may be larger than the compressed limit
+	s.maxCompressedBytes = int64(len(body))
+	if rec := serveEncoded(s, "gzip", body); rec.Code != http.StatusOK {
+		t.Errorf("status at the compressed limit = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestHandlerEnforcesBodyLimit(t *testing.T) {
+	s := NewServer(testEntitlements)
+	body := actionRequest(t, partnerHeader("org_acme"))
+	s.maxBodyBytes = int64(len(body)) - 1
+
+	if rec := serveEncoded(s, "", []byte(body)); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestHandlerRejectsUnsupportedOrInvalidEncoding(t *testing.T) {
+	s := NewServer(testEntitlements)
+
+	if rec := serveEncoded(s, "br", []byte("{}")); rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("br status = %d, want %d", rec.Code, http.StatusUnsupportedMediaType)
+	}
+	if rec := serveEncoded(s, "gzip", []byte("{}")); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid gzip status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestConfigureBodyLimit(t *testing.T) {
+	t.Setenv("MAX_BODY_BYTES", "2048")
+	t.Setenv("MAX_DECOMPRESSED_BYTES", "8192")
+	cfg := defaultConfig()
+	if err := cfg.configureBodyLimit(); err != nil {
+		t.Fatalf("configureBodyLimit: %v", err)
+	}
+	if cfg.maxBodyBytes != 2048 || cfg.maxCompressedBytes != 2048 || cfg.maxDecompressedBytes != 8192 {
+		t.Errorf("limits = %d/%d/%d, want 2048/2048/8192", cfg.maxBodyBytes, cfg.maxCompressedBytes, cfg.maxDecompressedBytes)
+	}
+
+	t.Setenv("MAX_COMPRESSED_BYTES", "0")
+	if err := cfg.configureBodyLimit(); err == nil {
+		t.Error("configureBodyLimit accepted MAX_COMPRESSED_BYTES=0")
+	}
+}
+
+func TestHandlerRejectsOversizedBodyWithoutDecoding(t *testing.T) {
+	logs := withDefaultLogger(t)
+	s := NewServer(testEntitlements)
+	// A well-formed request, so only the size can stop it from being decoded
+	body := `{"actionType":"PRE_ISSUE_ACCESS_TOKEN","padding":"` + strings.Repeat("x", defaultMaxBodyBytes) + `"}`
+
+	rec := serveEncoded(s, "", []byte(body))
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+	if got := rec.Body.String(); got != `{"actionStatus":"ERROR","errorMessage":"invalid_request","errorDescription":"Request body too large"}`+"\n" {
+		t.Errorf("body = %s, want a JSON ERROR response", got)
+	}
+	out := logs.String()
+	if !strings.Contains(out, `"msg":"Rejecting oversized request body","limit":"MAX_BODY_BYTES","limit_bytes":1048576`) {
+		t.Errorf("logs = %s, want the rejection logged with the limit", out)
+	}
+	for _, msg := range []string{"Error decoding request", "Rejecting incomplete request", "Processing request"} {
+		if strings.Contains(out, msg) {
+			t.Errorf("logs = %s, want no decode attempted", out)
+		}
+	}
+}
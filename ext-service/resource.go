@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// requestedResource returns the attributes of the resource the request targets,
+// read from additional headers named RESOURCE_HEADER_PREFIX+attribute and access
+// token claims named RESOURCE_CLAIM_PREFIX+attribute; a header takes precedence
+// over a claim for the same attribute. When a request names a resource, scopes
+// of entitlements whose object describes a different resource are not granted.
+func (c *Config) requestedResource(ev Event) map[string]string {
+	resource := make(map[string]string)
+	if c.resourceClaimPrefix != "" {
+		for _, claim := range ev.AccessToken.Claims {
+			if attr, ok := strings.CutPrefix(claim.Name, c.resourceClaimPrefix); ok && attr != "" {
+				resource[attr] = fmt.Sprint(claim.Value)
+			}
+		}
+	}
+	if c.resourceHeaderPrefix != "" {
+		for _, header := range ev.Request.AdditionalHeaders {
+			if attr, ok := strings.CutPrefix(header.Name, c.resourceHeaderPrefix); ok && attr != "" && len(header.Value) > 0 {
+				resource[attr] = header.Value[0]
+			}
+		}
+	}
+	return resource
+}
+
+// matchesResource reports whether an entitlement's object describes the
+// requested resource. Only attributes both define are compared, so an object
+// naming just a type covers every resource of that type, and a request naming
+// just a type matches objects of that type whatever their ID. An object value
+// may be a list, matching when the requested value is in it. No requested
+// resource means no filtering.
+func matchesResource(object map[string]interface{}, requested map[string]string) bool {
+	for attr, value := range requested {
+		want, ok := object[attr]
+		if !ok {
+			continue
+		}
+		if !valueMatches(value, want) {
+			return false
+		}
+	}
+	return true
+}
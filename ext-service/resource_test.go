@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMatchesResource(t *testing.T) {
+	object := map[string]interface{}{"type": "order", "id": []interface{}{"o-1", "o-2"}, "region": "eu"}
+	tests := []struct {
+		name      string
+		requested map[string]string
+		want      bool
+	}{
+		{"nothing requested", nil, true},
+		{"every attribute matches", map[string]string{"type": "order", "id": "o-2", "region": "eu"}, true},
+		{"subset matches", map[string]string{"type": "order"}, true},
+		{"attribute the object does not define", map[string]string{"type": "order", "tenant": "acme"}, true},
+		{"type differs", map[string]string{"type": "invoice"}, false},
+		{"id not in the list", map[string]string{"type": "order", "id": "o-3"}, false},
+	}
+	for _, tt := range tests {
+		if got := matchesResource(object, tt.requested); got != tt.want {
+			t.Errorf("%s: matchesResource = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if !matchesResource(nil, map[string]string{"type": "order"}) {
+		t.Error("an entitlement without an object did not match, want it to cover every resource")
+	}
+}
+
+func TestHandlerGrantsScopesForMatchingResource(t *testing.T) {
+	provider := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{
+		{EntitlementID: "ent_orders", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "orders", Object: map[string]interface{}{"type": "order", "id": "o-1"}},
+		{EntitlementID: "ent_invoices", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "invoices", Object: map[string]interface{}{"type": "invoice"}},
+	}}}
+	s := NewServer(provider)
+	s.resourceHeaderPrefix = "x-resource-"
+	s.resourceClaimPrefix = "resource_"
+	tests := []struct {
+		name    string
+		headers []Header
+		claims  []Claim
+		want    string
+	}{
+		{"no resource", nil, nil, `["partner:orders","partner:invoices"]`},
+		{"matching order", []Header{{Name: "x-resource-type", Value: []string{"order"}}, {Name: "x-resource-id", Value: []string{"o-1"}}}, nil, `["partner:orders"]`},
+		{"other order", []Header{{Name: "x-resource-type", Value: []string{"order"}}, {Name: "x-resource-id", Value: []string{"o-9"}}}, nil, `[]`},
+		{"type from a claim", nil, []Claim{{Name: "resource_type", Value: "invoice"}}, `["partner:invoices"]`},
+		{"header overrides claim", []Header{{Name: "x-resource-type", Value: []string{"order"}}}, []Claim{{Name: "resource_type", Value: "invoice"}}, `["partner:orders"]`},
+		{"no object matches", []Header{{Name: "x-resource-type", Value: []string{"shipment"}}}, nil, `[]`},
+	}
+	for _, tt := range tests {
+		req := Request{
+			ActionType: actionPreIssueAccessToken,
+			Event: Event{
+				Request:     RequestData{AdditionalHeaders: append([]Header{partnerHeader("org_acme")}, tt.headers...)},
+				AccessToken: AccessToken{Scopes: []string{}, Claims: tt.claims},
+			},
+			AllowedOperations: []Operation{{Op: "add", Paths: []string{accessTokenScopesPath}}},
+		}
+
+		_, resp := serve(t, s, http.MethodPost, marshalRequest(t, req))
+
+		scopes := grantedScopes(resp.Operations)
+		if scopes == nil {
+			scopes = []string{}
+		}
+		if got := mustJSON(t, scopes); got != tt.want {
+			t.Errorf("%s: scopes = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Oversized response policies (MAX_RESPONSE_POLICY)
+const (
+	responseLimitTruncate = "truncate"
+	responseLimitFail     = "fail"
+)
+
+// configureResponseLimit reads MAX_RESPONSE_BYTES and MAX_RESPONSE_POLICY
+func (c *Config) configureResponseLimit() error {
+	if v := os.Getenv("MAX_RESPONSE_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid MAX_RESPONSE_BYTES %q", v)
+		}
+		c.maxResponseBytes = n
+	}
+	switch policy := os.Getenv("MAX_RESPONSE_POLICY"); policy {
+	case "", responseLimitTruncate:
+		c.failOversizedResponses = false
+	case responseLimitFail:
+		c.failOversizedResponses = true
+	default:
+		return fmt.Errorf("invalid MAX_RESPONSE_POLICY %q (expected truncate or fail)", policy)
+	}
+	return nil
+}
+
+// limitResponseSize returns resp and its encoding unchanged when body fits in
+// MAX_RESPONSE_BYTES. Otherwise it either keeps the longest prefix of the
+// operations that fits, so the same response is always cut at the same place, or
+// replaces the response with a FAILED one, per MAX_RESPONSE_POLICY.
+func (c *Config) limitResponseSize(logger *slog.Logger, resp Response, body []byte) (Response, []byte, error) {
+	if c.maxResponseBytes <= 0 || len(body) <= c.maxResponseBytes {
+		return resp, body, nil
+	}
+
+	if c.failOversizedResponses {
+		logger.Warn("Response exceeds MAX_RESPONSE_BYTES, failing it", "bytes", len(body), "max_bytes", c.maxResponseBytes, "operations", len(resp.Operations))
+		failed := Response{
+			ActionStatus:       "FAILED",
+			FailureReason:      "response_too_large",
+			FailureDescription: "The token customizations exceed the maximum response size",
+		}
+		failedBody, err := marshalLine(failed)
+		return failed, failedBody, err
+	}
+
+	var encodeErr error
+	encoded := make(map[int][]byte)
+	encode := func(n int) []byte {
+		if b, ok := encoded[n]; ok {
+			return b
+		}
+		trimmed := resp
+		trimmed.Operations = resp.Operations[:n]
+		b, err := marshalLine(trimmed)
+		if err != nil {
+			encodeErr = err
+		}
+		encoded[n] = b
+		return b
+	}
+	// The first prefix length that no longer fits, less one, is the longest that does
+	kept := sort.Search(len(resp.Operations)+1, func(n int) bool {
+		return encodeErr != nil || len(encode(n)) > c.maxResponseBytes
+	}) - 1
+	if encodeErr != nil {
+		return resp, nil, encodeErr
+	}
+	if kept < 0 {
+		return resp, nil, fmt.Errorf("response without operations exceeds MAX_RESPONSE_BYTES %d", c.maxResponseBytes)
+	}
+
+	logger.Warn("Response exceeds MAX_RESPONSE_BYTES, dropping trailing operations",
+		"bytes", len(body), "max_bytes", c.maxResponseBytes, "operations", len(resp.Operations), "kept_operations", kept)
+	trimmed := resp
+	trimmed.Operations = resp.Operations[:kept]
+	return trimmed, encode(kept), nil
+}
+
+// errResponseDeadline is returned when building the response took too long
+var errResponseDeadline = errors.New("response build deadline exceeded")
+
+// configureResponseBuildTimeout reads RESPONSE_BUILD_TIMEOUT
+func (c *Config) configureResponseBuildTimeout() error {
+	v := os.Getenv("RESPONSE_BUILD_TIMEOUT")
+	if v == "" {
+		return nil
+	}
+	d, err := parseDuration(v)
+	if err != nil || d < 0 {
+		return fmt.Errorf("invalid RESPONSE_BUILD_TIMEOUT %q", v)
+	}
+	c.responseBuildTimeout = d
+	return nil
+}
+
+// responseBuildDeadline returns the deadline for a response whose build starts
+// at start, or the zero time when there is none
+func (c *Config) responseBuildDeadline(start time.Time) time.Time {
+	if c.responseBuildTimeout <= 0 {
+		return time.Time{}
+	}
+	return start.Add(c.responseBuildTimeout)
+}
+
+// encodeWithDeadline encodes v as a newline-terminated JSON document, giving up
+// with errResponseDeadline once deadline passes. Encoding cannot be interrupted,
+// so an encode that overruns finishes in the background and is discarded.
+func encodeWithDeadline(v interface{}, deadline time.Time) ([]byte, error) {
+	if deadline.IsZero() {
+		return marshalLine(v)
+	}
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return nil, errResponseDeadline
+	}
+
+	type result struct {
+		body []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		body, err := marshalLine(v)
+		done <- result{body, err}
+	}()
+
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.body, r.err
+	case <-timer.C:
+		return nil, errResponseDeadline
+	}
+}
+
+// marshalLine encodes v like json.Encoder does, with a trailing newline
+func marshalLine(v interface{}) ([]byte, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(body, '\n'), nil
+}
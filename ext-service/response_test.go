@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowJSON encodes as a string after delay, standing in for a huge value
+type slowJSON struct {
+	delay time.Duration
+}
+
+func (s slowJSON) MarshalJSON() ([]byte, error) {
+	time.Sleep(s.delay)
+	return []byte(`"slow"`), nil
+}
+
+func TestEncodeWithDeadline(t *testing.T) {
+	if body, err := encodeWithDeadline(slowJSON{}, time.Time{}); err != nil || string(body) != "\"slow\"\n" {
+		t.Errorf("without a deadline: body = %q, err = %v, want the encoding", body, err)
+	}
+	if body, err := encodeWithDeadline(slowJSON{}, time.Now().Add(time.Second)); err != nil || string(body) != "\"slow\"\n" {
+		t.Errorf("within the deadline: body = %q, err = %v, want the encoding", body, err)
+	}
+	if _, err := encodeWithDeadline(slowJSON{}, time.Now().Add(-time.Second)); !errors.Is(err, errResponseDeadline) {
+		t.Errorf("past the deadline: err = %v, want %v", err, errResponseDeadline)
+	}
+
+	returnsWithin(t, "slow encode", 150*time.Millisecond, func() error {
+		_, err := encodeWithDeadline(slowJSON{delay: 500 * time.Millisecond}, time.Now().Add(20*time.Millisecond))
+		return err
+	})
+}
+
+func TestHandlerFailsWhenResponseBuildOverrunsDeadline(t *testing.T) {
+	provider := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{{
+		EntitlementID: "ent_read",
+		Subject:       Subject{Type: "partner", ID: "org_acme"},
+		Action:        "read",
+		Claims:        map[string]interface{}{"catalog": slowJSON{delay: 300 * time.Millisecond}},
+	}}}}
+	s := NewServer(provider)
+	s.responseBuildTimeout = 20 * time.Millisecond
+	req := Request{
+		ActionType: actionPreIssueAccessToken,
+		Event: Event{
+			Request:     RequestData{AdditionalHeaders: []Header{partnerHeader("org_acme")}},
+			AccessToken: AccessToken{Scopes: []string{}},
+		},
+		AllowedOperations: []Operation{{Op: "add", Paths: []string{accessTokenScopesPath, accessTokenClaimsPath}}},
+	}
+
+	rec, resp := serve(t, s, http.MethodPost, marshalRequest(t, req))
+
+	if rec.Code != http.StatusServiceUnavailable || resp.ErrorDescription != "Response could not be built in time" {
+		t.Errorf("status = %d, response = %+v, want %d", rec.Code, resp, http.StatusServiceUnavailable)
+	}
+
+	// The same request fits a generous deadline
+	s.responseBuildTimeout = 5 * time.Second
+	if rec, resp := serve(t, s, http.MethodPost, marshalRequest(t, req)); rec.Code != http.StatusOK || resp.ActionStatus != "SUCCESS" {
+		t.Errorf("status = %d, response = %+v, want SUCCESS within the deadline", rec.Code, resp)
+	}
+}
+
+// manyScopesServer returns a server granting org_acme n scopes
+func manyScopesServer(n int) *Server {
+	data := &EntitlementsData{}
+	for i := 0; i < n; i++ {
+		data.Entitlements = append(data.Entitlements, Entitlement{
+			EntitlementID: fmt.Sprintf("ent_%02d", i),
+			Subject:       Subject{Type: "partner", ID: "org_acme"},
+			Action:        fmt.Sprintf("action_%02d", i),
+		})
+	}
+	return NewServer(fakeEntitlements{data: data})
+}
+
+func TestOversizedResponseIsTruncated(t *testing.T) {
+	logs := withDefaultLogger(t)
+	s := manyScopesServer(20)
+	s.maxResponseBytes = 500
+
+	body := serveRaw(s, actionRequest(t, partnerHeader("org_acme")))
+
+	if len(body) > s.maxResponseBytes {
+		t.Errorf("body = %d bytes, want at most %d", len(body), s.maxResponseBytes)
+	}
+	var resp Response
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("decode response %q: %v", body, err)
+	}
+	scopes := grantedScopes(resp.Operations)
+	if resp.ActionStatus != "SUCCESS" || len(scopes) == 0 || len(scopes) >= 20 {
+		t.Fatalf("response = %s, want SUCCESS with some but not all scopes", body)
+	}
+	// The longest prefix that fits is kept, so the next operation would not fit
+	for i, scope := range scopes {
+		if want := fmt.Sprintf("partner:action_%02d", i); scope != want {
+			t.Errorf("scope %d = %s, want %s", i, scope, want)
+		}
+	}
+	longer := resp
+	longer.Operations = append(resp.Operations, OperationResponse{Op: "add", Path: accessTokenScopesPath, Value: fmt.Sprintf("partner:action_%02d", len(scopes))})
+	if encoded, _ := marshalLine(longer); len(encoded) <= s.maxResponseBytes {
+		t.Errorf("%d operations fit in %d bytes, want the longest prefix kept", len(longer.Operations), s.maxResponseBytes)
+	}
+	if again := serveRaw(s, actionRequest(t, partnerHeader("org_acme"))); again != body {
+		t.Errorf("second response = %s, want the same cut as %s", again, body)
+	}
+	if out := logs.String(); !strings.Contains(out, "Response exceeds MAX_RESPONSE_BYTES, dropping trailing operations") {
+		t.Errorf("logs = %s, want the truncation logged", out)
+	}
+}
+
+func TestOversizedResponseFails(t *testing.T) {
+	s := manyScopesServer(20)
+	s.maxResponseBytes = 500
+	s.failOversizedResponses = true
+
+	rec, resp := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+
+	if rec.Code != http.StatusOK || resp.ActionStatus != "FAILED" || resp.FailureReason != "response_too_large" || len(resp.Operations) != 0 {
+		t.Errorf("status = %d, response = %+v, want a FAILED response_too_large", rec.Code, resp)
+	}
+
+	// A response within the limit is left alone
+	s.maxResponseBytes = 10000
+	if _, resp := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme"))); resp.ActionStatus != "SUCCESS" || len(resp.Operations) != 20 {
+		t.Errorf("response = %+v, want every operation within the limit", resp)
+	}
+}
+
+func TestLimitResponseSizeFailsWhenNothingFits(t *testing.T) {
+	c := Config{maxResponseBytes: 10}
+	resp := Response{ActionStatus: "SUCCESS", Operations: []OperationResponse{{Op: "add", Path: accessTokenScopesPath, Value: "partner:read"}}}
+	body, _ := marshalLine(resp)
+
+	if _, _, err := c.limitResponseSize(slog.Default(), resp, body); err == nil {
+		t.Error("limitResponseSize succeeded, want an error when the response without operations is over the limit")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RiskEvaluator scores how risky a token request is. Entitlements declaring a
+// maxRisk below the score do not grant their scopes.
+type RiskEvaluator interface {
+	Evaluate(ev Event, now time.Time) float64
+}
+
+// ruleRiskEvaluator adds up weighted request signals:
+//
+//	ipReputation     the IP reputation header value, 0 (good) to 1 (bad)
+//	untrustedDevice  the device claim is missing or not true
+//	offHours         the request falls outside business hours (UTC)
+type ruleRiskEvaluator struct {
+	ipReputationHeader string
+	deviceClaim        string
+	businessStart      int
+	businessEnd        int
+	weights            map[string]float64
+}
+
+// Evaluate returns the weighted sum of the signals present in the request
+func (e *ruleRiskEvaluator) Evaluate(ev Event, now time.Time) float64 {
+	var score float64
+
+	if raw := getHeaderValue(ev.Request.AdditionalHeaders, e.ipReputationHeader); raw != "" {
+		if reputation, err := strconv.ParseFloat(raw, 64); err == nil {
+			score += e.weights["ipReputation"] * clamp(reputation, 0, 1)
+		}
+	}
+
+	trusted := false
+	if value, ok := getClaimValue(ev.AccessToken.Claims, e.deviceClaim); ok {
+		trusted = value == true || value == "true"
+	}
+	if !trusted {
+		score += e.weights["untrustedDevice"]
+	}
+
+	if hour := now.UTC().Hour(); hour < e.businessStart || hour >= e.businessEnd {
+		score += e.weights["offHours"]
+	}
+
+	return score
+}
+
+// clamp limits v to [lo, hi]
+func clamp(v, lo, hi float64) float64 {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// configureRisk enables the rule-based evaluator when RISK_WEIGHTS is set
+func (c *Config) configureRisk() error {
+	rawWeights := os.Getenv("RISK_WEIGHTS")
+	if rawWeights == "" {
+		return nil
+	}
+
+	weights := make(map[string]float64)
+	for _, item := range strings.Split(rawWeights, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			return fmt.Errorf("invalid RISK_WEIGHTS entry %q (expected signal=weight)", item)
+		}
+		switch name {
+		case "ipReputation", "untrustedDevice", "offHours":
+		default:
+			return fmt.Errorf("unknown risk signal %q (expected ipReputation, untrustedDevice or offHours)", name)
+		}
+		weight, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid weight for risk signal %s: %q", name, value)
+		}
+		weights[name] = weight
+	}
+
+	evaluator := &ruleRiskEvaluator{
+		ipReputationHeader: "x-ip-reputation",
+		deviceClaim:        "device_trusted",
+		businessStart:      8,
+		businessEnd:        18,
+		weights:            weights,
+	}
+	if header := os.Getenv("RISK_IP_REPUTATION_HEADER"); header != "" {
+		evaluator.ipReputationHeader = header
+	}
+	if claim := os.Getenv("RISK_DEVICE_CLAIM"); claim != "" {
+		evaluator.deviceClaim = claim
+	}
+	if hours := os.Getenv("RISK_BUSINESS_HOURS"); hours != "" {
+		start, end, ok := strings.Cut(hours, "-")
+		startHour, err1 := strconv.Atoi(start)
+		endHour, err2 := strconv.Atoi(end)
+		if !ok || err1 != nil || err2 != nil || startHour < 0 || endHour > 24 || startHour >= endHour {
+			return fmt.Errorf("invalid RISK_BUSINESS_HOURS %q (expected start-end hours, e.g. 8-18)", hours)
+		}
+		evaluator.businessStart = startHour
+		evaluator.businessEnd = endHour
+	}
+
+	c.riskEvaluator = evaluator
+	return nil
+}
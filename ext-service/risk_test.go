@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// testRiskEvaluator weighs every signal and treats 08:00-18:00 UTC as business hours
+func testRiskEvaluator() *ruleRiskEvaluator {
+	return &ruleRiskEvaluator{
+		ipReputationHeader: "x-ip-reputation",
+		deviceClaim:        "device_trusted",
+		businessStart:      8,
+		businessEnd:        18,
+		weights:            map[string]float64{"ipReputation": 0.5, "untrustedDevice": 0.3, "offHours": 0.2},
+	}
+}
+
+// riskEvent is a request from a trusted or untrusted device with the IP reputation header
+func riskEvent(reputation string, trustedDevice bool) Event {
+	return Event{
+		Request:     RequestData{AdditionalHeaders: []Header{partnerHeader("org_acme"), {Name: "x-ip-reputation", Value: []string{reputation}}}},
+		AccessToken: AccessToken{Scopes: []string{}, Claims: []Claim{{Name: "device_trusted", Value: trustedDevice}}},
+	}
+}
+
+func TestRuleRiskEvaluator(t *testing.T) {
+	noon := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	night := time.Date(2025, 6, 1, 23, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		ev   Event
+		now  time.Time
+		want float64
+	}{
+		{"low risk", riskEvent("0", true), noon, 0},
+		{"bad reputation", riskEvent("1", true), noon, 0.5},
+		{"reputation clamped", riskEvent("7", true), noon, 0.5},
+		{"untrusted device off hours", riskEvent("0", false), night, 0.5},
+		{"every signal", riskEvent("0.5", false), night, 0.75},
+	}
+	for _, tt := range tests {
+		if got := testRiskEvaluator().Evaluate(tt.ev, tt.now); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: score = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHandlerDropsScopesAboveMaxRisk(t *testing.T) {
+	withClock(t, time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	maxRisk := 0.4
+	provider := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{
+		{EntitlementID: "ent_read", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "read"},
+		{EntitlementID: "ent_admin", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "admin", MaxRisk: &maxRisk},
+	}}}
+	s := NewServer(provider)
+	s.riskEvaluator = testRiskEvaluator()
+	tests := []struct {
+		name string
+		ev   Event
+		want []string
+	}{
+		{"low risk", riskEvent("0.2", true), []string{"partner:read", "partner:admin"}},
+		{"high risk", riskEvent("0.9", false), []string{"partner:read"}},
+	}
+	for _, tt := range tests {
+		req := Request{
+			ActionType:        actionPreIssueAccessToken,
+			Event:             tt.ev,
+			AllowedOperations: []Operation{{Op: "add", Paths: []string{accessTokenScopesPath}}},
+		}
+
+		_, resp := serve(t, s, http.MethodPost, marshalRequest(t, req))
+
+		if got := grantedScopes(resp.Operations); mustJSON(t, got) != mustJSON(t, tt.want) {
+			t.Errorf("%s: granted scopes = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConfigureRiskRejectsInvalidSettings(t *testing.T) {
+	for _, tt := range []struct{ weights, hours string }{
+		{"ipReputation", ""},
+		{"geo=1", ""},
+		{"offHours=high", ""},
+		{"offHours=1", "18-8"},
+	} {
+		t.Setenv("RISK_WEIGHTS", tt.weights)
+		t.Setenv("RISK_BUSINESS_HOURS", tt.hours)
+		cfg := defaultConfig()
+		if err := cfg.configureRisk(); err == nil {
+			t.Errorf("configureRisk accepted RISK_WEIGHTS=%q RISK_BUSINESS_HOURS=%q", tt.weights, tt.hours)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// rulesFile holds declarative rules of the form "when <conditions> then
+// <operations>", loaded from RULES_FILE at startup. For example:
+//
+//	rules:
+//	  - name: eu-quality-audit
+//	    when:
+//	      subject: org_acme
+//	      grantType: client_credentials
+//	      claims:
+//	        department: quality
+//	      headers:
+//	        x-region: eu
+//	    then:
+//	      - op: add
+//	        path: /accessToken/claims/-
+//	        value: {name: audit_required, value: true}
+type rulesFile struct {
+	Rules []rule `yaml:"rules"`
+}
+
+// rule emits its operations when every one of its conditions holds
+type rule struct {
+	Name string          `yaml:"name"`
+	When ruleConditions  `yaml:"when"`
+	Then []ruleOperation `yaml:"then"`
+}
+
+// ruleConditions are ANDed together; an unset condition always holds
+type ruleConditions struct {
+	// Subject is a partner ID of the request
+	Subject string `yaml:"subject"`
+	// GrantType is the grant type of the token request
+	GrantType string `yaml:"grantType"`
+	// Claims maps access token claim names to the value they must have. A claim
+	// holding an array matches when any element has the value.
+	Claims map[string]string `yaml:"claims"`
+	// Headers maps additional header names to a value they must carry
+	Headers map[string]string `yaml:"headers"`
+}
+
+// ruleOperation is an operation emitted by a rule
+type ruleOperation struct {
+	Op    string      `yaml:"op"`
+	Path  string      `yaml:"path"`
+	Value interface{} `yaml:"value"`
+}
+
+// configureRules loads and compiles RULES_FILE
+func (c *Config) configureRules() error {
+	path := os.Getenv("RULES_FILE")
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	compiled, err := compileRules(data)
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %w", path, err)
+	}
+	c.rules = compiled
+	slog.Info("Loaded rules", "count", len(compiled), "path", path)
+	return nil
+}
+
+// compileRules parses a rules document and checks every operation it can emit
+func compileRules(data []byte) ([]rule, error) {
+	var doc rulesFile
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	for i, r := range doc.Rules {
+		if r.Name == "" {
+			return nil, fmt.Errorf("rule %d has no name", i)
+		}
+		if len(r.Then) == 0 {
+			return nil, fmt.Errorf("rule %s has no operations", r.Name)
+		}
+		for _, op := range r.Then {
+			if op.Path == "" {
+				return nil, fmt.Errorf("rule %s: operation %s has no path", r.Name, op.Op)
+			}
+			if err := validateOperationValue(op.response()); err != nil {
+				return nil, fmt.Errorf("rule %s: %s %s: %w", r.Name, op.Op, op.Path, err)
+			}
+		}
+	}
+	return doc.Rules, nil
+}
+
+// response converts the rule operation into a response operation
+func (op ruleOperation) response() OperationResponse {
+	return OperationResponse{Op: op.Op, Path: op.Path, Value: op.Value}
+}
+
+// matches reports whether every condition of c holds for the request
+func (c ruleConditions) matches(ev Event, partners map[string]bool) bool {
+	if c.Subject != "" && !partners[c.Subject] {
+		return false
+	}
+	if c.GrantType != "" && c.GrantType != ev.Request.GrantType {
+		return false
+	}
+	for name, want := range c.Claims {
+		value, ok := getClaimValue(ev.AccessToken.Claims, name)
+		if !ok || !claimHasValue(value, want) {
+			return false
+		}
+	}
+	for name, want := range c.Headers {
+		if !headerHasValue(ev.Request.AdditionalHeaders, name, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyRules emits the operations of every matching rule, subject to allowedOperations
+func (c *Config) applyRules(ops *operationSet, allowed []Operation, ev Event, partners map[string]bool) {
+	for _, r := range c.rules {
+		if !r.When.matches(ev, partners) {
+			continue
+		}
+		ops.log().Debug("Rule matched", "rule", r.Name)
+		for _, op := range r.Then {
+			ops.applyIfAllowed(allowed, op.response())
+		}
+	}
+}
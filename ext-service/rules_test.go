@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// qualityAuditRules flags EU requests from the quality department of org_acme
+const qualityAuditRules = `
+rules:
+  - name: eu-quality-audit
+    when:
+      subject: org_acme
+      grantType: client_credentials
+      claims:
+        department: quality
+      headers:
+        x-region: eu
+    then:
+      - op: add
+        path: /accessToken/claims/-
+        value: {name: audit_required, value: true}
+`
+
+// rulesServer returns a server applying the compiled rules document
+func rulesServer(t *testing.T, doc string) *Server {
+	t.Helper()
+	compiled, err := compileRules([]byte(doc))
+	if err != nil {
+		t.Fatalf("compileRules: %v", err)
+	}
+	s := NewServer(testEntitlements)
+	s.rules = compiled
+	return s
+}
+
+// ruleRequest builds a request from org_acme with the x-region header and the
+// department claim
+func ruleRequest(t *testing.T, region string, department string, allowed []string) string {
+	t.Helper()
+	req := Request{
+		ActionType: actionPreIssueAccessToken,
+		Event: Event{
+			Request: RequestData{
+				GrantType:         "client_credentials",
+				AdditionalHeaders: []Header{partnerHeader("org_acme"), {Name: "x-region", Value: []string{region}}},
+			},
+			AccessToken: AccessToken{Scopes: []string{}, Claims: []Claim{{Name: "department", Value: department}}},
+		},
+		AllowedOperations: []Operation{{Op: "add", Paths: allowed}},
+	}
+	return marshalRequest(t, req)
+}
+
+func TestRuleCombiningClaimAndHeaderEmitsOperation(t *testing.T) {
+	s := rulesServer(t, qualityAuditRules)
+	allowed := []string{accessTokenScopesPath, accessTokenClaimsPath}
+	want := `{"op":"add","path":"/accessToken/claims/-","value":{"name":"audit_required","value":true}}`
+	tests := []struct {
+		name       string
+		region     string
+		department string
+		want       bool
+	}{
+		{"every condition holds", "eu", "quality", true},
+		{"header differs", "us", "quality", false},
+		{"claim differs", "eu", "sales", false},
+	}
+	for _, tt := range tests {
+		body := serveRaw(s, ruleRequest(t, tt.region, tt.department, allowed))
+		if got := strings.Contains(body, want); got != tt.want {
+			t.Errorf("%s: response = %s, want rule operation emitted %v", tt.name, body, tt.want)
+		}
+	}
+
+	if body := serveRaw(s, ruleRequest(t, "eu", "quality", []string{accessTokenScopesPath})); strings.Contains(body, "audit_required") {
+		t.Errorf("response = %s, want the rule operation dropped when its path is not allowed", body)
+	}
+}
+
+func TestRuleConditionsAreANDed(t *testing.T) {
+	ev := Event{
+		Request: RequestData{
+			GrantType:         "client_credentials",
+			AdditionalHeaders: []Header{{Name: "x-region", Value: []string{"eu"}}},
+		},
+		AccessToken: AccessToken{Claims: []Claim{{Name: "groups", Value: []interface{}{"ops", "quality"}}}},
+	}
+	partners := map[string]bool{"org_acme": true}
+	tests := []struct {
+		name       string
+		conditions ruleConditions
+		want       bool
+	}{
+		{"no conditions", ruleConditions{}, true},
+		{"all hold", ruleConditions{Subject: "org_acme", GrantType: "client_credentials", Claims: map[string]string{"groups": "quality"}, Headers: map[string]string{"x-region": "eu"}}, true},
+		{"subject differs", ruleConditions{Subject: "org_beta", Claims: map[string]string{"groups": "quality"}}, false},
+		{"grant type differs", ruleConditions{Subject: "org_acme", GrantType: "refresh_token"}, false},
+		{"claim missing", ruleConditions{Subject: "org_acme", Claims: map[string]string{"department": "quality"}}, false},
+		{"one of two headers missing", ruleConditions{Headers: map[string]string{"x-region": "eu", "x-channel": "web"}}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.conditions.matches(ev, partners); got != tt.want {
+			t.Errorf("%s: matches = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCompileRulesRejectsInvalidRules(t *testing.T) {
+	for _, doc := range []string{
+		"rules: [",
+		"rules:\n  - then: [{op: add, path: /accessToken/scopes/-, value: x}]",
+		"rules:\n  - name: empty",
+		"rules:\n  - name: no-path\n    then: [{op: add, value: x}]",
+		"rules:\n  - name: list-for-append\n    then: [{op: add, path: /accessToken/scopes/-, value: [a, b]}]",
+	} {
+		if _, err := compileRules([]byte(doc)); err == nil {
+			t.Errorf("compileRules accepted %q", doc)
+		}
+	}
+}
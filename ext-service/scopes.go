@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+)
+
+// scopePrefixRewrite maps an internal scope prefix to its external form
+type scopePrefixRewrite struct {
+	From string
+	To   string
+}
+
+// unsafeScopeChars matches characters replaced when a subject ID is embedded in a scope
+var unsafeScopeChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// Scope syntax policies (SCOPE_SYNTAX_POLICY) for computed scopes that are not
+// valid scope tokens
+const (
+	scopeSyntaxReject   = "reject"
+	scopeSyntaxSanitize = "sanitize"
+)
+
+// scopeToken reports whether r may appear in a scope: printable ASCII other than
+// space, '"' and '\' (scope-token in RFC 6749 section 3.3), which is what
+// Asgardeo accepts
+func scopeToken(r rune) bool {
+	return r == 0x21 || (r >= 0x23 && r <= 0x5B) || (r >= 0x5D && r <= 0x7E)
+}
+
+// normalizeScope validates a computed scope against the scope-token syntax. By
+// default a scope with any other character is rejected; with the sanitize policy
+// surrounding whitespace is trimmed, inner whitespace runs and other invalid
+// characters become underscores. An empty scope is always rejected.
+func (c *Config) normalizeScope(s string) (string, error) {
+	if strings.IndexFunc(s, func(r rune) bool { return !scopeToken(r) }) < 0 {
+		if s == "" {
+			return "", errors.New("scope is empty")
+		}
+		return s, nil
+	}
+	if !c.sanitizeScopes {
+		return "", fmt.Errorf("scope %q contains characters not allowed in a scope", s)
+	}
+
+	var b strings.Builder
+	space := false
+	for _, r := range strings.TrimSpace(s) {
+		switch {
+		case unicode.IsSpace(r):
+			space = true
+			continue
+		case space:
+			b.WriteByte('_')
+			space = false
+		}
+		if scopeToken(r) {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	if b.Len() == 0 {
+		return "", errors.New("scope is empty")
+	}
+	return b.String(), nil
+}
+
+// configureScopeSyntax reads SCOPE_SYNTAX_POLICY
+func (c *Config) configureScopeSyntax() error {
+	switch policy := os.Getenv("SCOPE_SYNTAX_POLICY"); policy {
+	case "", scopeSyntaxReject:
+		c.sanitizeScopes = false
+	case scopeSyntaxSanitize:
+		c.sanitizeScopes = true
+	default:
+		return fmt.Errorf("invalid SCOPE_SYNTAX_POLICY %q (expected %s or %s)", policy, scopeSyntaxReject, scopeSyntaxSanitize)
+	}
+	return nil
+}
+
+// scopeContext is the data available to the scope template. Subject.ID is
+// sanitized as with SCOPE_INCLUDE_SUBJECT.
+type scopeContext struct {
+	Subject       Subject
+	Action        string
+	EntitlementID string
+}
+
+// configureScopeTemplate parses SCOPE_TEMPLATE, and renders it once against an
+// example entitlement so a template naming unknown fields fails at startup
+func (c *Config) configureScopeTemplate() error {
+	text := os.Getenv("SCOPE_TEMPLATE")
+	if text == "" {
+		c.scopeTemplate = nil
+		return nil
+	}
+	tmpl, err := template.New("scope").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return fmt.Errorf("invalid SCOPE_TEMPLATE: %w", err)
+	}
+	example := scopeContext{Subject: Subject{Type: "partner", ID: "org_example"}, Action: "read", EntitlementID: "ent_example"}
+	if err := tmpl.Execute(new(bytes.Buffer), example); err != nil {
+		return fmt.Errorf("invalid SCOPE_TEMPLATE: %w", err)
+	}
+	c.scopeTemplate = tmpl
+	return nil
+}
+
+// buildScope returns the scope granted by an entitlement
+func (c *Config) buildScope(entitlement Entitlement) (string, error) {
+	if c.scopeTemplate != nil {
+		return c.renderScope(entitlement)
+	}
+	if entitlement.Action == "" {
+		return "", errors.New("entitlement has no action")
+	}
+	if !c.scopeIncludeSubject {
+		return fmt.Sprintf("%s:%s", entitlement.Subject.Type, entitlement.Action), nil
+	}
+
+	subjectID := sanitizeScopeSegment(entitlement.Subject.ID)
+	if c.scopeSubjectPosition == "suffix" {
+		return fmt.Sprintf("%s:%s:%s", entitlement.Subject.Type, entitlement.Action, subjectID), nil
+	}
+	return fmt.Sprintf("%s:%s:%s", entitlement.Subject.Type, subjectID, entitlement.Action), nil
+}
+
+// renderScope formats an entitlement's scope with SCOPE_TEMPLATE
+func (c *Config) renderScope(entitlement Entitlement) (string, error) {
+	var buf bytes.Buffer
+	err := c.scopeTemplate.Execute(&buf, scopeContext{
+		Subject:       Subject{Type: entitlement.Subject.Type, ID: sanitizeScopeSegment(entitlement.Subject.ID)},
+		Action:        entitlement.Action,
+		EntitlementID: entitlement.EntitlementID,
+	})
+	if err != nil {
+		return "", err
+	}
+	if buf.Len() == 0 {
+		return "", errors.New("scope template rendered an empty scope")
+	}
+	return buf.String(), nil
+}
+
+// sanitizeScopeSegment replaces characters that would break the scope format
+// (separators, whitespace and other punctuation) with underscores
+func sanitizeScopeSegment(value string) string {
+	return unsafeScopeChars.ReplaceAllString(value, "_")
+}
+
+// rewriteScope applies the first matching prefix rewrite rule to scope
+func (c *Config) rewriteScope(scope string) string {
+	for _, rule := range c.scopePrefixRewrites {
+		if strings.HasPrefix(scope, rule.From) {
+			return rule.To + strings.TrimPrefix(scope, rule.From)
+		}
+	}
+	return scope
+}
+
+// parseScopePrefixRewrites parses SCOPE_PREFIX_REWRITES, a comma-separated list
+// of from=to rules (an empty "to" strips the prefix), e.g. "internal:=ext:,legacy:="
+func parseScopePrefixRewrites(value string) ([]scopePrefixRewrite, error) {
+	var rules []scopePrefixRewrite
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(item, "=")
+		if !ok || from == "" {
+			return nil, fmt.Errorf("invalid scope prefix rewrite %q (expected from=to)", item)
+		}
+		rules = append(rules, scopePrefixRewrite{From: from, To: to})
+	}
+	return rules, nil
+}
+
+// enforceScopeLength applies MAX_SCOPE_LENGTH to scope. It returns the scope to
+// emit, or false when the scope must be dropped.
+func (c *Config) enforceScopeLength(logger *slog.Logger, scope string, entitlementID string) (string, bool) {
+	if c.maxScopeLength <= 0 || len(scope) <= c.maxScopeLength {
+		return scope, true
+	}
+
+	if !c.truncateLongScopes {
+		logger.Warn("Dropping scope: length exceeds MAX_SCOPE_LENGTH", "entitlement_id", entitlementID, "length", len(scope), "max_length", c.maxScopeLength)
+		return scope, false
+	}
+
+	truncated := scope[:c.maxScopeLength]
+	// Do not cut a multi-byte character in half
+	for !utf8.ValidString(truncated) {
+		truncated = truncated[:len(truncated)-1]
+	}
+	logger.Warn("Truncating scope: length exceeds MAX_SCOPE_LENGTH", "entitlement_id", entitlementID, "length", len(scope), "max_length", c.maxScopeLength)
+	return truncated, true
+}
+
+// configureScopeSubject reads SCOPE_INCLUDE_SUBJECT and SCOPE_SUBJECT_POSITION
+func (c *Config) configureScopeSubject() error {
+	c.scopeIncludeSubject = os.Getenv("SCOPE_INCLUDE_SUBJECT") == "true"
+	switch position := os.Getenv("SCOPE_SUBJECT_POSITION"); position {
+	case "", "prefix":
+		c.scopeSubjectPosition = "prefix"
+	case "suffix":
+		c.scopeSubjectPosition = "suffix"
+	default:
+		return fmt.Errorf("invalid SCOPE_SUBJECT_POSITION %q (expected prefix or suffix)", position)
+	}
+	return nil
+}
+
+// configureScopeLength reads MAX_SCOPE_LENGTH and SCOPE_LENGTH_POLICY
+func (c *Config) configureScopeLength() error {
+	if v := os.Getenv("MAX_SCOPE_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid MAX_SCOPE_LENGTH %q", v)
+		}
+		c.maxScopeLength = n
+	}
+
+	switch policy := os.Getenv("SCOPE_LENGTH_POLICY"); policy {
+	case "", "drop":
+		c.truncateLongScopes = false
+	case "truncate":
+		c.truncateLongScopes = true
+	default:
+		return fmt.Errorf("invalid SCOPE_LENGTH_POLICY %q (expected drop or truncate)", policy)
+	}
+	return nil
+}
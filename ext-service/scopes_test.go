@@ -0,0 +1,230 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"testing"
+)
+
+// scopeTemplateConfig returns the default settings with SCOPE_TEMPLATE set to text
+func scopeTemplateConfig(t *testing.T, text string) Config {
+	t.Helper()
+	t.Setenv("SCOPE_TEMPLATE", text)
+	cfg := defaultConfig()
+	if err := cfg.configureScopeTemplate(); err != nil {
+		t.Fatalf("configureScopeTemplate(%q): %v", text, err)
+	}
+	return cfg
+}
+
+func TestBuildScopeDefaultFormat(t *testing.T) {
+	cfg := defaultConfig()
+	got, err := cfg.buildScope(Entitlement{Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "read"})
+	if err != nil || got != "partner:read" {
+		t.Errorf("buildScope = %q, %v, want partner:read", got, err)
+	}
+}
+
+func TestBuildScopeIncludesSubject(t *testing.T) {
+	tests := []struct {
+		position  string
+		subjectID string
+		want      string
+	}{
+		{"", "acme", "partner:acme:read"},
+		{"prefix", "acme", "partner:acme:read"},
+		{"suffix", "acme", "partner:read:acme"},
+		{"prefix", "org:acme", "partner:org_acme:read"},
+		{"suffix", "acme corp", "partner:read:acme_corp"},
+		{"prefix", " a:b c ", "partner:_a_b_c_:read"},
+	}
+	for _, tt := range tests {
+		t.Setenv("SCOPE_INCLUDE_SUBJECT", "true")
+		t.Setenv("SCOPE_SUBJECT_POSITION", tt.position)
+		cfg := defaultConfig()
+		if err := cfg.configureScopeSubject(); err != nil {
+			t.Fatalf("configureScopeSubject: %v", err)
+		}
+
+		got, err := cfg.buildScope(Entitlement{Subject: Subject{Type: "partner", ID: tt.subjectID}, Action: "read"})
+		if err != nil || got != tt.want {
+			t.Errorf("position %q, subject %q: buildScope = %q, %v, want %q", tt.position, tt.subjectID, got, err, tt.want)
+		}
+	}
+
+	t.Setenv("SCOPE_SUBJECT_POSITION", "middle")
+	cfg := defaultConfig()
+	if err := cfg.configureScopeSubject(); err == nil {
+		t.Error("configureScopeSubject accepted SCOPE_SUBJECT_POSITION=middle")
+	}
+}
+
+func TestBuildScopeTemplate(t *testing.T) {
+	entitlement := Entitlement{EntitlementID: "ent_1", Subject: Subject{Type: "partner", ID: "org acme"}, Action: "read"}
+
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"urn:{{.Subject.Type}}:{{.Subject.ID}}:{{.Action}}", "urn:partner:org_acme:read"},
+		{"{{.Action}}_{{.Subject.ID}}", "read_org_acme"},
+		{"{{.EntitlementID}}", "ent_1"},
+	}
+	for _, tt := range tests {
+		cfg := scopeTemplateConfig(t, tt.template)
+		if got, err := cfg.buildScope(entitlement); err != nil || got != tt.want {
+			t.Errorf("template %q: buildScope = %q, %v, want %q", tt.template, got, err, tt.want)
+		}
+	}
+}
+
+func TestConfigureScopeTemplateRejectsInvalidTemplates(t *testing.T) {
+	for _, text := range []string{"{{.Action", "{{.Tenant}}:{{.Action}}"} {
+		t.Setenv("SCOPE_TEMPLATE", text)
+		cfg := defaultConfig()
+		if err := cfg.configureScopeTemplate(); err == nil {
+			t.Errorf("configureScopeTemplate(%q) succeeded, want an error", text)
+		}
+	}
+}
+
+func TestBuildScopeTemplateExecutionErrors(t *testing.T) {
+	cfg := scopeTemplateConfig(t, "{{slice .Subject.ID 0 5}}:{{.Action}}")
+	if _, err := cfg.buildScope(Entitlement{Subject: Subject{Type: "partner", ID: "ab"}, Action: "read"}); err == nil {
+		t.Error("buildScope succeeded for an ID too short to slice, want an error")
+	}
+
+	cfg = scopeTemplateConfig(t, `{{if eq .Action "read"}}{{.Action}}{{end}}`)
+	if _, err := cfg.buildScope(Entitlement{Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "write"}); err == nil {
+		t.Error("buildScope succeeded with an empty rendered scope, want an error")
+	}
+}
+
+func TestNormalizeScope(t *testing.T) {
+	tests := []struct {
+		scope     string
+		sanitize  bool
+		want      string
+		wantError bool
+	}{
+		{"partner:read", false, "partner:read", false},
+		{"urn:partner:org_acme:read/all", false, "urn:partner:org_acme:read/all", false},
+		{"partner:read all", false, "", true},
+		{"partner:read all", true, "partner:read_all", false},
+		{" partner:read \t all\n", true, "partner:read_all", false},
+		{"partner:lecture-été", false, "", true},
+		{"partner:lecture-été", true, "partner:lecture-_t_", false},
+		{`partner:"read"\`, true, "partner:_read__", false},
+		{"", false, "", true},
+		{"", true, "", true},
+		{" \t ", true, "", true},
+	}
+	for _, tt := range tests {
+		cfg := defaultConfig()
+		cfg.sanitizeScopes = tt.sanitize
+		got, err := cfg.normalizeScope(tt.scope)
+		if (err != nil) != tt.wantError || got != tt.want {
+			t.Errorf("normalizeScope(%q) with sanitize %v = %q, %v, want %q (error %v)", tt.scope, tt.sanitize, got, err, tt.want, tt.wantError)
+		}
+	}
+}
+
+func TestBuildScopeEmptyAction(t *testing.T) {
+	cfg := defaultConfig()
+	if got, err := cfg.buildScope(Entitlement{Subject: Subject{Type: "partner", ID: "org_acme"}}); err == nil {
+		t.Errorf("buildScope = %q, want an error for an entitlement without an action", got)
+	}
+}
+
+func TestHandlerSkipsInvalidScopes(t *testing.T) {
+	provider := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{
+		{EntitlementID: "ent_spaces", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "read all"},
+		{EntitlementID: "ent_read", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "read"},
+	}}}
+
+	_, resp := serve(t, NewServer(provider), http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+	if scopes := grantedScopes(resp.Operations); len(scopes) != 1 || scopes[0] != "partner:read" {
+		t.Errorf("granted scopes = %v, want [partner:read]", scopes)
+	}
+
+	sanitizing := NewServer(provider)
+	sanitizing.sanitizeScopes = true
+	_, resp = serve(t, sanitizing, http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+	if scopes := grantedScopes(resp.Operations); len(scopes) != 2 || scopes[0] != "partner:read_all" {
+		t.Errorf("granted scopes = %v, want [partner:read_all partner:read]", scopes)
+	}
+}
+
+func TestRewriteScope(t *testing.T) {
+	rules, err := parseScopePrefixRewrites(" internal:=ext: , legacy:= ,internal:beta:=beta:")
+	if err != nil {
+		t.Fatalf("parseScopePrefixRewrites: %v", err)
+	}
+	cfg := defaultConfig()
+	cfg.scopePrefixRewrites = rules
+
+	tests := []struct {
+		scope string
+		want  string
+	}{
+		{"internal:read", "ext:read"},
+		{"legacy:write", "write"},
+		// The first matching rule wins, even when a later one is more specific
+		{"internal:beta:read", "ext:beta:read"},
+		{"partner:read", "partner:read"},
+		{"xinternal:read", "xinternal:read"},
+	}
+	for _, tt := range tests {
+		if got := cfg.rewriteScope(tt.scope); got != tt.want {
+			t.Errorf("rewriteScope(%q) = %q, want %q", tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestParseScopePrefixRewritesRejectsInvalidRules(t *testing.T) {
+	for _, value := range []string{"internal:", "=ext:", "a=b,oops"} {
+		if _, err := parseScopePrefixRewrites(value); err == nil {
+			t.Errorf("parseScopePrefixRewrites(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestHandlerEnforcesMaxScopeLength(t *testing.T) {
+	provider := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{
+		{EntitlementID: "ent_long", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "read_everything"},
+		{EntitlementID: "ent_read", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "read"},
+	}}}
+	tests := []struct {
+		name     string
+		truncate bool
+		want     []string
+	}{
+		{"drop", false, []string{"partner:read"}},
+		{"truncate", true, []string{"partner:read_e", "partner:read"}},
+	}
+	for _, tt := range tests {
+		s := NewServer(provider)
+		s.maxScopeLength, s.truncateLongScopes = 14, tt.truncate
+
+		_, resp := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+
+		if got := grantedScopes(resp.Operations); mustJSON(t, got) != mustJSON(t, tt.want) {
+			t.Errorf("%s: granted scopes = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEnforceScopeLengthKeepsCharactersWhole(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.maxScopeLength, cfg.truncateLongScopes = 9, true
+
+	// "é" takes bytes 9 and 10; cutting at 9 would split it
+	got, ok := cfg.enforceScopeLength(slog.Default(), "partner:éa", "ent")
+	if !ok || got != "partner:" {
+		t.Errorf("enforceScopeLength = %q, %v, want %q", got, ok, "partner:")
+	}
+	cfg.maxScopeLength = 0
+	if got, ok := cfg.enforceScopeLength(slog.Default(), "partner:read", "ent"); !ok || got != "partner:read" {
+		t.Errorf("enforceScopeLength without a limit = %q, %v, want it unchanged", got, ok)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// connRequestsKey is the context key of the per-connection request counter
+type connRequestsKey struct{}
+
+// serverConfig holds the HTTP server connection settings
+type serverConfig struct {
+	keepAlives bool
+	// Connection timeouts bound how long a slow client can hold a connection: for
+	// the request headers, the whole request, writing the response, and idling
+	// between keep-alive requests
+	readHeaderTimeout  time.Duration
+	readTimeout        time.Duration
+	writeTimeout       time.Duration
+	idleTimeout        time.Duration
+	maxRequestsPerConn int64
+	// shutdownTimeout is how long in-flight requests may drain on shutdown
+	shutdownTimeout time.Duration
+	// tls is set when the service terminates TLS itself
+	tls *tls.Config
+}
+
+// defaultShutdownTimeout leaves headroom within the 30s Kubernetes termination grace period
+const defaultShutdownTimeout = 20 * time.Second
+
+// Default connection timeouts. Action requests are small and answered quickly,
+// so these only ever cut off stalled clients.
+const (
+	defaultReadHeaderTimeout = 5 * time.Second
+	defaultReadTimeout       = 10 * time.Second
+	defaultWriteTimeout      = 10 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+)
+
+// tlsVersions maps TLS_MIN_VERSION values to TLS versions
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// loadServerConfig reads KEEPALIVES_ENABLED, the connection timeouts,
+// MAX_REQUESTS_PER_CONN, SHUTDOWN_TIMEOUT and the TLS settings
+func loadServerConfig() (serverConfig, error) {
+	cfg := serverConfig{
+		keepAlives:        true,
+		readHeaderTimeout: defaultReadHeaderTimeout,
+		readTimeout:       defaultReadTimeout,
+		writeTimeout:      defaultWriteTimeout,
+		idleTimeout:       defaultIdleTimeout,
+		shutdownTimeout:   defaultShutdownTimeout,
+	}
+
+	switch v := os.Getenv("KEEPALIVES_ENABLED"); v {
+	case "", "true":
+	case "false":
+		cfg.keepAlives = false
+	default:
+		return cfg, fmt.Errorf("invalid KEEPALIVES_ENABLED %q (expected true or false)", v)
+	}
+
+	// 0 disables a timeout
+	timeouts := []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"READ_HEADER_TIMEOUT", &cfg.readHeaderTimeout},
+		{"READ_TIMEOUT", &cfg.readTimeout},
+		{"WRITE_TIMEOUT", &cfg.writeTimeout},
+		{"IDLE_TIMEOUT", &cfg.idleTimeout},
+		{"SHUTDOWN_TIMEOUT", &cfg.shutdownTimeout},
+	}
+	for _, timeout := range timeouts {
+		if v := os.Getenv(timeout.name); v != "" {
+			d, err := parseDuration(v)
+			if err != nil || d < 0 {
+				return cfg, fmt.Errorf("invalid %s %q", timeout.name, v)
+			}
+			*timeout.value = d
+		}
+	}
+
+	if v := os.Getenv("MAX_REQUESTS_PER_CONN"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid MAX_REQUESTS_PER_CONN %q", v)
+		}
+		cfg.maxRequestsPerConn = n
+	}
+
+	tlsCfg, err := loadTLSConfig()
+	if err != nil {
+		return cfg, err
+	}
+	cfg.tls = tlsCfg
+	return cfg, nil
+}
+
+// loadTLSConfig reads TLS_CERT_FILE, TLS_KEY_FILE and TLS_MIN_VERSION. It returns
+// nil when no certificate is configured, so the service serves plain HTTP.
+func loadTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	minVersion := uint16(tls.VersionTLS12)
+	if v := os.Getenv("TLS_MIN_VERSION"); v != "" {
+		version, ok := tlsVersions[v]
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS_MIN_VERSION %q (expected 1.2 or 1.3)", v)
+		}
+		minVersion = version
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: minVersion}, nil
+}
+
+// routes registers the service's endpoints: action requests on public, and
+// probes, metrics and admin endpoints on admin (the same mux when they share a
+// listener)
+func routes(public, admin *http.ServeMux, service *Server) {
+	public.HandleFunc("/token-validation", traceRequests("/token-validation", service.instrument("/token-validation", service.handler)))
+
+	if prom, ok := service.metrics.(*prometheusMetrics); ok {
+		admin.Handle("/metrics", prom.handler())
+	}
+	if service.adminToken != "" {
+		admin.HandleFunc("/stats", service.requireAdminToken(statsHandler))
+		admin.HandleFunc("/admin/disabled-tags", service.requireAdminToken(service.disabledTagsHandler))
+		admin.HandleFunc("/admin/maintenance", service.requireAdminToken(maintenanceHandler))
+		if service.recentRequests != nil {
+			admin.HandleFunc("/debug/recent", service.requireAdminToken(service.recentHandler))
+		}
+	}
+	// The loaded entitlements are guarded by the action shared secret, and only
+	// served when one is configured
+	if service.actionSharedSecret != "" {
+		admin.HandleFunc("/admin/entitlements", service.requireSharedSecret(entitlementsHandler))
+	}
+
+	// Health check endpoint for Envoy readiness probes
+	admin.HandleFunc("/health", healthHandler)
+	admin.HandleFunc("/healthz", healthHandler)
+	admin.HandleFunc("/ready", readyHandler)
+}
+
+// serveUntilSignal serves every server (over TLS when it has a TLS config) until
+// SIGINT or SIGTERM, then drains the servers, letting in-flight requests finish
+// for up to timeout before closing what is left. It returns once
+// all servers have stopped, or as soon as one fails to serve.
+func serveUntilSignal(servers []*http.Server, timeout time.Duration) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	stopped := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			stopped <- listenAndServe(server)
+		}(server)
+	}
+
+	var sig os.Signal
+	select {
+	case err := <-stopped:
+		return err
+	case sig = <-signals:
+	}
+	slog.Info("Shutting down, draining in-flight requests", "signal", sig.String(), "timeout", timeout.String())
+	markNotReady()
+	drain(servers, timeout, drainLogInterval)
+
+	for range servers {
+		if err := <-stopped; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drainLogInterval is how often the in-flight request count is logged while draining
+const drainLogInterval = time.Second
+
+// drain stops the servers accepting connections and waits for in-flight
+// requests to finish, logging how many are left every interval. Once timeout
+// elapses the remaining connections are closed. It reports whether the drain
+// completed cleanly rather than being forced by the timeout.
+func drain(servers []*http.Server, timeout time.Duration, interval time.Duration) bool {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var timedOut atomic.Bool
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				slog.Warn("Drain timeout elapsed, closing remaining connections", "addr", server.Addr, "error", err)
+				server.Close()
+				timedOut.Store(true)
+			}
+		}(server)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			remaining := timeout - time.Since(start)
+			slog.Info("Draining in-flight requests", "inFlight", inFlightRequests.Load(), "remaining", remaining.Round(time.Millisecond).String())
+		case <-done:
+			elapsed := time.Since(start).Round(time.Millisecond).String()
+			if timedOut.Load() {
+				// Closing the connections does not stop their handlers, so these
+				// are abandoned rather than finished
+				slog.Warn("Drain forced by timeout", "inFlight", inFlightRequests.Load(), "elapsed", elapsed)
+				return false
+			}
+			slog.Info("Drain completed cleanly", "elapsed", elapsed)
+			return true
+		}
+	}
+}
+
+// listenAndServe serves until the server is shut down, which is not an error
+func listenAndServe(server *http.Server) error {
+	var err error
+	if server.TLSConfig != nil {
+		// The certificate is already loaded into TLSConfig
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// newServer builds the HTTP server for addr with the connection settings applied
+func newServer(addr string, handler http.Handler, cfg serverConfig) *http.Server {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.readHeaderTimeout,
+		ReadTimeout:       cfg.readTimeout,
+		WriteTimeout:      cfg.writeTimeout,
+		IdleTimeout:       cfg.idleTimeout,
+		TLSConfig:         cfg.tls,
+	}
+	if cfg.maxRequestsPerConn > 0 {
+		server.Handler = limitRequestsPerConn(handler, cfg.maxRequestsPerConn)
+		server.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connRequestsKey{}, new(atomic.Int64))
+		}
+	}
+	server.SetKeepAlivesEnabled(cfg.keepAlives)
+	return server
+}
+
+// limitRequestsPerConn asks the client to close the connection once it has
+// carried max requests, so connections are rebalanced across instances after
+// a scale-up instead of staying pinned to the old ones
+func limitRequestsPerConn(next http.Handler, max int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if count, ok := r.Context().Value(connRequestsKey{}).(*atomic.Int64); ok && count.Add(1) >= max {
+			w.Header().Set("Connection", "close")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// prometheusServer returns a server recording on a Prometheus backend
+func prometheusServer() *Server {
+	s := NewServer(testEntitlements)
+	s.metrics = newPrometheusMetrics()
+	return s
+}
+
+// statusOf returns the status code of a request to url
+func statusOf(t *testing.T, method string, url string, body string) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRoutesSplitAcrossListeners(t *testing.T) {
+	public, admin := http.NewServeMux(), http.NewServeMux()
+	routes(public, admin, prometheusServer())
+
+	publicServer := httptest.NewServer(normalizePaths(logRequests(public)))
+	defer publicServer.Close()
+	adminServer := httptest.NewServer(normalizePaths(logRequests(admin)))
+	defer adminServer.Close()
+
+	tests := []struct {
+		server *httptest.Server
+		method string
+		path   string
+		want   int
+	}{
+		{publicServer, http.MethodPost, "/token-validation", http.StatusOK},
+		{publicServer, http.MethodGet, "/health", http.StatusNotFound},
+		{publicServer, http.MethodGet, "/ready", http.StatusNotFound},
+		{publicServer, http.MethodGet, "/metrics", http.StatusNotFound},
+		{adminServer, http.MethodPost, "/token-validation", http.StatusNotFound},
+		{adminServer, http.MethodGet, "/health", http.StatusOK},
+		{adminServer, http.MethodGet, "/healthz", http.StatusOK},
+		{adminServer, http.MethodGet, "/metrics", http.StatusOK},
+	}
+	for _, tt := range tests {
+		name := "public"
+		if tt.server == adminServer {
+			name = "admin"
+		}
+		if got := statusOf(t, tt.method, tt.server.URL+tt.path, actionRequest(t)); got != tt.want {
+			t.Errorf("%s %s on the %s listener = %d, want %d", tt.method, tt.path, name, got, tt.want)
+		}
+	}
+}
+
+func TestRoutesSharedListener(t *testing.T) {
+	mux := http.NewServeMux()
+	routes(mux, mux, prometheusServer())
+
+	server := httptest.NewServer(normalizePaths(logRequests(mux)))
+	defer server.Close()
+
+	for _, path := range []string{"/health", "/healthz", "/metrics"} {
+		if got := statusOf(t, http.MethodGet, server.URL+path, ""); got != http.StatusOK {
+			t.Errorf("GET %s = %d, want %d", path, got, http.StatusOK)
+		}
+	}
+	if got := statusOf(t, http.MethodPost, server.URL+"/token-validation", actionRequest(t)); got != http.StatusOK {
+		t.Errorf("POST /token-validation = %d, want %d", got, http.StatusOK)
+	}
+}
+
+func TestLoadServerConfigTimeouts(t *testing.T) {
+	cfg, err := loadServerConfig()
+	if err != nil {
+		t.Fatalf("loadServerConfig: %v", err)
+	}
+	server := newServer(":0", http.NotFoundHandler(), cfg)
+	if server.ReadHeaderTimeout != 5*time.Second || server.ReadTimeout != 10*time.Second ||
+		server.WriteTimeout != 10*time.Second || server.IdleTimeout != 120*time.Second {
+		t.Errorf("default timeouts = %v/%v/%v/%v, want 5s/10s/10s/2m0s",
+			server.ReadHeaderTimeout, server.ReadTimeout, server.WriteTimeout, server.IdleTimeout)
+	}
+
+	t.Setenv("WRITE_TIMEOUT", "30s")
+	t.Setenv("READ_TIMEOUT", "0")
+	cfg, err = loadServerConfig()
+	if err != nil {
+		t.Fatalf("loadServerConfig: %v", err)
+	}
+	if cfg.writeTimeout != 30*time.Second || cfg.readTimeout != 0 {
+		t.Errorf("timeouts = write %v read %v, want write 30s read 0s", cfg.writeTimeout, cfg.readTimeout)
+	}
+
+	t.Setenv("READ_HEADER_TIMEOUT", "-1s")
+	if _, err := loadServerConfig(); err == nil {
+		t.Error("loadServerConfig accepted a negative READ_HEADER_TIMEOUT")
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe to write from handlers still running
+// while a test reads it
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// withDefaultLogger sends the default logger's JSON output to the returned
+// buffer for the duration of a test
+func withDefaultLogger(t *testing.T) *lockedBuffer {
+	t.Helper()
+	logs := &lockedBuffer{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return logs
+}
+
+// inFlightServer serves an instrumented handler that blocks until release is
+// closed, and starts one request to it. It returns once the request is in flight.
+func inFlightServer(t *testing.T, release <-chan struct{}) *http.Server {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	started := make(chan struct{})
+	server := &http.Server{Handler: NewServer(testEntitlements).instrument("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})}
+	go server.Serve(listener)
+	go func() {
+		if resp, err := http.Get("http://" + listener.Addr().String() + "/slow"); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+	return server
+}
+
+func TestDrainWaitsForSlowRequest(t *testing.T) {
+	logs := withDefaultLogger(t)
+	release := make(chan struct{})
+	server := inFlightServer(t, release)
+	time.AfterFunc(100*time.Millisecond, func() { close(release) })
+
+	if !drain([]*http.Server{server}, 5*time.Second, 20*time.Millisecond) {
+		t.Fatal("drain was forced, want it to complete once the request finished")
+	}
+
+	out := logs.String()
+	if !strings.Contains(out, `"msg":"Draining in-flight requests","inFlight":1,`) {
+		t.Errorf("no progress log counting the in-flight request in:\n%s", out)
+	}
+	if !strings.Contains(out, `"msg":"Drain completed cleanly"`) {
+		t.Errorf("no clean drain log in:\n%s", out)
+	}
+}
+
+func TestDrainForcedByTimeout(t *testing.T) {
+	logs := withDefaultLogger(t)
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	server := inFlightServer(t, release)
+
+	if drain([]*http.Server{server}, 100*time.Millisecond, 20*time.Millisecond) {
+		t.Fatal("drain completed cleanly, want it forced by the timeout")
+	}
+
+	if out := logs.String(); !strings.Contains(out, `"msg":"Drain forced by timeout","inFlight":1,`) {
+		t.Errorf("no forced drain log counting the abandoned request in:\n%s", out)
+	}
+}
+
+// connectionCloses sends n sequential requests on one client to a server built
+// with cfg and reports, per response, whether the server asked to close the connection
+func connectionCloses(t *testing.T, cfg serverConfig, n int) []bool {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := newServer(listener.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), cfg)
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	client := &http.Client{Transport: &http.Transport{}}
+	defer client.CloseIdleConnections()
+	var closes []bool
+	for i := 0; i < n; i++ {
+		resp, err := client.Get("http://" + listener.Addr().String() + "/")
+		if err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+		resp.Body.Close()
+		closes = append(closes, resp.Close)
+	}
+	return closes
+}
+
+func TestServerKeepAliveSettings(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"default", nil, "[false,false,false]"},
+		{"keep-alives disabled", map[string]string{"KEEPALIVES_ENABLED": "false"}, "[true,true,true]"},
+		{"max requests per connection", map[string]string{"MAX_REQUESTS_PER_CONN": "2"}, "[false,true,false]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			cfg, err := loadServerConfig()
+			if err != nil {
+				t.Fatalf("loadServerConfig: %v", err)
+			}
+			if got := mustJSON(t, connectionCloses(t, cfg, 3)); got != tt.want {
+				t.Errorf("connection closes = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	t.Setenv("KEEPALIVES_ENABLED", "sometimes")
+	if _, err := loadServerConfig(); err == nil {
+		t.Error("loadServerConfig accepted KEEPALIVES_ENABLED=sometimes")
+	}
+}
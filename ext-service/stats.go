@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stats holds in-process counters for the /stats endpoint
+var stats serviceStats
+
+// serviceStats counts requests, entitlement matches and cache usage
+type serviceStats struct {
+	requests    atomic.Int64
+	matches     atomic.Int64
+	cacheHits   atomic.Int64
+	cacheMisses atomic.Int64
+
+	mu       sync.Mutex
+	lastLoad *loadInfo
+}
+
+// loadInfo describes the most recent entitlements file load
+type loadInfo struct {
+	Path         string    `json:"path"`
+	At           time.Time `json:"at"`
+	Entitlements int       `json:"entitlements"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// statsSnapshot is the JSON body of GET /stats
+type statsSnapshot struct {
+	Requests     int64     `json:"requests"`
+	Matches      int64     `json:"matches"`
+	InFlight     int64     `json:"inFlight"`
+	CacheHits    int64     `json:"cacheHits"`
+	CacheMisses  int64     `json:"cacheMisses"`
+	CacheHitRate float64   `json:"cacheHitRate"`
+	LastLoad     *loadInfo `json:"lastLoad"`
+}
+
+// recordLoad remembers the outcome of an entitlements file load
+func (s *serviceStats) recordLoad(path string, data *EntitlementsData, err error) {
+	info := &loadInfo{Path: path, At: time.Now()}
+	if err != nil {
+		info.Error = err.Error()
+	} else {
+		info.Entitlements = len(data.Entitlements)
+	}
+
+	s.mu.Lock()
+	s.lastLoad = info
+	s.mu.Unlock()
+}
+
+// snapshot returns the current counter values
+func (s *serviceStats) snapshot() statsSnapshot {
+	snap := statsSnapshot{
+		Requests:    s.requests.Load(),
+		Matches:     s.matches.Load(),
+		InFlight:    inFlightRequests.Load(),
+		CacheHits:   s.cacheHits.Load(),
+		CacheMisses: s.cacheMisses.Load(),
+	}
+	if lookups := snap.CacheHits + snap.CacheMisses; lookups > 0 {
+		snap.CacheHitRate = float64(snap.CacheHits) / float64(lookups)
+	}
+
+	s.mu.Lock()
+	snap.LastLoad = s.lastLoad
+	s.mu.Unlock()
+	return snap
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultReloadInterval is how often the entitlements file is checked for changes
+const defaultReloadInterval = 5 * time.Second
+
+// entitlementStore keeps parsed entitlements in memory and reloads them: a file
+// when it changes on disk, a remote source on every poll. A reload that fails
+// keeps the last good copy.
+//
+// Each load builds a complete snapshot off to the side and publishes it with a
+// single atomic pointer swap, so readers never take a lock and always see a
+// consistent snapshot, even while a large file is being re-parsed.
+type entitlementStore struct {
+	// source names the file or URL in logs
+	source string
+	// sourceType is "file", "url" or "configmap"
+	sourceType string
+	// load reads and parses the entitlements
+	load func() (*EntitlementsData, error)
+	// version returns the source's current version; nil means the source cannot
+	// tell, so every poll reloads it
+	version func() fileVersion
+	// metrics records the size of each load
+	metrics Metrics
+
+	// reloadMu serializes reloads and guards reloaded; readers never take it
+	reloadMu sync.Mutex
+	current  atomic.Pointer[entitlementSnapshot]
+	// reloaded are called after each successful reload
+	reloaded []func()
+}
+
+// entitlementSnapshot is one immutable load of the entitlements
+type entitlementSnapshot struct {
+	data       *EntitlementsData
+	err        error
+	version    fileVersion
+	generation int64
+	// loadedAt is when data was loaded
+	loadedAt time.Time
+}
+
+// fileVersion identifies a revision of a file by modification time and size
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+// defaultEntitlements serves the default entitlements file, ENTITLEMENTS_URL or
+// ENTITLEMENTS_CONFIGMAP
+var defaultEntitlements *entitlementStore
+
+// newEntitlementStore creates a store for the file at path and loads it once
+func newEntitlementStore(path string, m Metrics) *entitlementStore {
+	s := newStore(path, func() (*EntitlementsData, error) {
+		return loadEntitlementsWithPolicy(path)
+	}, func() fileVersion {
+		return statVersion(path)
+	}, m)
+	s.sourceType = "file"
+	return s
+}
+
+// newStore creates a store for source, recording its loads on m, and loads it once
+func newStore(source string, load func() (*EntitlementsData, error), version func() fileVersion, m Metrics) *entitlementStore {
+	s := &entitlementStore{source: source, load: load, version: version, metrics: m}
+	s.current.Store(&entitlementSnapshot{})
+	s.reload(s.currentVersion())
+	return s
+}
+
+// currentVersion returns the source's version (zero when it has none)
+func (s *entitlementStore) currentVersion() fileVersion {
+	if s.version == nil {
+		return fileVersion{}
+	}
+	return s.version()
+}
+
+// statVersion returns the current version of path (zero when it cannot be stat'ed)
+func statVersion(path string) fileVersion {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileVersion{}
+	}
+	return fileVersion{modTime: info.ModTime(), size: info.Size()}
+}
+
+// get returns the current entitlements, or the load error when no copy has
+// loaded successfully yet
+func (s *entitlementStore) get() (*EntitlementsData, error) {
+	snapshot := s.current.Load()
+	if snapshot.data == nil {
+		if snapshot.err == nil {
+			return nil, errors.New("entitlements not loaded")
+		}
+		return nil, snapshot.err
+	}
+	return snapshot.data, nil
+}
+
+// reloadIfChanged reloads the source when its version differs from the loaded
+// one, or always when the source has no version
+func (s *entitlementStore) reloadIfChanged() {
+	if s.version == nil {
+		s.reload(fileVersion{})
+		return
+	}
+	if version := s.version(); version != s.current.Load().version {
+		s.reload(version)
+	}
+}
+
+// reload loads the source and swaps it in. On failure the previous copy stays in
+// place; the version is still recorded so a broken file is not retried until it
+// changes again.
+func (s *entitlementStore) reload(version fileVersion) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	previous := s.current.Load()
+	data, err := s.load()
+	if err != nil {
+		next := *previous
+		next.version = version
+		if previous.data != nil {
+			slog.Error("Error reloading entitlements, keeping previous generation", "source", s.source, "generation", previous.generation, "error", err)
+		} else {
+			next.err = fmt.Errorf("failed to load entitlements: %w", err)
+			slog.Error("Error loading entitlements", "source", s.source, "error", err)
+		}
+		s.current.Store(&next)
+		return
+	}
+
+	next := &entitlementSnapshot{data: data, version: version, generation: previous.generation + 1, loadedAt: time.Now()}
+	s.current.Store(next)
+	for _, f := range s.reloaded {
+		f()
+	}
+	s.metrics.SetGauge(metricEntitlementsLoaded, float64(len(data.Entitlements)), Labels{{"source", s.source}})
+	slog.Info("Loaded entitlements", "count", len(data.Entitlements), "source", s.source, "generation", next.generation)
+	// The service becomes ready on the first successful load, at startup or on a
+	// later reload when the startup load failed. Later reloads leave the ready
+	// file alone, so one removed on shutdown stays removed.
+	if previous.data == nil {
+		if err := markReady(); err != nil {
+			slog.Error("Error marking service ready", "error", err)
+		}
+	}
+}
+
+// onReload registers f to be called after each later successful reload
+func (s *entitlementStore) onReload(f func()) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	s.reloaded = append(s.reloaded, f)
+}
+
+// watch polls the source for changes every interval
+func (s *entitlementStore) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.reloadIfChanged()
+	}
+}
+
+// configureEntitlementStore loads the default entitlements and keeps them fresh:
+// ENTITLEMENTS_CONFIGMAP is watched through the Kubernetes API, ENTITLEMENTS_URL
+// is refetched every ENTITLEMENTS_URL_TTL, otherwise the file is watched every
+// ENTITLEMENTS_RELOAD_INTERVAL (0 disables either). Loads are recorded on m.
+func configureEntitlementStore(m Metrics) error {
+	if v := os.Getenv("ENTITLEMENTS_CONFIGMAP"); v != "" {
+		source, err := newK8sConfigMapSource(v)
+		if err != nil {
+			return err
+		}
+		store, err := newConfigMapStore(source, m)
+		if err != nil {
+			return err
+		}
+		defaultEntitlements = store
+		go source.watch(store)
+		return nil
+	}
+	if v := os.Getenv("ENTITLEMENTS_URL"); v != "" {
+		remote, err := newRemoteEntitlements(v)
+		if err != nil {
+			return err
+		}
+		defaultEntitlements = newStore(remote.name, remote.fetch, nil, m)
+		defaultEntitlements.sourceType = "url"
+		if remote.ttl > 0 {
+			go defaultEntitlements.watch(remote.ttl)
+		}
+		return nil
+	}
+
+	interval := defaultReloadInterval
+	if v := os.Getenv("ENTITLEMENTS_RELOAD_INTERVAL"); v != "" {
+		d, err := parseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid ENTITLEMENTS_RELOAD_INTERVAL %q", v)
+		}
+		interval = d
+	}
+
+	defaultEntitlements = newEntitlementStore(defaultEntitlementsFile, m)
+	if interval > 0 {
+		go defaultEntitlements.watch(interval)
+	}
+	return nil
+}
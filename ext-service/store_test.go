@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestStoreLookupsDuringReloadsSeeCompleteSnapshots is meant to run with -race:
+// readers hammer get while reloads keep swapping in new generations
+func TestStoreLookupsDuringReloadsSeeCompleteSnapshots(t *testing.T) {
+	// The failed reloads are logged; keep them out of the test output
+	withDefaultLogger(t)
+	var loads atomic.Int64
+	store := newStore("test.json", func() (*EntitlementsData, error) {
+		n := loads.Add(1)
+		// Every third reload fails and must keep the previous generation
+		if n%3 == 0 {
+			return nil, errTest
+		}
+		data := &EntitlementsData{}
+		for i := 0; i < 50; i++ {
+			data.Entitlements = append(data.Entitlements, Entitlement{EntitlementID: fmt.Sprintf("gen_%d", n), Action: "read"})
+		}
+		return data, nil
+	}, nil, noopMetrics{})
+
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				data, err := store.get()
+				if err != nil {
+					t.Errorf("get: %v", err)
+					return
+				}
+				// A snapshot holds exactly one load
+				if len(data.Entitlements) != 50 {
+					t.Errorf("entitlements = %d, want 50", len(data.Entitlements))
+					return
+				}
+				for _, e := range data.Entitlements {
+					if e.EntitlementID != data.Entitlements[0].EntitlementID {
+						t.Errorf("snapshot mixes %s and %s", e.EntitlementID, data.Entitlements[0].EntitlementID)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	var reloaders sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		reloaders.Add(1)
+		go func() {
+			defer reloaders.Done()
+			for j := 0; j < 200; j++ {
+				store.reloadIfChanged()
+			}
+		}()
+	}
+	reloaders.Wait()
+	close(stop)
+	readers.Wait()
+
+	// 401 loads, of which every third failed
+	if generation := store.current.Load().generation; generation != 268 {
+		t.Errorf("generation = %d, want 268", generation)
+	}
+}
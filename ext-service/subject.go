@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// Subject conflict policies for when the partner header and subject claim disagree
+const (
+	conflictReject       = "reject"
+	conflictPreferHeader = "prefer-header"
+	conflictPreferClaim  = "prefer-claim"
+)
+
+// configureSubjectClaim reads SUBJECT_CLAIM and SUBJECT_TENANT_CONFLICT
+func (c *Config) configureSubjectClaim() error {
+	c.subjectClaim = os.Getenv("SUBJECT_CLAIM")
+	switch policy := os.Getenv("SUBJECT_TENANT_CONFLICT"); policy {
+	case "":
+		c.subjectConflictPolicy = conflictReject
+	case conflictReject, conflictPreferHeader, conflictPreferClaim:
+		c.subjectConflictPolicy = policy
+	default:
+		return fmt.Errorf("invalid SUBJECT_TENANT_CONFLICT %q (expected reject, prefer-header or prefer-claim)", policy)
+	}
+	return nil
+}
+
+// Subject ID normalization steps accepted by SUBJECT_NORMALIZE
+const (
+	normalizeTrim      = "trim"
+	normalizeLowercase = "lowercase"
+)
+
+var (
+	// subjectTrim and subjectLowercase enable the SUBJECT_NORMALIZE steps
+	subjectTrim      bool
+	subjectLowercase bool
+	// subjectStripPrefix is removed from the start of subject IDs when present
+	subjectStripPrefix string
+)
+
+// configureSubjectNormalization reads SUBJECT_NORMALIZE (comma-separated trim
+// and lowercase) and SUBJECT_STRIP_PREFIX
+func configureSubjectNormalization() error {
+	subjectTrim, subjectLowercase = false, false
+	for _, step := range strings.Split(os.Getenv("SUBJECT_NORMALIZE"), ",") {
+		switch step = strings.TrimSpace(step); step {
+		case "":
+		case normalizeTrim:
+			subjectTrim = true
+		case normalizeLowercase:
+			subjectLowercase = true
+		default:
+			return fmt.Errorf("invalid SUBJECT_NORMALIZE step %q (expected trim or lowercase)", step)
+		}
+	}
+	subjectStripPrefix = os.Getenv("SUBJECT_STRIP_PREFIX")
+	return nil
+}
+
+// subjectSource says where the ID of a subject type is read from: an additional
+// header or an access token claim
+type subjectSource struct {
+	// Source is "header" or "claim"
+	Source string
+	Name   string
+}
+
+// configureSubjectSources reads SUBJECT_SOURCES, a comma-separated list of
+// <type>=header:<name> or <type>=claim:<name>
+func (c *Config) configureSubjectSources() error {
+	sources, err := parseSubjectSources(os.Getenv("SUBJECT_SOURCES"))
+	if err != nil {
+		return err
+	}
+	c.subjectSources = sources
+	return nil
+}
+
+// parseSubjectSources parses a SUBJECT_SOURCES value
+func parseSubjectSources(v string) (map[string]subjectSource, error) {
+	sources := make(map[string]subjectSource)
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		subjectType, from, ok := strings.Cut(entry, "=")
+		source, name, hasName := strings.Cut(from, ":")
+		if !ok || subjectType == "" || !hasName || name == "" {
+			return nil, fmt.Errorf("invalid SUBJECT_SOURCES entry %q (expected <type>=header:<name> or <type>=claim:<name>)", entry)
+		}
+		if subjectType == "partner" {
+			return nil, fmt.Errorf("invalid SUBJECT_SOURCES entry %q: partner IDs are resolved from the partner header", entry)
+		}
+		if source != "header" && source != "claim" {
+			return nil, fmt.Errorf("invalid SUBJECT_SOURCES source %q (expected header or claim)", source)
+		}
+		sources[subjectType] = subjectSource{Source: source, Name: name}
+	}
+	return sources, nil
+}
+
+// resolveSubjectID returns the normalized ID of the request's subject of the
+// given type, or "" when the type has no source or the request does not carry it
+func (c *Config) resolveSubjectID(subjectType string, ev Event) string {
+	source, ok := c.subjectSources[subjectType]
+	if !ok {
+		return ""
+	}
+	var id string
+	switch source.Source {
+	case "header":
+		id = getHeaderValue(ev.Request.AdditionalHeaders, source.Name)
+	case "claim":
+		if value, ok := getClaimValue(ev.AccessToken.Claims, source.Name); ok {
+			id, _ = value.(string)
+		}
+	}
+	if id == "" {
+		return ""
+	}
+	return normalizeSubjectID(id)
+}
+
+// configureDefaultSubject reads DEFAULT_SUBJECT ("<type>:<id>"). It runs after
+// configureSubjectNormalization, since the ID is normalized like entitlement IDs.
+func (c *Config) configureDefaultSubject() error {
+	v := os.Getenv("DEFAULT_SUBJECT")
+	if v == "" {
+		c.defaultSubject = nil
+		return nil
+	}
+	subjectType, id, ok := strings.Cut(v, ":")
+	if !ok || subjectType == "" || id == "" {
+		return fmt.Errorf("invalid DEFAULT_SUBJECT %q (expected <type>:<id>)", v)
+	}
+	c.defaultSubject = &Subject{Type: subjectType, ID: normalizeSubjectID(id)}
+	return nil
+}
+
+// normalizeSubjectID applies the configured normalization to a subject ID. The
+// same normalization is applied to request partner IDs and to entitlement
+// subject IDs at load, so they compare consistently.
+func normalizeSubjectID(id string) string {
+	if subjectTrim {
+		id = strings.TrimSpace(id)
+	}
+	if subjectLowercase {
+		id = strings.ToLower(id)
+	}
+	if subjectStripPrefix != "" {
+		prefix := subjectStripPrefix
+		if subjectLowercase {
+			prefix = strings.ToLower(prefix)
+		}
+		id = strings.TrimPrefix(id, prefix)
+	}
+	return id
+}
+
+// resolvePartnerIDs returns the partner IDs for the request, and the entitlement
+// source a verified partner assertion selects (empty when none does). The
+// partner header may carry several IDs, as repeated values or comma-separated.
+// When a partner assertion header is configured the single ID is read from the
+// assertion JWT only, so a plain partner header cannot be used to bypass it.
+func (c *Config) resolvePartnerIDs(ctx context.Context, headers []Header) ([]string, string, error) {
+	if c.partnerAssertionHeader == "" {
+		return getHeaderValues(headers, "x-b2b-usp-partner"), "", nil
+	}
+
+	assertion := getHeaderValue(headers, c.partnerAssertionHeader)
+	if assertion == "" {
+		return nil, "", nil
+	}
+	partnerID, source, err := c.partnerIDFromAssertion(ctx, assertion, clock())
+	if err != nil || partnerID == "" {
+		return nil, "", err
+	}
+	return []string{partnerID}, source, nil
+}
+
+// normalizeSubjectIDs normalizes each ID, dropping empty and repeated ones
+func normalizeSubjectIDs(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	var normalized []string
+	for _, id := range ids {
+		id = normalizeSubjectID(id)
+		if id != "" && !seen[id] {
+			seen[id] = true
+			normalized = append(normalized, id)
+		}
+	}
+	return normalized
+}
+
+// partnerIDFromAssertion parses and verifies the partner assertion JWT and returns
+// the configured partner claim, and the source selector claim when one is
+// configured. Without a JWKS URL the assertion is only accepted when unsigned
+// assertions were explicitly allowed, and its source selector is ignored: only a
+// verified signature makes the selection trustworthy.
+func (c *Config) partnerIDFromAssertion(ctx context.Context, assertion string, now time.Time) (string, string, error) {
+	token, err := parseJWT(assertion)
+	if err != nil {
+		return "", "", err
+	}
+	if c.partnerAssertionVerifier != nil {
+		if err := c.partnerAssertionVerifier.verify(ctx, token); err != nil {
+			return "", "", err
+		}
+	} else if !c.allowUnsignedPartnerAssertions {
+		return "", "", errors.New("partner assertion cannot be verified: no JWKS URL is configured")
+	}
+	if err := token.validateTimeClaims(now); err != nil {
+		return "", "", err
+	}
+
+	partnerID, ok := token.Claims[c.partnerAssertionClaim].(string)
+	if !ok || partnerID == "" {
+		return "", "", fmt.Errorf("partner assertion has no %q claim", c.partnerAssertionClaim)
+	}
+
+	var source string
+	if c.partnerAssertionSourceClaim != "" {
+		if selected, _ := token.Claims[c.partnerAssertionSourceClaim].(string); selected != "" {
+			if c.partnerAssertionVerifier != nil {
+				source = selected
+			} else {
+				loggerFrom(ctx).Warn("Ignoring the source selector of an unsigned partner assertion", "claim", c.partnerAssertionSourceClaim)
+			}
+		}
+	}
+	return partnerID, source, nil
+}
+
+// reconcileSubject combines the partner IDs from the headers with the one in the
+// subject claim. When only one source is present it is used as is; when both are
+// present and the claim is not among the header IDs, the conflict policy decides.
+func (c *Config) reconcileSubject(logger *slog.Logger, headerIDs []string, claims []Claim) ([]string, error) {
+	if c.subjectClaim == "" {
+		return headerIDs, nil
+	}
+
+	var claimID string
+	if value, ok := getClaimValue(claims, c.subjectClaim); ok {
+		claimID, _ = value.(string)
+		claimID = normalizeSubjectID(claimID)
+	}
+
+	if claimID == "" {
+		return headerIDs, nil
+	}
+	if len(headerIDs) == 0 {
+		return []string{claimID}, nil
+	}
+	for _, id := range headerIDs {
+		if id == claimID {
+			return headerIDs, nil
+		}
+	}
+
+	logger.Warn("Subject conflict", "header_partner_ids", headerIDs, "claim", c.subjectClaim, "claim_partner_id", claimID, "policy", c.subjectConflictPolicy)
+	switch c.subjectConflictPolicy {
+	case conflictPreferHeader:
+		return headerIDs, nil
+	case conflictPreferClaim:
+		return []string{claimID}, nil
+	default:
+		return nil, fmt.Errorf("partner header %q conflicts with claim %s %q", headerIDs, c.subjectClaim, claimID)
+	}
+}
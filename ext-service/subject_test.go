@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withSubjectSources sets SUBJECT_SOURCES on cfg
+func withSubjectSources(t *testing.T, cfg *Config, v string) {
+	t.Helper()
+	sources, err := parseSubjectSources(v)
+	if err != nil {
+		t.Fatalf("parseSubjectSources(%q): %v", v, err)
+	}
+	cfg.subjectSources = sources
+}
+
+func TestResolveSubjectID(t *testing.T) {
+	cfg := defaultConfig()
+	withSubjectSources(t, &cfg, "user=claim:sub,group=header:x-group")
+	ev := Event{
+		Request: RequestData{AdditionalHeaders: []Header{{Name: "x-group", Value: []string{"admins", "ops"}}}},
+		AccessToken: AccessToken{Claims: []Claim{
+			{Name: "sub", Value: "alice"},
+			{Name: "groups", Value: []interface{}{"ignored"}},
+		}},
+	}
+
+	tests := []struct {
+		subjectType string
+		want        string
+	}{
+		{"user", "alice"},
+		{"group", "admins"},
+		{"partner", ""},
+		{"device", ""},
+	}
+	for _, tt := range tests {
+		if got := cfg.resolveSubjectID(tt.subjectType, ev); got != tt.want {
+			t.Errorf("resolveSubjectID(%q) = %q, want %q", tt.subjectType, got, tt.want)
+		}
+	}
+}
+
+func TestResolveSubjectIDMissing(t *testing.T) {
+	cfg := defaultConfig()
+	withSubjectSources(t, &cfg, "user=claim:sub,group=header:x-group")
+	ev := Event{AccessToken: AccessToken{Claims: []Claim{{Name: "sub", Value: 42}}}}
+
+	for _, subjectType := range []string{"user", "group"} {
+		if got := cfg.resolveSubjectID(subjectType, ev); got != "" {
+			t.Errorf("resolveSubjectID(%q) = %q, want none", subjectType, got)
+		}
+	}
+}
+
+func TestParseSubjectSourcesRejectsInvalidEntries(t *testing.T) {
+	for _, v := range []string{"user", "user=sub", "user=cookie:sid", "partner=header:x-partner", "=claim:sub"} {
+		if _, err := parseSubjectSources(v); err == nil {
+			t.Errorf("parseSubjectSources(%q) succeeded, want an error", v)
+		}
+	}
+}
+
+func TestHandlerMatchesUserAndGroupSubjects(t *testing.T) {
+	provider := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{
+		{EntitlementID: "ent_user", Subject: Subject{Type: "user", ID: "alice"}, Action: "profile"},
+		{EntitlementID: "ent_group", Subject: Subject{Type: "group", ID: "admins"}, Action: "admin"},
+		{EntitlementID: "ent_other_user", Subject: Subject{Type: "user", ID: "bob"}, Action: "other"},
+		{EntitlementID: "ent_partner", Subject: Subject{Type: "partner", ID: "alice"}, Action: "order"},
+	}}}
+
+	req := Request{
+		ActionType: actionPreIssueAccessToken,
+		Event: Event{
+			Request:     RequestData{AdditionalHeaders: []Header{{Name: "x-group", Value: []string{"admins"}}}},
+			AccessToken: AccessToken{Claims: []Claim{{Name: "sub", Value: "alice"}}, Scopes: []string{}},
+		},
+		AllowedOperations: []Operation{{Op: "add", Paths: []string{accessTokenScopesPath}}},
+	}
+	s := NewServer(provider)
+	withSubjectSources(t, &s.Config, "user=claim:sub,group=header:x-group")
+	_, resp := serve(t, s, http.MethodPost, marshalRequest(t, req))
+
+	scopes := grantedScopes(resp.Operations)
+	if len(scopes) != 2 || scopes[0] != "user:profile" || scopes[1] != "group:admin" {
+		t.Errorf("granted scopes = %v, want [user:profile group:admin]", scopes)
+	}
+}
+
+// withPartnerAssertion makes s read partner IDs from a partner assertion header
+// verified by verifier, rejecting invalid assertions
+func withPartnerAssertion(s *Server, verifier *jwksVerifier, allowUnsigned bool) *Server {
+	s.partnerAssertionHeader, s.partnerAssertionVerifier = "x-partner-assertion", verifier
+	s.rejectInvalidPartnerAssertion, s.allowUnsignedPartnerAssertions = true, allowUnsigned
+	return s
+}
+
+// assertionHeader carries token in the partner assertion header
+func assertionHeader(token string) Header {
+	return Header{Name: "x-partner-assertion", Value: []string{token}}
+}
+
+// unsignedJWT builds a JWT over claims with an empty signature
+func unsignedJWT(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(mustJSON(t, v)))
+	}
+	return encode(jwtHeader{Alg: "none"}) + "." + encode(claims) + "."
+}
+
+// sourceSelectionServer combines a document granting org_acme read with a PDP
+// granting it write, reading the source selector from the "source" claim
+func sourceSelectionServer(verifier *jwksVerifier, allowUnsigned bool) *Server {
+	write := fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{
+		{EntitlementID: "ent_write", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "write"},
+	}}}
+	s := precedenceServer(
+		namedSource{name: sourceDocument, provider: testEntitlements},
+		namedSource{name: sourcePDP, provider: write},
+	)
+	s.partnerAssertionSourceClaim = "source"
+	return withPartnerAssertion(s, verifier, allowUnsigned)
+}
+
+func TestSignedAssertionSelectsSource(t *testing.T) {
+	key := testSigningKey()
+	verifier := newJWKSVerifier(jwksServer(t, key, "k1", nil).URL, time.Second)
+	s := sourceSelectionServer(verifier, false)
+
+	token := signJWT(t, key, "k1", map[string]interface{}{"partner_id": "org_acme", "source": "pdp"})
+	_, resp := serve(t, s, http.MethodPost, actionRequest(t, assertionHeader(token)))
+
+	if scopes := grantedScopes(resp.Operations); len(scopes) != 1 || scopes[0] != "partner:write" {
+		t.Errorf("granted scopes = %v, want [partner:write] from the selected source only", scopes)
+	}
+
+	token = signJWT(t, key, "k1", map[string]interface{}{"partner_id": "org_acme", "source": "ldap"})
+	_, resp = serve(t, s, http.MethodPost, actionRequest(t, assertionHeader(token)))
+
+	if scopes := grantedScopes(resp.Operations); len(scopes) != 2 {
+		t.Errorf("granted scopes with an unknown source = %v, want both sources combined", scopes)
+	}
+}
+
+func TestUnsignedAssertionSourceSelectorIgnored(t *testing.T) {
+	logs := withDefaultLogger(t)
+	s := sourceSelectionServer(nil, true)
+
+	token := unsignedJWT(t, map[string]interface{}{"partner_id": "org_acme", "source": "pdp"})
+	_, resp := serve(t, s, http.MethodPost, actionRequest(t, assertionHeader(token)))
+
+	if scopes := grantedScopes(resp.Operations); len(scopes) != 2 || scopes[0] != "partner:read" || scopes[1] != "partner:write" {
+		t.Errorf("granted scopes = %v, want [partner:read partner:write] from every source", scopes)
+	}
+	if !strings.Contains(logs.String(), "Ignoring the source selector of an unsigned partner assertion") {
+		t.Errorf("logs = %s, want the ignored selector logged", logs.String())
+	}
+}
+
+func TestHandlerVerifiesPartnerAssertion(t *testing.T) {
+	key := testSigningKey()
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	verifier := newJWKSVerifier(jwksServer(t, key, "k1", nil).URL, time.Second)
+	claims := map[string]interface{}{"partner_id": "org_acme"}
+
+	tests := []struct {
+		name          string
+		verifier      *jwksVerifier
+		allowUnsigned bool
+		token         string
+		wantStatus    int
+	}{
+		{"signed", verifier, false, signJWT(t, key, "k1", claims), http.StatusOK},
+		{"bad signature", verifier, false, signJWT(t, other, "k1", claims), http.StatusBadRequest},
+		{"unsigned with JWKS", verifier, false, unsignedJWT(t, claims), http.StatusBadRequest},
+		{"unsigned without JWKS", nil, false, unsignedJWT(t, claims), http.StatusBadRequest},
+		{"unsigned explicitly allowed", nil, true, unsignedJWT(t, claims), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := withPartnerAssertion(NewServer(testEntitlements), tt.verifier, tt.allowUnsigned)
+
+			rec, resp := serve(t, s, http.MethodPost, actionRequest(t, assertionHeader(tt.token)))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK {
+				if scopes := grantedScopes(resp.Operations); len(scopes) != 1 || scopes[0] != "partner:read" {
+					t.Errorf("granted scopes = %v, want [partner:read]", scopes)
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileSubject(t *testing.T) {
+	claims := func(id string) []Claim { return []Claim{{Name: "partner_id", Value: id}} }
+	tests := []struct {
+		name      string
+		policy    string
+		headerIDs []string
+		claims    []Claim
+		want      []string
+		wantErr   bool
+	}{
+		{"agreement", conflictReject, []string{"org_acme"}, claims("org_acme"), []string{"org_acme"}, false},
+		{"claim among header ids", conflictReject, []string{"org_beta", "org_acme"}, claims("org_acme"), []string{"org_beta", "org_acme"}, false},
+		{"header only", conflictReject, []string{"org_acme"}, nil, []string{"org_acme"}, false},
+		{"claim only", conflictReject, nil, claims("org_acme"), []string{"org_acme"}, false},
+		{"conflict rejected", conflictReject, []string{"org_beta"}, claims("org_acme"), nil, true},
+		{"conflict prefers header", conflictPreferHeader, []string{"org_beta"}, claims("org_acme"), []string{"org_beta"}, false},
+		{"conflict prefers claim", conflictPreferClaim, []string{"org_beta"}, claims("org_acme"), []string{"org_acme"}, false},
+	}
+	for _, tt := range tests {
+		cfg := defaultConfig()
+		cfg.subjectClaim, cfg.subjectConflictPolicy = "partner_id", tt.policy
+
+		got, err := cfg.reconcileSubject(slog.Default(), tt.headerIDs, tt.claims)
+		if (err != nil) != tt.wantErr || strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: reconcileSubject = %v, %v, want %v (error %v)", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestHandlerRejectsSubjectConflict(t *testing.T) {
+	logs := withDefaultLogger(t)
+	s := NewServer(testEntitlements)
+	s.subjectClaim = "partner_id"
+	req := Request{
+		ActionType: actionPreIssueAccessToken,
+		Event: Event{
+			Request:     RequestData{AdditionalHeaders: []Header{partnerHeader("org_beta")}},
+			AccessToken: AccessToken{Scopes: []string{}, Claims: []Claim{{Name: "partner_id", Value: "org_acme"}}},
+		},
+		AllowedOperations: []Operation{{Op: "add", Paths: []string{accessTokenScopesPath}}},
+	}
+
+	rec, resp := serve(t, s, http.MethodPost, marshalRequest(t, req))
+
+	if rec.Code != http.StatusBadRequest || resp.ActionStatus != "ERROR" {
+		t.Errorf("status = %d, response = %+v, want a 400 ERROR response", rec.Code, resp)
+	}
+	if out := logs.String(); !strings.Contains(out, "Subject conflict") || !strings.Contains(out, `"claim_partner_id":"org_acme"`) || !strings.Contains(out, "org_beta") {
+		t.Errorf("logs = %s, want both partner IDs logged", out)
+	}
+}
+
+func TestConfigureSubjectClaimRejectsUnknownPolicy(t *testing.T) {
+	t.Setenv("SUBJECT_TENANT_CONFLICT", "prefer-newest")
+	cfg := defaultConfig()
+	if err := cfg.configureSubjectClaim(); err == nil {
+		t.Error("configureSubjectClaim accepted an unknown policy")
+	}
+}
+
+// withSubjectNormalization applies SUBJECT_NORMALIZE and SUBJECT_STRIP_PREFIX
+// for the duration of a test
+func withSubjectNormalization(t *testing.T, steps string, stripPrefix string) {
+	t.Helper()
+	t.Setenv("SUBJECT_NORMALIZE", steps)
+	t.Setenv("SUBJECT_STRIP_PREFIX", stripPrefix)
+	if err := configureSubjectNormalization(); err != nil {
+		t.Fatalf("configureSubjectNormalization: %v", err)
+	}
+	t.Cleanup(func() { subjectTrim, subjectLowercase, subjectStripPrefix = false, false, "" })
+}
+
+func TestNormalizeSubjectID(t *testing.T) {
+	tests := []struct {
+		steps       string
+		stripPrefix string
+		id          string
+		want        string
+	}{
+		{"", "", " ACME ", " ACME "},
+		{"trim", "", " ACME ", "ACME"},
+		{"trim,lowercase", "", " ACME ", "acme"},
+		{"trim,lowercase", "ORG_", " ORG_Acme", "acme"},
+		{"", "org_", "org_acme", "acme"},
+	}
+	for _, tt := range tests {
+		withSubjectNormalization(t, tt.steps, tt.stripPrefix)
+		if got := normalizeSubjectID(tt.id); got != tt.want {
+			t.Errorf("SUBJECT_NORMALIZE=%q SUBJECT_STRIP_PREFIX=%q: normalizeSubjectID(%q) = %q, want %q", tt.steps, tt.stripPrefix, tt.id, got, tt.want)
+		}
+	}
+
+	t.Setenv("SUBJECT_NORMALIZE", "uppercase")
+	if err := configureSubjectNormalization(); err == nil {
+		t.Error("configureSubjectNormalization accepted an unknown step")
+	}
+}
+
+func TestHandlerMatchesNormalizedSubjectIDs(t *testing.T) {
+	withSubjectNormalization(t, "trim,lowercase", "")
+	// Entitlement subject IDs are normalized the same way when loaded
+	data, err := decodeEntitlements(strings.NewReader(`{"entitlements": [{"entitlementId": "ent_read", "subject": {"type": "partner", "id": "Acme"}, "action": "read"}]}`), "test")
+	if err != nil {
+		t.Fatalf("decodeEntitlements: %v", err)
+	}
+
+	_, resp := serve(t, NewServer(fakeEntitlements{data: data}), http.MethodPost, actionRequest(t, partnerHeader("ACME ")))
+
+	if scopes := grantedScopes(resp.Operations); len(scopes) != 1 || scopes[0] != "partner:read" {
+		t.Errorf("granted scopes = %v, want [partner:read] for ACME matching acme", scopes)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+)
+
+// tokenSubjectClaim is the access token claim holding the token subject
+const tokenSubjectClaim = "sub"
+
+// subjectRewrite records a rewritten token subject in the audit log
+type subjectRewrite struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// targetsSubject reports whether op would change the sub claim, either by its path
+// or by adding another claim named sub
+func targetsSubject(op OperationResponse) bool {
+	if op.Path == claimPath(tokenSubjectClaim) {
+		return true
+	}
+	claim, ok := op.Value.(Claim)
+	return ok && op.Path == accessTokenClaimsPath && claim.Name == tokenSubjectClaim
+}
+
+// subjectRewriteOperation returns the operation replacing the sub claim for the
+// matched entitlements. The "{partner}" placeholder in rewriteSubject is replaced
+// with the entitlement's partner ID. No operation is returned when no entitlement
+// rewrites the subject, the token has no sub claim or the matched entitlements
+// disagree on the new subject.
+func subjectRewriteOperation(logger *slog.Logger, matched []Entitlement, claims []Claim) (OperationResponse, bool) {
+	var subject, from string
+	for _, entitlement := range matched {
+		if entitlement.RewriteSubject == "" {
+			continue
+		}
+		value := strings.ReplaceAll(entitlement.RewriteSubject, "{partner}", entitlement.Subject.ID)
+		if subject != "" && value != subject {
+			logger.Warn("Not rewriting subject: entitlements rewrite it to different values", "entitlement_ids", []string{from, entitlement.EntitlementID})
+			return OperationResponse{}, false
+		}
+		subject, from = value, entitlement.EntitlementID
+	}
+	if subject == "" {
+		return OperationResponse{}, false
+	}
+	if _, ok := getClaimValue(claims, tokenSubjectClaim); !ok {
+		logger.Warn("Not rewriting subject: token has no sub claim", "entitlement_id", from)
+		return OperationResponse{}, false
+	}
+	return OperationResponse{Op: "replace", Path: claimPath(tokenSubjectClaim), Value: subject}, true
+}
+
+// applySubjectRewrite emits a subject rewrite. Unlike other operations it needs
+// ALLOW_SUBJECT_REWRITE (enabled) and an allowedOperations entry naming the sub
+// claim path exactly; a path prefix such as "/accessToken/claims/" is not enough.
+func (s *operationSet) applySubjectRewrite(enabled bool, allowed []Operation, op OperationResponse, claims []Claim) {
+	if !enabled {
+		s.skip(op, "subject rewrite is disabled (ALLOW_SUBJECT_REWRITE)")
+		return
+	}
+	explicit := false
+	for _, operation := range allowed {
+		if operation.Op != op.Op {
+			continue
+		}
+		for _, path := range operation.Paths {
+			if path == op.Path {
+				explicit = true
+			}
+		}
+	}
+	if !explicit {
+		s.skip(op, "operation not explicitly in allowedOperations")
+		return
+	}
+	if err := validateOperationValue(op); err != nil {
+		s.skip(op, err.Error())
+		return
+	}
+	from, _ := getClaimValue(claims, tokenSubjectClaim)
+	s.log().Warn("Rewriting token subject", "audit", true, "from", from, "to", op.Value)
+	s.emit(op)
+}
+
+// subjectRewriteFor returns the subject rewrite among ops, if any
+func subjectRewriteFor(ops []OperationResponse, claims []Claim) *subjectRewrite {
+	for _, op := range ops {
+		if op.Op == "replace" && op.Path == claimPath(tokenSubjectClaim) {
+			from, _ := getClaimValue(claims, tokenSubjectClaim)
+			return &subjectRewrite{From: from, To: op.Value}
+		}
+	}
+	return nil
+}
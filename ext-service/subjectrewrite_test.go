@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// rewriteEntitlements maps org_acme tokens to a canonical partner subject
+var rewriteEntitlements = fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{{
+	EntitlementID:  "ent_read",
+	Subject:        Subject{Type: "partner", ID: "org_acme"},
+	Action:         "read",
+	RewriteSubject: "partner:{partner}",
+}}}}
+
+func TestHandlerRewritesSubjectOnlyWhenEnabledAndAllowed(t *testing.T) {
+	rewrite := `{"op":"replace","path":"/accessToken/claims/sub","value":"partner:org_acme"}`
+	tests := []struct {
+		name    string
+		enabled bool
+		allowed []Operation
+		want    bool
+	}{
+		{"enabled and allowed", true, []Operation{{Op: "replace", Paths: []string{"/accessToken/claims/sub"}}}, true},
+		{"flag off", false, []Operation{{Op: "replace", Paths: []string{"/accessToken/claims/sub"}}}, false},
+		{"not allowed", true, nil, false},
+		{"allowed by prefix only", true, []Operation{{Op: "replace", Paths: []string{"/accessToken/claims/"}}}, false},
+	}
+	for _, tt := range tests {
+		logs := withDefaultLogger(t)
+		s := NewServer(rewriteEntitlements)
+		s.allowSubjectRewrite = tt.enabled
+		req := Request{
+			ActionType: actionPreIssueAccessToken,
+			Event: Event{
+				Request:     RequestData{AdditionalHeaders: []Header{partnerHeader("org_acme")}},
+				AccessToken: AccessToken{Scopes: []string{}, Claims: []Claim{{Name: "sub", Value: "svc-client"}}},
+			},
+			AllowedOperations: append([]Operation{{Op: "add", Paths: []string{accessTokenScopesPath}}}, tt.allowed...),
+		}
+
+		body := serveRaw(s, marshalRequest(t, req))
+
+		if got := strings.Contains(body, rewrite); got != tt.want {
+			t.Errorf("%s: response = %s, want the rewrite emitted %v", tt.name, body, tt.want)
+		}
+		audited := strings.Contains(logs.String(), `"msg":"Rewriting token subject","partner_id":"org_acme","audit":true,"from":"svc-client","to":"partner:org_acme"`)
+		if audited != tt.want {
+			t.Errorf("%s: logs = %s, want the rewrite audited %v", tt.name, logs.String(), tt.want)
+		}
+	}
+}
+
+func TestSubjectRewriteOperation(t *testing.T) {
+	claims := []Claim{{Name: "sub", Value: "svc-client"}}
+	acme := Entitlement{EntitlementID: "ent_acme", Subject: Subject{ID: "org_acme"}, RewriteSubject: "partner:{partner}"}
+	beta := Entitlement{EntitlementID: "ent_beta", Subject: Subject{ID: "org_beta"}, RewriteSubject: "partner:{partner}"}
+
+	if _, ok := subjectRewriteOperation(slog.Default(), []Entitlement{{EntitlementID: "ent_plain"}}, claims); ok {
+		t.Error("rewrite emitted without rewriteSubject")
+	}
+	if _, ok := subjectRewriteOperation(slog.Default(), []Entitlement{acme}, nil); ok {
+		t.Error("rewrite emitted for a token without a sub claim")
+	}
+	if _, ok := subjectRewriteOperation(slog.Default(), []Entitlement{acme, beta}, claims); ok {
+		t.Error("rewrite emitted although the entitlements disagree")
+	}
+	if op, ok := subjectRewriteOperation(slog.Default(), []Entitlement{acme, acme}, claims); !ok || op.Value != "partner:org_acme" {
+		t.Errorf("operation = %+v, %v, want the agreed subject", op, ok)
+	}
+}
+
+func TestSubjectCannotBeChangedThroughOtherOperations(t *testing.T) {
+	var set operationSet
+	allowed := []Operation{{Op: "add", Paths: []string{accessTokenClaimsPath}}, {Op: "replace", Paths: []string{"/accessToken/claims/sub"}}}
+
+	set.applyIfAllowed(allowed, OperationResponse{Op: "add", Path: accessTokenClaimsPath, Value: Claim{Name: "sub", Value: "someone"}})
+	set.applyIfAllowed(allowed, claimOperation([]Claim{{Name: "sub", Value: "svc-client"}}, "sub", "someone"))
+
+	if len(set.operations) != 0 {
+		t.Errorf("operations = %+v, want sub changes dropped", set.operations)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// tagFilter holds the entitlement tags currently disabled. It starts from
+// DISABLED_TAGS and can be changed at runtime through the admin endpoint.
+type tagFilter struct {
+	mu       sync.RWMutex
+	disabled map[string]bool
+}
+
+// configureDisabledTags reads DISABLED_TAGS (comma-separated)
+func (c *Config) configureDisabledTags() {
+	var tags []string
+	for _, tag := range strings.Split(os.Getenv("DISABLED_TAGS"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	c.disabledTags.set(tags)
+}
+
+// set replaces the disabled tags
+func (f *tagFilter) set(tags []string) {
+	disabled := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		disabled[tag] = true
+	}
+	f.mu.Lock()
+	f.disabled = disabled
+	f.mu.Unlock()
+	if len(tags) > 0 {
+		slog.Info("Disabled entitlement tags", "tags", tags)
+	}
+}
+
+// list returns the disabled tags, sorted
+func (f *tagFilter) list() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	tags := make([]string, 0, len(f.disabled))
+	for tag := range f.disabled {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// disabledTag returns the first tag of e that is disabled, if any
+func (f *tagFilter) disabledTag(e Entitlement) (string, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, tag := range e.Tags {
+		if f.disabled[tag] {
+			return tag, true
+		}
+	}
+	return "", false
+}
+
+// disabledTagsHandler returns (GET) or replaces (PUT, a JSON array of tags) the
+// disabled entitlement tags. Cached evaluations are dropped on a change, since
+// they may include entitlements that are now disabled or leave out ones that
+// are no longer.
+func (s *Server) disabledTagsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var tags []string
+		if err := json.NewDecoder(r.Body).Decode(&tags); err != nil {
+			http.Error(w, "Invalid JSON body: expected an array of tags", http.StatusBadRequest)
+			return
+		}
+		s.disabledTags.set(tags)
+		s.operationsCache.purge()
+		slog.Info("Disabled entitlement tags updated via admin endpoint", "tags", tags)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(s.disabledTags.list()); err != nil {
+		slog.Error("Error encoding disabled tags", "error", err)
+	}
+}
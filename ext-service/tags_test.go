@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// taggedEntitlements grants org_acme read, and write through an experimental
+// entitlement
+var taggedEntitlements = fakeEntitlements{data: &EntitlementsData{Entitlements: []Entitlement{
+	{EntitlementID: "ent_read", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "read", Tags: []string{"core"}},
+	{EntitlementID: "ent_write", Subject: Subject{Type: "partner", ID: "org_acme"}, Action: "write", Tags: []string{"beta", "experimental"}},
+}}}
+
+func TestHandlerExcludesEntitlementsWithDisabledTags(t *testing.T) {
+	logs := withDefaultLogger(t)
+	s := NewServer(taggedEntitlements)
+
+	_, resp := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+	if got := mustJSON(t, grantedScopes(resp.Operations)); got != `["partner:read","partner:write"]` {
+		t.Errorf("scopes = %s, want both while no tag is disabled", got)
+	}
+
+	s.disabledTags.set([]string{"experimental"})
+	_, resp = serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+	if got := mustJSON(t, grantedScopes(resp.Operations)); got != `["partner:read"]` {
+		t.Errorf("scopes = %s, want the experimental entitlement excluded", got)
+	}
+	if out := logs.String(); !strings.Contains(out, `"entitlement_id":"ent_write","tag":"experimental"`) {
+		t.Errorf("logs = %s, want the disabled entitlement logged", out)
+	}
+}
+
+func TestDisabledTagsEndpoint(t *testing.T) {
+	s := NewServer(taggedEntitlements)
+	s.adminToken = "admin"
+	mux := http.NewServeMux()
+	routes(mux, mux, s)
+
+	// Cache the evaluation with every entitlement enabled first
+	serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+
+	r := httptest.NewRequest(http.MethodPut, "/admin/disabled-tags", strings.NewReader(`["experimental","beta"]`))
+	r.Header.Set("Authorization", "Bearer admin")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK || rec.Body.String() != "[\"beta\",\"experimental\"]\n" {
+		t.Fatalf("PUT status = %d, body = %q, want the sorted tags", rec.Code, rec.Body.String())
+	}
+
+	if rec := adminGet(t, s, "/admin/disabled-tags", "admin"); rec.Body.String() != "[\"beta\",\"experimental\"]\n" {
+		t.Errorf("GET body = %q, want the disabled tags", rec.Body.String())
+	}
+	_, resp := serve(t, s, http.MethodPost, actionRequest(t, partnerHeader("org_acme")))
+	if got := mustJSON(t, grantedScopes(resp.Operations)); got != `["partner:read"]` {
+		t.Errorf("scopes = %s, want the cached evaluation dropped after the change", got)
+	}
+
+	r = httptest.NewRequest(http.MethodPut, "/admin/disabled-tags", strings.NewReader(`"experimental"`))
+	r.Header.Set("Authorization", "Bearer admin")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, r)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("PUT of a non-array status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestConfigureDisabledTags(t *testing.T) {
+	t.Setenv("DISABLED_TAGS", " experimental, ,beta ")
+	c := defaultConfig()
+
+	c.configureDisabledTags()
+
+	if got := strings.Join(c.disabledTags.list(), ","); got != "beta,experimental" {
+		t.Errorf("disabled tags = %s, want beta,experimental", got)
+	}
+}
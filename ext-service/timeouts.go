@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// configureTimeouts reads REQUEST_TIMEOUT and PARTNER_ASSERTION_JWKS_TIMEOUT.
+//
+// Each remote source has its own timeout so a slow one does not force a short
+// timeout on the others: the attribute service uses ATTRIBUTE_SERVICE_TIMEOUT, the
+// partner-assertion JWKS fetch uses PARTNER_ASSERTION_JWKS_TIMEOUT and the policy
+// decision point uses PDP_TIMEOUT. REQUEST_TIMEOUT bounds the context of each
+// action request, which all of these calls use, so it caps them whatever their
+// own timeouts. Entitlement reloads run outside any request and only use their
+// own timeout.
+func (c *Config) configureTimeouts() error {
+	if v := os.Getenv("REQUEST_TIMEOUT"); v != "" {
+		d, err := parseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid REQUEST_TIMEOUT %q", v)
+		}
+		c.requestTimeout = d
+	}
+	if v := os.Getenv("PARTNER_ASSERTION_JWKS_TIMEOUT"); v != "" {
+		d, err := parseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid PARTNER_ASSERTION_JWKS_TIMEOUT %q", v)
+		}
+		c.jwksTimeout = d
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// slowServer responds after delay, or when the client gives up. The request body
+// is read first, since a disconnect is only noticed once it has been consumed.
+func slowServer(t *testing.T, delay time.Duration) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// returnsWithin fails the test unless call returns an error within limit
+func returnsWithin(t *testing.T, name string, limit time.Duration, call func() error) {
+	t.Helper()
+	start := time.Now()
+	err := call()
+	if err == nil {
+		t.Errorf("%s: error = nil, want a timeout", name)
+	}
+	if elapsed := time.Since(start); elapsed > limit {
+		t.Errorf("%s: returned after %v, want within %v", name, elapsed, limit)
+	}
+}
+
+func TestJWKSFetchHonorsTimeouts(t *testing.T) {
+	server := slowServer(t, 5*time.Second)
+	token, _ := parseJWT(signJWT(t, testSigningKey(), "k1", map[string]interface{}{}))
+
+	returnsWithin(t, "own timeout", time.Second, func() error {
+		return newJWKSVerifier(server.URL, 50*time.Millisecond).verify(context.Background(), token)
+	})
+	returnsWithin(t, "request timeout", time.Second, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		return newJWKSVerifier(server.URL, time.Minute).verify(ctx, token)
+	})
+}
+
+func TestAttributeServiceHonorsTimeouts(t *testing.T) {
+	server := slowServer(t, 5*time.Second)
+	newEnricher := func(timeout time.Duration) *attributeEnricher {
+		return &attributeEnricher{
+			urlTemplate: server.URL + "/{subject}",
+			client:      &http.Client{Timeout: timeout},
+			cache:       newLRUCache[string, map[string]interface{}](8, 0),
+		}
+	}
+
+	returnsWithin(t, "own timeout", time.Second, func() error {
+		_, err := newEnricher(50*time.Millisecond).attributes(context.Background(), "org_acme", time.Now())
+		return err
+	})
+	returnsWithin(t, "request timeout", time.Second, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := newEnricher(time.Minute).attributes(ctx, "org_acme", time.Now())
+		return err
+	})
+}
+
+func TestPDPHonorsTimeouts(t *testing.T) {
+	server := slowServer(t, 5*time.Second)
+	newSource := func(timeout string) *restPDPSource {
+		t.Setenv("PDP_TIMEOUT", timeout)
+		source, err := newRESTPDPSource(server.URL)
+		if err != nil {
+			t.Fatalf("newRESTPDPSource: %v", err)
+		}
+		return source
+	}
+	query := EntitlementsQuery{Subjects: []Subject{{Type: "partner", ID: "org_acme"}}, Now: time.Now()}
+
+	returnsWithin(t, "own timeout", time.Second, func() error {
+		_, err := newSource("50ms").EntitlementsFor(context.Background(), query)
+		return err
+	})
+	returnsWithin(t, "request timeout", time.Second, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := newSource("1m").EntitlementsFor(ctx, query)
+		return err
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// configureSlowRequests reads SLOW_REQUEST_MS
+func (c *Config) configureSlowRequests() error {
+	v := os.Getenv("SLOW_REQUEST_MS")
+	if v == "" {
+		return nil
+	}
+	ms, err := strconv.Atoi(v)
+	if err != nil || ms < 0 {
+		return fmt.Errorf("invalid SLOW_REQUEST_MS %q", v)
+	}
+	c.slowRequestThreshold = time.Duration(ms) * time.Millisecond
+	return nil
+}
+
+// requestTiming collects the phase durations of one request for the
+// slow-request log. Handlers reach it through the request context.
+type requestTiming struct {
+	start     time.Time
+	last      time.Time
+	partnerID string
+	phases    []timingPhase
+	// span is the request's trace span, whose child spans are the phases
+	span trace.Span
+	// metrics records each phase's duration
+	metrics Metrics
+}
+
+// timingPhase is the time spent in one named phase of a request
+type timingPhase struct {
+	name     string
+	duration time.Duration
+}
+
+type requestTimingKey struct{}
+
+// withRequestTiming returns ctx carrying a new timing started at start, whose
+// phases are recorded on m
+func withRequestTiming(ctx context.Context, start time.Time, m Metrics) (context.Context, *requestTiming) {
+	t := &requestTiming{start: start, last: start, span: trace.SpanFromContext(ctx), metrics: m}
+	return context.WithValue(ctx, requestTimingKey{}, t), t
+}
+
+// timingFrom returns the request's timing, or nil when it is not being timed
+func timingFrom(ctx context.Context) *requestTiming {
+	t, _ := ctx.Value(requestTimingKey{}).(*requestTiming)
+	return t
+}
+
+// mark ends the phase named name, which ran since the previous mark
+func (t *requestTiming) mark(name string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.phases = append(t.phases, timingPhase{name: name, duration: now.Sub(t.last)})
+	t.metrics.ObserveHistogram(metricPhaseDuration, now.Sub(t.last).Seconds(), Labels{{"phase", name}})
+	tracePhase(t.span, name, t.last, now)
+	t.last = now
+}
+
+// setPartner records the partner the request was evaluated for
+func (t *requestTiming) setPartner(partnerID string) {
+	if t != nil {
+		t.partnerID = partnerID
+	}
+}
+
+// logIfSlow logs the request with its timing breakdown when it took longer than
+// threshold
+func (t *requestTiming) logIfSlow(logger *slog.Logger, threshold time.Duration, path string, status int, end time.Time) {
+	total := end.Sub(t.start)
+	if threshold <= 0 || total <= threshold {
+		return
+	}
+	phases := make(map[string]int64, len(t.phases))
+	for _, phase := range t.phases {
+		phases[phase.name] = phase.duration.Milliseconds()
+	}
+	logger.Warn("Slow request", "path", path, "status", status, "partner_id", t.partnerID, "latency_ms", total.Milliseconds(), "phases_ms", phases)
+}
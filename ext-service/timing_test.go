@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// timedHandler records a lookup phase for org_acme that takes delay
+func timedHandler(delay time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		timing := timingFrom(r.Context())
+		timing.setPartner("org_acme")
+		time.Sleep(delay)
+		timing.mark("lookup")
+	}
+}
+
+func TestSlowRequestIsLoggedWithBreakdown(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		delay     time.Duration
+		want      bool
+	}{
+		{"slow request", 10 * time.Millisecond, 30 * time.Millisecond, true},
+		{"fast request", time.Second, 0, false},
+		{"threshold disabled", 0, 30 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		logs := withDefaultLogger(t)
+		s := NewServer(testEntitlements)
+		s.slowRequestThreshold = tt.threshold
+
+		s.instrument("/token-validation", timedHandler(tt.delay))(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/token-validation", nil))
+
+		out := logs.String()
+		if got := strings.Contains(out, `"level":"WARN","msg":"Slow request"`); got != tt.want {
+			t.Errorf("%s: logs = %s, want slow request logged %v", tt.name, out, tt.want)
+		}
+		if tt.want && (!strings.Contains(out, `"partner_id":"org_acme"`) || !strings.Contains(out, `"phases_ms":{"lookup":`)) {
+			t.Errorf("%s: logs = %s, want the partner and phase breakdown", tt.name, out)
+		}
+	}
+}
+
+func TestConfigureSlowRequests(t *testing.T) {
+	t.Setenv("SLOW_REQUEST_MS", "250")
+	c := defaultConfig()
+	if err := c.configureSlowRequests(); err != nil || c.slowRequestThreshold != 250*time.Millisecond {
+		t.Errorf("threshold = %v, err = %v, want 250ms", c.slowRequestThreshold, err)
+	}
+
+	for _, value := range []string{"-1", "1s"} {
+		t.Setenv("SLOW_REQUEST_MS", value)
+		if err := c.configureSlowRequests(); err == nil {
+			t.Errorf("configureSlowRequests accepted %q", value)
+		}
+	}
+}
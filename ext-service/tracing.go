@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName is the instrumentation scope of the service's spans
+const tracerName = "ext_service_entitle_validation"
+
+// defaultTraceServiceName is the service.name of exported spans unless
+// OTEL_SERVICE_NAME is set
+const defaultTraceServiceName = "asgardeo-ext-service"
+
+var (
+	// tracer starts the service's spans; the no-op tracer is used until an
+	// exporter is configured, so tracing costs nothing by default
+	tracer trace.Tracer = noop.NewTracerProvider().Tracer(tracerName)
+	// tracePropagator continues traces from incoming traceparent headers
+	tracePropagator propagation.TextMapPropagator = propagation.TraceContext{}
+)
+
+// configureTracing exports spans over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT
+// or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set. The exporter reads the other
+// standard OTEL_EXPORTER_OTLP_* variables itself. The returned function flushes
+// and stops the exporter.
+func configureTracing(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = defaultTraceServiceName
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+	)
+	tracer = provider.Tracer(tracerName)
+	return provider.Shutdown, nil
+}
+
+// traceRequests runs each request to path in a server span, continuing the
+// caller's trace when the request carries a traceparent header. Handlers add
+// attributes with setSpanAttributes, and requestTiming records its phases as
+// child spans.
+func traceRequests(path string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, path, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPRequestMethodKey.String(r.Method), semconv.URLPath(r.URL.Path)))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	}
+}
+
+// setSpanAttributes adds attributes to the request's span
+func setSpanAttributes(ctx context.Context, attrs ...attribute.KeyValue) {
+	if span := trace.SpanFromContext(ctx); span.IsRecording() {
+		span.SetAttributes(attrs...)
+	}
+}
+
+// tracePhase records a request phase that ran from start to end as a child of
+// the request's span
+func tracePhase(parent trace.Span, name string, start, end time.Time) {
+	if parent == nil || !parent.IsRecording() {
+		return
+	}
+	_, span := tracer.Start(trace.ContextWithSpan(context.Background(), parent), name, trace.WithTimestamp(start))
+	span.End(trace.WithTimestamp(end))
+}
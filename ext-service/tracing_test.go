@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// withSpanRecorder records the service's spans in memory for the duration of a test
+func withSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	previous := tracer
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer(tracerName)
+	t.Cleanup(func() { tracer = previous })
+	return recorder
+}
+
+func TestTokenValidationSpans(t *testing.T) {
+	recorder := withSpanRecorder(t)
+	mux := http.NewServeMux()
+	routes(mux, mux, NewServer(testEntitlements))
+
+	r := httptest.NewRequest(http.MethodPost, "/token-validation", strings.NewReader(actionRequest(t, partnerHeader("org_acme"))))
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	root, ok := spans["/token-validation"]
+	if !ok {
+		t.Fatalf("no request span among %v", spans)
+	}
+	if got := root.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace ID = %s, want the incoming traceparent's", got)
+	}
+	if got := root.Parent().SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("parent span ID = %s, want the incoming traceparent's", got)
+	}
+
+	attrs := make(map[attribute.Key]string)
+	for _, attr := range root.Attributes() {
+		attrs[attr.Key] = attr.Value.Emit()
+	}
+	want := map[attribute.Key]string{
+		"action_type": actionPreIssueAccessToken,
+		"client_id":   "client",
+		"partner_id":  "org_acme",
+	}
+	for key, value := range want {
+		if attrs[key] != value {
+			t.Errorf("attribute %s = %q, want %q", key, attrs[key], value)
+		}
+	}
+
+	for _, name := range []string{"decode", "lookup", "encode"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if span.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("%s span is not a child of the request span", name)
+		}
+	}
+}
+
+func TestTokenValidationWithoutTracing(t *testing.T) {
+	mux := http.NewServeMux()
+	routes(mux, mux, NewServer(testEntitlements))
+
+	r := httptest.NewRequest(http.MethodPost, "/token-validation", strings.NewReader(actionRequest(t, partnerHeader("org_acme"))))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
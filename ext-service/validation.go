@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// UnmarshalJSON decodes the request data and records that the request carried it
+func (d *RequestData) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	type plain RequestData
+	if err := json.Unmarshal(data, (*plain)(d)); err != nil {
+		return err
+	}
+	d.present = true
+	return nil
+}
+
+// UnmarshalJSON decodes the access token and records that the request carried it
+func (t *AccessToken) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	type plain AccessToken
+	if err := json.Unmarshal(data, (*plain)(t)); err != nil {
+		return err
+	}
+	t.present = true
+	return nil
+}
+
+// validateRequest checks that a decoded request carries the fields every action
+// needs, so an incomplete one is refused instead of matching nothing. The error
+// lists all missing fields by their JSON path.
+func validateRequest(req Request) error {
+	var missing []string
+	if req.ActionType == "" {
+		missing = append(missing, "actionType")
+	}
+	if !req.Event.Request.present {
+		missing = append(missing, "event.request")
+	}
+	if !req.Event.AccessToken.present {
+		missing = append(missing, "event.accessToken")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required fields: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
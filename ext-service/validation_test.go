@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHandlerRejectsMissingFields(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "actionType",
+			body: `{"event":{"request":{"clientId":"client"},"accessToken":{"scopes":[]}}}`,
+			want: "The action request is missing required fields: actionType",
+		},
+		{
+			name: "event.request",
+			body: `{"actionType":"PRE_ISSUE_ACCESS_TOKEN","event":{"accessToken":{"scopes":[]}}}`,
+			want: "The action request is missing required fields: event.request",
+		},
+		{
+			name: "null event.request",
+			body: `{"actionType":"PRE_ISSUE_ACCESS_TOKEN","event":{"request":null,"accessToken":{"scopes":[]}}}`,
+			want: "The action request is missing required fields: event.request",
+		},
+		{
+			name: "event.accessToken",
+			body: `{"actionType":"PRE_ISSUE_ACCESS_TOKEN","event":{"request":{"clientId":"client"}}}`,
+			want: "The action request is missing required fields: event.accessToken",
+		},
+		{
+			name: "everything",
+			body: `{}`,
+			want: "The action request is missing required fields: actionType, event.request, event.accessToken",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, resp := serve(t, NewServer(testEntitlements), http.MethodPost, tt.body)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+			}
+			if resp.ActionStatus != "FAILED" || resp.FailureReason != "invalid_request" {
+				t.Fatalf("response = %+v, want FAILED invalid_request", resp)
+			}
+			if resp.FailureDescription != tt.want {
+				t.Errorf("failureDescription = %q, want %q", resp.FailureDescription, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateRequestAcceptsCompleteRequest(t *testing.T) {
+	body := `{"actionType":"PRE_ISSUE_ACCESS_TOKEN","event":{"request":{},"accessToken":{}}}`
+	_, resp := serve(t, NewServer(testEntitlements), http.MethodPost, body)
+
+	if resp.ActionStatus != "SUCCESS" {
+		t.Errorf("response = %+v, want SUCCESS", resp)
+	}
+}